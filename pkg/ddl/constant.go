@@ -90,6 +90,9 @@ const (
 		ordinal int,
 		error BLOB,
 		summary json,
+		group_name varchar(256),
+		serial_key varchar(256),
+		weight bigint,
 		key idx_task_key(task_key),
 		key idx_exec_id(exec_id),
 		unique uk_task_key_step_ordinal(task_key, step, ordinal)
@@ -115,6 +118,9 @@ const (
 		ordinal int,
 		error BLOB,
 		summary json,
+		group_name varchar(256),
+		serial_key varchar(256),
+		weight bigint,
 		key idx_task_key(task_key),
 		key idx_state_update_time(state_update_time))`
 )
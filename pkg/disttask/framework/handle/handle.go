@@ -16,14 +16,19 @@ package handle
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	"github.com/pingcap/tidb/pkg/disttask/framework/storage"
 	"github.com/pingcap/tidb/pkg/metrics"
+	"github.com/pingcap/tidb/pkg/sessionctx"
 	"github.com/pingcap/tidb/pkg/util/backoff"
 	"github.com/pingcap/tidb/pkg/util/logutil"
+	"github.com/pingcap/tidb/pkg/util/syncutil"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -34,8 +39,144 @@ var (
 	// in the same node as the scheduler manager.
 	// put it here to avoid cyclic import.
 	TaskChangedCh = make(chan struct{}, 1)
+
+	// ErrTaskFinished is the cause of the context returned by TaskContext when
+	// the task reaches a terminal state.
+	ErrTaskFinished = errors.New("task finished")
+
+	// ErrCircuitBreakerOpen is the error when a task is submitted while the
+	// circuit breaker of the task type is open, see SetCircuitBreaker.
+	ErrCircuitBreakerOpen = errors.New("circuit breaker of the task type is open")
+
+	traceContextPropagator = propagation.TraceContext{}
+
+	taskCancelledCh = struct {
+		syncutil.Mutex
+		ch chan struct{}
+	}{ch: make(chan struct{})}
+
+	circuitBreakers = struct {
+		syncutil.RWMutex
+		m map[proto.TaskType]circuitBreaker
+	}{m: make(map[proto.TaskType]circuitBreaker)}
+
+	taskManagerProvider atomic.Pointer[TaskManagerProvider]
 )
 
+// TaskManager defines the interface to access tasks used by the functions of
+// this package, storage.TaskManager is the implementation backed by system
+// tables of TiDB.
+type TaskManager interface {
+	GetCPUCountOfManagedNode(ctx context.Context) (int, error)
+	CreateTaskWithParams(ctx context.Context, key string, tp proto.TaskType, concurrency int, meta []byte, extraParams proto.ExtraParams) (int64, error)
+	CreateTaskWithSession(ctx context.Context, se sessionctx.Context, key string, tp proto.TaskType, concurrency int, meta []byte, extraParams proto.ExtraParams) (int64, error)
+	GetTaskByID(ctx context.Context, taskID int64) (*proto.Task, error)
+	GetTaskByIDWithHistory(ctx context.Context, taskID int64) (*proto.Task, error)
+	GetTaskBaseByID(ctx context.Context, taskID int64) (*proto.TaskBase, error)
+	GetTaskBaseByIDWithHistory(ctx context.Context, taskID int64) (*proto.TaskBase, error)
+	GetTaskByKey(ctx context.Context, key string) (*proto.Task, error)
+	GetTaskByKeyWithHistory(ctx context.Context, key string) (*proto.Task, error)
+	GetFinishedSubtasksWithHistory(ctx context.Context, taskID int64) ([]*proto.Subtask, error)
+	GetLastFinishedTasksByType(ctx context.Context, tp proto.TaskType, limit int) ([]*proto.Task, error)
+	GetUnfinishedTaskCntByType(ctx context.Context, tp proto.TaskType) (int, error)
+	CancelTask(ctx context.Context, taskID int64) error
+	CancelTaskWithMode(ctx context.Context, taskID int64, mode proto.CancelMode) error
+	PauseTask(ctx context.Context, taskKey string) (bool, error)
+	ResumeTask(ctx context.Context, taskKey string) (bool, error)
+	SetTaskGenerationFrozen(ctx context.Context, taskID int64, frozen bool) error
+}
+
+var _ TaskManager = &storage.TaskManager{}
+
+// TaskManagerProvider provides the TaskManager.
+type TaskManagerProvider func() (TaskManager, error)
+
+// RegisterTaskManagerProvider registers an alternate storage of tasks, such as
+// when the framework is embedded in other systems, it's used by all accesses to
+// tasks outside the scheduler and task executor managers, which take their
+// storage as the argument of NewManager. the storage should also implement
+// scheduler.TaskManager to preview the plan of tasks.
+// nil restores the default provider, which is storage.GetTaskManager.
+func RegisterTaskManagerProvider(provider TaskManagerProvider) {
+	if provider == nil {
+		taskManagerProvider.Store(nil)
+		return
+	}
+	taskManagerProvider.Store(&provider)
+}
+
+// GetTaskManager gets the TaskManager from the registered provider, see
+// RegisterTaskManagerProvider.
+func GetTaskManager() (TaskManager, error) {
+	if provider := taskManagerProvider.Load(); provider != nil {
+		return (*provider)()
+	}
+	taskManager, err := storage.GetTaskManager()
+	if err != nil {
+		return nil, err
+	}
+	return taskManager, nil
+}
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+}
+
+// SetCircuitBreaker sets the circuit breaker of the task type, once the last
+// threshold tasks of the type are all failures, the breaker is open,
+// and new tasks of the type are rejected with ErrCircuitBreakerOpen until
+// cooldown has passed since the last one finishes. the state of the breaker
+// is derived from finished tasks, so it's shared by all nodes of the cluster.
+// which tasks count as failures is controlled by the failure policy of the
+// task type, see proto.FailurePolicy.
+// threshold <= 0 removes the breaker.
+func SetCircuitBreaker(tp proto.TaskType, threshold int, cooldown time.Duration) {
+	circuitBreakers.Lock()
+	defer circuitBreakers.Unlock()
+	if threshold <= 0 {
+		delete(circuitBreakers.m, tp)
+		return
+	}
+	circuitBreakers.m[tp] = circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func getCircuitBreaker(tp proto.TaskType) (circuitBreaker, bool) {
+	circuitBreakers.RLock()
+	defer circuitBreakers.RUnlock()
+	cb, ok := circuitBreakers.m[tp]
+	return cb, ok
+}
+
+// checkCircuitBreaker returns ErrCircuitBreakerOpen if the circuit breaker of
+// the task type is open, see SetCircuitBreaker.
+// tasks cancelled by user are also reverted, but they're not taken as failures
+// by default, see proto.Task.IsFailure.
+func checkCircuitBreaker(ctx context.Context, taskManager TaskManager, tp proto.TaskType) error {
+	cb, ok := getCircuitBreaker(tp)
+	if !ok {
+		return nil
+	}
+	tasks, err := taskManager.GetLastFinishedTasksByType(ctx, tp, cb.threshold)
+	if err != nil {
+		return err
+	}
+	if len(tasks) < cb.threshold {
+		return nil
+	}
+	for _, t := range tasks {
+		if !t.IsFailure() {
+			return nil
+		}
+	}
+	// the latest task is the first one.
+	if remaining := cb.cooldown - time.Since(tasks[0].StateUpdateTime); remaining > 0 {
+		return errors.Annotatef(ErrCircuitBreakerOpen, "last %d tasks of type %s are reverted, retry after %s",
+			cb.threshold, tp, remaining.Round(time.Second))
+	}
+	return nil
+}
+
 // NotifyTaskChange is used to notify the scheduler manager that the task is changed,
 // either a new task is submitted or a task is finished.
 func NotifyTaskChange() {
@@ -45,9 +186,26 @@ func NotifyTaskChange() {
 	}
 }
 
+// TaskCancelledCh returns a channel which is closed when a task is cancelled on
+// this node, it's used by task executor managers in the same process to cancel
+// running subtasks of the task without waiting for the next check, callers
+// should get a new channel after it's closed.
+func TaskCancelledCh() <-chan struct{} {
+	taskCancelledCh.Lock()
+	defer taskCancelledCh.Unlock()
+	return taskCancelledCh.ch
+}
+
+func notifyTaskCancelled() {
+	taskCancelledCh.Lock()
+	defer taskCancelledCh.Unlock()
+	close(taskCancelledCh.ch)
+	taskCancelledCh.ch = make(chan struct{})
+}
+
 // GetCPUCountOfManagedNode gets the CPU count of the managed node.
 func GetCPUCountOfManagedNode(ctx context.Context) (int, error) {
-	manager, err := storage.GetTaskManager()
+	manager, err := GetTaskManager()
 	if err != nil {
 		return 0, err
 	}
@@ -56,7 +214,14 @@ func GetCPUCountOfManagedNode(ctx context.Context) (int, error) {
 
 // SubmitTask submits a task.
 func SubmitTask(ctx context.Context, taskKey string, taskType proto.TaskType, concurrency int, taskMeta []byte) (*proto.Task, error) {
-	taskManager, err := storage.GetTaskManager()
+	return SubmitTaskWithParams(ctx, taskKey, taskType, concurrency, taskMeta, proto.ExtraParams{})
+}
+
+// SubmitTaskWithParams submits a task with extra params.
+// if ctx carries a valid span context, it's saved as the trace context of the
+// task unless extraParams.TraceContext is set.
+func SubmitTaskWithParams(ctx context.Context, taskKey string, taskType proto.TaskType, concurrency int, taskMeta []byte, extraParams proto.ExtraParams) (*proto.Task, error) {
+	taskManager, err := GetTaskManager()
 	if err != nil {
 		return nil, err
 	}
@@ -67,8 +232,19 @@ func SubmitTask(ctx context.Context, taskKey string, taskType proto.TaskType, co
 	if task != nil {
 		return nil, storage.ErrTaskAlreadyExists
 	}
+	if err = checkCircuitBreaker(ctx, taskManager, taskType); err != nil {
+		return nil, err
+	}
+	if extraParams.MetaVersion == 0 {
+		extraParams.MetaVersion, _ = proto.GetMetaVersion(taskType)
+	}
+	if len(extraParams.TraceContext) == 0 && trace.SpanContextFromContext(ctx).IsValid() {
+		carrier := propagation.MapCarrier{}
+		traceContextPropagator.Inject(ctx, carrier)
+		extraParams.TraceContext = carrier
+	}
 
-	taskID, err := taskManager.CreateTask(ctx, taskKey, taskType, concurrency, taskMeta)
+	taskID, err := taskManager.CreateTaskWithParams(ctx, taskKey, taskType, concurrency, taskMeta, extraParams)
 	if err != nil {
 		return nil, err
 	}
@@ -83,17 +259,128 @@ func SubmitTask(ctx context.Context, taskKey string, taskType proto.TaskType, co
 	return task, nil
 }
 
+// SubmitTaskAfter submits a task which is kept pending until startAfter, such
+// as to run the task in a maintenance window, see proto.ExtraParams.StartAfter.
+func SubmitTaskAfter(ctx context.Context, taskKey string, taskType proto.TaskType, concurrency int, taskMeta []byte, extraParams proto.ExtraParams, startAfter time.Time) (*proto.Task, error) {
+	if !startAfter.IsZero() {
+		extraParams.StartAfter = startAfter.Unix()
+	}
+	return SubmitTaskWithParams(ctx, taskKey, taskType, concurrency, taskMeta, extraParams)
+}
+
+// SubmitChildTask submits a task as the child of the parent task, it's called
+// by the scheduler or executor of the parent task to spawn follow-up tasks at
+// runtime, such as repair tasks for corrupt partitions. the parent task waits
+// for its children to finish if it's submitted with ExtraParams.WaitForChildren.
+func SubmitChildTask(ctx context.Context, parentTaskID int64, taskKey string, taskType proto.TaskType, concurrency int, taskMeta []byte, extraParams proto.ExtraParams) (*proto.Task, error) {
+	taskManager, err := GetTaskManager()
+	if err != nil {
+		return nil, err
+	}
+	parent, err := taskManager.GetTaskBaseByID(ctx, parentTaskID)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parent task %d", parentTaskID)
+	}
+	if parent.IsDone() {
+		return nil, errors.Errorf("parent task %d is already finished", parentTaskID)
+	}
+	extraParams.ParentTaskID = parentTaskID
+	return SubmitTaskWithParams(ctx, taskKey, taskType, concurrency, taskMeta, extraParams)
+}
+
+// ContextWithTaskTrace returns a context carrying the trace context of the
+// request which submits the task, if there is any.
+func ContextWithTaskTrace(ctx context.Context, task *proto.Task) context.Context {
+	if len(task.ExtraParams.TraceContext) == 0 {
+		return ctx
+	}
+	return traceContextPropagator.Extract(ctx, propagation.MapCarrier(task.ExtraParams.TraceContext))
+}
+
+// SubmitTaskBlocking is like SubmitTaskWithParams, but it waits until the count
+// of unfinished tasks of the task type is less than limit before submitting the
+// task, so the backlog of the task type is bounded.
+// the check is not atomic with the submission, so concurrent submissions might
+// exceed the limit slightly.
+func SubmitTaskBlocking(ctx context.Context, taskKey string, taskType proto.TaskType, concurrency int, taskMeta []byte, extraParams proto.ExtraParams, limit int) (*proto.Task, error) {
+	taskManager, err := GetTaskManager()
+	if err != nil {
+		return nil, err
+	}
+	ticker := time.NewTicker(checkTaskFinishInterval)
+	defer ticker.Stop()
+
+	logger := logutil.Logger(ctx).With(zap.String("task-key", taskKey), zap.Stringer("task-type", taskType))
+	for {
+		cnt, err := taskManager.GetUnfinishedTaskCntByType(ctx, taskType)
+		if err != nil {
+			logger.Warn("cannot get unfinished task count during waiting", zap.Error(err))
+		} else if cnt < limit {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return SubmitTaskWithParams(ctx, taskKey, taskType, concurrency, taskMeta, extraParams)
+}
+
+// TaskHandle is the handle of a submitted task, it's used to wait for the task
+// to finish or to cancel it, see SubmitTaskWithHandle.
+type TaskHandle struct {
+	task *proto.Task
+}
+
+// SubmitTaskWithHandle is like SubmitTaskWithParams, but it returns the handle
+// of the submitted task.
+func SubmitTaskWithHandle(ctx context.Context, taskKey string, taskType proto.TaskType, concurrency int, taskMeta []byte, extraParams proto.ExtraParams) (*TaskHandle, error) {
+	task, err := SubmitTaskWithParams(ctx, taskKey, taskType, concurrency, taskMeta, extraParams)
+	if err != nil {
+		return nil, err
+	}
+	return &TaskHandle{task: task}, nil
+}
+
+// Task returns the task when it's submitted.
+func (h *TaskHandle) Task() *proto.Task {
+	return h.task
+}
+
+// Wait waits until the task finishes, and returns the finished task, the error
+// of the task, such as the one the task is reverted with, is in the returned
+// task, the returned error is only about waiting.
+func (h *TaskHandle) Wait(ctx context.Context) (*proto.Task, error) {
+	if _, err := WaitTask(ctx, h.task.ID, func(t *proto.TaskBase) bool {
+		return t.IsDone()
+	}); err != nil {
+		return nil, err
+	}
+	taskManager, err := GetTaskManager()
+	if err != nil {
+		return nil, err
+	}
+	return taskManager.GetTaskByIDWithHistory(ctx, h.task.ID)
+}
+
+// Cancel cancels the task, and the task is reverted, call Wait to wait for it,
+// see CancelTask.
+func (h *TaskHandle) Cancel(ctx context.Context) error {
+	return CancelTask(ctx, h.task.Key)
+}
+
 // WaitTaskDoneOrPaused waits for a task done or paused.
 // this API returns error if task failed or cancelled.
 func WaitTaskDoneOrPaused(ctx context.Context, id int64) error {
 	logger := logutil.Logger(ctx).With(zap.Int64("task-id", id))
 	_, err := WaitTask(ctx, id, func(t *proto.TaskBase) bool {
-		return t.IsDone() || t.State == proto.TaskStatePaused
+		return t.State.IsTerminal() || t.State == proto.TaskStatePaused
 	})
 	if err != nil {
 		return err
 	}
-	taskManager, err := storage.GetTaskManager()
+	taskManager, err := GetTaskManager()
 	if err != nil {
 		return err
 	}
@@ -105,6 +392,9 @@ func WaitTaskDoneOrPaused(ctx context.Context, id int64) error {
 	switch found.State {
 	case proto.TaskStateSucceed:
 		return nil
+	case proto.TaskStatePartialSuccess:
+		logger.Warn("task partially succeeded", zap.Error(found.Error))
+		return nil
 	case proto.TaskStateReverted:
 		logger.Error("task reverted", zap.Error(found.Error))
 		return found.Error
@@ -119,7 +409,7 @@ func WaitTaskDoneOrPaused(ctx context.Context, id int64) error {
 
 // WaitTaskDoneByKey waits for a task done by task key.
 func WaitTaskDoneByKey(ctx context.Context, taskKey string) error {
-	taskManager, err := storage.GetTaskManager()
+	taskManager, err := GetTaskManager()
 	if err != nil {
 		return err
 	}
@@ -128,14 +418,14 @@ func WaitTaskDoneByKey(ctx context.Context, taskKey string) error {
 		return err
 	}
 	_, err = WaitTask(ctx, task.ID, func(t *proto.TaskBase) bool {
-		return t.IsDone()
+		return t.State.IsTerminal()
 	})
 	return err
 }
 
 // WaitTask waits for a task until it meets the matchFn.
 func WaitTask(ctx context.Context, id int64, matchFn func(base *proto.TaskBase) bool) (*proto.TaskBase, error) {
-	taskManager, err := storage.GetTaskManager()
+	taskManager, err := GetTaskManager()
 	if err != nil {
 		return nil, err
 	}
@@ -161,9 +451,134 @@ func WaitTask(ctx context.Context, id int64, matchFn func(base *proto.TaskBase)
 	}
 }
 
-// CancelTask cancels a task.
+// SubtaskResult is the result of a finished subtask, see StreamSubtaskResults.
+type SubtaskResult struct {
+	SubtaskID int64
+	Step      proto.Step
+	State     proto.SubtaskState
+	ExecID    string
+	// Summary is the summary of the subtask in JSON format.
+	Summary string
+	Meta    []byte
+}
+
+// StreamSubtaskResults returns a channel which delivers results of subtasks of
+// the task as they finish, each subtask is delivered once, the channel is
+// closed after the task is done and all results are delivered, or when ctx is
+// cancelled.
+// Note: if subtasks are compacted when moved to history table, the aggregated
+// rows are delivered too, see storage.SubtaskCompactionThreshold.
+func StreamSubtaskResults(ctx context.Context, taskID int64) (<-chan SubtaskResult, error) {
+	taskManager, err := GetTaskManager()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = taskManager.GetTaskBaseByIDWithHistory(ctx, taskID); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan SubtaskResult)
+	go func() {
+		defer close(ch)
+		logger := logutil.Logger(ctx).With(zap.Int64("task-id", taskID))
+		ticker := time.NewTicker(checkTaskFinishInterval)
+		defer ticker.Stop()
+		delivered := make(map[int64]struct{})
+		// returns true if the task is done and all results are delivered.
+		deliver := func() (bool, error) {
+			// get task state before subtasks, so we don't miss subtasks
+			// finished in between.
+			task, err := taskManager.GetTaskBaseByIDWithHistory(ctx, taskID)
+			if err != nil {
+				return false, err
+			}
+			subtasks, err := taskManager.GetFinishedSubtasksWithHistory(ctx, taskID)
+			if err != nil {
+				return false, err
+			}
+			for _, st := range subtasks {
+				if _, ok := delivered[st.ID]; ok {
+					continue
+				}
+				select {
+				case ch <- SubtaskResult{
+					SubtaskID: st.ID,
+					Step:      st.Step,
+					State:     st.State,
+					ExecID:    st.ExecID,
+					Summary:   st.Summary,
+					Meta:      st.Meta,
+				}:
+				case <-ctx.Done():
+					return false, ctx.Err()
+				}
+				delivered[st.ID] = struct{}{}
+			}
+			return task.State.IsTerminal(), nil
+		}
+		for {
+			done, err := deliver()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Warn("stream subtask results failed", zap.Error(err))
+			}
+			if done {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// TaskContext returns a context derived from ctx which is cancelled with cause
+// ErrTaskFinished when the task reaches a terminal state, it can be used to
+// coordinate goroutines related to the task.
+// the task state is checked in background until the task is done or ctx is
+// cancelled.
+func TaskContext(ctx context.Context, taskID int64) (context.Context, error) {
+	taskManager, err := GetTaskManager()
+	if err != nil {
+		return nil, err
+	}
+	task, err := taskManager.GetTaskBaseByIDWithHistory(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	taskCtx, cancel := context.WithCancelCause(ctx)
+	if task.IsDone() {
+		cancel(ErrTaskFinished)
+		return taskCtx, nil
+	}
+	go func() {
+		_, err := WaitTask(taskCtx, taskID, func(t *proto.TaskBase) bool {
+			return t.IsDone()
+		})
+		if err == nil {
+			err = ErrTaskFinished
+		}
+		cancel(err)
+	}()
+	return taskCtx, nil
+}
+
+// CancelTask cancels a task, running subtasks are interrupted immediately.
 func CancelTask(ctx context.Context, taskKey string) error {
-	taskManager, err := storage.GetTaskManager()
+	return CancelTaskWithMode(ctx, taskKey, proto.CancelModeForce)
+}
+
+// CancelTaskWithMode cancels a task with the mode, see proto.CancelMode.
+// running subtasks of the task on this node observe the cancellation at once,
+// and those on other nodes observe it within taskexecutor.TaskCheckInterval,
+// the task is reverted by the scheduler after that.
+func CancelTaskWithMode(ctx context.Context, taskKey string, mode proto.CancelMode) error {
+	taskManager, err := GetTaskManager()
 	if err != nil {
 		return err
 	}
@@ -175,12 +590,16 @@ func CancelTask(ctx context.Context, taskKey string) error {
 		}
 		return err
 	}
-	return taskManager.CancelTask(ctx, task.ID)
+	if err = taskManager.CancelTaskWithMode(ctx, task.ID, mode); err != nil {
+		return err
+	}
+	notifyTaskCancelled()
+	return nil
 }
 
 // PauseTask pauses a task.
 func PauseTask(ctx context.Context, taskKey string) error {
-	taskManager, err := storage.GetTaskManager()
+	taskManager, err := GetTaskManager()
 	if err != nil {
 		return err
 	}
@@ -194,7 +613,7 @@ func PauseTask(ctx context.Context, taskKey string) error {
 
 // ResumeTask resumes a task.
 func ResumeTask(ctx context.Context, taskKey string) error {
-	taskManager, err := storage.GetTaskManager()
+	taskManager, err := GetTaskManager()
 	if err != nil {
 		return err
 	}
@@ -206,6 +625,21 @@ func ResumeTask(ctx context.Context, taskKey string) error {
 	return err
 }
 
+// FreezeSubtaskGeneration freezes or unfreezes the subtask generation of a
+// task, when frozen, subtasks already generated still run to finish, but the
+// scheduler doesn't generate subtasks of the next step until it's unfrozen.
+func FreezeSubtaskGeneration(ctx context.Context, taskKey string, frozen bool) error {
+	taskManager, err := GetTaskManager()
+	if err != nil {
+		return err
+	}
+	task, err := taskManager.GetTaskByKey(ctx, taskKey)
+	if err != nil {
+		return err
+	}
+	return taskManager.SetTaskGenerationFrozen(ctx, task.ID, frozen)
+}
+
 // RunWithRetry runs a function with retry, when retry exceed max retry time, it
 // returns the last error met.
 // if the function fails with err, it should return a bool to indicate whether
@@ -16,6 +16,7 @@ package handle_test
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"sync/atomic"
 	"testing"
@@ -50,22 +51,19 @@ func TestHandle(t *testing.T) {
 	// no scheduler registered
 	task, err := handle.SubmitTask(ctx, "1", proto.TaskTypeExample, 2, proto.EmptyMeta)
 	require.NoError(t, err)
-	waitedTaskBase, err := handle.WaitTask(ctx, task.ID, func(task *proto.TaskBase) bool {
-		return task.IsDone()
-	})
-	require.NoError(t, err)
-	require.Equal(t, proto.TaskStateFailed, waitedTaskBase.State)
-	waitedTask, err := mgr.GetTaskByIDWithHistory(ctx, task.ID)
-	require.NoError(t, err)
-	require.ErrorContains(t, waitedTask.Error, "unknown task type")
+	require.Eventually(t, func() bool {
+		task, err := mgr.GetTaskByID(ctx, task.ID)
+		require.NoError(t, err)
+		return task.ExtraParams.StatusMessage == "unsupported task type"
+	}, 10*time.Second, 100*time.Millisecond)
 
 	task, err = mgr.GetTaskByID(ctx, 1)
 	require.NoError(t, err)
 	require.Equal(t, int64(1), task.ID)
 	require.Equal(t, "1", task.Key)
 	require.Equal(t, proto.TaskTypeExample, task.Type)
-	// no scheduler registered.
-	require.Equal(t, proto.TaskStateFailed, task.State)
+	// no scheduler registered, the task is skipped.
+	require.Equal(t, proto.TaskStatePending, task.State)
 	require.Equal(t, proto.StepInit, task.Step)
 	require.Equal(t, 2, task.Concurrency)
 	require.Equal(t, proto.EmptyMeta, task.Meta)
@@ -151,3 +149,270 @@ func TestRunWithRetry(t *testing.T) {
 	)
 	require.ErrorIs(t, err, context.Canceled)
 }
+
+func TestTaskContext(t *testing.T) {
+	ctx := util.WithInternalSourceType(context.Background(), "handle_test")
+
+	store := testkit.CreateMockStore(t)
+	gtk := testkit.NewTestKit(t, store)
+	pool := pools.NewResourcePool(func() (pools.Resource, error) {
+		return gtk.Session(), nil
+	}, 1, 1, time.Second)
+	defer pool.Close()
+	mgr := storage.NewTaskManager(pool)
+	storage.SetTaskManager(mgr)
+
+	_, err := handle.TaskContext(ctx, 1)
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+
+	taskID, err := mgr.CreateTask(ctx, "key1", proto.TaskTypeExample, 1, proto.EmptyMeta)
+	require.NoError(t, err)
+	taskCtx, err := handle.TaskContext(ctx, taskID)
+	require.NoError(t, err)
+	task, err := mgr.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	require.NoError(t, mgr.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, nil))
+	time.Sleep(time.Second)
+	require.NoError(t, taskCtx.Err())
+
+	require.NoError(t, mgr.SucceedTask(ctx, taskID))
+	select {
+	case <-taskCtx.Done():
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "task context is not cancelled")
+	}
+	require.ErrorIs(t, context.Cause(taskCtx), handle.ErrTaskFinished)
+
+	// task already finished.
+	taskCtx, err = handle.TaskContext(ctx, taskID)
+	require.NoError(t, err)
+	require.ErrorIs(t, context.Cause(taskCtx), handle.ErrTaskFinished)
+
+	// cancelled by parent context.
+	taskID, err = mgr.CreateTask(ctx, "key2", proto.TaskTypeExample, 1, proto.EmptyMeta)
+	require.NoError(t, err)
+	parentCtx, cancel := context.WithCancel(ctx)
+	taskCtx, err = handle.TaskContext(parentCtx, taskID)
+	require.NoError(t, err)
+	cancel()
+	<-taskCtx.Done()
+	require.ErrorIs(t, context.Cause(taskCtx), context.Canceled)
+}
+
+func TestStreamSubtaskResults(t *testing.T) {
+	// subtasks are driven by hand below, stop the executor of this node from
+	// picking them up.
+	testkit.EnableFailPoint(t, "github.com/pingcap/tidb/pkg/domain/MockDisableDistTask", "return(true)")
+	ctx := util.WithInternalSourceType(context.Background(), "handle_test")
+
+	store := testkit.CreateMockStore(t)
+	gtk := testkit.NewTestKit(t, store)
+	pool := pools.NewResourcePool(func() (pools.Resource, error) {
+		return gtk.Session(), nil
+	}, 1, 1, time.Second)
+	defer pool.Close()
+	mgr := storage.NewTaskManager(pool)
+	storage.SetTaskManager(mgr)
+	require.NoError(t, mgr.InitMeta(ctx, ":4000", ""))
+
+	_, err := handle.StreamSubtaskResults(ctx, 1)
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+
+	taskID, err := mgr.CreateTask(ctx, "key1", proto.TaskTypeExample, 1, proto.EmptyMeta)
+	require.NoError(t, err)
+	task, err := mgr.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	subtasks := make([]*proto.Subtask, 0, 3)
+	for i := 0; i < 3; i++ {
+		subtasks = append(subtasks, proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+			":4000", 1, proto.EmptyMeta, i+1))
+	}
+	require.NoError(t, mgr.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+	resultCh, err := handle.StreamSubtaskResults(ctx, taskID)
+	require.NoError(t, err)
+
+	subtasks, err = mgr.GetSubtasksWithHistory(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 3)
+	for i, st := range subtasks {
+		require.NoError(t, mgr.StartSubtask(ctx, st.ID, ":4000"))
+		meta := []byte(fmt.Sprintf("result%d", i))
+		require.NoError(t, mgr.FinishSubtask(ctx, ":4000", st.ID, meta))
+		select {
+		case res := <-resultCh:
+			require.Equal(t, st.ID, res.SubtaskID)
+			require.Equal(t, proto.StepOne, res.Step)
+			require.Equal(t, proto.SubtaskStateSucceed, res.State)
+			require.Equal(t, meta, res.Meta)
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "subtask result is not delivered")
+		}
+	}
+
+	// the channel is closed after the task is done.
+	require.NoError(t, mgr.SucceedTask(ctx, taskID))
+	select {
+	case _, ok := <-resultCh:
+		require.False(t, ok)
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "result channel is not closed")
+	}
+}
+
+func TestSubmitTaskBlocking(t *testing.T) {
+	ctx := util.WithInternalSourceType(context.Background(), "handle_test")
+
+	store := testkit.CreateMockStore(t)
+	gtk := testkit.NewTestKit(t, store)
+	pool := pools.NewResourcePool(func() (pools.Resource, error) {
+		return gtk.Session(), nil
+	}, 1, 1, time.Second)
+	defer pool.Close()
+	mgr := storage.NewTaskManager(pool)
+	storage.SetTaskManager(mgr)
+
+	task1, err := handle.SubmitTaskBlocking(ctx, "key1", proto.TaskTypeExample, 1, proto.EmptyMeta, proto.ExtraParams{}, 1)
+	require.NoError(t, err)
+	// tasks of other types are not counted.
+	_, err = handle.SubmitTaskBlocking(ctx, "key-other", proto.TaskTypeExample+"-other", 1, proto.EmptyMeta, proto.ExtraParams{}, 1)
+	require.NoError(t, err)
+
+	// cancelled by context when blocking.
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second)
+	_, err = handle.SubmitTaskBlocking(timeoutCtx, "key2", proto.TaskTypeExample, 1, proto.EmptyMeta, proto.ExtraParams{}, 1)
+	cancel()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = mgr.GetTaskByKey(ctx, "key2")
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+
+	// blocks until the first task finishes.
+	errCh := make(chan error)
+	go func() {
+		_, err := handle.SubmitTaskBlocking(ctx, "key2", proto.TaskTypeExample, 1, proto.EmptyMeta, proto.ExtraParams{}, 1)
+		errCh <- err
+	}()
+	select {
+	case <-errCh:
+		require.FailNow(t, "task is submitted before the first task finishes")
+	case <-time.After(time.Second):
+	}
+	task, err := mgr.GetTaskByID(ctx, task1.ID)
+	require.NoError(t, err)
+	require.NoError(t, mgr.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, nil))
+	require.NoError(t, mgr.SucceedTask(ctx, task1.ID))
+	select {
+	case err = <-errCh:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "task is not submitted after the first task finishes")
+	}
+	_, err = mgr.GetTaskByKey(ctx, "key2")
+	require.NoError(t, err)
+}
+
+func TestSubmitTaskCircuitBreaker(t *testing.T) {
+	ctx := util.WithInternalSourceType(context.Background(), "handle_test")
+
+	store := testkit.CreateMockStore(t)
+	gtk := testkit.NewTestKit(t, store)
+	pool := pools.NewResourcePool(func() (pools.Resource, error) {
+		return gtk.Session(), nil
+	}, 1, 1, time.Second)
+	defer pool.Close()
+	mgr := storage.NewTaskManager(pool)
+	storage.SetTaskManager(mgr)
+
+	handle.SetCircuitBreaker(proto.TaskTypeExample, 2, 3*time.Second)
+	t.Cleanup(func() {
+		handle.SetCircuitBreaker(proto.TaskTypeExample, 0, 0)
+	})
+	revertTask := func(key string) {
+		task, err := handle.SubmitTask(ctx, key, proto.TaskTypeExample, 1, proto.EmptyMeta)
+		require.NoError(t, err)
+		require.NoError(t, mgr.RevertTask(ctx, task.ID, proto.TaskStatePending, errors.New("mock downstream error")))
+		require.NoError(t, mgr.RevertedTask(ctx, task.ID))
+	}
+
+	// a task cancelled by user isn't a failure.
+	task, err := handle.SubmitTask(ctx, "cancelled", proto.TaskTypeExample, 1, proto.EmptyMeta)
+	require.NoError(t, err)
+	require.NoError(t, mgr.CancelTask(ctx, task.ID))
+	require.NoError(t, mgr.RevertTask(ctx, task.ID, proto.TaskStateCancelling, nil))
+	require.NoError(t, mgr.RevertedTask(ctx, task.ID))
+	revertTask("key1")
+	// not enough consecutive failures.
+	revertTask("key2")
+
+	// the breaker is tripped.
+	_, err = handle.SubmitTask(ctx, "key3", proto.TaskTypeExample, 1, proto.EmptyMeta)
+	require.ErrorIs(t, err, handle.ErrCircuitBreakerOpen)
+	require.ErrorContains(t, err, "last 2 tasks of type Example are reverted")
+	_, err = mgr.GetTaskByKey(ctx, "key3")
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+	// tasks of other types are not affected.
+	_, err = handle.SubmitTask(ctx, "key-other", proto.TaskTypeExample+"-other", 1, proto.EmptyMeta)
+	require.NoError(t, err)
+
+	// the breaker is reset after cooldown.
+	require.Eventually(t, func() bool {
+		_, err = handle.SubmitTask(ctx, "key3", proto.TaskTypeExample, 1, proto.EmptyMeta)
+		if err != nil {
+			require.ErrorIs(t, err, handle.ErrCircuitBreakerOpen)
+			return false
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+	task, err = mgr.GetTaskByKey(ctx, "key3")
+	require.NoError(t, err)
+	require.NoError(t, mgr.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, nil))
+	require.NoError(t, mgr.SucceedTask(ctx, task.ID))
+	// a succeed task closes the breaker.
+	revertTask("key4")
+	_, err = handle.SubmitTask(ctx, "key5", proto.TaskTypeExample, 1, proto.EmptyMeta)
+	require.NoError(t, err)
+}
+
+func TestSubmitTaskCircuitBreakerFailurePolicy(t *testing.T) {
+	ctx := util.WithInternalSourceType(context.Background(), "handle_test")
+
+	store := testkit.CreateMockStore(t)
+	gtk := testkit.NewTestKit(t, store)
+	pool := pools.NewResourcePool(func() (pools.Resource, error) {
+		return gtk.Session(), nil
+	}, 1, 1, time.Second)
+	defer pool.Close()
+	mgr := storage.NewTaskManager(pool)
+	storage.SetTaskManager(mgr)
+
+	handle.SetCircuitBreaker(proto.TaskTypeExample, 2, time.Hour)
+	t.Cleanup(func() {
+		handle.SetCircuitBreaker(proto.TaskTypeExample, 0, 0)
+		proto.RegisterFailurePolicy(proto.TaskTypeExample, proto.FailurePolicy{})
+	})
+	cancelTask := func(key string) {
+		task, err := handle.SubmitTask(ctx, key, proto.TaskTypeExample, 1, proto.EmptyMeta)
+		require.NoError(t, err)
+		require.NoError(t, mgr.CancelTask(ctx, task.ID))
+		require.NoError(t, mgr.RevertTask(ctx, task.ID, proto.TaskStateCancelling, nil))
+		require.NoError(t, mgr.RevertedTask(ctx, task.ID))
+	}
+
+	// cancelled tasks are ignored by default.
+	cancelTask("key1")
+	cancelTask("key2")
+	_, err := handle.SubmitTask(ctx, "key3", proto.TaskTypeExample, 1, proto.EmptyMeta)
+	require.NoError(t, err)
+	task, err := mgr.GetTaskByKey(ctx, "key3")
+	require.NoError(t, err)
+	require.NoError(t, mgr.CancelTask(ctx, task.ID))
+	require.NoError(t, mgr.RevertTask(ctx, task.ID, proto.TaskStateCancelling, nil))
+	require.NoError(t, mgr.RevertedTask(ctx, task.ID))
+
+	// cancelled tasks count as failures if the policy says so.
+	proto.RegisterFailurePolicy(proto.TaskTypeExample, proto.FailurePolicy{CountCancelled: true})
+	_, err = handle.SubmitTask(ctx, "key4", proto.TaskTypeExample, 1, proto.EmptyMeta)
+	require.ErrorIs(t, err, handle.ErrCircuitBreakerOpen)
+	proto.RegisterFailurePolicy(proto.TaskTypeExample, proto.FailurePolicy{})
+	_, err = handle.SubmitTask(ctx, "key4", proto.TaskTypeExample, 1, proto.EmptyMeta)
+	require.NoError(t, err)
+}
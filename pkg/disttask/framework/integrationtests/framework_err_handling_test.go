@@ -15,6 +15,7 @@
 package integrationtests
 
 import (
+	"slices"
 	"testing"
 
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
@@ -38,3 +39,22 @@ func TestPlanNotRetryableOnNextSubtasksBatchErr(t *testing.T) {
 	task = testutil.SubmitAndWaitTask(c.Ctx, t, "key2", 1)
 	require.Equal(t, proto.TaskStateReverted, task.State)
 }
+
+func TestInitialPlanErrRevertsFromInitializing(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	testutil.RegisterTaskMeta(t, c.MockCtrl, testutil.GetPlanNotRetryableErrSchedulerExt(c.MockCtrl), c.TestContext, nil)
+	taskBase := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
+	require.Equal(t, proto.TaskStateReverted, taskBase.State)
+	task, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, taskBase.ID)
+	require.NoError(t, err)
+	require.ErrorContains(t, task.Error, "not retryable err")
+	require.Equal(t, proto.StepInit, task.Step)
+	// the task is reverted from initializing without entering running.
+	states := testutil.GetTaskStateEvents("key1")
+	idx := slices.Index(states, proto.TaskStateInitializing)
+	require.GreaterOrEqual(t, idx, 0, states)
+	require.Less(t, idx+1, len(states), states)
+	require.Equal(t, proto.TaskStateReverting, states[idx+1], states)
+	require.NotContains(t, states, proto.TaskStateRunning)
+}
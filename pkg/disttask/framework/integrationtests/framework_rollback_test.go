@@ -15,8 +15,12 @@
 package integrationtests
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/pingcap/tidb/pkg/disttask/framework/handle"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	"github.com/pingcap/tidb/pkg/disttask/framework/testutil"
 	"github.com/pingcap/tidb/pkg/testkit"
@@ -31,3 +35,80 @@ func TestFrameworkRollback(t *testing.T) {
 	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
 	require.Equal(t, proto.TaskStateReverted, task.State)
 }
+
+func TestFrameworkRollbackFinishedBeforeReverted(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		AllErrorRetryable: true,
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 2},
+		},
+	})
+	var startedCnt, rolledBackCnt atomic.Int32
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, _ *proto.Subtask) error {
+		startedCnt.Add(1)
+		<-ctx.Done()
+		// simulate a slow rollback of the side effects of the subtask.
+		time.Sleep(time.Second)
+		rolledBackCnt.Add(1)
+		return ctx.Err()
+	})
+
+	_, err := handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return startedCnt.Load() == 2
+	}, 10*time.Second, 100*time.Millisecond)
+	require.NoError(t, handle.CancelTask(c.Ctx, "key1"))
+	require.Equal(t, proto.TaskStateReverted, testutil.WaitTaskDone(c.Ctx, t, "key1").State)
+	require.EqualValues(t, 2, rolledBackCnt.Load())
+}
+
+func TestFrameworkRevertProgress(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 3, 16, true)
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		AllErrorRetryable: true,
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 3},
+		},
+	})
+	var startedCnt atomic.Int32
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, _ *proto.Subtask) error {
+		idx := startedCnt.Add(1)
+		<-ctx.Done()
+		// simulate slow rollbacks which take different time on each node.
+		time.Sleep(time.Duration(idx) * 700 * time.Millisecond)
+		return ctx.Err()
+	})
+
+	task, err := handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return startedCnt.Load() == 3
+	}, 10*time.Second, 100*time.Millisecond)
+	progress, err := c.TaskMgr.GetRevertProgress(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.Equal(t, &proto.RevertProgress{Reverting: 3}, progress)
+	require.NoError(t, handle.CancelTask(c.Ctx, "key1"))
+
+	observed := make(map[int64]struct{})
+	require.Eventually(t, func() bool {
+		progress, err := c.TaskMgr.GetRevertProgress(c.Ctx, task.ID)
+		require.NoError(t, err)
+		require.EqualValues(t, 3, progress.Total())
+		observed[progress.Reverted] = struct{}{}
+		return progress.Done()
+	}, 30*time.Second, 100*time.Millisecond)
+	// subtasks are reverted one by one.
+	require.Contains(t, observed, int64(1))
+	require.Contains(t, observed, int64(2))
+	require.Contains(t, observed, int64(3))
+
+	require.Equal(t, proto.TaskStateReverted, testutil.WaitTaskDone(c.Ctx, t, "key1").State)
+	progress, err = c.TaskMgr.GetRevertProgress(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.Equal(t, &proto.RevertProgress{Reverted: 3}, progress)
+	desc, err := c.TaskMgr.DescribeTask(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.Contains(t, desc, "revert progress: 3/3 subtasks reverted (pending: 0, reverting: 0, failed: 0)\n")
+}
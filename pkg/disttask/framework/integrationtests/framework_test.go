@@ -16,18 +16,30 @@ package integrationtests
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pingcap/errors"
+	"github.com/pingcap/failpoint"
+	"github.com/pingcap/tidb/pkg/disttask/framework/handle"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	"github.com/pingcap/tidb/pkg/disttask/framework/scheduler"
 	"github.com/pingcap/tidb/pkg/disttask/framework/storage"
+	"github.com/pingcap/tidb/pkg/disttask/framework/taskexecutor"
+	"github.com/pingcap/tidb/pkg/disttask/framework/taskexecutor/execute"
 	"github.com/pingcap/tidb/pkg/disttask/framework/testutil"
+	"github.com/pingcap/tidb/pkg/metrics"
 	"github.com/pingcap/tidb/pkg/testkit"
 	"github.com/pingcap/tidb/pkg/util"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func submitTaskAndCheckSuccessForBasic(ctx context.Context, t *testing.T, taskKey string, testContext *testutil.TestContext) {
@@ -130,6 +142,129 @@ func TestFrameworkCancelTask(t *testing.T) {
 	require.Equal(t, proto.TaskStateReverted, task.State)
 }
 
+func TestFrameworkTaskNeverEnteredState(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	testutil.RegisterTaskMeta(t, c.MockCtrl, testutil.GetMockBasicSchedulerExt(c.MockCtrl), c.TestContext, nil)
+	submitTaskAndCheckSuccessForBasic(c.Ctx, t, "key1", c.TestContext)
+	testutil.AssertTaskNeverEnteredState(c.Ctx, t, "key1", proto.TaskStateCancelling)
+	states := testutil.GetTaskStateEvents("key1")
+	require.Equal(t, proto.TaskStateSucceed, states[len(states)-1])
+}
+
+func checkCancelTaskWithMode(t *testing.T, mode proto.CancelMode) {
+	c := testutil.NewTestDXFContext(t, 1, 16, true)
+
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 1},
+		},
+	})
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	var interrupted, completed atomic.Bool
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, _ *proto.Subtask) error {
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			interrupted.Store(true)
+			return ctx.Err()
+		case <-release:
+			completed.Store(true)
+			return nil
+		}
+	})
+
+	_, err := handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "subtask not started")
+	}
+	require.NoError(t, handle.CancelTaskWithMode(c.Ctx, "key1", mode))
+	if mode == proto.CancelModeGraceful {
+		require.Eventually(t, func() bool {
+			task, err := c.TaskMgr.GetTaskByKey(c.Ctx, "key1")
+			require.NoError(t, err)
+			return task.State == proto.TaskStateReverting
+		}, 10*time.Second, 100*time.Millisecond)
+		// wait task executor manager handles the reverting task, the in-flight
+		// subtask is not interrupted.
+		time.Sleep(3 * taskexecutor.TaskCheckInterval)
+		require.False(t, interrupted.Load())
+		close(release)
+	}
+	task := testutil.WaitTaskDone(c.Ctx, t, "key1")
+	require.Equal(t, proto.TaskStateReverted, task.State)
+	subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 1)
+	if mode == proto.CancelModeGraceful {
+		require.True(t, completed.Load())
+		require.False(t, interrupted.Load())
+		require.Equal(t, proto.SubtaskStateSucceed, subtasks[0].State)
+	} else {
+		require.True(t, interrupted.Load())
+		require.False(t, completed.Load())
+	}
+}
+
+func TestFrameworkCancelTaskGracefully(t *testing.T) {
+	checkCancelTaskWithMode(t, proto.CancelModeGraceful)
+}
+
+func TestFrameworkCancelTaskForcefully(t *testing.T) {
+	checkCancelTaskWithMode(t, proto.CancelModeForce)
+}
+
+func TestFrameworkReplayTask(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 2},
+		},
+	})
+	var taskMetas sync.Map
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, subtask *proto.Subtask) error {
+		task, err := c.TaskMgr.GetTaskByID(ctx, subtask.TaskID)
+		if err != nil {
+			return err
+		}
+		taskMetas.Store(task.ID, task.Meta)
+		return nil
+	})
+
+	taskMeta := []byte(`{"input": "some-file"}`)
+	task, err := handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 2, taskMeta)
+	require.NoError(t, err)
+	taskBase := testutil.WaitTaskDone(c.Ctx, t, "key1")
+	require.Equal(t, proto.TaskStateSucceed, taskBase.State)
+	// wait the task moved to history.
+	require.Eventually(t, func() bool {
+		_, err := c.TaskMgr.GetTaskByID(c.Ctx, task.ID)
+		return errors.Cause(err) == storage.ErrTaskNotFound
+	}, 10*time.Second, 100*time.Millisecond)
+
+	_, err = c.TaskMgr.ReplayTask(c.Ctx, task.ID+100, "key2")
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+	replayedID, err := c.TaskMgr.ReplayTask(c.Ctx, task.ID, "key2")
+	require.NoError(t, err)
+	require.NotEqual(t, task.ID, replayedID)
+	taskBase = testutil.WaitTaskDone(c.Ctx, t, "key2")
+	require.Equal(t, proto.TaskStateSucceed, taskBase.State)
+	require.Equal(t, replayedID, taskBase.ID)
+	replayedTask, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, replayedID)
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskTypeExample, replayedTask.Type)
+	require.Equal(t, 2, replayedTask.Concurrency)
+	for _, id := range []int64{task.ID, replayedID} {
+		meta, ok := taskMetas.Load(id)
+		require.True(t, ok)
+		require.Equal(t, taskMeta, meta)
+	}
+}
+
 func TestFrameworkSubTaskFailed(t *testing.T) {
 	c := testutil.NewTestDXFContext(t, 1, 16, true)
 
@@ -139,6 +274,552 @@ func TestFrameworkSubTaskFailed(t *testing.T) {
 	require.Equal(t, proto.TaskStateReverted, task.State)
 }
 
+type partialSuccessSchedulerExt struct {
+	scheduler.Extension
+	threshold float64
+}
+
+func (e *partialSuccessSchedulerExt) GetSuccessThreshold(*proto.TaskBase) float64 {
+	return e.threshold
+}
+
+func TestFrameworkSubtaskPartialSuccess(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	schedulerExt := &partialSuccessSchedulerExt{
+		Extension: testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+			StepInfos: []testutil.StepInfo{
+				{Step: proto.StepOne, SubtaskCnt: 10},
+			},
+		}),
+		threshold: 0.7,
+	}
+	var failedMetas atomic.Pointer[map[string]struct{}]
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(_ context.Context, subtask *proto.Subtask) error {
+		if _, ok := (*failedMetas.Load())[string(subtask.Meta)]; ok {
+			return errors.Errorf("mock %s failed", subtask.Meta)
+		}
+		return nil
+	})
+
+	// 8/10 subtasks succeed, reaches the threshold.
+	failedMetas.Store(&map[string]struct{}{"subtask-3": {}, "subtask-7": {}})
+	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
+	require.Equal(t, proto.TaskStatePartialSuccess, task.State)
+	fullTask, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.ErrorContains(t, fullTask.Error, "2 subtasks failed")
+	require.ErrorContains(t, fullTask.Error, "mock subtask-3 failed")
+	require.ErrorContains(t, fullTask.Error, "mock subtask-7 failed")
+	subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 10)
+	var failedCnt int
+	for _, st := range subtasks {
+		if st.State == proto.SubtaskStateFailed {
+			failedCnt++
+		}
+	}
+	require.Equal(t, 2, failedCnt)
+
+	// 6/10 subtasks succeed, the task is reverted.
+	failedMetas.Store(&map[string]struct{}{"subtask-0": {}, "subtask-3": {}, "subtask-5": {}, "subtask-7": {}})
+	task = testutil.SubmitAndWaitTask(c.Ctx, t, "key2", 1)
+	require.Equal(t, proto.TaskStateReverted, task.State)
+}
+
+type successEvaluatorSchedulerExt struct {
+	scheduler.Extension
+	expectedRowCount atomic.Int64
+	summaryCnt       atomic.Int32
+}
+
+func (e *successEvaluatorSchedulerExt) EvaluateSuccess(_ context.Context, _ *proto.Task, summaries []string) (proto.TaskState, error) {
+	e.summaryCnt.Store(int32(len(summaries)))
+	var total int64
+	for _, summary := range summaries {
+		var s struct {
+			RowCount int64 `json:"row_count"`
+		}
+		if err := json.Unmarshal([]byte(summary), &s); err != nil {
+			return "", err
+		}
+		total += s.RowCount
+	}
+	if expected := e.expectedRowCount.Load(); total < expected*9/10 || total > expected*11/10 {
+		return proto.TaskStateReverting, errors.Errorf("row count %d is out of tolerance of %d", total, expected)
+	}
+	return proto.TaskStateSucceed, nil
+}
+
+func TestFrameworkEvaluateSuccess(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	schedulerExt := &successEvaluatorSchedulerExt{
+		Extension: testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+			StepInfos: []testutil.StepInfo{
+				{Step: proto.StepOne, SubtaskCnt: 2},
+				{Step: proto.StepTwo, SubtaskCnt: 2},
+			},
+		}),
+	}
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, subtask *proto.Subtask) error {
+		return c.TaskMgr.UpdateSubtaskRowCount(ctx, subtask.ID, 10)
+	})
+
+	// all subtasks succeed, but the aggregated row count is out of tolerance.
+	schedulerExt.expectedRowCount.Store(100)
+	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
+	require.Equal(t, proto.TaskStateReverted, task.State)
+	require.EqualValues(t, 4, schedulerExt.summaryCnt.Load())
+	fullTask, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.ErrorContains(t, fullTask.Error, "row count 40 is out of tolerance of 100")
+	for _, step := range []proto.Step{proto.StepOne, proto.StepTwo} {
+		subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, step)
+		require.NoError(t, err)
+		require.Len(t, subtasks, 2)
+		for _, st := range subtasks {
+			require.Equal(t, proto.SubtaskStateSucceed, st.State)
+		}
+	}
+
+	// row count within tolerance, the task succeeds.
+	schedulerExt.expectedRowCount.Store(42)
+	task = testutil.SubmitAndWaitTask(c.Ctx, t, "key2", 1)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+}
+
+type seededSchedulerExt struct {
+	scheduler.Extension
+}
+
+func (*seededSchedulerExt) OnNextSubtasksBatch(_ context.Context, _ storage.TaskHandle, task *proto.Task, _ []string, _ proto.Step) ([][]byte, error) {
+	rnd := rand.New(rand.NewSource(task.ExtraParams.Seed))
+	metas := make([][]byte, 0, 5)
+	for i := 0; i < 5; i++ {
+		metas = append(metas, []byte(fmt.Sprintf("subtask-%d", rnd.Int63())))
+	}
+	return metas, nil
+}
+
+func TestFrameworkSubtaskGenerationSeed(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	schedulerExt := &seededSchedulerExt{
+		Extension: testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+			StepInfos: []testutil.StepInfo{
+				{Step: proto.StepOne, SubtaskCnt: 5},
+			},
+		}),
+	}
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(context.Context, *proto.Subtask) error {
+		return nil
+	})
+
+	submitAndGetSubtaskMetas := func(taskKey string, seed int64) []string {
+		task, err := handle.SubmitTaskWithParams(c.Ctx, taskKey, proto.TaskTypeExample, 1, nil, proto.ExtraParams{Seed: seed})
+		require.NoError(t, err)
+		require.Equal(t, seed, task.ExtraParams.Seed)
+		require.Equal(t, proto.TaskStateSucceed, testutil.WaitTaskDone(c.Ctx, t, taskKey).State)
+		fullTask, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, task.ID)
+		require.NoError(t, err)
+		require.Equal(t, seed, fullTask.ExtraParams.Seed)
+		subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, proto.StepOne)
+		require.NoError(t, err)
+		metas := make([]string, 0, len(subtasks))
+		for _, st := range subtasks {
+			metas = append(metas, string(st.Meta))
+		}
+		slices.Sort(metas)
+		return metas
+	}
+	metas1 := submitAndGetSubtaskMetas("key1", 123)
+	require.Len(t, metas1, 5)
+	metas2 := submitAndGetSubtaskMetas("key2", 123)
+	require.Equal(t, metas1, metas2)
+	metas3 := submitAndGetSubtaskMetas("key3", 456)
+	require.NotEqual(t, metas1, metas3)
+}
+
+func TestFrameworkNodeAllowlist(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 3, 16, true)
+
+	testutil.RegisterTaskMetaWithDXFCtx(c, testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 6},
+		},
+	}), func(context.Context, *proto.Subtask) error {
+		return nil
+	})
+
+	checkSubtasksRunOn := func(taskID int64, execID string) {
+		subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, taskID, proto.StepOne)
+		require.NoError(t, err)
+		require.Len(t, subtasks, 6)
+		for _, st := range subtasks {
+			require.Equal(t, execID, st.ExecID)
+		}
+	}
+
+	task, err := handle.SubmitTaskWithParams(c.Ctx, "key1", proto.TaskTypeExample, 1, nil,
+		proto.ExtraParams{NodeAllowlist: []string{":4001"}})
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskStateSucceed, testutil.WaitTaskDone(c.Ctx, t, "key1").State)
+	checkSubtasksRunOn(task.ID, ":4001")
+
+	// no allowlisted node is available, the task waits in initializing
+	// state until it comes up.
+	task, err = handle.SubmitTaskWithParams(c.Ctx, "key2", proto.TaskTypeExample, 1, nil,
+		proto.ExtraParams{NodeAllowlist: []string{":4003"}})
+	require.NoError(t, err)
+	time.Sleep(2 * time.Second)
+	taskBase, err := c.TaskMgr.GetTaskBaseByID(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskStateInitializing, taskBase.State)
+	c.ScaleOut(1)
+	require.Equal(t, proto.TaskStateSucceed, testutil.WaitTaskDone(c.Ctx, t, "key2").State)
+	checkSubtasksRunOn(task.ID, ":4003")
+}
+
+// countingTaskStore is an alternate storage of the framework, it records calls
+// of some methods and delegates them to the TiDB table based one.
+type countingTaskStore struct {
+	*storage.TaskManager
+	createTaskCnt    atomic.Int32
+	switchStepCnt    atomic.Int32
+	finishSubtaskCnt atomic.Int32
+}
+
+func (s *countingTaskStore) CreateTaskWithParams(ctx context.Context, key string, tp proto.TaskType, concurrency int, meta []byte, extraParams proto.ExtraParams) (int64, error) {
+	s.createTaskCnt.Add(1)
+	return s.TaskManager.CreateTaskWithParams(ctx, key, tp, concurrency, meta, extraParams)
+}
+
+func (s *countingTaskStore) SwitchTaskStep(ctx context.Context, task *proto.Task, nextState proto.TaskState, nextStep proto.Step, subtasks []*proto.Subtask) error {
+	s.switchStepCnt.Add(1)
+	return s.TaskManager.SwitchTaskStep(ctx, task, nextState, nextStep, subtasks)
+}
+
+func (s *countingTaskStore) FinishSubtask(ctx context.Context, execID string, subtaskID int64, meta []byte) error {
+	s.finishSubtaskCnt.Add(1)
+	return s.TaskManager.FinishSubtask(ctx, execID, subtaskID, meta)
+}
+
+func TestFrameworkWithAlternateStorage(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 0, 16, true)
+	testutil.RegisterTaskMetaWithDXFCtx(c, testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 3},
+		},
+	}), func(context.Context, *proto.Subtask) error {
+		return nil
+	})
+
+	taskStore := &countingTaskStore{TaskManager: c.TaskMgr}
+	handle.RegisterTaskManagerProvider(func() (handle.TaskManager, error) {
+		return taskStore, nil
+	})
+	t.Cleanup(func() {
+		handle.RegisterTaskManagerProvider(nil)
+	})
+	scheduler.MockServerInfo.Store(&[]string{":4000"})
+	exeMgr, err := taskexecutor.NewManager(c.Ctx, ":4000", taskStore)
+	require.NoError(t, err)
+	require.NoError(t, exeMgr.InitMeta())
+	require.NoError(t, exeMgr.Start())
+	t.Cleanup(exeMgr.Stop)
+	schMgr := scheduler.NewManager(c.Ctx, taskStore, ":4000")
+	schMgr.Start()
+	t.Cleanup(schMgr.Stop)
+
+	preview, err := scheduler.PreviewPlan(c.Ctx, proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, preview.SubtaskCnt)
+	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	// the task is submitted through the registered provider.
+	require.EqualValues(t, 1, taskStore.createTaskCnt.Load())
+	require.Positive(t, taskStore.switchStepCnt.Load())
+	require.EqualValues(t, 3, taskStore.finishSubtaskCnt.Load())
+}
+
+type stepConcurrencySchedulerExt struct {
+	scheduler.Extension
+}
+
+func (*stepConcurrencySchedulerExt) StepConcurrency(_ *proto.Task, step proto.Step) int {
+	if step == proto.StepOne {
+		return 8
+	}
+	return 2
+}
+
+func TestFrameworkStepConcurrency(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	schedulerExt := &stepConcurrencySchedulerExt{
+		Extension: testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+			StepInfos: []testutil.StepInfo{
+				{Step: proto.StepOne, SubtaskCnt: 4},
+				{Step: proto.StepTwo, SubtaskCnt: 4},
+			},
+		}),
+	}
+	var (
+		mu              sync.Mutex
+		stepConcurrency = make(map[proto.Step]map[int]struct{})
+	)
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(_ context.Context, subtask *proto.Subtask) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := stepConcurrency[subtask.Step]; !ok {
+			stepConcurrency[subtask.Step] = make(map[int]struct{})
+		}
+		stepConcurrency[subtask.Step][subtask.Concurrency] = struct{}{}
+		return nil
+	})
+
+	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 8)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	require.Equal(t, map[proto.Step]map[int]struct{}{
+		proto.StepOne: {8: {}},
+		proto.StepTwo: {2: {}},
+	}, stepConcurrency)
+}
+
+func TestFrameworkZeroSubtaskTask(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 0},
+			{Step: proto.StepTwo, SubtaskCnt: 0},
+		},
+	})
+	var runCnt atomic.Int32
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(_ context.Context, _ *proto.Subtask) error {
+		runCnt.Add(1)
+		return nil
+	})
+
+	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	require.Equal(t, proto.StepDone, task.Step)
+	require.EqualValues(t, 0, runCnt.Load())
+}
+
+func TestFrameworkTraceContextPropagation(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 2},
+			{Step: proto.StepTwo, SubtaskCnt: 1},
+		},
+	})
+	var (
+		mu       sync.Mutex
+		traceIDs []trace.TraceID
+	)
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, _ *proto.Subtask) error {
+		mu.Lock()
+		defer mu.Unlock()
+		traceIDs = append(traceIDs, trace.SpanContextFromContext(ctx).TraceID())
+		return nil
+	})
+
+	traceID := trace.TraceID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     trace.SpanID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		TraceFlags: trace.FlagsSampled,
+	})
+	submitCtx := trace.ContextWithSpanContext(c.Ctx, spanCtx)
+	_, err := handle.SubmitTask(submitCtx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	task := testutil.WaitTaskDone(c.Ctx, t, "key1")
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	require.Len(t, traceIDs, 3)
+	for _, id := range traceIDs {
+		require.Equal(t, traceID, id)
+	}
+}
+
+type fakeSecretResolver struct {
+	secrets map[proto.SecretRef]string
+}
+
+// ResolveSecret implements execute.SecretResolver.ResolveSecret.
+func (r *fakeSecretResolver) ResolveSecret(_ context.Context, ref proto.SecretRef) (string, error) {
+	secret, ok := r.secrets[ref]
+	if !ok {
+		return "", errors.Errorf("secret %s not found", ref)
+	}
+	return secret, nil
+}
+
+type secretTaskMeta struct {
+	AccessKey proto.SecretRef `json:"access_key"`
+}
+
+func TestFrameworkSecretRef(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	const secret = "mock-s3-secret-access-key"
+	execute.SetSecretResolver(&fakeSecretResolver{secrets: map[proto.SecretRef]string{
+		"vault://s3/access-key": secret,
+	}})
+	t.Cleanup(func() {
+		execute.SetSecretResolver(nil)
+	})
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 2},
+		},
+	})
+	var resolvedCnt atomic.Int32
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, subtask *proto.Subtask) error {
+		task, err := c.TaskMgr.GetTaskByID(ctx, subtask.TaskID)
+		if err != nil {
+			return err
+		}
+		var meta secretTaskMeta
+		if err = json.Unmarshal(task.Meta, &meta); err != nil {
+			return err
+		}
+		got, err := execute.ResolveSecret(ctx, meta.AccessKey)
+		if err != nil {
+			return err
+		}
+		if got != secret {
+			return errors.Errorf("unexpected secret %s", got)
+		}
+		resolvedCnt.Add(1)
+		return nil
+	})
+
+	taskMeta, err := json.Marshal(&secretTaskMeta{AccessKey: "vault://s3/access-key"})
+	require.NoError(t, err)
+	_, err = handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 1, taskMeta)
+	require.NoError(t, err)
+	task := testutil.WaitTaskDone(c.Ctx, t, "key1")
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	require.EqualValues(t, 2, resolvedCnt.Load())
+
+	// the secret is never persisted, only the reference is.
+	require.Eventually(t, func() bool {
+		_, err := c.TaskMgr.GetTaskByID(c.Ctx, task.ID)
+		return errors.Cause(err) == storage.ErrTaskNotFound
+	}, 10*time.Second, 100*time.Millisecond)
+	fullTask, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.Contains(t, string(fullTask.Meta), "vault://s3/access-key")
+	require.NotContains(t, string(fullTask.Meta), secret)
+	subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 2)
+	for _, subtask := range subtasks {
+		require.NotContains(t, string(subtask.Meta), secret)
+	}
+}
+
+func TestFrameworkStalledTask(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 1, 16, true)
+	bakWindow, bakCancel := scheduler.GetTaskStallDetection()
+	scheduler.SetTaskStallDetection(time.Second, false)
+	t.Cleanup(func() {
+		scheduler.SetTaskStallDetection(bakWindow, bakCancel)
+	})
+
+	testutil.RegisterTaskMetaWithDXFCtx(c, testutil.GetMockBasicSchedulerExt(c.MockCtrl), func(ctx context.Context, _ *proto.Subtask) error {
+		// block until the task is reverted.
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	getStalledCnt := func() float64 {
+		pb := &dto.Metric{}
+		require.NoError(t, metrics.DistTaskStalledCounter.WithLabelValues(proto.TaskTypeExample.String()).Write(pb))
+		return pb.GetCounter().GetValue()
+	}
+	stalledCnt := getStalledCnt()
+	task, err := handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return getStalledCnt() > stalledCnt
+	}, 10*time.Second, 100*time.Millisecond)
+	// only reported once.
+	time.Sleep(2 * time.Second)
+	require.Equal(t, stalledCnt+1, getStalledCnt())
+	taskBase, err := c.TaskMgr.GetTaskBaseByID(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskStateRunning, taskBase.State)
+
+	// stalled task is reverted automatically.
+	scheduler.SetTaskStallDetection(time.Second, true)
+	require.Equal(t, proto.TaskStateReverted, testutil.WaitTaskDone(c.Ctx, t, "key1").State)
+	fullTask, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.ErrorContains(t, fullTask.Error, "task makes no progress")
+}
+
+func TestFrameworkSubtaskLeaseRenewal(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+	bakInterval, bakMissed := taskexecutor.SubtaskLeaseRenewInterval, taskexecutor.SubtaskLeaseMaxMissedRenewals
+	// the lease TTL is 1s, much shorter than the time to run a subtask.
+	taskexecutor.SubtaskLeaseRenewInterval = 200 * time.Millisecond
+	taskexecutor.SubtaskLeaseMaxMissedRenewals = 5
+	t.Cleanup(func() {
+		taskexecutor.SubtaskLeaseRenewInterval, taskexecutor.SubtaskLeaseMaxMissedRenewals = bakInterval, bakMissed
+	})
+
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		AllErrorRetryable: true,
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 2},
+		},
+	})
+	var (
+		mu      sync.Mutex
+		runCnts = make(map[int64]int)
+	)
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, subtask *proto.Subtask) error {
+		mu.Lock()
+		runCnts[subtask.ID]++
+		mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(4 * time.Second):
+		}
+		return nil
+	})
+
+	task, err := handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		subtasks, err := c.TaskMgr.GetActiveSubtasks(c.Ctx, task.ID)
+		require.NoError(t, err)
+		if len(subtasks) != 2 {
+			return false
+		}
+		for _, st := range subtasks {
+			if st.State != proto.SubtaskStateRunning || st.LeaseExpireTime.IsZero() {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Equal(t, proto.TaskStateSucceed, testutil.WaitTaskDone(c.Ctx, t, "key1").State)
+	// subtasks are never rescheduled, so each of them only runs once.
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, runCnts, 2)
+	for id, cnt := range runCnts {
+		require.Equal(t, 1, cnt, "subtask %d", id)
+	}
+}
+
 func TestFrameworkSubTaskInitEnvFailed(t *testing.T) {
 	c := testutil.NewTestDXFContext(t, 1, 16, true)
 	testutil.RegisterTaskMeta(t, c.MockCtrl, testutil.GetMockBasicSchedulerExt(c.MockCtrl), c.TestContext, nil)
@@ -243,6 +924,105 @@ func TestFrameworkCleanUpRoutine(t *testing.T) {
 	require.NotEmpty(t, subtasks)
 }
 
+type orderedCleanUpRoutine struct {
+	taskMgr *storage.TaskManager
+	mu      sync.Mutex
+	order   scheduler.CleanUpOrder
+	// archived records whether the task is archived on each CleanUp call.
+	archived map[int64][]bool
+}
+
+func (r *orderedCleanUpRoutine) CleanUp(ctx context.Context, task *proto.Task) error {
+	_, err := r.taskMgr.GetTaskBaseByID(ctx, task.ID)
+	archived := errors.Cause(err) == storage.ErrTaskNotFound
+	if err != nil && !archived {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.archived[task.ID] = append(r.archived[task.ID], archived)
+	return nil
+}
+
+func (r *orderedCleanUpRoutine) CleanUpOrder() scheduler.CleanUpOrder {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.order
+}
+
+func (r *orderedCleanUpRoutine) setOrder(order scheduler.CleanUpOrder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.order = order
+}
+
+func (r *orderedCleanUpRoutine) getArchived(taskID int64) []bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.archived[taskID])
+}
+
+func TestFrameworkCleanUpOrder(t *testing.T) {
+	bak := scheduler.DefaultCleanUpInterval
+	t.Cleanup(func() {
+		scheduler.DefaultCleanUpInterval = bak
+	})
+	scheduler.DefaultCleanUpInterval = 500 * time.Millisecond
+	c := testutil.NewTestDXFContext(t, 1, 16, true)
+	testutil.RegisterTaskMeta(t, c.MockCtrl, testutil.GetMockBasicSchedulerExt(c.MockCtrl), c.TestContext, nil)
+	routine := &orderedCleanUpRoutine{taskMgr: c.TaskMgr, archived: make(map[int64][]bool)}
+	scheduler.RegisterSchedulerCleanUpFactory(proto.TaskTypeExample, func() scheduler.CleanUpRoutine {
+		return routine
+	})
+	isArchived := func(taskID int64) bool {
+		_, err := c.TaskMgr.GetTaskBaseByID(c.Ctx, taskID)
+		if errors.Cause(err) != storage.ErrTaskNotFound {
+			require.NoError(t, err)
+			return false
+		}
+		task, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, taskID)
+		require.NoError(t, err)
+		return !task.ExtraParams.CleanUpPending
+	}
+
+	// cleanup then archive, crash before archiving, cleanup runs again and the
+	// task is archived after recovery.
+	transferErrFP := "github.com/pingcap/tidb/pkg/disttask/framework/scheduler/mockTransferErr"
+	require.NoError(t, failpoint.Enable(transferErrFP, "return()"))
+	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	require.Eventually(t, func() bool {
+		return len(routine.getArchived(task.ID)) >= 2
+	}, 10*time.Second, 100*time.Millisecond)
+	require.False(t, isArchived(task.ID))
+	require.NoError(t, failpoint.Disable(transferErrFP))
+	require.Eventually(t, func() bool {
+		return isArchived(task.ID)
+	}, 10*time.Second, 100*time.Millisecond)
+	require.NotContains(t, routine.getArchived(task.ID), true)
+
+	// archive then cleanup, crash before cleanup, the task is kept pending in
+	// history and cleaned up after recovery.
+	routine.setOrder(scheduler.CleanUpAfterArchive)
+	crashFP := "github.com/pingcap/tidb/pkg/disttask/framework/scheduler/mockCrashBeforeArchivedCleanUp"
+	require.NoError(t, failpoint.Enable(crashFP, "return()"))
+	task = testutil.SubmitAndWaitTask(c.Ctx, t, "key2", 1)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	require.Eventually(t, func() bool {
+		fullTask, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, task.ID)
+		require.NoError(t, err)
+		return fullTask.ExtraParams.CleanUpPending
+	}, 10*time.Second, 100*time.Millisecond)
+	_, err := c.TaskMgr.GetTaskBaseByID(c.Ctx, task.ID)
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+	require.Empty(t, routine.getArchived(task.ID))
+	require.NoError(t, failpoint.Disable(crashFP))
+	require.Eventually(t, func() bool {
+		return isArchived(task.ID)
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Equal(t, []bool{true}, routine.getArchived(task.ID))
+}
+
 func TestTaskCancelledBeforeUpdateTask(t *testing.T) {
 	c := testutil.NewTestDXFContext(t, 1, 16, true)
 
@@ -251,3 +1031,656 @@ func TestTaskCancelledBeforeUpdateTask(t *testing.T) {
 	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
 	require.Equal(t, proto.TaskStateReverted, task.State)
 }
+
+type metaRecordSchedulerExt struct {
+	scheduler.Extension
+	mu    sync.Mutex
+	metas []string
+}
+
+func (e *metaRecordSchedulerExt) OnNextSubtasksBatch(ctx context.Context, h storage.TaskHandle, task *proto.Task, execIDs []string, nextStep proto.Step) ([][]byte, error) {
+	e.mu.Lock()
+	e.metas = append(e.metas, string(task.Meta))
+	e.mu.Unlock()
+	return e.Extension.OnNextSubtasksBatch(ctx, h, task, execIDs, nextStep)
+}
+
+func TestFrameworkMigrateTaskMeta(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 1, 16, true)
+	schedulerExt := &metaRecordSchedulerExt{
+		Extension: testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+			AllErrorRetryable: true,
+			StepInfos: []testutil.StepInfo{
+				{Step: proto.StepOne, SubtaskCnt: 1},
+			},
+		}),
+	}
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(context.Context, *proto.Subtask) error {
+		return nil
+	})
+	var migratedCnt, migratedFrom atomic.Int32
+	proto.RegisterMetaVersion(proto.TaskTypeExample, 2, func(oldVersion int, meta []byte) ([]byte, error) {
+		migratedCnt.Add(1)
+		migratedFrom.Store(int32(oldVersion))
+		if string(meta) != `{"name":"v1"}` {
+			return nil, errors.Errorf("unexpected meta %s", meta)
+		}
+		return []byte(`{"name":"v2"}`), nil
+	})
+	t.Cleanup(func() {
+		proto.RegisterMetaVersion(proto.TaskTypeExample, proto.InitialMetaVersion, nil)
+	})
+
+	// the task is created with v1 meta, it's migrated before execution.
+	task, err := handle.SubmitTaskWithParams(c.Ctx, "key1", proto.TaskTypeExample, 1,
+		[]byte(`{"name":"v1"}`), proto.ExtraParams{MetaVersion: 1})
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskStateSucceed, testutil.WaitTaskDone(c.Ctx, t, task.Key).State)
+	require.EqualValues(t, 1, migratedCnt.Load())
+	require.EqualValues(t, 1, migratedFrom.Load())
+	schedulerExt.mu.Lock()
+	require.NotEmpty(t, schedulerExt.metas)
+	for _, meta := range schedulerExt.metas {
+		require.Equal(t, `{"name":"v2"}`, meta)
+	}
+	schedulerExt.metas = nil
+	schedulerExt.mu.Unlock()
+	fullTask, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"v2"}`, string(fullTask.Meta))
+	require.Equal(t, 2, fullTask.ExtraParams.MetaVersion)
+
+	// new tasks are created with the current version, and are not migrated.
+	task, err = handle.SubmitTask(c.Ctx, "key2", proto.TaskTypeExample, 1, []byte(`{"name":"v2"}`))
+	require.NoError(t, err)
+	require.Equal(t, 2, task.ExtraParams.MetaVersion)
+	require.Equal(t, proto.TaskStateSucceed, testutil.WaitTaskDone(c.Ctx, t, task.Key).State)
+	require.EqualValues(t, 1, migratedCnt.Load())
+}
+
+func TestFrameworkTaskHandleWait(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+	testutil.RegisterTaskMeta(t, c.MockCtrl, testutil.GetMockBasicSchedulerExt(c.MockCtrl), c.TestContext, nil)
+
+	h, err := handle.SubmitTaskWithHandle(c.Ctx, "key1", proto.TaskTypeExample, 1, nil, proto.ExtraParams{})
+	require.NoError(t, err)
+	require.Equal(t, "key1", h.Task().Key)
+	task, err := h.Wait(c.Ctx)
+	require.NoError(t, err)
+	require.Equal(t, h.Task().ID, task.ID)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	require.NoError(t, task.Error)
+	require.Equal(t, 3, c.TestContext.CollectedSubtaskCnt(task.ID, proto.StepOne))
+	require.Equal(t, 1, c.TestContext.CollectedSubtaskCnt(task.ID, proto.StepTwo))
+
+	// waiting is interrupted by ctx.
+	h, err = handle.SubmitTaskWithHandle(c.Ctx, "key2", proto.TaskTypeExample, 1, nil, proto.ExtraParams{})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(c.Ctx)
+	cancel()
+	_, err = h.Wait(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	task, err = h.Wait(c.Ctx)
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+}
+
+func TestFrameworkTaskHandleCancel(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		AllErrorRetryable: true,
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 2},
+		},
+	})
+	var startedCnt atomic.Int32
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, _ *proto.Subtask) error {
+		startedCnt.Add(1)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	h, err := handle.SubmitTaskWithHandle(c.Ctx, "key1", proto.TaskTypeExample, 1, nil, proto.ExtraParams{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return startedCnt.Load() == 2
+	}, 10*time.Second, 100*time.Millisecond)
+	require.NoError(t, h.Cancel(c.Ctx))
+	task, err := h.Wait(c.Ctx)
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskStateReverted, task.State)
+	require.ErrorContains(t, task.Error, "cancelled by user")
+}
+
+func TestFrameworkSubtaskAssignmentHook(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 3, 16, true)
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		AllErrorRetryable: true,
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 1},
+		},
+	})
+	var (
+		mu          sync.Mutex
+		assignments []scheduler.SubtaskAssignment
+		targetNode  string
+		runOnNode   string
+	)
+	scheduler.SetSubtaskAssignmentHook(func(_ context.Context, a *scheduler.SubtaskAssignment) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		assignments = append(assignments, *a)
+		// redirect the subtask to a node other than the chosen one.
+		for _, node := range a.Candidates {
+			if node != a.ExecID {
+				targetNode = node
+				break
+			}
+		}
+		return targetNode, nil
+	})
+	t.Cleanup(func() {
+		scheduler.SetSubtaskAssignmentHook(nil)
+	})
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(_ context.Context, subtask *proto.Subtask) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runOnNode = subtask.ExecID
+		return nil
+	})
+
+	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, assignments, 1)
+	require.Equal(t, task.ID, assignments[0].Task.ID)
+	require.Equal(t, proto.StepOne, assignments[0].Subtask.Step)
+	require.Len(t, assignments[0].Candidates, 3)
+	require.NotEqual(t, assignments[0].ExecID, targetNode)
+	require.Equal(t, targetNode, runOnNode)
+	nodes, err := testutil.GetSubtaskNodes(c.Ctx, c.TaskMgr, task.ID)
+	require.NoError(t, err)
+	require.Equal(t, []string{targetNode}, nodes)
+}
+
+func TestFrameworkWaitForChildTasks(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		AllErrorRetryable: true,
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 1},
+		},
+	})
+	var (
+		spawned      atomic.Bool
+		childStarted = make(chan struct{})
+		releaseChild = make(chan struct{})
+	)
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, subtask *proto.Subtask) error {
+		task, err := c.TaskMgr.GetTaskByID(ctx, subtask.TaskID)
+		if err != nil {
+			return err
+		}
+		if task.ExtraParams.ParentTaskID != 0 {
+			close(childStarted)
+			<-releaseChild
+			return nil
+		}
+		// the subtask of the parent task spawns a child task.
+		if spawned.CompareAndSwap(false, true) {
+			_, err = handle.SubmitChildTask(ctx, subtask.TaskID, "child", proto.TaskTypeExample, 1, nil, proto.ExtraParams{})
+		}
+		return err
+	})
+
+	parent, err := handle.SubmitTaskWithParams(c.Ctx, "parent", proto.TaskTypeExample, 1, nil,
+		proto.ExtraParams{WaitForChildren: true})
+	require.NoError(t, err)
+	select {
+	case <-childStarted:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "child task is not started")
+	}
+	child, err := c.TaskMgr.GetTaskByKey(c.Ctx, "child")
+	require.NoError(t, err)
+	require.Equal(t, parent.ID, child.ExtraParams.ParentTaskID)
+	children, err := c.TaskMgr.GetChildTasks(c.Ctx, parent.ID)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Equal(t, child.ID, children[0].ID)
+
+	// all subtasks of the parent task are done, but it waits for the child.
+	require.Eventually(t, func() bool {
+		cntByStates, err := c.TaskMgr.GetSubtaskCntGroupByStates(c.Ctx, parent.ID, proto.StepOne)
+		require.NoError(t, err)
+		return cntByStates[proto.SubtaskStateSucceed] == 1
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Never(t, func() bool {
+		task, err := c.TaskMgr.GetTaskBaseByIDWithHistory(c.Ctx, parent.ID)
+		require.NoError(t, err)
+		return task.IsDone()
+	}, 2*time.Second, 100*time.Millisecond)
+
+	close(releaseChild)
+	task := testutil.WaitTaskDone(c.Ctx, t, "parent")
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	task = testutil.WaitTaskDone(c.Ctx, t, "child")
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+
+	// child task can't be submitted to a finished parent.
+	_, err = handle.SubmitChildTask(c.Ctx, parent.ID, "child2", proto.TaskTypeExample, 1, nil, proto.ExtraParams{})
+	require.Error(t, err)
+}
+
+func TestFrameworkCancelPropagationLatency(t *testing.T) {
+	// check intervals are not reduced, so the cancellation is propagated by
+	// notification instead of polling.
+	c := testutil.NewTestDXFContext(t, 1, 16, false)
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		AllErrorRetryable: true,
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 1},
+		},
+	})
+	var (
+		started    = make(chan struct{})
+		observedAt = make(chan time.Time, 1)
+	)
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, _ *proto.Subtask) error {
+		close(started)
+		<-ctx.Done()
+		observedAt <- time.Now()
+		return ctx.Err()
+	})
+
+	task, err := handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	select {
+	case <-started:
+	case <-time.After(30 * time.Second):
+		require.FailNow(t, "subtask is not started")
+	}
+	cancelledAt := time.Now()
+	require.NoError(t, handle.CancelTask(c.Ctx, task.Key))
+	select {
+	case at := <-observedAt:
+		require.Less(t, at.Sub(cancelledAt), taskexecutor.TaskCheckInterval)
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "running subtask doesn't observe the cancellation")
+	}
+	task2 := testutil.WaitTaskDone(c.Ctx, t, task.Key)
+	require.Equal(t, proto.TaskStateReverted, task2.State)
+}
+
+func TestFrameworkFreezeSubtaskGeneration(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		AllErrorRetryable: true,
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 2},
+			{Step: proto.StepTwo, SubtaskCnt: 2},
+		},
+	})
+	var (
+		stepOneStarted = make(chan struct{}, 2)
+		releaseStepOne = make(chan struct{})
+	)
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(_ context.Context, subtask *proto.Subtask) error {
+		if subtask.Step == proto.StepOne {
+			stepOneStarted <- struct{}{}
+			<-releaseStepOne
+		}
+		return nil
+	})
+
+	task, err := handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-stepOneStarted:
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "subtasks of step one are not started")
+		}
+	}
+	// freeze generation in the middle of step one, existing subtasks drain.
+	require.NoError(t, handle.FreezeSubtaskGeneration(c.Ctx, "key1", true))
+	frozen, err := c.TaskMgr.IsTaskGenerationFrozen(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.True(t, frozen)
+	close(releaseStepOne)
+	require.Eventually(t, func() bool {
+		cntByStates, err := c.TaskMgr.GetSubtaskCntGroupByStates(c.Ctx, task.ID, proto.StepOne)
+		require.NoError(t, err)
+		return cntByStates[proto.SubtaskStateSucceed] == 2
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Never(t, func() bool {
+		cntByStates, err := c.TaskMgr.GetSubtaskCntGroupByStates(c.Ctx, task.ID, proto.StepTwo)
+		require.NoError(t, err)
+		return len(cntByStates) > 0
+	}, 2*time.Second, 100*time.Millisecond)
+	task, err = c.TaskMgr.GetTaskByID(c.Ctx, task.ID)
+	require.NoError(t, err)
+	require.Equal(t, proto.StepOne, task.Step)
+	require.True(t, task.ExtraParams.FreezeGeneration)
+
+	require.NoError(t, handle.FreezeSubtaskGeneration(c.Ctx, "key1", false))
+	task2 := testutil.WaitTaskDone(c.Ctx, t, "key1")
+	require.Equal(t, proto.TaskStateSucceed, task2.State)
+	subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, proto.StepTwo)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 2)
+}
+
+type stepFailureModeSchedulerExt struct {
+	scheduler.Extension
+	mode proto.StepFailureMode
+}
+
+func (e *stepFailureModeSchedulerExt) GetStepFailureMode(_ *proto.TaskBase, step proto.Step) proto.StepFailureMode {
+	if step == proto.StepTwo {
+		return e.mode
+	}
+	return proto.StepFailureModeRevert
+}
+
+func TestFrameworkCancelStepSubtasks(t *testing.T) {
+	for _, mode := range []proto.StepFailureMode{proto.StepFailureModeRevert, proto.StepFailureModeSkip} {
+		t.Run(string(mode), func(t *testing.T) {
+			c := testutil.NewTestDXFContext(t, 2, 16, true)
+			schedulerExt := &stepFailureModeSchedulerExt{
+				Extension: testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+					AllErrorRetryable: true,
+					StepInfos: []testutil.StepInfo{
+						{Step: proto.StepOne, SubtaskCnt: 2},
+						{Step: proto.StepTwo, SubtaskCnt: 2},
+					},
+				}),
+				mode: mode,
+			}
+			stepTwoStarted := make(chan struct{}, 2)
+			testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(ctx context.Context, subtask *proto.Subtask) error {
+				if subtask.Step == proto.StepTwo {
+					stepTwoStarted <- struct{}{}
+					// run until the subtask is cancelled.
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				return nil
+			})
+
+			task, err := handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 1, nil)
+			require.NoError(t, err)
+			for i := 0; i < 2; i++ {
+				select {
+				case <-stepTwoStarted:
+				case <-time.After(10 * time.Second):
+					require.FailNow(t, "subtasks of step two are not started")
+				}
+			}
+			require.NoError(t, c.TaskMgr.CancelStepSubtasks(c.Ctx, task.ID, proto.StepTwo))
+			cnt, err := c.TaskMgr.GetStepCanceledSubtaskCnt(c.Ctx, task.ID, proto.StepTwo)
+			require.NoError(t, err)
+			require.EqualValues(t, 2, cnt)
+			// subtasks of other steps are not affected.
+			cnt, err = c.TaskMgr.GetStepCanceledSubtaskCnt(c.Ctx, task.ID, proto.StepOne)
+			require.NoError(t, err)
+			require.Zero(t, cnt)
+
+			testutil.WaitTaskDone(c.Ctx, t, "key1")
+			task, err = c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, task.ID)
+			require.NoError(t, err)
+			switch mode {
+			case proto.StepFailureModeRevert:
+				require.Equal(t, proto.TaskStateReverted, task.State)
+				require.ErrorContains(t, task.Error, "subtasks of step 2 are cancelled")
+			case proto.StepFailureModeSkip:
+				require.Equal(t, proto.TaskStateSucceed, task.State)
+			}
+		})
+	}
+}
+
+type iterativeSchedulerExt struct {
+	scheduler.Extension
+	// convergeAt is the iteration at which StepOne converges, 0 means never.
+	convergeAt int
+	mu         sync.Mutex
+	iterations []int
+}
+
+func (e *iterativeSchedulerExt) RefineStepSubtasks(_ context.Context, _ storage.TaskHandle, task *proto.Task, iteration int) ([][]byte, error) {
+	if task.Step != proto.StepOne {
+		return nil, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.iterations = append(e.iterations, iteration)
+	if e.convergeAt > 0 && iteration >= e.convergeAt {
+		return nil, nil
+	}
+	return [][]byte{[]byte(fmt.Sprintf("refined-%d-1", iteration)), []byte(fmt.Sprintf("refined-%d-2", iteration))}, nil
+}
+
+func (e *iterativeSchedulerExt) getIterations() []int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.iterations)
+}
+
+func TestFrameworkIterativeStep(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+	schedulerExt := &iterativeSchedulerExt{
+		Extension: testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+			AllErrorRetryable: true,
+			StepInfos: []testutil.StepInfo{
+				{Step: proto.StepOne, SubtaskCnt: 2},
+				{Step: proto.StepTwo, SubtaskCnt: 1},
+			},
+		}),
+		convergeAt: 3,
+	}
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, nil)
+	checkSubtaskCnt := func(taskID int64, step proto.Step, expected int) {
+		subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, taskID, step)
+		require.NoError(t, err)
+		require.Len(t, subtasks, expected)
+		for _, subtask := range subtasks {
+			require.Equal(t, proto.SubtaskStateSucceed, subtask.State)
+		}
+	}
+
+	// converge after 3 iterations, then advance to StepTwo.
+	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	require.Equal(t, []int{1, 2, 3}, schedulerExt.getIterations())
+	checkSubtaskCnt(task.ID, proto.StepOne, 6)
+	checkSubtaskCnt(task.ID, proto.StepTwo, 1)
+
+	// the step never converges, it advances after max iterations.
+	bak := scheduler.MaxStepIterations
+	scheduler.MaxStepIterations = 2
+	t.Cleanup(func() {
+		scheduler.MaxStepIterations = bak
+	})
+	schedulerExt.mu.Lock()
+	schedulerExt.convergeAt, schedulerExt.iterations = 0, nil
+	schedulerExt.mu.Unlock()
+	task = testutil.SubmitAndWaitTask(c.Ctx, t, "key2", 1)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	require.Equal(t, []int{1}, schedulerExt.getIterations())
+	checkSubtaskCnt(task.ID, proto.StepOne, 4)
+	checkSubtaskCnt(task.ID, proto.StepTwo, 1)
+}
+
+func TestFrameworkSubtaskMetrics(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	testutil.RegisterTaskMeta(t, c.MockCtrl, testutil.GetMockBasicSchedulerExt(c.MockCtrl), c.TestContext,
+		func(ctx context.Context, subtask *proto.Subtask) error {
+			if err := c.TaskMgr.ReportSubtaskMetric(ctx, subtask.ID, "rows_skipped", 1); err != nil {
+				return err
+			}
+			// reporting again overwrites the previous value.
+			if err := c.TaskMgr.ReportSubtaskMetric(ctx, subtask.ID, "rows_skipped", 3); err != nil {
+				return err
+			}
+			return c.TaskMgr.ReportSubtaskMetric(ctx, subtask.ID, "bytes_written", 1.5)
+		})
+	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	for _, step := range []proto.Step{proto.StepOne, proto.StepTwo} {
+		subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, step)
+		require.NoError(t, err)
+		require.NotEmpty(t, subtasks)
+		for _, subtask := range subtasks {
+			require.Equal(t, map[string]float64{"rows_skipped": 3, "bytes_written": 1.5}, subtask.Metrics)
+		}
+	}
+}
+
+func TestFrameworkPreviewPlan(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 3, 16, true)
+	unblockCh := make(chan struct{})
+	testutil.RegisterTaskMetaWithDXFCtx(c, testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		AllErrorRetryable: true,
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 5},
+			{Step: proto.StepTwo, SubtaskCnt: 1},
+		},
+	}), func(ctx context.Context, _ *proto.Subtask) error {
+		select {
+		case <-unblockCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	_, err := scheduler.PreviewPlan(c.Ctx, "unknown", 1, nil)
+	require.ErrorContains(t, err, "task type unknown is not supported")
+	var preview scheduler.PlanPreview
+	require.Eventually(t, func() bool {
+		preview, err = scheduler.PreviewPlan(c.Ctx, proto.TaskTypeExample, 1, nil)
+		require.NoError(t, err)
+		return len(preview.NodeSubtaskCnt) == 3
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Equal(t, proto.StepOne, preview.Step)
+	require.Equal(t, 5, preview.SubtaskCnt)
+	// nothing is created by preview.
+	tasks, err := c.TaskMgr.GetTaskByKeyWithHistory(c.Ctx, "key1")
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+	require.Nil(t, tasks)
+
+	// subtasks are blocked, so they're not moved by the balancer before we
+	// check the distribution.
+	task, err := handle.SubmitTask(c.Ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	var subtasks []*proto.Subtask
+	require.Eventually(t, func() bool {
+		subtasks, err = c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, proto.StepOne)
+		require.NoError(t, err)
+		return len(subtasks) == 5
+	}, 10*time.Second, 100*time.Millisecond)
+	nodeSubtaskCnt := make(map[string]int, 3)
+	for _, subtask := range subtasks {
+		nodeSubtaskCnt[subtask.ExecID]++
+	}
+	require.Equal(t, preview.NodeSubtaskCnt, nodeSubtaskCnt)
+	close(unblockCh)
+	require.Equal(t, proto.TaskStateSucceed, testutil.WaitTaskDone(c.Ctx, t, "key1").State)
+}
+
+func TestFrameworkSubtaskMetaBudget(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+	// metas of subtasks of StepOne take 45 bytes, and StepTwo 9 bytes.
+	testutil.RegisterTaskMetaWithDXFCtx(c, testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 5},
+			{Step: proto.StepTwo, SubtaskCnt: 1},
+		},
+	}), nil)
+	submitAndWait := func(taskKey string, budget int64) *proto.Task {
+		_, err := handle.SubmitTaskWithParams(c.Ctx, taskKey, proto.TaskTypeExample, 1, nil,
+			proto.ExtraParams{SubtaskMetaBudget: budget})
+		require.NoError(t, err)
+		taskBase := testutil.WaitTaskDone(c.Ctx, t, taskKey)
+		task, err := c.TaskMgr.GetTaskByIDWithHistory(c.Ctx, taskBase.ID)
+		require.NoError(t, err)
+		return task
+	}
+
+	// exceeded on planning the first step.
+	task := submitAndWait("key1", 40)
+	require.Equal(t, proto.TaskStateReverted, task.State)
+	require.ErrorContains(t, task.Error, "meta budget exceeded")
+	subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, proto.StepOne)
+	require.NoError(t, err)
+	require.Empty(t, subtasks)
+
+	// subtasks of former steps are counted too.
+	task = submitAndWait("key2", 50)
+	require.Equal(t, proto.TaskStateReverted, task.State)
+	require.ErrorContains(t, task.Error, "meta budget exceeded")
+	subtasks, err = c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 5)
+	subtasks, err = c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, proto.StepTwo)
+	require.NoError(t, err)
+	require.Empty(t, subtasks)
+
+	// within budget.
+	task = submitAndWait("key3", 54)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+}
+
+type retryableExecutorExt struct {
+	taskexecutor.Extension
+}
+
+func (*retryableExecutorExt) IsRetryableError(error) bool {
+	return true
+}
+
+func TestFrameworkRetryOnNewNode(t *testing.T) {
+	c := testutil.NewTestDXFContext(t, 2, 16, true)
+
+	schedulerExt := testutil.GetMockSchedulerExt(c.MockCtrl, testutil.SchedulerInfo{
+		StepInfos: []testutil.StepInfo{
+			{Step: proto.StepOne, SubtaskCnt: 1},
+		},
+	})
+	var (
+		mu      sync.Mutex
+		execIDs []string
+	)
+	testutil.RegisterTaskMetaWithDXFCtx(c, schedulerExt, func(_ context.Context, subtask *proto.Subtask) error {
+		mu.Lock()
+		defer mu.Unlock()
+		execIDs = append(execIDs, subtask.ExecID)
+		if len(execIDs) == 1 {
+			return errors.New("mock node-local corruption")
+		}
+		return nil
+	})
+	factory := taskexecutor.GetTaskExecutorFactory(proto.TaskTypeExample)
+	taskexecutor.RegisterTaskType(proto.TaskTypeExample,
+		func(ctx context.Context, id string, task *proto.Task, taskTable taskexecutor.TaskTable) taskexecutor.TaskExecutor {
+			e := factory(ctx, id, task, taskTable).(*taskexecutor.BaseTaskExecutor)
+			e.Extension = &retryableExecutorExt{Extension: e.Extension}
+			return e
+		},
+		taskexecutor.WithSubtaskRetryPolicy(taskexecutor.RetryOnNewNode),
+	)
+
+	task := testutil.SubmitAndWaitTask(c.Ctx, t, "key1", 1)
+	require.Equal(t, proto.TaskStateSucceed, task.State)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, execIDs, 2)
+	require.NotEqual(t, execIDs[0], execIDs[1])
+	subtasks, err := c.TaskMgr.GetSubtasksWithHistory(c.Ctx, task.ID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 1)
+	require.Equal(t, execIDs[1], subtasks[0].ExecID)
+}
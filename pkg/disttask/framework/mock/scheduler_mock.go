@@ -369,6 +369,21 @@ func (mr *MockTaskManagerMockRecorder) GetAllSubtasksByStepAndState(arg0, arg1,
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllSubtasksByStepAndState", reflect.TypeOf((*MockTaskManager)(nil).GetAllSubtasksByStepAndState), arg0, arg1, arg2, arg3)
 }
 
+// GetFinishedSubtasksWithHistory mocks base method.
+func (m *MockTaskManager) GetFinishedSubtasksWithHistory(arg0 context.Context, arg1 int64) ([]*proto.Subtask, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetFinishedSubtasksWithHistory", arg0, arg1)
+	ret0, _ := ret[0].([]*proto.Subtask)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetFinishedSubtasksWithHistory indicates an expected call of GetFinishedSubtasksWithHistory.
+func (mr *MockTaskManagerMockRecorder) GetFinishedSubtasksWithHistory(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFinishedSubtasksWithHistory", reflect.TypeOf((*MockTaskManager)(nil).GetFinishedSubtasksWithHistory), arg0, arg1)
+}
+
 // GetManagedNodes mocks base method.
 func (m *MockTaskManager) GetManagedNodes(arg0 context.Context) ([]proto.ManagedNode, error) {
 	m.ctrl.T.Helper()
@@ -494,6 +509,48 @@ func (mr *MockTaskManagerMockRecorder) GetUsedSlotsOnNodes(arg0 any) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUsedSlotsOnNodes", reflect.TypeOf((*MockTaskManager)(nil).GetUsedSlotsOnNodes), arg0)
 }
 
+// InitializeTask mocks base method.
+func (m *MockTaskManager) InitializeTask(arg0 context.Context, arg1 int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InitializeTask", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// InitializeTask indicates an expected call of InitializeTask.
+func (mr *MockTaskManagerMockRecorder) InitializeTask(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InitializeTask", reflect.TypeOf((*MockTaskManager)(nil).InitializeTask), arg0, arg1)
+}
+
+// MigrateTaskMeta mocks base method.
+func (m *MockTaskManager) MigrateTaskMeta(arg0 context.Context, arg1 int64, arg2, arg3 int, arg4 []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MigrateTaskMeta", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MigrateTaskMeta indicates an expected call of MigrateTaskMeta.
+func (mr *MockTaskManagerMockRecorder) MigrateTaskMeta(arg0, arg1, arg2, arg3, arg4 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MigrateTaskMeta", reflect.TypeOf((*MockTaskManager)(nil).MigrateTaskMeta), arg0, arg1, arg2, arg3, arg4)
+}
+
+// PartialSucceedTask mocks base method.
+func (m *MockTaskManager) PartialSucceedTask(arg0 context.Context, arg1 int64, arg2 error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PartialSucceedTask", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PartialSucceedTask indicates an expected call of PartialSucceedTask.
+func (mr *MockTaskManagerMockRecorder) PartialSucceedTask(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PartialSucceedTask", reflect.TypeOf((*MockTaskManager)(nil).PartialSucceedTask), arg0, arg1, arg2)
+}
+
 // PauseTask mocks base method.
 func (m *MockTaskManager) PauseTask(arg0 context.Context, arg1 string) (bool, error) {
 	m.ctrl.T.Helper()
@@ -537,6 +594,21 @@ func (mr *MockTaskManagerMockRecorder) ResumeSubtasks(arg0, arg1 any) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResumeSubtasks", reflect.TypeOf((*MockTaskManager)(nil).ResumeSubtasks), arg0, arg1)
 }
 
+// ResumeTask mocks base method.
+func (m *MockTaskManager) ResumeTask(arg0 context.Context, arg1 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResumeTask", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResumeTask indicates an expected call of ResumeTask.
+func (mr *MockTaskManagerMockRecorder) ResumeTask(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResumeTask", reflect.TypeOf((*MockTaskManager)(nil).ResumeTask), arg0, arg1)
+}
+
 // ResumedTask mocks base method.
 func (m *MockTaskManager) ResumedTask(arg0 context.Context, arg1 int64) error {
 	m.ctrl.T.Helper()
@@ -14,7 +14,10 @@
 
 package planner
 
-import "github.com/pingcap/tidb/pkg/disttask/framework/storage"
+import (
+	"github.com/pingcap/tidb/pkg/disttask/framework/handle"
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+)
 
 // Planner represents a distribute plan planner.
 type Planner struct{}
@@ -26,7 +29,7 @@ func NewPlanner() *Planner {
 
 // Run runs the distribute plan.
 func (*Planner) Run(planCtx PlanCtx, plan LogicalPlan) (int64, error) {
-	taskManager, err := storage.GetTaskManager()
+	taskManager, err := handle.GetTaskManager()
 	if err != nil {
 		return 0, err
 	}
@@ -43,5 +46,6 @@ func (*Planner) Run(planCtx PlanCtx, plan LogicalPlan) (int64, error) {
 		planCtx.TaskType,
 		planCtx.ThreadCnt,
 		taskMeta,
+		proto.ExtraParams{},
 	)
 }
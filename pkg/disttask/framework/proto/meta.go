@@ -0,0 +1,213 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// MetaFormat is the serialization format of task meta.
+type MetaFormat int
+
+const (
+	// MetaFormatJSON serializes meta as human-readable JSON, it's the default
+	// format, and it's compatible with metas written before formats are introduced.
+	MetaFormatJSON MetaFormat = iota
+	// MetaFormatBinary serializes meta by BinaryMeta, such as types generated
+	// by protobuf, it's more compact than JSON.
+	MetaFormatBinary
+)
+
+// metaFormatBinaryMarker is the first byte of metas in binary format, JSON
+// never starts with it, so metas of different formats can coexist and the
+// format is detected on read.
+const metaFormatBinaryMarker byte = 0x01
+
+// BinaryMeta is the meta which can be serialized in MetaFormatBinary, types
+// generated by gogo protobuf implement it.
+type BinaryMeta interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+var metaFormats = struct {
+	sync.RWMutex
+	m map[TaskType]MetaFormat
+}{
+	m: make(map[TaskType]MetaFormat),
+}
+
+// RegisterMetaFormat sets the format used to serialize metas of the task type
+// in MarshalMeta, metas already written are still readable after the format
+// is changed.
+func RegisterMetaFormat(tp TaskType, format MetaFormat) {
+	metaFormats.Lock()
+	defer metaFormats.Unlock()
+	metaFormats.m[tp] = format
+}
+
+// GetMetaFormat returns the meta format of the task type, MetaFormatJSON if
+// not registered.
+func GetMetaFormat(tp TaskType) MetaFormat {
+	metaFormats.RLock()
+	defer metaFormats.RUnlock()
+	return metaFormats.m[tp]
+}
+
+// InitialMetaVersion is the version of the task meta schema before any version
+// is registered for the task type.
+const InitialMetaVersion = 1
+
+// MetaMigrateFn migrates the task meta of oldVersion to the current version.
+type MetaMigrateFn func(oldVersion int, meta []byte) ([]byte, error)
+
+type metaVersion struct {
+	version int
+	migrate MetaMigrateFn
+}
+
+var metaVersions = struct {
+	sync.RWMutex
+	m map[TaskType]metaVersion
+}{
+	m: make(map[TaskType]metaVersion),
+}
+
+// RegisterMetaVersion sets the current version of the task meta schema of the
+// task type, new tasks are created with this version, and metas of in-flight
+// tasks with older versions are migrated by migrate when the scheduler loads
+// the task, before any subtask of it is executed.
+func RegisterMetaVersion(tp TaskType, version int, migrate MetaMigrateFn) {
+	metaVersions.Lock()
+	defer metaVersions.Unlock()
+	metaVersions.m[tp] = metaVersion{version: version, migrate: migrate}
+}
+
+// GetMetaVersion returns the current version of the task meta schema of the
+// task type and the function to migrate older metas, InitialMetaVersion and
+// nil if not registered.
+func GetMetaVersion(tp TaskType) (int, MetaMigrateFn) {
+	metaVersions.RLock()
+	defer metaVersions.RUnlock()
+	v, ok := metaVersions.m[tp]
+	if !ok {
+		return InitialMetaVersion, nil
+	}
+	return v.version, v.migrate
+}
+
+// MarshalMeta serializes the meta in the format of the task type, meta must
+// implement BinaryMeta if the format is MetaFormatBinary.
+func MarshalMeta(tp TaskType, meta any) ([]byte, error) {
+	if GetMetaFormat(tp) != MetaFormatBinary {
+		return json.Marshal(meta)
+	}
+	bm, ok := meta.(BinaryMeta)
+	if !ok {
+		return nil, fmt.Errorf("meta of type %T doesn't support binary format", meta)
+	}
+	data, err := bm.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{metaFormatBinaryMarker}, data...), nil
+}
+
+// UnmarshalMeta deserializes the meta, the format is detected from data, so
+// it can read metas written in any format.
+func UnmarshalMeta(data []byte, meta any) error {
+	if len(data) == 0 || data[0] != metaFormatBinaryMarker {
+		return json.Unmarshal(data, meta)
+	}
+	bm, ok := meta.(BinaryMeta)
+	if !ok {
+		return fmt.Errorf("meta of type %T doesn't support binary format", meta)
+	}
+	return bm.Unmarshal(data[1:])
+}
+
+// SubtaskMetaCodec serializes the subtask metas of some step of a task type.
+type SubtaskMetaCodec interface {
+	Marshal(meta any) ([]byte, error)
+	Unmarshal(data []byte, meta any) error
+}
+
+// taskMetaCodec serializes subtask metas the same way as task metas, see
+// MarshalMeta.
+type taskMetaCodec struct {
+	tp TaskType
+}
+
+// Marshal implements SubtaskMetaCodec.
+func (c taskMetaCodec) Marshal(meta any) ([]byte, error) {
+	return MarshalMeta(c.tp, meta)
+}
+
+// Unmarshal implements SubtaskMetaCodec.
+func (taskMetaCodec) Unmarshal(data []byte, meta any) error {
+	return UnmarshalMeta(data, meta)
+}
+
+type subtaskMetaCodecKey struct {
+	tp   TaskType
+	step Step
+}
+
+var subtaskMetaCodecs = struct {
+	sync.RWMutex
+	m map[subtaskMetaCodecKey]SubtaskMetaCodec
+}{
+	m: make(map[subtaskMetaCodecKey]SubtaskMetaCodec),
+}
+
+// RegisterSubtaskMetaCodec sets the codec of subtask metas of the step of the
+// task type, it should be registered on all nodes, as subtask metas are
+// written by the scheduler and read by task executors.
+func RegisterSubtaskMetaCodec(tp TaskType, step Step, codec SubtaskMetaCodec) {
+	subtaskMetaCodecs.Lock()
+	defer subtaskMetaCodecs.Unlock()
+	subtaskMetaCodecs.m[subtaskMetaCodecKey{tp: tp, step: step}] = codec
+}
+
+// GetSubtaskMetaCodec returns the codec of subtask metas of the step of the
+// task type, if not registered, subtask metas are serialized the same way as
+// task metas of the task type.
+func GetSubtaskMetaCodec(tp TaskType, step Step) SubtaskMetaCodec {
+	subtaskMetaCodecs.RLock()
+	defer subtaskMetaCodecs.RUnlock()
+	if codec, ok := subtaskMetaCodecs.m[subtaskMetaCodecKey{tp: tp, step: step}]; ok {
+		return codec
+	}
+	return taskMetaCodec{tp: tp}
+}
+
+// MarshalSubtaskMeta serializes the subtask meta by the codec of the step of
+// the task type, it's used by the scheduler to build subtask metas.
+func MarshalSubtaskMeta(tp TaskType, step Step, meta any) ([]byte, error) {
+	return GetSubtaskMetaCodec(tp, step).Marshal(meta)
+}
+
+// UnmarshalSubtaskMeta deserializes the meta of the subtask as T by the codec
+// of the step of the task type, it's used by task executors to read subtask
+// metas, and by the scheduler to read the metas of finished subtasks.
+func UnmarshalSubtaskMeta[T any](subtask *Subtask) (*T, error) {
+	meta := new(T)
+	if err := GetSubtaskMetaCodec(subtask.Type, subtask.Step).Unmarshal(subtask.Meta, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
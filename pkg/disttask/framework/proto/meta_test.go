@@ -0,0 +1,159 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetaFormat(t *testing.T) {
+	var (
+		jsonType   TaskType = "json-meta"
+		binaryType TaskType = "binary-meta"
+	)
+	require.Equal(t, MetaFormatJSON, GetMetaFormat(jsonType))
+	RegisterMetaFormat(binaryType, MetaFormatBinary)
+	require.Equal(t, MetaFormatBinary, GetMetaFormat(binaryType))
+
+	meta := &metapb.Region{
+		Id:       1,
+		StartKey: []byte("a"),
+		EndKey:   []byte("z"),
+		Peers:    []*metapb.Peer{{Id: 2, StoreId: 3}},
+	}
+	checkMeta := func(got *metapb.Region) {
+		require.Equal(t, meta.Id, got.Id)
+		require.Equal(t, meta.StartKey, got.StartKey)
+		require.Equal(t, meta.EndKey, got.EndKey)
+		require.Len(t, got.Peers, 1)
+		require.Equal(t, meta.Peers[0].Id, got.Peers[0].Id)
+		require.Equal(t, meta.Peers[0].StoreId, got.Peers[0].StoreId)
+	}
+
+	jsonData, err := MarshalMeta(jsonType, meta)
+	require.NoError(t, err)
+	require.Equal(t, byte('{'), jsonData[0])
+	binaryData, err := MarshalMeta(binaryType, meta)
+	require.NoError(t, err)
+	require.Equal(t, metaFormatBinaryMarker, binaryData[0])
+	require.Less(t, len(binaryData), len(jsonData))
+
+	// format is detected on read, regardless of the format of the task type.
+	for _, data := range [][]byte{jsonData, binaryData} {
+		got := &metapb.Region{}
+		require.NoError(t, UnmarshalMeta(data, got))
+		checkMeta(got)
+	}
+
+	// metas written before the format is changed are still readable.
+	RegisterMetaFormat(jsonType, MetaFormatBinary)
+	got := &metapb.Region{}
+	require.NoError(t, UnmarshalMeta(jsonData, got))
+	checkMeta(got)
+
+	// meta must support binary format.
+	type plainMeta struct {
+		Name string `json:"name"`
+	}
+	_, err = MarshalMeta(binaryType, &plainMeta{Name: "a"})
+	require.ErrorContains(t, err, "doesn't support binary format")
+	require.ErrorContains(t, UnmarshalMeta(binaryData, &plainMeta{}), "doesn't support binary format")
+	plainData, err := MarshalMeta(TaskTypeExample, &plainMeta{Name: "a"})
+	require.NoError(t, err)
+	plain := &plainMeta{}
+	require.NoError(t, UnmarshalMeta(plainData, plain))
+	require.Equal(t, "a", plain.Name)
+}
+
+func TestMetaVersion(t *testing.T) {
+	var tp TaskType = "versioned-meta"
+	version, migrate := GetMetaVersion(tp)
+	require.Equal(t, InitialMetaVersion, version)
+	require.Nil(t, migrate)
+
+	RegisterMetaVersion(tp, 3, func(oldVersion int, meta []byte) ([]byte, error) {
+		return append(meta, byte('0'+oldVersion)), nil
+	})
+	version, migrate = GetMetaVersion(tp)
+	require.Equal(t, 3, version)
+	migrated, err := migrate(1, []byte("v"))
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(migrated))
+
+	params := ExtraParams{}
+	require.Equal(t, InitialMetaVersion, params.GetMetaVersion())
+	params.MetaVersion = 3
+	require.Equal(t, 3, params.GetMetaVersion())
+}
+
+// prefixedJSONCodec is a SubtaskMetaCodec which writes JSON with a prefix.
+type prefixedJSONCodec struct {
+	prefix []byte
+}
+
+func (c prefixedJSONCodec) Marshal(meta any) ([]byte, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, c.prefix...), data...), nil
+}
+
+func (c prefixedJSONCodec) Unmarshal(data []byte, meta any) error {
+	if !bytes.HasPrefix(data, c.prefix) {
+		return errors.New("unexpected prefix")
+	}
+	return json.Unmarshal(data[len(c.prefix):], meta)
+}
+
+func TestSubtaskMetaCodec(t *testing.T) {
+	var tp TaskType = "subtask-meta-codec"
+	type stepOneMeta struct {
+		Files []string `json:"files"`
+		Size  int64    `json:"size"`
+	}
+	meta := &stepOneMeta{Files: []string{"a.csv", "b.csv"}, Size: 100}
+
+	// not registered, serialized the same way as task metas.
+	_, ok := GetSubtaskMetaCodec(tp, StepOne).(taskMetaCodec)
+	require.True(t, ok)
+	data, err := MarshalSubtaskMeta(tp, StepOne, meta)
+	require.NoError(t, err)
+	require.Equal(t, byte('{'), data[0])
+	got, err := UnmarshalSubtaskMeta[stepOneMeta](&Subtask{SubtaskBase: SubtaskBase{Type: tp, Step: StepOne}, Meta: data})
+	require.NoError(t, err)
+	require.Equal(t, meta, got)
+
+	// codecs are registered per step.
+	RegisterSubtaskMetaCodec(tp, StepOne, prefixedJSONCodec{prefix: []byte("v2:")})
+	data, err = MarshalSubtaskMeta(tp, StepOne, meta)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(data, []byte("v2:")))
+	subtask := &Subtask{SubtaskBase: SubtaskBase{Type: tp, Step: StepOne}, Meta: data}
+	got, err = UnmarshalSubtaskMeta[stepOneMeta](subtask)
+	require.NoError(t, err)
+	require.Equal(t, meta, got)
+	_, ok = GetSubtaskMetaCodec(tp, StepTwo).(taskMetaCodec)
+	require.True(t, ok)
+	subtask.Step = StepTwo
+	_, err = UnmarshalSubtaskMeta[stepOneMeta](subtask)
+	require.Error(t, err)
+}
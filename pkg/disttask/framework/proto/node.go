@@ -23,3 +23,23 @@ type ManagedNode struct {
 	Role     string
 	CPUCount int
 }
+
+// NodeResource is the available resource of a node, it's reported by the node
+// resource reporter of the scheduler, and used to check whether a node can run
+// some subtask.
+type NodeResource struct {
+	CPUCount int
+	// MemTotal is the total memory of the node in bytes.
+	MemTotal uint64
+	// MemAvailable is the free memory of the node in bytes.
+	MemAvailable uint64
+}
+
+// SubtaskResource is the resource a subtask needs to run, task executors
+// reserve it on the node before starting the subtask, see
+// execute.ResourceEstimator.
+type SubtaskResource struct {
+	CPUCount int
+	// Mem is the memory in bytes.
+	Mem uint64
+}
@@ -0,0 +1,21 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proto
+
+// SecretRef is a reference to a secret, such as the access key of S3.
+// task meta should store the reference instead of the secret itself, so the
+// secret is never persisted in task and subtask tables, including history
+// tables, it's resolved when running subtasks, see execute.ResolveSecret.
+type SecretRef string
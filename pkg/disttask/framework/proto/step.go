@@ -27,6 +27,18 @@ const (
 	StepDone Step = -2
 )
 
+// StepFailureMode decides what the scheduler does when the subtasks of a step
+// are cancelled by the operator, see storage.TaskManager.CancelStepSubtasks.
+type StepFailureMode string
+
+const (
+	// StepFailureModeRevert reverts the task, it's the default mode.
+	StepFailureModeRevert StepFailureMode = "revert"
+	// StepFailureModeSkip ignores the cancelled subtasks, the step finishes
+	// when the other subtasks of it succeed, and the task continues to run.
+	StepFailureModeSkip StepFailureMode = "skip"
+)
+
 // Step2Str converts step to string.
 // it's too bad that we define step as int 🙃.
 func Step2Str(t TaskType, s Step) string {
@@ -16,6 +16,7 @@ package proto
 
 import (
 	"fmt"
+	"slices"
 	"sync/atomic"
 	"time"
 
@@ -29,6 +30,10 @@ import (
 // we do this to make the subtask can be scheduled to other node again, it's NOT
 // a normal state transition.
 //
+// NOTE: `running` -> `retrying` -> `running` happens when the subtask meets
+// retryable error and the task type has a retry backoffer, the subtask waits in
+// `retrying` state until its next retry time, see Subtask.NextRetryTime.
+//
 //	               ┌──────────────┐
 //	               │          ┌───┴──┐
 //	               │ ┌───────►│paused│
@@ -49,6 +54,9 @@ const (
 	SubtaskStateFailed   SubtaskState = "failed"
 	SubtaskStateCanceled SubtaskState = "canceled"
 	SubtaskStatePaused   SubtaskState = "paused"
+	// SubtaskStateRetrying means the subtask meets retryable error and is
+	// waiting for the next retry.
+	SubtaskStateRetrying SubtaskState = "retrying"
 )
 
 type (
@@ -60,6 +68,54 @@ func (s SubtaskState) String() string {
 	return string(s)
 }
 
+// subtaskStateTransforms is the legal transitions of subtask states, besides
+// the normal path in the state machine above, subtasks can be finished from
+// pending/paused directly, such as when the task is reverted, and succeed,
+// failed and canceled are terminal states.
+var subtaskStateTransforms = map[SubtaskState][]SubtaskState{
+	SubtaskStatePending: {
+		SubtaskStateRunning,
+		SubtaskStatePaused,
+		SubtaskStateSucceed,
+		SubtaskStateFailed,
+		SubtaskStateCanceled,
+	},
+	SubtaskStateRunning: {
+		SubtaskStatePending,
+		SubtaskStateRetrying,
+		SubtaskStatePaused,
+		SubtaskStateSucceed,
+		SubtaskStateFailed,
+		SubtaskStateCanceled,
+	},
+	SubtaskStateRetrying: {
+		SubtaskStateRunning,
+		SubtaskStatePaused,
+		SubtaskStateSucceed,
+		SubtaskStateFailed,
+		SubtaskStateCanceled,
+	},
+	SubtaskStatePaused: {
+		SubtaskStatePending,
+		SubtaskStateSucceed,
+		SubtaskStateFailed,
+		SubtaskStateCanceled,
+	},
+	SubtaskStateSucceed:  {},
+	SubtaskStateFailed:   {},
+	SubtaskStateCanceled: {},
+}
+
+// VerifySubtaskStateTransform verifies whether the subtask state transform is
+// valid, transform to the same state is always valid, so the update can be
+// retried.
+func VerifySubtaskStateTransform(from, to SubtaskState) bool {
+	if from == to {
+		return true
+	}
+	return slices.Contains(subtaskStateTransforms[from], to)
+}
+
 // SubtaskBase contains the basic information of a subtask.
 // we define this to avoid load subtask meta which might be very large into memory.
 type SubtaskBase struct {
@@ -83,6 +139,10 @@ type SubtaskBase struct {
 	// Ordinal is the ordinal of subtask, should be unique for some task and step.
 	// starts from 1.
 	Ordinal int
+	// LeaseExpireTime is the time when the lease of the running subtask expires,
+	// the task executor renews it periodically while running the subtask.
+	// it's 0 if the lease is never renewed.
+	LeaseExpireTime time.Time
 }
 
 func (t *SubtaskBase) String() string {
@@ -105,6 +165,9 @@ type Subtask struct {
 	// it can be used as subtask end time if the subtask is finished.
 	// it's 0 if it hasn't started yet.
 	UpdateTime time.Time
+	// EndTime is the time when the subtask is finished.
+	// it's 0 if it hasn't finished yet.
+	EndTime time.Time
 	// Meta is the metadata of subtask, should not be nil.
 	// meta of different subtasks of same step must be different too.
 	// NOTE: this field can be changed by StepExecutor.OnFinished method, to store
@@ -112,6 +175,32 @@ type Subtask struct {
 	// On other code path, this field should be read-only.
 	Meta    []byte
 	Summary string
+	// Group is the logical group of the subtask, such as the partition the
+	// subtask belongs to, subtasks of a group can be cancelled together without
+	// cancelling the task. empty means the subtask doesn't belong to any group.
+	Group string
+	// SerialKey is the key of subtasks which must run serially, such as the
+	// partition the subtask touches, at most 1 subtask of the task with the
+	// same SerialKey is running at the same time, while subtasks with different
+	// keys run in parallel. empty means no such restriction.
+	SerialKey string
+	// Weight is the relative amount of work of the subtask, such as the data
+	// size it processes, it's used to compute the weighted progress of the task.
+	// 0 means the default weight 1.
+	Weight int64
+	// NextRetryTime is the time when the subtask in retrying state is retried,
+	// it's 0 in other states.
+	NextRetryTime time.Time
+	// Metrics are the custom metrics reported by the step executor, such as
+	// rows skipped or bytes written, see TaskManager.ReportSubtaskMetric.
+	// it's nil if no metric is reported.
+	Metrics map[string]float64
+	// TargetStoreIDs and TargetRegionIDs are hints of the TiKV stores and
+	// regions holding the data the subtask works on, the scheduler prefers
+	// nodes co-located with the data. they're only used when scheduling the
+	// subtask and not persisted.
+	TargetStoreIDs  []uint64
+	TargetRegionIDs []uint64
 }
 
 // NewSubtask create a new subtask.
@@ -169,6 +258,57 @@ func (a *Allocatable) Free(n int64) {
 	a.used.Add(-n)
 }
 
+// RevertProgress is the progress of reverting a task, it's counted by the
+// subtasks of the step the task is reverted in. subtasks are reverted by
+// cancelling them, a running subtask is cancelled after its step executor is
+// cleaned up, so it's in reverting status until then. subtasks which succeed
+// before the task is reverted are not counted.
+type RevertProgress struct {
+	// Pending is the number of subtasks which are not started.
+	Pending int64
+	// Reverting is the number of running subtasks which are being cancelled.
+	Reverting int64
+	// Reverted is the number of cancelled subtasks.
+	Reverted int64
+	// Failed is the number of failed subtasks.
+	Failed int64
+}
+
+// NewRevertProgress creates a RevertProgress from the count of subtasks
+// grouped by state.
+func NewRevertProgress(cntByStates map[SubtaskState]int64) *RevertProgress {
+	p := &RevertProgress{}
+	for state, cnt := range cntByStates {
+		switch state {
+		case SubtaskStatePending, SubtaskStateRetrying, SubtaskStatePaused:
+			p.Pending += cnt
+		case SubtaskStateRunning:
+			p.Reverting += cnt
+		case SubtaskStateCanceled:
+			p.Reverted += cnt
+		case SubtaskStateFailed:
+			p.Failed += cnt
+		}
+	}
+	return p
+}
+
+// Total returns the number of subtasks to revert.
+func (p *RevertProgress) Total() int64 {
+	return p.Pending + p.Reverting + p.Reverted + p.Failed
+}
+
+// Done returns whether all subtasks are reverted or failed.
+func (p *RevertProgress) Done() bool {
+	return p.Pending == 0 && p.Reverting == 0
+}
+
+// String implements fmt.Stringer interface.
+func (p *RevertProgress) String() string {
+	return fmt.Sprintf("%d/%d subtasks reverted (pending: %d, reverting: %d, failed: %d)",
+		p.Reverted, p.Total(), p.Pending, p.Reverting, p.Failed)
+}
+
 // StepResource is the max resource that a task step can use.
 // it's also the max resource that a subtask can use, as we run subtasks of task
 // step in sequence.
@@ -16,6 +16,7 @@ package proto
 
 import (
 	"math/rand"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -40,6 +41,35 @@ func TestSubtaskIsDone(t *testing.T) {
 	}
 }
 
+func TestVerifySubtaskStateTransform(t *testing.T) {
+	allStates := []SubtaskState{
+		SubtaskStatePending,
+		SubtaskStateRunning,
+		SubtaskStateRetrying,
+		SubtaskStatePaused,
+		SubtaskStateSucceed,
+		SubtaskStateFailed,
+		SubtaskStateCanceled,
+	}
+	legal := map[SubtaskState][]SubtaskState{
+		SubtaskStatePending:  {SubtaskStateRunning, SubtaskStatePaused, SubtaskStateSucceed, SubtaskStateFailed, SubtaskStateCanceled},
+		SubtaskStateRunning:  {SubtaskStatePending, SubtaskStateRetrying, SubtaskStatePaused, SubtaskStateSucceed, SubtaskStateFailed, SubtaskStateCanceled},
+		SubtaskStateRetrying: {SubtaskStateRunning, SubtaskStatePaused, SubtaskStateSucceed, SubtaskStateFailed, SubtaskStateCanceled},
+		SubtaskStatePaused:   {SubtaskStatePending, SubtaskStateSucceed, SubtaskStateFailed, SubtaskStateCanceled},
+	}
+	for _, from := range allStates {
+		for _, to := range allStates {
+			expected := from == to || slices.Contains(legal[from], to)
+			require.Equal(t, expected, VerifySubtaskStateTransform(from, to), "from %s to %s", from, to)
+		}
+	}
+	// terminal states cannot be changed.
+	for _, from := range []SubtaskState{SubtaskStateSucceed, SubtaskStateFailed, SubtaskStateCanceled} {
+		require.False(t, VerifySubtaskStateTransform(from, SubtaskStateRunning))
+		require.False(t, VerifySubtaskStateTransform(from, SubtaskStatePending))
+	}
+}
+
 func TestAllocatable(t *testing.T) {
 	allocatable := NewAllocatable(123456)
 	require.Equal(t, int64(123456), allocatable.Capacity())
@@ -72,3 +102,27 @@ func TestAllocatable(t *testing.T) {
 	wg.Wait()
 	require.Equal(t, int64(0), allocatable.Used())
 }
+
+func TestRevertProgress(t *testing.T) {
+	p := NewRevertProgress(map[SubtaskState]int64{
+		SubtaskStateSucceed:  5,
+		SubtaskStatePending:  1,
+		SubtaskStateRetrying: 1,
+		SubtaskStateRunning:  2,
+		SubtaskStateCanceled: 3,
+		SubtaskStateFailed:   1,
+	})
+	require.Equal(t, &RevertProgress{Pending: 2, Reverting: 2, Reverted: 3, Failed: 1}, p)
+	require.EqualValues(t, 8, p.Total())
+	require.False(t, p.Done())
+	require.Equal(t, "3/8 subtasks reverted (pending: 2, reverting: 2, failed: 1)", p.String())
+
+	p = NewRevertProgress(map[SubtaskState]int64{
+		SubtaskStateSucceed:  1,
+		SubtaskStateCanceled: 2,
+		SubtaskStateFailed:   1,
+	})
+	require.True(t, p.Done())
+	require.EqualValues(t, 3, p.Total())
+	require.True(t, NewRevertProgress(nil).Done())
+}
@@ -15,6 +15,8 @@
 package proto
 
 import (
+	"slices"
+	"sync"
 	"time"
 )
 
@@ -23,6 +25,13 @@ import (
 // Note: if a task fails during running, it will end with `reverted` state.
 // The `failed` state is used to mean the framework cannot run the task, such as
 // invalid task type, scheduler init error(fatal), etc.
+// The `partial_success` state is used by best-effort tasks, it means some
+// subtasks failed, but the ratio of succeed subtasks reaches the success
+// threshold of the task type, so the task is not reverted.
+// The `initializing` state is between `pending` and `running`, the scheduler is
+// doing the initial planning of the task in this state, it's not drawn below,
+// it transforms to other states the same way as `pending`, and to `reverting`
+// if the initial planning fails, so planning failures are attributable.
 //
 //	                            ┌────────┐
 //	                ┌───────────│resuming│◄────────┐
@@ -33,7 +42,10 @@ import (
 //	   ▲            ▼ │
 //	┌──┴────┐     ┌───┴───┐     ┌────────┐
 //	│pending├────►│running├────►│succeed │
-//	└──┬────┘     └──┬┬───┘     └────────┘
+//	└──┬────┘     └┬─┬┬───┘     └────────┘
+//	   │           │ ││         ┌───────────────┐
+//	   │           └─┼┼────────►│partial_success│
+//	   │             ││         └───────────────┘
 //	   │             ││         ┌─────────┐     ┌────────┐
 //	   │             │└────────►│reverting├────►│reverted│
 //	   │             ▼          └─────────┘     └────────┘
@@ -51,6 +63,13 @@ const (
 	TaskStatePausing    TaskState = "pausing"
 	TaskStatePaused     TaskState = "paused"
 	TaskStateResuming   TaskState = "resuming"
+	// TaskStatePartialSuccess means the task finished with some failed subtasks,
+	// see PartialSuccessExtension in scheduler package.
+	TaskStatePartialSuccess TaskState = "partial_success"
+	// TaskStateInitializing means the scheduler is doing the initial planning
+	// of the task, the task switches to running once subtasks of the first
+	// step are created.
+	TaskStateInitializing TaskState = "initializing"
 )
 
 type (
@@ -68,6 +87,71 @@ func (s TaskState) String() string {
 	return string(s)
 }
 
+// terminalStates are the states in which the task is done, the state of the
+// task won't change anymore.
+var terminalStates = []TaskState{
+	TaskStateSucceed,
+	TaskStateReverted,
+	TaskStateFailed,
+	TaskStatePartialSuccess,
+}
+
+// TerminalStates returns all terminal states of task.
+func TerminalStates() []TaskState {
+	return slices.Clone(terminalStates)
+}
+
+// IsTerminal checks whether the task is done in this state.
+func (s TaskState) IsTerminal() bool {
+	return slices.Contains(terminalStates, s)
+}
+
+// IsFailure checks whether the task doesn't finish successfully in this state.
+// tasks cancelled by user end in reverted state too, use Task.IsFailure to
+// tell them apart.
+func (s TaskState) IsFailure() bool {
+	return s == TaskStateReverted || s == TaskStateFailed
+}
+
+// FailurePolicy controls which finished tasks of a task type count as
+// failures, such as for circuit breakers, see Task.IsFailure.
+type FailurePolicy struct {
+	// CountCancelled means tasks cancelled by user count as failures.
+	CountCancelled bool
+	// CountPartialSuccess means tasks which partially succeed count as
+	// failures.
+	CountPartialSuccess bool
+}
+
+var failurePolicies = struct {
+	sync.RWMutex
+	m map[TaskType]FailurePolicy
+}{
+	m: make(map[TaskType]FailurePolicy),
+}
+
+// RegisterFailurePolicy sets the failure policy of the task type, the zero
+// FailurePolicy is used if not registered.
+func RegisterFailurePolicy(tp TaskType, policy FailurePolicy) {
+	failurePolicies.Lock()
+	defer failurePolicies.Unlock()
+	failurePolicies.m[tp] = policy
+}
+
+// GetFailurePolicy returns the failure policy of the task type.
+func GetFailurePolicy(tp TaskType) FailurePolicy {
+	failurePolicies.RLock()
+	defer failurePolicies.RUnlock()
+	return failurePolicies.m[tp]
+}
+
+// IsRunningLike checks whether the task is to be run or being run in this
+// state, the scheduler allocates slots for such tasks.
+func (s TaskState) IsRunningLike() bool {
+	return s == TaskStatePending || s == TaskStateInitializing || s == TaskStateRunning ||
+		s == TaskStateResuming
+}
+
 const (
 	// TaskIDLabelName is the label name of task id.
 	TaskIDLabelName = "task_id"
@@ -98,8 +182,7 @@ type TaskBase struct {
 
 // IsDone checks if the task is done.
 func (t *TaskBase) IsDone() bool {
-	return t.State == TaskStateSucceed || t.State == TaskStateReverted ||
-		t.State == TaskStateFailed
+	return t.State.IsTerminal()
 }
 
 // CompareTask a wrapper of Compare.
@@ -141,7 +224,8 @@ func (t *TaskBase) Compare(other *TaskBase) int {
 //	priority asc, create_time asc, id asc.
 type Task struct {
 	TaskBase
-	// SchedulerID is not used now.
+	// SchedulerID is the ID of the server whose scheduler drives the task,
+	// it's empty if the task is not scheduled yet.
 	SchedulerID     string
 	StartTime       time.Time
 	StateUpdateTime time.Time
@@ -151,8 +235,147 @@ type Task struct {
 	// 	- on task cleanup, we might do some redaction on the meta.
 	Meta  []byte
 	Error error
+	// ExtraParams is the extra params of task, see ExtraParams for details.
+	ExtraParams ExtraParams
+}
+
+// ExtraParams is the extra params of task, it's stored as a JSON in the
+// extra_params column of the task table.
+type ExtraParams struct {
+	// Seed is used to make the subtask generation deterministic, scheduler
+	// extension can use it to seed the randomness when splitting subtasks, so
+	// tasks with the same meta and seed produce the same subtasks.
+	// 0 means not set.
+	Seed int64 `json:"seed,omitempty"`
+	// NodeAllowlist is the list of node IDs that subtasks of the task can be
+	// scheduled to, empty means no limit. If none of them is available, the
+	// task waits until some of them come back.
+	NodeAllowlist []string `json:"node_allowlist,omitempty"`
+	// ResumeAt is the unix timestamp in seconds at which the paused task is
+	// resumed automatically, see TaskManager.PauseUntil.
+	// 0 means the task is not paused or is paused until resumed manually.
+	ResumeAt int64 `json:"resume_at,omitempty"`
+	// StartAfter is the unix timestamp in seconds before which the task is kept
+	// pending and not scheduled, such as to run the task in a maintenance
+	// window, see handle.SubmitTaskAfter.
+	// 0 means the task can be scheduled at once.
+	StartAfter int64 `json:"start_after,omitempty"`
+	// TraceContext is the trace context of the request which submits the task,
+	// in the format of W3C Trace Context, it's propagated into the context of
+	// subtask execution for end-to-end tracing.
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+	// Ephemeral means the task and its subtasks are deleted directly when the
+	// task is finished instead of being moved to history tables, it's used by
+	// high-frequency tasks which don't need history retention.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// PurgeSubtaskSummary means summaries of subtasks are purged when they're
+	// moved to history table after the task is finished, the task and subtasks
+	// are still kept in history, it's used by tasks whose subtask summaries are
+	// large and only needed during execution.
+	PurgeSubtaskSummary bool `json:"purge_subtask_summary,omitempty"`
+	// CancelMode is the mode to cancel the task, it's set when the task is
+	// cancelled, see CancelMode.
+	CancelMode CancelMode `json:"cancel_mode,omitempty"`
+	// StatusMessage is a free-text line describing the current activity of the
+	// task, such as "merging SST files", see TaskManager.SetTaskStatusMessage.
+	StatusMessage string `json:"status_message,omitempty"`
+	// RetryBudget is the total number of subtask retries allowed for the task,
+	// it's shared by all subtasks of the task, once it's exhausted, subtasks
+	// fail on the next retryable error, and the task is reverted.
+	// 0 means no limit.
+	RetryBudget int `json:"retry_budget,omitempty"`
+	// NoAutoRetry means the task is never retried automatically, such as
+	// destructive or one-shot tasks, any error, even retryable ones, fails the
+	// subtask or the planning, and the task is reverted.
+	NoAutoRetry bool `json:"no_auto_retry,omitempty"`
+	// SubtaskRetries is the number of subtask retries consumed from RetryBudget,
+	// see TaskManager.ConsumeRetryBudget.
+	SubtaskRetries int `json:"subtask_retries,omitempty"`
+	// MetaVersion is the version of the schema of the task meta, see
+	// RegisterMetaVersion. 0 means the task is created before the meta version
+	// of the task type is registered, it's taken as InitialMetaVersion.
+	MetaVersion int `json:"meta_version,omitempty"`
+	// TimeoutSeconds is the max duration in seconds the task can run since it
+	// starts, see Task.Deadline.
+	// 0 means no limit.
+	TimeoutSeconds int64 `json:"timeout_seconds,omitempty"`
+	// ParentTaskID is the ID of the task which spawns the task at runtime, such
+	// as repair tasks for corrupt partitions, see handle.SubmitChildTask.
+	// 0 means the task has no parent.
+	ParentTaskID int64 `json:"parent_task_id,omitempty"`
+	// WaitForChildren means the task doesn't finish until all its child tasks
+	// finish, the task stays in the last step after all subtasks are done.
+	WaitForChildren bool `json:"wait_for_children,omitempty"`
+	// FreezeGeneration means the scheduler doesn't generate subtasks of the
+	// next step, subtasks already generated still run to finish, it can be
+	// toggled at runtime, see handle.FreezeSubtaskGeneration.
+	FreezeGeneration bool `json:"freeze_generation,omitempty"`
+	// StepIteration is the number of times current step is refined, i.e. the
+	// subtasks of the step are re-enqueued based on the results of the last
+	// iteration, see storage.TaskManager.RefineStep. it's reset when the task
+	// switches to the next step.
+	StepIteration int `json:"step_iteration,omitempty"`
+	// Poked means the task is poked by operator to force the owning scheduler
+	// to re-evaluate it, such as when the task gets stuck, it's cleared once
+	// the scheduler takes it, see storage.TaskManager.PokeTask.
+	Poked bool `json:"poked,omitempty"`
+	// CleanUpPending means the task is moved to history before its cleanup
+	// routine runs, and the cleanup hasn't finished yet, it's cleared once the
+	// cleanup succeeds, see scheduler.CleanUpAfterArchive.
+	CleanUpPending bool `json:"cleanup_pending,omitempty"`
+	// SubtaskMetaBudget is the max total bytes of metas of subtasks of the task,
+	// subtasks of former steps which are not moved to history are counted too.
+	// planning fails and the task is reverted if it's exceeded.
+	// 0 means no limit.
+	SubtaskMetaBudget int64 `json:"subtask_meta_budget,omitempty"`
+}
+
+// GetMetaVersion returns the version of the schema of the task meta.
+func (p *ExtraParams) GetMetaVersion() int {
+	if p.MetaVersion == 0 {
+		return InitialMetaVersion
+	}
+	return p.MetaVersion
+}
+
+// Deadline returns the deadline of the task, it's derived from the start time
+// and ExtraParams.TimeoutSeconds, ok is false if the task has no deadline or
+// is not started yet.
+func (t *Task) Deadline() (deadline time.Time, ok bool) {
+	if t.ExtraParams.TimeoutSeconds <= 0 || t.StartTime.IsZero() {
+		return time.Time{}, false
+	}
+	return t.StartTime.Add(time.Duration(t.ExtraParams.TimeoutSeconds) * time.Second), true
+}
+
+// IsFailure checks whether the finished task counts as a failure according to
+// the failure policy of its type, see FailurePolicy. unfinished tasks are not
+// failures.
+func (t *Task) IsFailure() bool {
+	policy := GetFailurePolicy(t.Type)
+	switch {
+	case t.State == TaskStatePartialSuccess:
+		return policy.CountPartialSuccess
+	case !t.State.IsFailure():
+		return false
+	case t.ExtraParams.CancelMode != "":
+		return policy.CountCancelled
+	}
+	return true
 }
 
+// CancelMode is the mode to cancel a task.
+type CancelMode string
+
+const (
+	// CancelModeForce interrupts the running subtasks immediately, it's the
+	// default mode.
+	CancelModeForce CancelMode = "force"
+	// CancelModeGraceful lets the running subtasks finish, and no more
+	// subtask is started, the task is reverted after that.
+	CancelModeGraceful CancelMode = "graceful"
+)
+
 var (
 	// EmptyMeta is the empty meta of task/subtask.
 	EmptyMeta = []byte("{}")
@@ -47,6 +47,83 @@ func TestTaskIsDone(t *testing.T) {
 	}
 }
 
+func TestTaskStateClassification(t *testing.T) {
+	cases := []struct {
+		state       TaskState
+		terminal    bool
+		runningLike bool
+		failure     bool
+	}{
+		{TaskStatePending, false, true, false},
+		{TaskStateInitializing, false, true, false},
+		{TaskStateRunning, false, true, false},
+		{TaskStateSucceed, true, false, false},
+		{TaskStateFailed, true, false, true},
+		{TaskStateReverting, false, false, false},
+		{TaskStateReverted, true, false, true},
+		{TaskStateCancelling, false, false, false},
+		{TaskStatePausing, false, false, false},
+		{TaskStatePaused, false, false, false},
+		{TaskStateResuming, false, true, false},
+		{TaskStatePartialSuccess, true, false, false},
+	}
+	var terminalStates []TaskState
+	for _, c := range cases {
+		require.Equal(t, c.terminal, c.state.IsTerminal(), c.state)
+		require.Equal(t, c.runningLike, c.state.IsRunningLike(), c.state)
+		require.Equal(t, c.failure, c.state.IsFailure(), c.state)
+		if c.failure {
+			require.True(t, c.terminal, c.state)
+		}
+		if c.terminal {
+			terminalStates = append(terminalStates, c.state)
+		}
+	}
+	require.ElementsMatch(t, terminalStates, TerminalStates())
+	// the returned states can be modified by caller.
+	states := TerminalStates()
+	states[0] = TaskStateRunning
+	require.False(t, TaskStateRunning.IsTerminal())
+}
+
+func TestTaskIsFailure(t *testing.T) {
+	var tp TaskType = "failure-policy"
+	t.Cleanup(func() {
+		RegisterFailurePolicy(tp, FailurePolicy{})
+	})
+	newTask := func(state TaskState, cancelMode CancelMode) *Task {
+		return &Task{
+			TaskBase:    TaskBase{Type: tp, State: state},
+			ExtraParams: ExtraParams{CancelMode: cancelMode},
+		}
+	}
+	cases := []struct {
+		task *Task
+		// whether the task is a failure with the default policy, and with the
+		// policy counting cancelled and partial success tasks.
+		failure, strictFailure bool
+	}{
+		{newTask(TaskStateRunning, ""), false, false},
+		{newTask(TaskStateCancelling, CancelModeForce), false, false},
+		{newTask(TaskStateSucceed, ""), false, false},
+		{newTask(TaskStatePartialSuccess, ""), false, true},
+		{newTask(TaskStateFailed, ""), true, true},
+		{newTask(TaskStateReverted, ""), true, true},
+		{newTask(TaskStateReverted, CancelModeForce), false, true},
+		{newTask(TaskStateReverted, CancelModeGraceful), false, true},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.failure, c.task.IsFailure(), c.task.State)
+	}
+	RegisterFailurePolicy(tp, FailurePolicy{CountCancelled: true, CountPartialSuccess: true})
+	require.Equal(t, FailurePolicy{CountCancelled: true, CountPartialSuccess: true}, GetFailurePolicy(tp))
+	for _, c := range cases {
+		require.Equal(t, c.strictFailure, c.task.IsFailure(), c.task.State)
+	}
+	// policies of other types are not affected.
+	require.Equal(t, FailurePolicy{}, GetFailurePolicy(TaskTypeExample))
+}
+
 func TestTaskCompare(t *testing.T) {
 	taskA := Task{TaskBase: TaskBase{
 		ID:         100,
@@ -0,0 +1,98 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+	"slices"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/util/syncutil"
+	"go.uber.org/zap"
+)
+
+// SubtaskAssignment is the decision of the scheduler to assign a subtask to a
+// node, it's passed to SubtaskAssignmentHook before subtasks of the step are
+// committed.
+type SubtaskAssignment struct {
+	Task    *proto.Task
+	Subtask *proto.Subtask
+	// Candidates are the nodes the subtask can be assigned to.
+	Candidates []string
+	// ExecID is the node chosen by the scheduler.
+	ExecID string
+}
+
+// SubtaskAssignmentHook is used by external systems to observe and influence
+// the placement of subtasks, it returns the node to assign the subtask to,
+// returning a.ExecID accepts the decision, returning another node of
+// a.Candidates redirects the subtask to it, and returning an error vetoes the
+// scheduling of the step, the scheduler retries it later.
+// Note: subtasks might still be moved by the balancer later, such as when the
+// node they're assigned to is dead.
+type SubtaskAssignmentHook func(ctx context.Context, a *SubtaskAssignment) (string, error)
+
+var subtaskAssignmentHook = struct {
+	syncutil.RWMutex
+	hook SubtaskAssignmentHook
+}{}
+
+// SetSubtaskAssignmentHook sets the hook of subtask assignment, nil means
+// subtasks are assigned by the scheduler only.
+func SetSubtaskAssignmentHook(hook SubtaskAssignmentHook) {
+	subtaskAssignmentHook.Lock()
+	defer subtaskAssignmentHook.Unlock()
+	subtaskAssignmentHook.hook = hook
+}
+
+func getSubtaskAssignmentHook() SubtaskAssignmentHook {
+	subtaskAssignmentHook.RLock()
+	defer subtaskAssignmentHook.RUnlock()
+	return subtaskAssignmentHook.hook
+}
+
+// applySubtaskAssignmentHook passes the assignment of each subtask to the hook,
+// see SubtaskAssignmentHook. redirecting to a node which is not a candidate is
+// ignored.
+func (s *BaseScheduler) applySubtaskAssignmentHook(task *proto.Task, subtasks []*proto.Subtask, nodes []string) error {
+	hook := getSubtaskAssignmentHook()
+	if hook == nil {
+		return nil
+	}
+	for _, subtask := range subtasks {
+		execID, err := hook(s.ctx, &SubtaskAssignment{
+			Task:       task,
+			Subtask:    subtask,
+			Candidates: slices.Clone(nodes),
+			ExecID:     subtask.ExecID,
+		})
+		if err != nil {
+			return errors.Annotatef(err, "subtask assignment is vetoed, ordinal %d", subtask.Ordinal)
+		}
+		if execID == subtask.ExecID {
+			continue
+		}
+		if !slices.Contains(nodes, execID) {
+			s.logger.Warn("subtask assignment hook redirects subtask to a node which is not a candidate, ignore it",
+				zap.Int("ordinal", subtask.Ordinal), zap.String("node", execID), zap.Strings("candidates", nodes))
+			continue
+		}
+		s.logger.Info("subtask is redirected by assignment hook", zap.Int("ordinal", subtask.Ordinal),
+			zap.String("from", subtask.ExecID), zap.String("to", execID))
+		subtask.ExecID = execID
+	}
+	return nil
+}
@@ -22,6 +22,8 @@ import (
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	llog "github.com/pingcap/tidb/pkg/lightning/log"
+	"github.com/pingcap/tidb/pkg/metrics"
+	"github.com/pingcap/tidb/pkg/util/backoff"
 	"github.com/pingcap/tidb/pkg/util/intest"
 	"go.uber.org/zap"
 )
@@ -29,8 +31,69 @@ import (
 var (
 	// balanceCheckInterval is the interval to check whether we need to balance the subtasks.
 	balanceCheckInterval = 3 * CheckTaskFinishedInterval
+	// maxBalanceRetryInterval is the max interval between 2 balance rounds when
+	// balance keeps failing.
+	maxBalanceRetryInterval = time.Minute
+	// SubtaskAffinityWindow is the stickiness window of subtask assignment.
+	// when a subtask is scheduled away from its node because the node is dead
+	// or doesn't have enough slots, we remember the node, and within this window,
+	// we prefer to schedule the subtask back to it if it's healthy again, so the
+	// warmed caches on it can be reused.
+	// set it to 0 to disable the stickiness.
+	SubtaskAffinityWindow = 5 * time.Minute
+	// SubtaskBalanceQuantum is the max number of subtasks of one task which are
+	// rescheduled in one balance round, the rest are left to later rounds, so
+	// a task with many subtasks to reschedule yields to other tasks, and all
+	// tasks make progress in a round-robin way.
+	// 0 means no limit.
+	SubtaskBalanceQuantum = 0
+	// SubtaskReassignCooldown is the min interval between 2 reassignments of
+	// one subtask, a subtask which is reassigned within this window stays on
+	// its node, even if the node is dead or doesn't have enough slots, until
+	// the window elapses. it dampens the flapping of subtasks between nodes
+	// when heartbeats of them time out repeatedly.
+	// 0 means no cooldown.
+	SubtaskReassignCooldown time.Duration
 )
 
+// subtaskAffinity records the original node of a subtask.
+type subtaskAffinity struct {
+	node      string
+	movedTime time.Time
+}
+
+// BalanceRoundStats is the stats of the scheduling decisions made in one balance
+// round, it's used to tune the balance frequency.
+type BalanceRoundStats struct {
+	// Assigned is the number of subtasks assigned to other nodes, as their node
+	// is dead or doesn't have enough slots.
+	Assigned int
+	// Reassigned is the number of subtasks moved between healthy nodes, to make
+	// subtasks balanced or to schedule them back to their original node.
+	Reassigned int
+	// Skipped is the number of subtasks which should be scheduled but are left
+	// to later rounds, because of SubtaskBalanceQuantum, or their original node
+	// is full, or no node has enough slots to run them.
+	Skipped int
+	// Errors is the number of tasks which fail to balance.
+	Errors int
+}
+
+// BalanceStatsRecorder records the stats of each balance round.
+type BalanceStatsRecorder interface {
+	RecordBalanceRound(stats BalanceRoundStats)
+}
+
+type metricsBalanceStatsRecorder struct{}
+
+// RecordBalanceRound implements BalanceStatsRecorder.
+func (metricsBalanceStatsRecorder) RecordBalanceRound(stats BalanceRoundStats) {
+	metrics.DistTaskBalanceCounter.WithLabelValues("assigned").Add(float64(stats.Assigned))
+	metrics.DistTaskBalanceCounter.WithLabelValues("reassigned").Add(float64(stats.Reassigned))
+	metrics.DistTaskBalanceCounter.WithLabelValues("skipped").Add(float64(stats.Skipped))
+	metrics.DistTaskBalanceCounter.WithLabelValues("error").Add(float64(stats.Errors))
+}
+
 // balancer is used to balance subtasks on managed nodes
 // it handles 2 cases:
 //   - managed node scale in/out.
@@ -45,6 +108,15 @@ type balancer struct {
 	// a helper temporary map to record the used slots of each node during balance
 	// to avoid passing it around.
 	currUsedSlots map[string]int
+	// subtask id -> original node of the subtask, see SubtaskAffinityWindow.
+	affinities map[int64]subtaskAffinity
+	// subtask id -> last time the subtask is reassigned, see
+	// SubtaskReassignCooldown.
+	reassignTimes map[int64]time.Time
+	// stats of current balance round, it's reported to recorder at the end of
+	// the round.
+	stats    BalanceRoundStats
+	recorder BalanceStatsRecorder
 }
 
 func newBalancer(param Param) *balancer {
@@ -56,17 +128,30 @@ func newBalancer(param Param) *balancer {
 		Param:         param,
 		logger:        logger,
 		currUsedSlots: make(map[string]int),
+		affinities:    make(map[int64]subtaskAffinity),
+		reassignTimes: make(map[int64]time.Time),
+		recorder:      metricsBalanceStatsRecorder{},
 	}
 }
 
 func (b *balancer) balanceLoop(ctx context.Context, sm *Manager) {
+	// the reassignment of subtasks is retried with backoff when the balance
+	// round fails, so a failing task doesn't keep hammering the storage.
+	retryBackoffer := backoff.NewExponential(balanceCheckInterval, 2, maxBalanceRetryInterval)
+	interval, failCnt := balanceCheckInterval, 0
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(balanceCheckInterval):
+		case <-time.After(interval):
 		}
 		b.balance(ctx, sm)
+		if b.stats.Errors > 0 {
+			interval = retryBackoffer.Backoff(failCnt)
+			failCnt++
+		} else {
+			interval, failCnt = balanceCheckInterval, 0
+		}
 	}
 }
 
@@ -79,12 +164,19 @@ func (b *balancer) balance(ctx context.Context, sm *Manager) {
 	for _, n := range managedNodes {
 		b.currUsedSlots[n] = 0
 	}
+	b.cleanupExpiredAffinities(time.Now())
+	b.cleanupExpiredReassignTimes(time.Now())
+	b.stats = BalanceRoundStats{}
+	defer func() {
+		b.recorder.RecordBalanceRound(b.stats)
+	}()
 
 	schedulers := sm.getSchedulers()
 	for _, sch := range schedulers {
 		if err := b.balanceSubtasks(ctx, sch, managedNodes); err != nil {
 			b.logger.Warn("failed to balance subtasks",
 				zap.Int64("task-id", sch.GetTask().ID), llog.ShortError(err))
+			b.stats.Errors++
 			return
 		}
 	}
@@ -97,6 +189,13 @@ func (b *balancer) balanceSubtasks(ctx context.Context, sch Scheduler, managedNo
 		return err
 	}
 	if len(eligibleNodes) == 0 {
+		if len(task.ExtraParams.NodeAllowlist) > 0 {
+			// none of the allowlisted nodes is available, subtasks of the task
+			// have to wait until some of them come back.
+			b.logger.Info("no allowlisted nodes available to balance subtasks",
+				zap.Int64("task-id", task.ID))
+			return nil
+		}
 		return errors.New("no eligible nodes to balance subtasks")
 	}
 	return b.doBalanceSubtasks(ctx, task.ID, eligibleNodes)
@@ -115,9 +214,13 @@ func (b *balancer) doBalanceSubtasks(ctx context.Context, taskID int64, eligible
 	// managed nodes, subtasks of task might not be balanced.
 	adjustedNodes := filterNodesWithEnoughSlots(b.currUsedSlots, b.slotMgr.getCapacity(),
 		eligibleNodes, subtasks[0].Concurrency)
+	// a node which fails to renew the lease of running subtasks is taken as
+	// dead for this task, all subtasks on it are scheduled away.
+	adjustedNodes = b.excludeLeaseExpiredNodes(taskID, subtasks, adjustedNodes, time.Now())
 	if len(adjustedNodes) == 0 {
 		// no node has enough slots to run the subtasks, skip balance and skip
 		// update used slots.
+		b.stats.Skipped += len(subtasks)
 		return nil
 	}
 	adjustedNodeMap := make(map[string]struct{}, len(adjustedNodes))
@@ -184,9 +287,31 @@ func (b *balancer) doBalanceSubtasks(ctx context.Context, taskID int64, eligible
 			executorSubtasks[node] = sts[:len(sts)-cnt]
 		}
 	}
+	subtasksNeedSchedule = append(subtasksNeedSchedule,
+		b.collectSubtasksBack2OriginalNode(executorSubtasks, adjustedNodeMap, averageSubtaskCnt)...)
 	if len(subtasksNeedSchedule) == 0 {
 		return nil
 	}
+	oldExecIDs := make(map[int64]string, len(subtasksNeedSchedule))
+	for _, st := range subtasksNeedSchedule {
+		oldExecIDs[st.ID] = st.ExecID
+	}
+	defer func() {
+		if err == nil {
+			b.updateAffinities(subtasksNeedSchedule, oldExecIDs, adjustedNodeMap)
+		}
+	}()
+
+	// prefer the original node of the subtask if it's healthy.
+	subtasksWithoutAffinity := make([]*proto.SubtaskBase, 0, len(subtasksNeedSchedule))
+	for _, st := range subtasksNeedSchedule {
+		if node, ok := b.getAffinityNode(st.ID, adjustedNodeMap); ok {
+			st.ExecID = node
+			executorSubtasks[node] = append(executorSubtasks[node], st)
+			continue
+		}
+		subtasksWithoutAffinity = append(subtasksWithoutAffinity, st)
+	}
 
 	for i := 0; i < len(adjustedNodes) && remainder > 0; i++ {
 		if _, ok := executorWithOneMoreSubtask[adjustedNodes[i]]; !ok {
@@ -202,19 +327,194 @@ func (b *balancer) doBalanceSubtasks(ctx context.Context, taskID int64, eligible
 		if _, ok := executorWithOneMoreSubtask[node]; ok {
 			targetSubtaskCnt = averageSubtaskCnt + 1
 		}
-		for i := len(sts); i < targetSubtaskCnt && fillIdx < len(subtasksNeedSchedule); i++ {
-			subtasksNeedSchedule[fillIdx].ExecID = node
+		for i := len(sts); i < targetSubtaskCnt && fillIdx < len(subtasksWithoutAffinity); i++ {
+			subtasksWithoutAffinity[fillIdx].ExecID = node
 			fillIdx++
 		}
 	}
+	// subtasks scheduled back to their original nodes might occupy the place
+	// of others, schedule the rest in round-robin.
+	for i := 0; fillIdx < len(subtasksWithoutAffinity); i++ {
+		subtasksWithoutAffinity[fillIdx].ExecID = adjustedNodes[i%len(adjustedNodes)]
+		fillIdx++
+	}
 
+	subtasksNeedSchedule = b.keepSubtasksInCooldown(taskID, subtasksNeedSchedule, oldExecIDs, time.Now())
+	if len(subtasksNeedSchedule) == 0 {
+		return nil
+	}
+	if quantum := SubtaskBalanceQuantum; quantum > 0 && len(subtasksNeedSchedule) > quantum {
+		for _, st := range subtasksNeedSchedule[quantum:] {
+			st.ExecID = oldExecIDs[st.ID]
+		}
+		b.stats.Skipped += len(subtasksNeedSchedule) - quantum
+		b.logger.Info("reschedule part of the subtasks in this round, yield to other tasks",
+			zap.Int64("task-id", taskID),
+			zap.Int("quantum", quantum),
+			zap.Int("need-schedule", len(subtasksNeedSchedule)))
+		subtasksNeedSchedule = subtasksNeedSchedule[:quantum]
+	}
 	if err = b.taskMgr.UpdateSubtasksExecIDs(ctx, subtasksNeedSchedule); err != nil {
 		return err
 	}
+	now := time.Now()
+	for _, st := range subtasksNeedSchedule {
+		oldExecID := oldExecIDs[st.ID]
+		if st.ExecID == oldExecID {
+			continue
+		}
+		if SubtaskReassignCooldown > 0 {
+			b.reassignTimes[st.ID] = now
+		}
+		if _, ok := adjustedNodeMap[oldExecID]; ok {
+			b.stats.Reassigned++
+		} else {
+			b.stats.Assigned++
+		}
+	}
 	b.logger.Info("balance subtasks", zap.Stringers("subtasks", subtasksNeedSchedule))
 	return nil
 }
 
+// keepSubtasksInCooldown restores the node of subtasks which are reassigned
+// within SubtaskReassignCooldown, and returns the rest.
+func (b *balancer) keepSubtasksInCooldown(taskID int64, subtasks []*proto.SubtaskBase, oldExecIDs map[int64]string, now time.Time) []*proto.SubtaskBase {
+	if SubtaskReassignCooldown <= 0 || len(b.reassignTimes) == 0 {
+		return subtasks
+	}
+	res := subtasks[:0]
+	for _, st := range subtasks {
+		oldExecID := oldExecIDs[st.ID]
+		lastReassignTime, ok := b.reassignTimes[st.ID]
+		if st.ExecID != oldExecID && ok && now.Sub(lastReassignTime) < SubtaskReassignCooldown {
+			b.logger.Info("subtask is reassigned recently, keep it on its node",
+				zap.Int64("task-id", taskID),
+				zap.Int64("subtask-id", st.ID),
+				zap.String("node", oldExecID),
+				zap.Time("last-reassign-time", lastReassignTime))
+			st.ExecID = oldExecID
+			b.stats.Skipped++
+			continue
+		}
+		res = append(res, st)
+	}
+	return res
+}
+
+// excludeLeaseExpiredNodes removes nodes which have running subtasks with
+// expired lease from nodes, i.e. the task executor on it has missed too many
+// renewals. subtasks which never renew the lease are skipped.
+func (b *balancer) excludeLeaseExpiredNodes(taskID int64, subtasks []*proto.SubtaskBase, nodes []string, now time.Time) []string {
+	expiredNodes := make(map[string]struct{})
+	for _, st := range subtasks {
+		if st.State == proto.SubtaskStateRunning && !st.LeaseExpireTime.IsZero() &&
+			now.After(st.LeaseExpireTime) {
+			b.logger.Info("subtask lease expired, take the node as dead",
+				zap.Int64("task-id", taskID),
+				zap.Int64("subtask-id", st.ID),
+				zap.String("node", st.ExecID),
+				zap.Time("lease-expire-time", st.LeaseExpireTime))
+			expiredNodes[st.ExecID] = struct{}{}
+		}
+	}
+	if len(expiredNodes) == 0 {
+		return nodes
+	}
+	res := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		if _, ok := expiredNodes[n]; !ok {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// collectSubtasksBack2OriginalNode collects pending subtasks which can be
+// scheduled back to their original nodes, and removes them from executorSubtasks.
+// we only do this when the original node has room for it, to avoid moving
+// subtasks back and forth with the balance logic.
+func (b *balancer) collectSubtasksBack2OriginalNode(
+	executorSubtasks map[string][]*proto.SubtaskBase,
+	adjustedNodeMap map[string]struct{},
+	averageSubtaskCnt int,
+) []*proto.SubtaskBase {
+	if len(b.affinities) == 0 {
+		return nil
+	}
+	res := make([]*proto.SubtaskBase, 0)
+	returnedCnts := make(map[string]int)
+	for node, sts := range executorSubtasks {
+		remaining := sts[:0]
+		for _, st := range sts {
+			origNode, ok := b.getAffinityNode(st.ID, adjustedNodeMap)
+			if ok && origNode != node && st.State == proto.SubtaskStatePending &&
+				len(executorSubtasks[origNode])+returnedCnts[origNode] < averageSubtaskCnt+1 {
+				returnedCnts[origNode]++
+				b.logger.Info("schedule subtask back to its original node",
+					zap.Int64("subtask-id", st.ID),
+					zap.String("from", node),
+					zap.String("to", origNode))
+				res = append(res, st)
+				continue
+			}
+			if ok && origNode != node && st.State == proto.SubtaskStatePending {
+				// the original node is full.
+				b.stats.Skipped++
+			}
+			remaining = append(remaining, st)
+		}
+		executorSubtasks[node] = remaining
+	}
+	return res
+}
+
+// getAffinityNode returns the original node of the subtask if it's healthy and
+// the subtask is still in the stickiness window.
+func (b *balancer) getAffinityNode(subtaskID int64, adjustedNodeMap map[string]struct{}) (string, bool) {
+	affinity, ok := b.affinities[subtaskID]
+	if !ok || time.Since(affinity.movedTime) > SubtaskAffinityWindow {
+		return "", false
+	}
+	if _, ok = adjustedNodeMap[affinity.node]; !ok {
+		return "", false
+	}
+	return affinity.node, true
+}
+
+func (b *balancer) updateAffinities(subtasks []*proto.SubtaskBase, oldExecIDs map[int64]string, adjustedNodeMap map[string]struct{}) {
+	now := time.Now()
+	for _, st := range subtasks {
+		if affinity, ok := b.affinities[st.ID]; ok {
+			if affinity.node == st.ExecID {
+				delete(b.affinities, st.ID)
+			}
+			continue
+		}
+		oldExecID := oldExecIDs[st.ID]
+		if _, ok := adjustedNodeMap[oldExecID]; ok || SubtaskAffinityWindow <= 0 {
+			// subtasks moved from healthy nodes are for balance, don't stick them.
+			continue
+		}
+		b.affinities[st.ID] = subtaskAffinity{node: oldExecID, movedTime: now}
+	}
+}
+
+func (b *balancer) cleanupExpiredAffinities(now time.Time) {
+	for id, affinity := range b.affinities {
+		if now.Sub(affinity.movedTime) > SubtaskAffinityWindow {
+			delete(b.affinities, id)
+		}
+	}
+}
+
+func (b *balancer) cleanupExpiredReassignTimes(now time.Time) {
+	for id, t := range b.reassignTimes {
+		if now.Sub(t) >= SubtaskReassignCooldown {
+			delete(b.reassignTimes, id)
+		}
+	}
+}
+
 func (b *balancer) updateUsedNodes(subtasks []*proto.SubtaskBase) {
 	used := make(map[string]int, len(b.currUsedSlots))
 	// see slotManager.alloc in task executor.
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/pkg/disttask/framework/mock"
@@ -416,6 +417,145 @@ func TestBalanceMultipleTasks(t *testing.T) {
 	}
 }
 
+func TestBalanceSubtasksWithQuantum(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	bak := SubtaskBalanceQuantum
+	SubtaskBalanceQuantum = 2
+	t.Cleanup(func() {
+		SubtaskBalanceQuantum = bak
+	})
+
+	mockTaskMgr := mock.NewMockTaskManager(ctrl)
+	ctx := context.Background()
+	manager := NewManager(ctx, mockTaskMgr, "1")
+	manager.slotMgr.updateCapacity(16)
+	manager.nodeMgr.managedNodes.Store(&[]string{"tidb1", "tidb2"})
+	b := newBalancer(Param{
+		taskMgr: manager.taskMgr,
+		nodeMgr: manager.nodeMgr,
+		slotMgr: manager.slotMgr,
+	})
+	// subtasks of both tasks are on the dead node tidb0.
+	taskSubtasks := make([][]*proto.SubtaskBase, 2)
+	for i := range taskSubtasks {
+		taskID := int64(i + 1)
+		for j := 0; j < 4; j++ {
+			taskSubtasks[i] = append(taskSubtasks[i], &proto.SubtaskBase{
+				ID: taskID*10 + int64(j), ExecID: "tidb0", Concurrency: 1, State: proto.SubtaskStatePending})
+		}
+		sch := mock.NewMockScheduler(ctrl)
+		sch.EXPECT().GetTask().Return(&proto.Task{TaskBase: proto.TaskBase{ID: taskID}}).AnyTimes()
+		sch.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+		manager.addScheduler(taskID, sch)
+		mockTaskMgr.EXPECT().GetActiveSubtasks(gomock.Any(), taskID).Return(taskSubtasks[i], nil).Times(2)
+	}
+	mockTaskMgr.EXPECT().UpdateSubtasksExecIDs(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, subtasks []*proto.SubtaskBase) error {
+			require.Len(t, subtasks, 2)
+			return nil
+		}).Times(4)
+	countMoved := func(subtasks []*proto.SubtaskBase) int {
+		var cnt int
+		for _, st := range subtasks {
+			if st.ExecID != "tidb0" {
+				cnt++
+			}
+		}
+		return cnt
+	}
+
+	// both tasks make progress in the first round.
+	b.balance(ctx, manager)
+	require.Equal(t, 2, countMoved(taskSubtasks[0]))
+	require.Equal(t, 2, countMoved(taskSubtasks[1]))
+	b.balance(ctx, manager)
+	require.Equal(t, 4, countMoved(taskSubtasks[0]))
+	require.Equal(t, 4, countMoved(taskSubtasks[1]))
+	require.True(t, ctrl.Satisfied())
+}
+
+type recordingBalanceStatsRecorder struct {
+	rounds []BalanceRoundStats
+}
+
+func (r *recordingBalanceStatsRecorder) RecordBalanceRound(stats BalanceRoundStats) {
+	r.rounds = append(r.rounds, stats)
+}
+
+func TestBalanceRoundStats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	bak := SubtaskBalanceQuantum
+	SubtaskBalanceQuantum = 3
+	t.Cleanup(func() {
+		SubtaskBalanceQuantum = bak
+	})
+
+	mockTaskMgr := mock.NewMockTaskManager(ctrl)
+	ctx := context.Background()
+	manager := NewManager(ctx, mockTaskMgr, "1")
+	manager.slotMgr.updateCapacity(16)
+	manager.nodeMgr.managedNodes.Store(&[]string{"tidb1", "tidb2"})
+	b := newBalancer(Param{
+		taskMgr: manager.taskMgr,
+		nodeMgr: manager.nodeMgr,
+		slotMgr: manager.slotMgr,
+	})
+	recorder := &recordingBalanceStatsRecorder{}
+	b.recorder = recorder
+
+	taskSubtasks := [][]*proto.SubtaskBase{
+		// 4 subtasks on the dead node tidb0, 3 of them are assigned to other
+		// nodes, and 1 is skipped because of the quantum.
+		{
+			{ID: 1, ExecID: "tidb0", Concurrency: 1, State: proto.SubtaskStatePending},
+			{ID: 2, ExecID: "tidb0", Concurrency: 1, State: proto.SubtaskStatePending},
+			{ID: 3, ExecID: "tidb0", Concurrency: 1, State: proto.SubtaskStatePending},
+			{ID: 4, ExecID: "tidb0", Concurrency: 1, State: proto.SubtaskStatePending},
+			{ID: 5, ExecID: "tidb1", Concurrency: 1, State: proto.SubtaskStatePending},
+		},
+		// 1 subtask is reassigned from tidb1 to tidb2.
+		{
+			{ID: 6, ExecID: "tidb1", Concurrency: 1, State: proto.SubtaskStatePending},
+			{ID: 7, ExecID: "tidb1", Concurrency: 1, State: proto.SubtaskStatePending},
+			{ID: 8, ExecID: "tidb1", Concurrency: 1, State: proto.SubtaskStatePending},
+		},
+		// no node has enough slots, skipped.
+		{
+			{ID: 9, ExecID: "tidb0", Concurrency: 16, State: proto.SubtaskStatePending},
+		},
+	}
+	for i := range taskSubtasks {
+		taskID := int64(i + 1)
+		sch := mock.NewMockScheduler(ctrl)
+		sch.EXPECT().GetTask().Return(&proto.Task{TaskBase: proto.TaskBase{ID: taskID}}).AnyTimes()
+		sch.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return(nil, nil)
+		manager.addScheduler(taskID, sch)
+		mockTaskMgr.EXPECT().GetActiveSubtasks(gomock.Any(), taskID).Return(taskSubtasks[i], nil)
+	}
+	mockTaskMgr.EXPECT().UpdateSubtasksExecIDs(gomock.Any(), gomock.Any()).Return(nil).Times(2)
+	// failed to balance the last task.
+	sch := mock.NewMockScheduler(ctrl)
+	sch.EXPECT().GetTask().Return(&proto.Task{TaskBase: proto.TaskBase{ID: 4}}).AnyTimes()
+	sch.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return(nil, errors.New("mock error"))
+	manager.addScheduler(4, sch)
+
+	b.balance(ctx, manager)
+	require.True(t, ctrl.Satisfied())
+	require.Equal(t, []BalanceRoundStats{{Assigned: 3, Reassigned: 1, Skipped: 2, Errors: 1}}, recorder.rounds)
+
+	// stats are reset for each round.
+	for i := 1; i <= 4; i++ {
+		manager.delScheduler(int64(i))
+	}
+	b.balance(ctx, manager)
+	require.Equal(t, []BalanceRoundStats{
+		{Assigned: 3, Reassigned: 1, Skipped: 2, Errors: 1},
+		{},
+	}, recorder.rounds)
+}
+
 func TestBalancerUpdateUsedNodes(t *testing.T) {
 	b := newBalancer(Param{})
 	b.updateUsedNodes([]*proto.SubtaskBase{
@@ -430,3 +570,192 @@ func TestBalancerUpdateUsedNodes(t *testing.T) {
 	})
 	require.Equal(t, map[string]int{"tidb1": 20, "tidb2": 8, "tidb3": 12}, b.currUsedSlots)
 }
+
+func TestBalanceSubtaskAffinity(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+
+	mockTaskMgr := mock.NewMockTaskManager(ctrl)
+	mockScheduler := mock.NewMockScheduler(ctrl)
+	mockScheduler.EXPECT().GetTask().Return(&proto.Task{TaskBase: proto.TaskBase{ID: 1}}).AnyTimes()
+	mockScheduler.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+	slotMgr := newSlotManager()
+	slotMgr.updateCapacity(16)
+	newTestBalancer := func() *balancer {
+		return newBalancer(Param{
+			taskMgr: mockTaskMgr,
+			nodeMgr: newNodeManager(""),
+			slotMgr: slotMgr,
+		})
+	}
+	balanceAndCheck := func(b *balancer, subtasks []*proto.SubtaskBase, eligibleNodes []string, expectedExecIDs []string) {
+		mockTaskMgr.EXPECT().GetActiveSubtasks(gomock.Any(), gomock.Any()).Return(subtasks, nil)
+		changed := false
+		for i, st := range subtasks {
+			if st.ExecID != expectedExecIDs[i] {
+				changed = true
+			}
+		}
+		if changed {
+			mockTaskMgr.EXPECT().UpdateSubtasksExecIDs(gomock.Any(), gomock.Any()).Return(nil)
+		}
+		b.currUsedSlots = make(map[string]int, len(eligibleNodes))
+		for _, n := range eligibleNodes {
+			b.currUsedSlots[n] = 0
+		}
+		require.NoError(t, b.balanceSubtasks(ctx, mockScheduler, eligibleNodes))
+		for i, st := range subtasks {
+			require.Equal(t, expectedExecIDs[i], st.ExecID, "subtask %d", st.ID)
+		}
+		require.True(t, ctrl.Satisfied())
+	}
+
+	// tidb1 is dead, subtask 1 is scheduled away, and come back when tidb1 is alive again.
+	b := newTestBalancer()
+	subtasks := []*proto.SubtaskBase{
+		{ID: 1, ExecID: "tidb1", Concurrency: 16, State: proto.SubtaskStatePending},
+		{ID: 2, ExecID: "tidb2", Concurrency: 16, State: proto.SubtaskStatePending},
+	}
+	balanceAndCheck(b, subtasks, []string{"tidb2", "tidb3"}, []string{"tidb3", "tidb2"})
+	balanceAndCheck(b, subtasks, []string{"tidb1", "tidb2", "tidb3"}, []string{"tidb1", "tidb2"})
+	require.Empty(t, b.affinities)
+
+	// the original node is still dead, subtask 1 goes elsewhere.
+	b = newTestBalancer()
+	subtasks = []*proto.SubtaskBase{
+		{ID: 1, ExecID: "tidb1", Concurrency: 16, State: proto.SubtaskStatePending},
+		{ID: 2, ExecID: "tidb2", Concurrency: 16, State: proto.SubtaskStatePending},
+	}
+	balanceAndCheck(b, subtasks, []string{"tidb2", "tidb3"}, []string{"tidb3", "tidb2"})
+	balanceAndCheck(b, subtasks, []string{"tidb2", "tidb3"}, []string{"tidb3", "tidb2"})
+	balanceAndCheck(b, subtasks, []string{"tidb2", "tidb4"}, []string{"tidb4", "tidb2"})
+	// still remember the original node.
+	balanceAndCheck(b, subtasks, []string{"tidb1", "tidb2", "tidb4"}, []string{"tidb1", "tidb2"})
+
+	// running subtask is not moved back.
+	b = newTestBalancer()
+	subtasks = []*proto.SubtaskBase{
+		{ID: 1, ExecID: "tidb1", Concurrency: 16, State: proto.SubtaskStateRunning},
+		{ID: 2, ExecID: "tidb2", Concurrency: 16, State: proto.SubtaskStatePending},
+	}
+	balanceAndCheck(b, subtasks, []string{"tidb2", "tidb3"}, []string{"tidb3", "tidb2"})
+	balanceAndCheck(b, subtasks, []string{"tidb1", "tidb2", "tidb3"}, []string{"tidb3", "tidb2"})
+
+	// stickiness is disabled.
+	bak := SubtaskAffinityWindow
+	SubtaskAffinityWindow = 0
+	t.Cleanup(func() {
+		SubtaskAffinityWindow = bak
+	})
+	b = newTestBalancer()
+	subtasks = []*proto.SubtaskBase{
+		{ID: 1, ExecID: "tidb1", Concurrency: 16, State: proto.SubtaskStatePending},
+		{ID: 2, ExecID: "tidb2", Concurrency: 16, State: proto.SubtaskStatePending},
+	}
+	balanceAndCheck(b, subtasks, []string{"tidb2", "tidb3"}, []string{"tidb3", "tidb2"})
+	balanceAndCheck(b, subtasks, []string{"tidb1", "tidb2", "tidb3"}, []string{"tidb3", "tidb2"})
+	require.Empty(t, b.affinities)
+}
+
+func TestBalanceLeaseExpiredSubtasks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+
+	mockTaskMgr := mock.NewMockTaskManager(ctrl)
+	mockScheduler := mock.NewMockScheduler(ctrl)
+	mockScheduler.EXPECT().GetTask().Return(&proto.Task{TaskBase: proto.TaskBase{ID: 1}}).AnyTimes()
+	mockScheduler.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+	slotMgr := newSlotManager()
+	slotMgr.updateCapacity(16)
+	b := newBalancer(Param{
+		taskMgr: mockTaskMgr,
+		nodeMgr: newNodeManager(""),
+		slotMgr: slotMgr,
+	})
+	now := time.Now()
+	// subtask 1 missed too many renewals, subtask 3 never renews the lease.
+	subtasks := []*proto.SubtaskBase{
+		{ID: 1, ExecID: "tidb1", Concurrency: 16, State: proto.SubtaskStateRunning, LeaseExpireTime: now.Add(-time.Second)},
+		{ID: 2, ExecID: "tidb2", Concurrency: 16, State: proto.SubtaskStateRunning, LeaseExpireTime: now.Add(time.Minute)},
+		{ID: 3, ExecID: "tidb3", Concurrency: 16, State: proto.SubtaskStateRunning},
+	}
+	mockTaskMgr.EXPECT().GetActiveSubtasks(gomock.Any(), gomock.Any()).Return(subtasks, nil)
+	mockTaskMgr.EXPECT().UpdateSubtasksExecIDs(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, subtasks []*proto.SubtaskBase) error {
+			require.Len(t, subtasks, 1)
+			require.EqualValues(t, 1, subtasks[0].ID)
+			return nil
+		})
+	b.currUsedSlots = map[string]int{"tidb1": 0, "tidb2": 0, "tidb3": 0}
+	require.NoError(t, b.balanceSubtasks(ctx, mockScheduler, []string{"tidb1", "tidb2", "tidb3"}))
+	require.Equal(t, "tidb2", subtasks[0].ExecID)
+	require.Equal(t, "tidb2", subtasks[1].ExecID)
+	require.Equal(t, "tidb3", subtasks[2].ExecID)
+	require.True(t, ctrl.Satisfied())
+}
+
+func TestBalanceSubtaskReassignCooldown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+
+	bak := SubtaskReassignCooldown
+	SubtaskReassignCooldown = time.Minute
+	t.Cleanup(func() {
+		SubtaskReassignCooldown = bak
+	})
+	mockTaskMgr := mock.NewMockTaskManager(ctrl)
+	mockScheduler := mock.NewMockScheduler(ctrl)
+	mockScheduler.EXPECT().GetTask().Return(&proto.Task{TaskBase: proto.TaskBase{ID: 1}}).AnyTimes()
+	mockScheduler.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+	slotMgr := newSlotManager()
+	slotMgr.updateCapacity(16)
+	b := newBalancer(Param{
+		taskMgr: mockTaskMgr,
+		nodeMgr: newNodeManager(""),
+		slotMgr: slotMgr,
+	})
+	// heartbeat of the node running subtask 1 times out.
+	subtasks := []*proto.SubtaskBase{
+		{ID: 1, ExecID: "tidb1", Concurrency: 16, State: proto.SubtaskStateRunning, LeaseExpireTime: time.Now().Add(-time.Second)},
+	}
+	flap := func(expectReassign bool) {
+		subtasks[0].LeaseExpireTime = time.Now().Add(-time.Second)
+		mockTaskMgr.EXPECT().GetActiveSubtasks(gomock.Any(), gomock.Any()).Return(subtasks, nil)
+		if expectReassign {
+			mockTaskMgr.EXPECT().UpdateSubtasksExecIDs(gomock.Any(), gomock.Any()).Return(nil)
+		}
+		b.currUsedSlots = map[string]int{"tidb1": 0, "tidb2": 0}
+		b.stats = BalanceRoundStats{}
+		require.NoError(t, b.balanceSubtasks(ctx, mockScheduler, []string{"tidb1", "tidb2"}))
+		require.True(t, ctrl.Satisfied())
+	}
+
+	flap(true)
+	require.Equal(t, "tidb2", subtasks[0].ExecID)
+	require.Equal(t, 1, b.stats.Assigned)
+	// heartbeats on tidb2 time out soon after, the subtask stays on it.
+	for i := 0; i < 3; i++ {
+		flap(false)
+		require.Equal(t, "tidb2", subtasks[0].ExecID)
+		require.Equal(t, 1, b.stats.Skipped)
+	}
+	// the window elapses.
+	b.reassignTimes[1] = time.Now().Add(-SubtaskReassignCooldown)
+	flap(true)
+	require.Equal(t, "tidb1", subtasks[0].ExecID)
+	b.cleanupExpiredReassignTimes(time.Now())
+	require.Contains(t, b.reassignTimes, int64(1))
+
+	// no cooldown.
+	SubtaskReassignCooldown = 0
+	b.cleanupExpiredReassignTimes(time.Now())
+	require.Empty(t, b.reassignTimes)
+	flap(true)
+	require.Equal(t, "tidb2", subtasks[0].ExecID)
+	flap(true)
+	require.Equal(t, "tidb1", subtasks[0].ExecID)
+	require.Empty(t, b.reassignTimes)
+}
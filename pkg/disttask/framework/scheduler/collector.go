@@ -15,7 +15,11 @@
 package scheduler
 
 import (
+	"cmp"
+	"fmt"
+	"slices"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -37,6 +41,8 @@ func init() {
 // Therefore, a custom collector is used.
 type collector struct {
 	subtaskInfo atomic.Pointer[[]*proto.SubtaskBase]
+	// taskInfo is only used by RenderMetrics.
+	taskInfo atomic.Pointer[[]*proto.TaskBase]
 
 	subtasks        *prometheus.Desc
 	subtaskDuration *prometheus.Desc
@@ -124,3 +130,136 @@ func (c *collector) setDistSubtaskDuration(ch chan<- prometheus.Metric, subtask
 		)
 	}
 }
+
+// RenderMetrics renders the task and subtask metrics in Prometheus text
+// exposition format, for environments which can't scrape the metrics through
+// the Prometheus registry. The metrics are rendered from the snapshot of task
+// table collected by the scheduler manager periodically, so it's empty if the
+// manager is not started on this node, and task metrics only cover the tasks
+// returned by TaskManager.GetTopUnfinishedTasks.
+func RenderMetrics() string {
+	return subtaskCollector.render(time.Now())
+}
+
+func (c *collector) render(now time.Time) string {
+	var tasks []*proto.TaskBase
+	if p := c.taskInfo.Load(); p != nil {
+		tasks = *p
+	}
+	var subtasks []*proto.SubtaskBase
+	if p := c.subtaskInfo.Load(); p != nil {
+		subtasks = *p
+	}
+
+	var sb strings.Builder
+	// task_type => state => cnt
+	taskCnt := make(map[string]map[string]int)
+	taskQueueDepth := make(map[string]int)
+	for _, task := range tasks {
+		tp := task.Type.String()
+		if _, ok := taskCnt[tp]; !ok {
+			taskCnt[tp] = make(map[string]int)
+		}
+		taskCnt[tp][task.State.String()]++
+		if task.State == proto.TaskStatePending {
+			taskQueueDepth[tp]++
+		}
+	}
+	writeMetricHeader(&sb, "tidb_disttask_tasks", "Number of unfinished tasks.")
+	for _, tp := range sortedKeys(taskCnt) {
+		for _, state := range sortedKeys(taskCnt[tp]) {
+			writeMetric(&sb, "tidb_disttask_tasks", float64(taskCnt[tp][state]),
+				"task_type", tp, "state", state)
+		}
+	}
+	writeMetricHeader(&sb, "tidb_disttask_task_queue_depth", "Number of tasks waiting to be scheduled.")
+	for _, tp := range sortedKeys(taskQueueDepth) {
+		writeMetric(&sb, "tidb_disttask_task_queue_depth", float64(taskQueueDepth[tp]), "task_type", tp)
+	}
+
+	type subtaskKey struct {
+		taskType string
+		taskID   int64
+		state    string
+		execID   string
+	}
+	subtaskCnt := make(map[subtaskKey]int)
+	subtaskQueueDepth := make(map[string]int)
+	for _, subtask := range subtasks {
+		subtaskCnt[subtaskKey{subtask.Type.String(), subtask.TaskID, subtask.State.String(), subtask.ExecID}]++
+		if subtask.State == proto.SubtaskStatePending {
+			subtaskQueueDepth[subtask.Type.String()]++
+		}
+	}
+	keys := make([]subtaskKey, 0, len(subtaskCnt))
+	for k := range subtaskCnt {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b subtaskKey) int {
+		if a.taskID != b.taskID {
+			return cmp.Compare(a.taskID, b.taskID)
+		}
+		if a.state != b.state {
+			return strings.Compare(a.state, b.state)
+		}
+		return strings.Compare(a.execID, b.execID)
+	})
+	writeMetricHeader(&sb, "tidb_disttask_subtasks", "Number of subtasks.")
+	for _, k := range keys {
+		writeMetric(&sb, "tidb_disttask_subtasks", float64(subtaskCnt[k]),
+			"task_type", k.taskType, "task_id", strconv.FormatInt(k.taskID, 10),
+			"status", k.state, "exec_id", k.execID)
+	}
+	writeMetricHeader(&sb, "tidb_disttask_subtask_queue_depth", "Number of subtasks waiting to be run.")
+	for _, tp := range sortedKeys(subtaskQueueDepth) {
+		writeMetric(&sb, "tidb_disttask_subtask_queue_depth", float64(subtaskQueueDepth[tp]), "task_type", tp)
+	}
+	writeMetricHeader(&sb, "tidb_disttask_subtask_duration", "Duration of subtasks in different states.")
+	for _, subtask := range subtasks {
+		var start time.Time
+		switch subtask.State {
+		case proto.SubtaskStatePending:
+			start = subtask.CreateTime
+		case proto.SubtaskStateRunning:
+			start = subtask.StartTime
+		default:
+			continue
+		}
+		writeMetric(&sb, "tidb_disttask_subtask_duration", now.Sub(start).Seconds(),
+			"task_type", subtask.Type.String(), "task_id", strconv.FormatInt(subtask.TaskID, 10),
+			"status", subtask.State.String(), "subtask_id", strconv.FormatInt(subtask.ID, 10),
+			"exec_id", subtask.ExecID)
+	}
+	return sb.String()
+}
+
+func writeMetricHeader(sb *strings.Builder, name, help string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+// writeMetric writes one sample, labels are pairs of label name and value.
+func writeMetric(sb *strings.Builder, name string, value float64, labels ...string) {
+	sb.WriteString(name)
+	if len(labels) > 0 {
+		sb.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(sb, "%s=%q", labels[i], labels[i+1])
+		}
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	sb.WriteByte('\n')
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderMetrics(t *testing.T) {
+	c := newCollector()
+	now := time.Now()
+	// nothing collected yet.
+	require.NotContains(t, c.render(now), "{")
+
+	tasks := []*proto.TaskBase{
+		{ID: 1, Type: proto.TaskTypeExample, State: proto.TaskStateRunning},
+		{ID: 2, Type: proto.TaskTypeExample, State: proto.TaskStatePending},
+		{ID: 3, Type: proto.TaskTypeExample, State: proto.TaskStatePending},
+		{ID: 4, Type: proto.ImportInto, State: proto.TaskStateReverting},
+	}
+	subtasks := []*proto.SubtaskBase{
+		{ID: 1, TaskID: 1, Type: proto.TaskTypeExample, State: proto.SubtaskStateRunning,
+			ExecID: "tidb1", StartTime: now.Add(-10 * time.Second)},
+		{ID: 2, TaskID: 1, Type: proto.TaskTypeExample, State: proto.SubtaskStatePending,
+			ExecID: "tidb1", CreateTime: now.Add(-5 * time.Second)},
+		{ID: 3, TaskID: 1, Type: proto.TaskTypeExample, State: proto.SubtaskStatePending,
+			ExecID: "tidb1", CreateTime: now.Add(-5 * time.Second)},
+		{ID: 4, TaskID: 1, Type: proto.TaskTypeExample, State: proto.SubtaskStateSucceed,
+			ExecID: "tidb2"},
+	}
+	c.taskInfo.Store(&tasks)
+	c.subtaskInfo.Store(&subtasks)
+	text := c.render(now)
+
+	for _, name := range []string{
+		"tidb_disttask_tasks",
+		"tidb_disttask_task_queue_depth",
+		"tidb_disttask_subtasks",
+		"tidb_disttask_subtask_queue_depth",
+		"tidb_disttask_subtask_duration",
+	} {
+		require.Contains(t, text, "# HELP "+name+" ")
+		require.Contains(t, text, "# TYPE "+name+" gauge\n")
+	}
+	lines := strings.Split(text, "\n")
+	for _, l := range []string{
+		`tidb_disttask_tasks{task_type="Example",state="running"} 1`,
+		`tidb_disttask_tasks{task_type="Example",state="pending"} 2`,
+		`tidb_disttask_tasks{task_type="ImportInto",state="reverting"} 1`,
+		`tidb_disttask_task_queue_depth{task_type="Example"} 2`,
+		`tidb_disttask_subtasks{task_type="Example",task_id="1",status="pending",exec_id="tidb1"} 2`,
+		`tidb_disttask_subtasks{task_type="Example",task_id="1",status="running",exec_id="tidb1"} 1`,
+		`tidb_disttask_subtasks{task_type="Example",task_id="1",status="succeed",exec_id="tidb2"} 1`,
+		`tidb_disttask_subtask_queue_depth{task_type="Example"} 2`,
+		`tidb_disttask_subtask_duration{task_type="Example",task_id="1",status="running",subtask_id="1",exec_id="tidb1"} 10`,
+		`tidb_disttask_subtask_duration{task_type="Example",task_id="1",status="pending",subtask_id="2",exec_id="tidb1"} 5`,
+	} {
+		require.Contains(t, lines, l)
+	}
+	// only pending and running subtasks have duration.
+	require.NotContains(t, text, `subtask_id="4"`)
+	require.NotContains(t, text, `tidb_disttask_task_queue_depth{task_type="ImportInto"}`)
+}
@@ -16,14 +16,19 @@ package scheduler
 
 import (
 	"context"
+	"time"
 
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	"github.com/pingcap/tidb/pkg/disttask/framework/storage"
 	"github.com/pingcap/tidb/pkg/sessionctx"
 	"github.com/pingcap/tidb/pkg/util/syncutil"
+	"golang.org/x/time/rate"
 )
 
 // TaskManager defines the interface to access task table.
+// storage.TaskManager is the implementation backed by system tables of TiDB,
+// the scheduler only depends on this interface, so an alternate storage can be
+// plugged in by passing it to NewManager.
 type TaskManager interface {
 	// GetTopUnfinishedTasks returns unfinished tasks, limited by MaxConcurrentTask*2,
 	// to make sure lower rank tasks can be scheduled if resource is enough.
@@ -31,6 +36,9 @@ type TaskManager interface {
 	GetTopUnfinishedTasks(ctx context.Context) ([]*proto.TaskBase, error)
 	// GetAllSubtasks gets all subtasks with basic columns.
 	GetAllSubtasks(ctx context.Context) ([]*proto.SubtaskBase, error)
+	// GetFinishedSubtasksWithHistory gets finished subtasks of all steps of the
+	// task, subtasks in history table are included.
+	GetFinishedSubtasksWithHistory(ctx context.Context, taskID int64) ([]*proto.Subtask, error)
 	GetTasksInStates(ctx context.Context, states ...any) (task []*proto.Task, err error)
 	GetTaskByID(ctx context.Context, taskID int64) (task *proto.Task, err error)
 	GetTaskBaseByID(ctx context.Context, taskID int64) (task *proto.TaskBase, err error)
@@ -43,6 +51,11 @@ type TaskManager interface {
 	CancelTask(ctx context.Context, taskID int64) error
 	// FailTask updates task state to Failed and updates task error.
 	FailTask(ctx context.Context, taskID int64, currentState proto.TaskState, taskErr error) error
+	// InitializeTask updates task state from pending to initializing.
+	InitializeTask(ctx context.Context, taskID int64) error
+	// MigrateTaskMeta updates the meta of the task to the one migrated from
+	// fromVersion to toVersion, see proto.RegisterMetaVersion.
+	MigrateTaskMeta(ctx context.Context, taskID int64, fromVersion, toVersion int, meta []byte) error
 	// RevertTask updates task state to reverting, and task error.
 	RevertTask(ctx context.Context, taskID int64, taskState proto.TaskState, taskErr error) error
 	// RevertedTask updates task state to reverted.
@@ -51,10 +64,15 @@ type TaskManager interface {
 	PauseTask(ctx context.Context, taskKey string) (bool, error)
 	// PausedTask updated task state to paused.
 	PausedTask(ctx context.Context, taskID int64) error
+	// ResumeTask updates task state from paused to resuming.
+	ResumeTask(ctx context.Context, taskKey string) (bool, error)
 	// ResumedTask updated task state from resuming to running.
 	ResumedTask(ctx context.Context, taskID int64) error
 	// SucceedTask updates a task to success state.
 	SucceedTask(ctx context.Context, taskID int64) error
+	// PartialSucceedTask updates a task to partial success state, taskErr
+	// records the errors of failed subtasks.
+	PartialSucceedTask(ctx context.Context, taskID int64, taskErr error) error
 	// SwitchTaskStep switches the task to the next step and add subtasks in one
 	// transaction. It will change task state too if we're switch from InitStep to
 	// next step.
@@ -92,6 +110,115 @@ type TaskManager interface {
 	WithNewTxn(ctx context.Context, fn func(se sessionctx.Context) error) error
 }
 
+// TaskOwnerUpdater is an optional interface of TaskManager, storages which
+// implement it record the server whose scheduler drives the task, so the tasks
+// owned by some server can be queried, such as before draining the server.
+type TaskOwnerUpdater interface {
+	// UpdateTaskOwner records serverID as the owner of the task.
+	UpdateTaskOwner(ctx context.Context, taskID int64, serverID string) error
+}
+
+// TaskStatusMessageSetter is an optional interface of TaskManager, storages
+// which implement it can flag tasks with a status message, such as tasks of
+// unsupported type, see UnsupportedTaskTypeStatus.
+type TaskStatusMessageSetter interface {
+	// SetTaskStatusMessage sets the status message of the task, empty msg
+	// clears it.
+	SetTaskStatusMessage(ctx context.Context, taskID int64, msg string) error
+}
+
+// ChildTaskGetter is an optional interface of TaskManager, storages which
+// implement it support tasks waiting for their child tasks, see
+// proto.ExtraParams.WaitForChildren.
+type ChildTaskGetter interface {
+	// GetChildTasks gets the child tasks of the task, including finished ones.
+	GetChildTasks(ctx context.Context, parentTaskID int64) ([]*proto.TaskBase, error)
+}
+
+// GenerationFreezeChecker is an optional interface of TaskManager, storages
+// which implement it support freezing the subtask generation of a task at
+// runtime, see proto.ExtraParams.FreezeGeneration.
+type GenerationFreezeChecker interface {
+	// IsTaskGenerationFrozen returns whether the subtask generation of the task
+	// is frozen.
+	IsTaskGenerationFrozen(ctx context.Context, taskID int64) (bool, error)
+}
+
+// DeferredTaskGetter is an optional interface of TaskManager, storages which
+// implement it support deferring the start of a task until a specified time,
+// see proto.ExtraParams.StartAfter.
+type DeferredTaskGetter interface {
+	// GetDeferredTasks returns the start time of pending tasks which are
+	// deferred, keyed by task ID.
+	GetDeferredTasks(ctx context.Context) (map[int64]time.Time, error)
+}
+
+// PokedTaskTaker is an optional interface of TaskManager, storages which
+// implement it support operators poking a stuck task to force the owning
+// scheduler to re-evaluate it, see storage.TaskManager.PokeTask.
+type PokedTaskTaker interface {
+	// TakePokedTasks returns the IDs of poked tasks and clears their poke flags.
+	TakePokedTasks(ctx context.Context) ([]int64, error)
+}
+
+// ArchivedTaskCleaner is an optional interface of TaskManager, storages which
+// implement it support running CleanUp after the task is moved to history, see
+// CleanUpAfterArchive.
+type ArchivedTaskCleaner interface {
+	// GetCleanUpPendingTasks returns the archived tasks whose CleanUp hasn't
+	// finished, see proto.ExtraParams.CleanUpPending.
+	GetCleanUpPendingTasks(ctx context.Context) ([]*proto.Task, error)
+	// FinishArchivedTaskCleanUp clears the CleanUp pending mark of the archived
+	// task, the meta of the task is updated too, as CleanUp might redact it.
+	FinishArchivedTaskCleanUp(ctx context.Context, task *proto.Task) error
+}
+
+// SubtaskMetaSizeGetter is an optional interface of TaskManager, storages which
+// implement it count the metas of existing subtasks of the task in the budget,
+// see proto.ExtraParams.SubtaskMetaBudget.
+type SubtaskMetaSizeGetter interface {
+	// GetSubtaskMetaSize returns the total bytes of metas of subtasks of the
+	// task which are not moved to history.
+	GetSubtaskMetaSize(ctx context.Context, taskID int64) (int64, error)
+}
+
+// GroupCanceledSubtaskCounter is an optional interface of TaskManager, storages
+// which support cancelling a group of subtasks implement it, subtasks cancelled
+// with their group don't fail the task.
+type GroupCanceledSubtaskCounter interface {
+	// GetGroupCanceledSubtaskCnt returns the count of subtasks of the step of
+	// the task which are cancelled with their group.
+	GetGroupCanceledSubtaskCnt(ctx context.Context, taskID int64, step proto.Step) (int64, error)
+}
+
+// StepCanceledSubtaskCounter is an optional interface of TaskManager, storages
+// which support cancelling the subtasks of a step implement it, what subtasks
+// cancelled with their step mean to the task depends on the failure mode of the
+// step, see StepFailureModeGetter.
+type StepCanceledSubtaskCounter interface {
+	// GetStepCanceledSubtaskCnt returns the count of subtasks of the step of
+	// the task which are cancelled with their step.
+	GetStepCanceledSubtaskCnt(ctx context.Context, taskID int64, step proto.Step) (int64, error)
+}
+
+// StepRefineSwitcher is an optional interface of TaskManager, storages which
+// implement it support refining a step iteratively, see StepRefiner.
+type StepRefineSwitcher interface {
+	// RefineStep inserts the refined subtasks of current step of the task for
+	// the next iteration, and increases proto.ExtraParams.StepIteration.
+	RefineStep(ctx context.Context, task *proto.Task, subtasks []*proto.Subtask) error
+}
+
+// LimitedTaskStepSwitcher is an optional interface of TaskManager, storages
+// which implement it can pace the creation of subtasks by the limiter set by
+// SetSubtaskCreationLimiter.
+type LimitedTaskStepSwitcher interface {
+	// SwitchTaskStepWithLimiter is similar to SwitchTaskStepInBatch, but it
+	// waits on the limiter before inserting each batch of subtasks.
+	SwitchTaskStepWithLimiter(ctx context.Context, task *proto.Task, nextState proto.TaskState,
+		nextStep proto.Step, subtasks []*proto.Subtask, limiter *rate.Limiter) error
+}
+
 // Extension is used to control the process operations for each task.
 // it's used to extend functions of BaseScheduler.
 // as golang doesn't support inheritance, we embed this interface in Scheduler
@@ -108,6 +235,8 @@ type Extension interface {
 	// 	1. task is pending and entering it's first step.
 	// 	2. subtasks scheduled has all finished with no error.
 	// when next step is StepDone, it should return nil, nil.
+	// if no subtask is generated for a step, the step is skipped and the next
+	// step is planned immediately, so a task with nothing to do succeeds directly.
 	OnNextSubtasksBatch(ctx context.Context, h storage.TaskHandle, task *proto.Task, execIDs []string, step proto.Step) (subtaskMetas [][]byte, err error)
 
 	// OnDone is called when task is done, either finished successfully or failed
@@ -134,6 +263,128 @@ type Extension interface {
 	GetNextStep(task *proto.TaskBase) proto.Step
 }
 
+// PartialSuccessExtension is an optional interface of Extension, best-effort
+// task types can implement it to tolerate some failed subtasks.
+type PartialSuccessExtension interface {
+	// GetSuccessThreshold returns the min ratio of succeed subtasks of current
+	// step of the task, the valid range is (0, 1].
+	// if the threshold < 1, the step runs in collect-errors mode: scheduler waits
+	// all subtasks of the step to finish instead of reverting the task on the
+	// first failed subtask, if the ratio of succeed subtasks reaches the threshold,
+	// the task continues to run and will end in TaskStatePartialSuccess, else
+	// the task is reverted.
+	GetSuccessThreshold(task *proto.TaskBase) float64
+}
+
+// StepFailureModeGetter is an optional interface of Extension, task types
+// whose steps can be skipped when their subtasks are cancelled by the operator
+// can implement it, see proto.StepFailureMode. if it's not implemented, the
+// task is reverted.
+type StepFailureModeGetter interface {
+	// GetStepFailureMode returns the failure mode of the step of the task.
+	GetStepFailureMode(task *proto.TaskBase, step proto.Step) proto.StepFailureMode
+}
+
+// StepRefiner is an optional interface of Extension, task types whose step
+// iterates until convergence can implement it, so the step re-enqueues refined
+// subtasks based on the results of the last iteration, instead of declaring
+// multiple static steps. the iterations of a step are limited by
+// MaxStepIterations.
+type StepRefiner interface {
+	// RefineStepSubtasks is called when all subtasks of current step of the
+	// task succeed, iteration is the number of iterations run, starts from 1.
+	// it returns the metas of the subtasks of the next iteration, empty means
+	// the step converges, and the task switches to the next step.
+	RefineStepSubtasks(ctx context.Context, h storage.TaskHandle, task *proto.Task, iteration int) ([][]byte, error)
+}
+
+// SuccessEvaluator is an optional interface of Extension, task types whose
+// success is more than all subtasks succeed, such as some metric aggregated
+// from subtask summaries is within tolerance, can implement it.
+type SuccessEvaluator interface {
+	// EvaluateSuccess is called after all steps of the task finish, before the
+	// task succeeds, to decide the final state of the task. summaries are the
+	// summaries of succeed subtasks of all steps, ordered by subtask ID.
+	// it returns TaskStateSucceed to let the task succeed, or TaskStateReverting
+	// to revert the task, and the returned error is recorded as the task error,
+	// for other states, the returned error is taken as evaluation failure, and
+	// the task is evaluated again later.
+	EvaluateSuccess(ctx context.Context, task *proto.Task, summaries []string) (proto.TaskState, error)
+}
+
+// StepConcurrencyExtension is an optional interface of Extension, task types
+// whose steps have very different optimal parallelism can implement it to use
+// a different concurrency for subtasks of some step.
+type StepConcurrencyExtension interface {
+	// StepConcurrency returns the concurrency of subtasks of the step, it
+	// overrides the task concurrency for that step, 0 means using the task
+	// concurrency.
+	// the result is capped by the task concurrency, as slots on nodes are
+	// reserved by the task concurrency.
+	StepConcurrency(task *proto.Task, step proto.Step) int
+}
+
+// SubtaskGrouper is an optional interface of Extension, task types whose
+// subtasks belong to logical groups, such as partitions, can implement it, so
+// a group of subtasks can be cancelled together, see proto.Subtask.Group.
+type SubtaskGrouper interface {
+	// GetSubtaskGroup returns the group of the subtask of the step with meta.
+	GetSubtaskGroup(task *proto.Task, step proto.Step, meta []byte) string
+}
+
+// SubtaskSerializer is an optional interface of Extension, task types whose
+// subtasks touching the same data, such as a partition, must run serially can
+// implement it, see proto.Subtask.SerialKey.
+type SubtaskSerializer interface {
+	// GetSubtaskSerialKey returns the serial key of the subtask of the step
+	// with meta, empty means the subtask can run in parallel with any others.
+	GetSubtaskSerialKey(task *proto.Task, step proto.Step, meta []byte) string
+}
+
+// SubtaskWeigher is an optional interface of Extension, task types whose
+// subtasks represent uneven amount of work can implement it, so the progress of
+// the task is weighted by the work of subtasks, see proto.Subtask.Weight.
+type SubtaskWeigher interface {
+	// GetSubtaskWeight returns the weight of the subtask of the step with meta,
+	// 0 means the default weight.
+	GetSubtaskWeight(task *proto.Task, step proto.Step, meta []byte) int64
+}
+
+// SubtaskResourceChecker is an optional interface of Extension, task types
+// whose subtasks need lots of resource, such as memory, can implement it, so
+// subtasks are scheduled to nodes which can run them, see NodeResourceReporter.
+type SubtaskResourceChecker interface {
+	// CanRun checks whether the node with the resource can run the subtask.
+	CanRun(subtask *proto.Subtask, res *proto.NodeResource) bool
+}
+
+// SubtaskLocalityHinter is an optional interface of Extension, task types whose
+// subtasks work on data of some TiKV regions can implement it, so subtasks are
+// scheduled to nodes co-located with the data, see LocalityReporter.
+type SubtaskLocalityHinter interface {
+	// GetSubtaskLocality returns the IDs of TiKV stores and regions holding the
+	// data of the subtask of the step with meta, see proto.Subtask.TargetStoreIDs.
+	GetSubtaskLocality(task *proto.Task, step proto.Step, meta []byte) (storeIDs, regionIDs []uint64)
+}
+
+// TaskSelector selects the next task to schedule from the schedulable tasks, it
+// enables strategies such as shortest-job-first or deadline-aware scheduling,
+// see Manager.SetTaskSelector.
+type TaskSelector interface {
+	// SelectTask returns the index of the next task to schedule in tasks, tasks
+	// is never empty, and it's sorted by task order, see proto.Task.
+	SelectTask(tasks []*proto.TaskBase) int
+}
+
+// FIFOTaskSelector is the default TaskSelector, it schedules tasks in task
+// order.
+type FIFOTaskSelector struct{}
+
+// SelectTask implements TaskSelector.
+func (FIFOTaskSelector) SelectTask([]*proto.TaskBase) int {
+	return 0
+}
+
 // Param is used to pass parameters when creating scheduler.
 type Param struct {
 	taskMgr        TaskManager
@@ -185,6 +436,41 @@ type CleanUpRoutine interface {
 	// task.Meta can be updated here, such as redacting some sensitive info.
 	CleanUp(ctx context.Context, task *proto.Task) error
 }
+
+// RevertCleanUpController is an optional interface of CleanUpRoutine, it
+// controls whether CleanUp runs for tasks which are reverted or failed, such as
+// to remove partial external artifacts, CleanUp always runs for tasks which
+// succeed. if it's not implemented, CleanUp runs for all finished tasks.
+type RevertCleanUpController interface {
+	// CleanUpOnRevert returns whether CleanUp runs for reverted or failed tasks.
+	CleanUpOnRevert() bool
+}
+
+// CleanUpOrder is the order of running CleanUpRoutine and moving the finished
+// task to history tables.
+type CleanUpOrder int
+
+const (
+	// CleanUpBeforeArchive runs CleanUp before the task is moved to history, if
+	// the node crashes in between, CleanUp runs again on the task in next round,
+	// so CleanUp must be idempotent. it's the default order.
+	CleanUpBeforeArchive CleanUpOrder = iota
+	// CleanUpAfterArchive runs CleanUp after the task is moved to history, such
+	// as when external resources are referenced until the task is archived. the
+	// archived task is marked until CleanUp succeeds, so CleanUp is retried in
+	// next rounds if the node crashes in between, see ArchivedTaskCleaner.
+	// ephemeral tasks always run CleanUp before they are deleted.
+	CleanUpAfterArchive
+)
+
+// CleanUpOrderController is an optional interface of CleanUpRoutine, it
+// controls the order of running CleanUp and moving the task to history, see
+// CleanUpOrder. if it's not implemented, CleanUpBeforeArchive is used.
+type CleanUpOrderController interface {
+	// CleanUpOrder returns the order of running CleanUp and archiving the task.
+	CleanUpOrder() CleanUpOrder
+}
+
 type cleanUpFactoryFn func() CleanUpRoutine
 
 var cleanUpFactoryMap = struct {
@@ -216,3 +502,14 @@ func ClearSchedulerCleanUpFactory() {
 	defer cleanUpFactoryMap.Unlock()
 	cleanUpFactoryMap.m = make(map[proto.TaskType]cleanUpFactoryFn)
 }
+
+var _ TaskManager = &storage.TaskManager{}
+var _ TaskStatusMessageSetter = &storage.TaskManager{}
+var _ ChildTaskGetter = &storage.TaskManager{}
+var _ GenerationFreezeChecker = &storage.TaskManager{}
+var _ DeferredTaskGetter = &storage.TaskManager{}
+var _ StepCanceledSubtaskCounter = &storage.TaskManager{}
+var _ StepRefineSwitcher = &storage.TaskManager{}
+var _ PokedTaskTaker = &storage.TaskManager{}
+var _ ArchivedTaskCleaner = &storage.TaskManager{}
+var _ SubtaskMetaSizeGetter = &storage.TaskManager{}
@@ -0,0 +1,130 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/util/syncutil"
+	"go.uber.org/zap"
+)
+
+// LocalityReporter reports the location of nodes and data, it's used with
+// SubtaskLocalityHinter to schedule subtasks to nodes co-located with their
+// data.
+type LocalityReporter interface {
+	// GetNodeStores returns the IDs of TiKV stores co-located with the nodes,
+	// such as stores on the same host.
+	GetNodeStores(ctx context.Context, nodes []string) (map[string][]uint64, error)
+	// GetRegionStores returns the IDs of TiKV stores holding peers of the
+	// regions.
+	GetRegionStores(ctx context.Context, regionIDs []uint64) (map[uint64][]uint64, error)
+}
+
+var localityReporter = struct {
+	syncutil.RWMutex
+	r LocalityReporter
+}{}
+
+// SetLocalityReporter sets the reporter of locality, nil means subtasks are
+// scheduled without considering data locality.
+func SetLocalityReporter(r LocalityReporter) {
+	localityReporter.Lock()
+	defer localityReporter.Unlock()
+	localityReporter.r = r
+}
+
+func getLocalityReporter() LocalityReporter {
+	localityReporter.RLock()
+	defer localityReporter.RUnlock()
+	return localityReporter.r
+}
+
+// localityScore returns how close the node is to the data of the subtask, it's
+// the number of the target stores of the subtask co-located with the node, the
+// stores of target regions included.
+func localityScore(subtask *proto.Subtask, nodeStores map[uint64]struct{}, regionStores map[uint64][]uint64) int {
+	score := 0
+	for _, storeID := range subtask.TargetStoreIDs {
+		if _, ok := nodeStores[storeID]; ok {
+			score++
+		}
+	}
+	for _, regionID := range subtask.TargetRegionIDs {
+		for _, storeID := range regionStores[regionID] {
+			if _, ok := nodeStores[storeID]; ok {
+				score++
+			}
+		}
+	}
+	return score
+}
+
+// placeSubtasksByLocality moves subtasks to the node closest to their data,
+// see localityScore. if there are multiple such nodes, the scheduled node is
+// kept if it's one of them, else the one with the least subtasks is chosen.
+// subtasks without locality hints are kept on the scheduled node.
+func (s *BaseScheduler) placeSubtasksByLocality(subtasks []*proto.Subtask, nodes []string) {
+	reporter := getLocalityReporter()
+	if reporter == nil || len(nodes) <= 1 {
+		return
+	}
+	var regionIDs []uint64
+	for _, subtask := range subtasks {
+		regionIDs = append(regionIDs, subtask.TargetRegionIDs...)
+	}
+	nodeStores, err := reporter.GetNodeStores(s.ctx, nodes)
+	if err != nil {
+		s.logger.Warn("get node stores failed, schedule subtasks without locality", zap.Error(err))
+		return
+	}
+	var regionStores map[uint64][]uint64
+	if len(regionIDs) > 0 {
+		if regionStores, err = reporter.GetRegionStores(s.ctx, regionIDs); err != nil {
+			s.logger.Warn("get region stores failed, schedule subtasks without locality", zap.Error(err))
+			return
+		}
+	}
+	storeSets := make(map[string]map[uint64]struct{}, len(nodes))
+	for _, node := range nodes {
+		set := make(map[uint64]struct{}, len(nodeStores[node]))
+		for _, storeID := range nodeStores[node] {
+			set[storeID] = struct{}{}
+		}
+		storeSets[node] = set
+	}
+	subtaskCnts := make(map[string]int, len(nodes))
+	for _, subtask := range subtasks {
+		subtaskCnts[subtask.ExecID]++
+	}
+	for _, subtask := range subtasks {
+		if len(subtask.TargetStoreIDs) == 0 && len(subtask.TargetRegionIDs) == 0 {
+			continue
+		}
+		best, bestScore := subtask.ExecID, localityScore(subtask, storeSets[subtask.ExecID], regionStores)
+		for _, node := range nodes {
+			score := localityScore(subtask, storeSets[node], regionStores)
+			if score > bestScore || (score == bestScore && best != subtask.ExecID && subtaskCnts[node] < subtaskCnts[best]) {
+				best, bestScore = node, score
+			}
+		}
+		if best != subtask.ExecID {
+			subtaskCnts[subtask.ExecID]--
+			subtaskCnts[best]++
+			subtask.ExecID = best
+		}
+	}
+}
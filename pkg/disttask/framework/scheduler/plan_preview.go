@@ -0,0 +1,122 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/disttask/framework/handle"
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+)
+
+// PlanPreview is the projected plan of the first step of a task, see PreviewPlan.
+type PlanPreview struct {
+	// Step is the first step of the task, it's StepDone if the task has no
+	// step to run.
+	Step proto.Step
+	// SubtaskCnt is the count of subtasks of the step.
+	SubtaskCnt int
+	// NodeSubtaskCnt is the estimated count of subtasks on each node, keyed by
+	// the exec ID of the node.
+	NodeSubtaskCnt map[string]int
+}
+
+// PreviewPlan projects the subtasks of the first step of a task of taskType
+// with meta given current cluster state, such as for capacity planning before
+// running a large task, nothing is created.
+// the distribution is estimated, as cluster state might change before the task
+// runs, and the balancer moves subtasks at runtime. subtasks of later steps are
+// not projected, as they depend on the results of former steps.
+// the planner of the task type should be free of side effects when generating
+// subtasks, as it's called without a real task.
+// the TaskManager is got from the provider registered in handle, see
+// handle.RegisterTaskManagerProvider.
+func PreviewPlan(ctx context.Context, taskType proto.TaskType, concurrency int, meta []byte) (PlanPreview, error) {
+	mgr, err := handle.GetTaskManager()
+	if err != nil {
+		return PlanPreview{}, err
+	}
+	taskMgr, ok := mgr.(TaskManager)
+	if !ok {
+		return PlanPreview{}, errors.New("the task manager doesn't support previewing plan")
+	}
+	return previewPlan(ctx, taskMgr, taskType, concurrency, meta)
+}
+
+func previewPlan(ctx context.Context, taskMgr TaskManager, taskType proto.TaskType, concurrency int, meta []byte) (PlanPreview, error) {
+	schedulerFactory := getSchedulerFactory(taskType)
+	if schedulerFactory == nil {
+		return PlanPreview{}, errors.Errorf("task type %s is not supported", taskType)
+	}
+	nodeMgr, slotMgr := newNodeManager(""), newSlotManager()
+	nodeMgr.refreshManagedNodes(ctx, taskMgr, slotMgr)
+	param := Param{
+		taskMgr: taskMgr,
+		nodeMgr: nodeMgr,
+		slotMgr: slotMgr,
+	}
+	// the task is planned in initializing state, same as a real task.
+	task := &proto.Task{
+		TaskBase: proto.TaskBase{
+			Type:        taskType,
+			State:       proto.TaskStateInitializing,
+			Step:        proto.StepInit,
+			Concurrency: concurrency,
+			CreateTime:  time.Now(),
+		},
+		Meta: meta,
+	}
+	sch := schedulerFactory(ctx, task, param)
+	if err := sch.Init(); err != nil {
+		return PlanPreview{}, err
+	}
+	defer sch.Close()
+	base, ok := sch.(*BaseScheduler)
+	if !ok {
+		base = NewBaseScheduler(ctx, task, param)
+		base.Extension = sch
+	}
+
+	nextStep := base.GetNextStep(&task.TaskBase)
+	if nextStep == proto.StepDone {
+		return PlanPreview{Step: nextStep}, nil
+	}
+	eligibleNodes, err := getEligibleNodes(ctx, base, nodeMgr.getManagedNodes())
+	if err != nil {
+		return PlanPreview{}, err
+	}
+	if len(eligibleNodes) == 0 {
+		return PlanPreview{}, errors.New("no eligible node to run the task")
+	}
+	metas, err := base.OnNextSubtasksBatch(ctx, base, task, eligibleNodes, nextStep)
+	if err != nil {
+		return PlanPreview{}, err
+	}
+	subtasks, _, err := base.newSubtasks(task, nextStep, metas, eligibleNodes)
+	if err != nil {
+		return PlanPreview{}, err
+	}
+	preview := PlanPreview{
+		Step:           nextStep,
+		SubtaskCnt:     len(subtasks),
+		NodeSubtaskCnt: make(map[string]int, len(eligibleNodes)),
+	}
+	for _, subtask := range subtasks {
+		preview.NodeSubtaskCnt[subtask.ExecID]++
+	}
+	return preview, nil
+}
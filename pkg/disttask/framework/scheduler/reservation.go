@@ -0,0 +1,129 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"sync"
+
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+)
+
+// ResourceReservations records the resource reserved by in-flight subtasks on
+// nodes, see execute.ResourceEstimator. task executors reserve the resource on
+// their node before starting a subtask and release it after the subtask
+// finishes, and the scheduler deducts the reserved resource from the reported
+// resource of nodes when placing subtasks, see SubtaskResourceChecker.
+type ResourceReservations struct {
+	mu sync.Mutex
+	// exec ID -> reservations on the node.
+	nodes map[string]*nodeReservation
+}
+
+type nodeReservation struct {
+	capacity proto.SubtaskResource
+	used     proto.SubtaskResource
+	// subtask id -> reserved resource.
+	reserved map[int64]proto.SubtaskResource
+}
+
+var resourceReservations = NewResourceReservations()
+
+// NewResourceReservations creates a new ResourceReservations.
+func NewResourceReservations() *ResourceReservations {
+	return &ResourceReservations{nodes: make(map[string]*nodeReservation)}
+}
+
+// GetResourceReservations returns the resource reservations of nodes in this
+// instance.
+func GetResourceReservations() *ResourceReservations {
+	return resourceReservations
+}
+
+func (r *ResourceReservations) getNodeLocked(node string) *nodeReservation {
+	n, ok := r.nodes[node]
+	if !ok {
+		n = &nodeReservation{reserved: make(map[int64]proto.SubtaskResource)}
+		r.nodes[node] = n
+	}
+	return n
+}
+
+// SetCapacity sets the resource of the node which can be reserved.
+func (r *ResourceReservations) SetCapacity(node string, cpuCount int, mem uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.getNodeLocked(node).capacity = proto.SubtaskResource{CPUCount: cpuCount, Mem: mem}
+}
+
+// Reserve reserves res on the node for the subtask, it returns false if the
+// resource reserved by in-flight subtasks leaves not enough for it. a subtask
+// which needs more than the capacity of the node can be reserved when nothing
+// is reserved, so it's not starved. reserving again is a no-op.
+func (r *ResourceReservations) Reserve(node string, subtaskID int64, res proto.SubtaskResource) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.getNodeLocked(node)
+	if _, ok := n.reserved[subtaskID]; ok {
+		return true
+	}
+	if len(n.reserved) > 0 && (n.used.CPUCount+res.CPUCount > n.capacity.CPUCount ||
+		n.used.Mem+res.Mem > n.capacity.Mem) {
+		return false
+	}
+	n.reserved[subtaskID] = res
+	n.used.CPUCount += res.CPUCount
+	n.used.Mem += res.Mem
+	return true
+}
+
+// Release releases the resource reserved on the node for the subtask.
+func (r *ResourceReservations) Release(node string, subtaskID int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[node]
+	if !ok {
+		return
+	}
+	res, ok := n.reserved[subtaskID]
+	if !ok {
+		return
+	}
+	delete(n.reserved, subtaskID)
+	n.used.CPUCount -= res.CPUCount
+	n.used.Mem -= res.Mem
+}
+
+// Reserved returns the resource reserved on the node.
+func (r *ResourceReservations) Reserved(node string) proto.SubtaskResource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n, ok := r.nodes[node]; ok {
+		return n.used
+	}
+	return proto.SubtaskResource{}
+}
+
+// available returns the resource of the node left after the reservations.
+func (r *ResourceReservations) available(node string, res *proto.NodeResource) *proto.NodeResource {
+	reserved := r.Reserved(node)
+	avail := *res
+	avail.CPUCount = max(avail.CPUCount-reserved.CPUCount, 0)
+	if avail.MemAvailable > reserved.Mem {
+		avail.MemAvailable -= reserved.Mem
+	} else {
+		avail.MemAvailable = 0
+	}
+	return &avail
+}
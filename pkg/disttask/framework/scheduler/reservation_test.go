@@ -0,0 +1,144 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/disttask/framework/mock"
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	schmock "github.com/pingcap/tidb/pkg/disttask/framework/scheduler/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestResourceReservations(t *testing.T) {
+	r := NewResourceReservations()
+	r.SetCapacity(":4000", 16, 10<<30)
+	heavy := proto.SubtaskResource{CPUCount: 8, Mem: 6 << 30}
+	light := proto.SubtaskResource{CPUCount: 4, Mem: 1 << 30}
+
+	require.True(t, r.Reserve(":4000", 1, heavy))
+	// reserving again is a no-op.
+	require.True(t, r.Reserve(":4000", 1, heavy))
+	require.Equal(t, heavy, r.Reserved(":4000"))
+	// in-flight reservation is taken into account.
+	require.False(t, r.Reserve(":4000", 2, heavy))
+	require.True(t, r.Reserve(":4000", 3, light))
+	// reservations are kept per node.
+	require.True(t, r.Reserve(":4001", 2, heavy))
+	r.Release(":4001", 2)
+	r.Release(":4000", 1)
+	require.True(t, r.Reserve(":4000", 2, heavy))
+	r.Release(":4000", 2)
+	r.Release(":4000", 3)
+	r.Release(":4000", 3)
+	r.Release(":4002", 3)
+	require.Equal(t, proto.SubtaskResource{}, r.Reserved(":4000"))
+
+	// a subtask which needs more than the capacity can run alone.
+	huge := proto.SubtaskResource{CPUCount: 32, Mem: 20 << 30}
+	require.True(t, r.Reserve(":4000", 4, huge))
+	require.False(t, r.Reserve(":4000", 5, light))
+	require.Equal(t, &proto.NodeResource{CPUCount: 0, MemTotal: 16 << 30, MemAvailable: 0},
+		r.available(":4000", &proto.NodeResource{CPUCount: 16, MemTotal: 16 << 30, MemAvailable: 12 << 30}))
+	r.Release(":4000", 4)
+	require.True(t, r.Reserve(":4000", 5, light))
+	require.Equal(t, &proto.NodeResource{CPUCount: 12, MemTotal: 16 << 30, MemAvailable: 11 << 30},
+		r.available(":4000", &proto.NodeResource{CPUCount: 16, MemTotal: 16 << 30, MemAvailable: 12 << 30}))
+}
+
+func TestResourceReservationsSerializeHeavySubtasks(t *testing.T) {
+	r := NewResourceReservations()
+	r.SetCapacity(":4000", 16, 10<<30)
+	heavy := proto.SubtaskResource{CPUCount: 8, Mem: 6 << 30}
+	var (
+		wg               sync.WaitGroup
+		running          atomic.Int32
+		overlapped       atomic.Bool
+		finishedSubtasks atomic.Int32
+	)
+	for i := 1; i <= 2; i++ {
+		subtaskID := int64(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !r.Reserve(":4000", subtaskID, heavy) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			defer r.Release(":4000", subtaskID)
+			if running.Add(1) > 1 {
+				overlapped.Store(true)
+			}
+			time.Sleep(100 * time.Millisecond)
+			running.Add(-1)
+			finishedSubtasks.Add(1)
+		}()
+	}
+	wg.Wait()
+	require.EqualValues(t, 2, finishedSubtasks.Load())
+	require.False(t, overlapped.Load())
+	require.Equal(t, proto.SubtaskResource{}, r.Reserved(":4000"))
+}
+
+func TestSchedulerPlaceSubtasksByResourceWithReservations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	taskMgr := mock.NewMockTaskManager(ctrl)
+	schExt := schmock.NewMockExtension(ctrl)
+	task := proto.Task{
+		TaskBase: proto.TaskBase{
+			ID:          1,
+			State:       proto.TaskStatePending,
+			Step:        proto.StepInit,
+			Concurrency: 1,
+		},
+	}
+	sch := createScheduler(&task, true, taskMgr, ctrl)
+	sch.Extension = &resourceCheckExtension{MockExtension: schExt}
+	SetNodeResourceReporter(fakeNodeResourceReporter{
+		":4000": {CPUCount: 8, MemTotal: 16 << 30, MemAvailable: 12 << 30},
+		":4001": {CPUCount: 8, MemTotal: 16 << 30, MemAvailable: 12 << 30},
+	})
+	// a heavy subtask of another task is in flight on :4000.
+	GetResourceReservations().SetCapacity(":4000", 8, 16<<30)
+	require.True(t, GetResourceReservations().Reserve(":4000", 100, proto.SubtaskResource{CPUCount: 4, Mem: 6 << 30}))
+	t.Cleanup(func() {
+		SetNodeResourceReporter(nil)
+		GetResourceReservations().Release(":4000", 100)
+	})
+
+	schExt.EXPECT().GetNextStep(gomock.Any()).Return(proto.StepOne)
+	schExt.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return([]string{":4000", ":4001"}, nil)
+	schExt.EXPECT().OnNextSubtasksBatch(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return([][]byte{[]byte("memory-heavy"), []byte("light")}, nil)
+	taskMgr.EXPECT().GetUsedSlotsOnNodes(gomock.Any()).Return(nil, nil)
+	var subtasks []*proto.Subtask
+	taskMgr.EXPECT().SwitchTaskStep(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ *proto.Task, _ proto.TaskState, _ proto.Step, sts []*proto.Subtask) error {
+			subtasks = sts
+			return nil
+		})
+	require.NoError(t, sch.Switch2NextStep())
+	require.True(t, ctrl.Satisfied())
+	require.Len(t, subtasks, 2)
+	// :4000 reports enough memory, but most of it is reserved.
+	require.Equal(t, ":4001", subtasks[0].ExecID)
+	require.Equal(t, ":4001", subtasks[1].ExecID)
+}
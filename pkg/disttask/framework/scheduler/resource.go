@@ -0,0 +1,94 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/util/syncutil"
+	"go.uber.org/zap"
+)
+
+// NodeResourceReporter reports the available resource of nodes, it's used
+// with SubtaskResourceChecker to schedule subtasks to nodes which can run them.
+type NodeResourceReporter interface {
+	// GetNodeResources returns the resource of the nodes, nodes without
+	// resource reported are taken as able to run any subtask.
+	GetNodeResources(ctx context.Context, nodes []string) (map[string]*proto.NodeResource, error)
+}
+
+var nodeResourceReporter = struct {
+	syncutil.RWMutex
+	r NodeResourceReporter
+}{}
+
+// SetNodeResourceReporter sets the reporter of node resource, nil means
+// subtasks are scheduled without checking node resource.
+func SetNodeResourceReporter(r NodeResourceReporter) {
+	nodeResourceReporter.Lock()
+	defer nodeResourceReporter.Unlock()
+	nodeResourceReporter.r = r
+}
+
+func getNodeResourceReporter() NodeResourceReporter {
+	nodeResourceReporter.RLock()
+	defer nodeResourceReporter.RUnlock()
+	return nodeResourceReporter.r
+}
+
+// placeSubtasksByResource moves subtasks which can't run on their scheduled
+// node to the next node in nodes which can run them, subtasks that no node can
+// run are kept on the scheduled node. the resource reserved by in-flight
+// subtasks on a node is deducted from its reported resource, see
+// ResourceReservations.
+func (s *BaseScheduler) placeSubtasksByResource(subtasks []*proto.Subtask, nodes []string) {
+	checker, ok := s.Extension.(SubtaskResourceChecker)
+	if !ok || len(nodes) <= 1 {
+		return
+	}
+	reporter := getNodeResourceReporter()
+	if reporter == nil {
+		return
+	}
+	resources, err := reporter.GetNodeResources(s.ctx, nodes)
+	if err != nil {
+		s.logger.Warn("get node resources failed, schedule subtasks without checking resource", zap.Error(err))
+		return
+	}
+	canRun := func(subtask *proto.Subtask, node string) bool {
+		res, ok := resources[node]
+		return !ok || checker.CanRun(subtask, resourceReservations.available(node, res))
+	}
+	for i, subtask := range subtasks {
+		if canRun(subtask, subtask.ExecID) {
+			continue
+		}
+		placed := false
+		for j := 1; j < len(nodes); j++ {
+			node := nodes[(i+j)%len(nodes)]
+			if canRun(subtask, node) {
+				subtask.ExecID = node
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			s.logger.Warn("no node has enough resource to run the subtask",
+				zap.Int("ordinal", subtask.Ordinal),
+				zap.String("exec-id", subtask.ExecID))
+		}
+	}
+}
@@ -15,8 +15,11 @@
 package scheduler
 
 import (
+	"cmp"
 	"context"
+	"maps"
 	"math/rand"
+	"slices"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -35,6 +38,7 @@ import (
 	disttaskutil "github.com/pingcap/tidb/pkg/util/disttask"
 	"github.com/pingcap/tidb/pkg/util/intest"
 	"github.com/pingcap/tidb/pkg/util/logutil"
+	"github.com/pingcap/tidb/pkg/util/syncutil"
 	"go.uber.org/zap"
 )
 
@@ -43,6 +47,9 @@ const (
 	// so we use a special error message to indicate that the task is cancelled
 	// by user.
 	taskCancelMsg = "cancelled by user"
+	// maxPartialSuccessErrCnt is the max number of subtask errors recorded in
+	// the error of a partial succeeded task.
+	maxPartialSuccessErrCnt = 10
 )
 
 var (
@@ -55,8 +62,34 @@ var (
 	RetrySQLInterval = 3 * time.Second
 	// RetrySQLMaxInterval is the max interval between two SQL retries.
 	RetrySQLMaxInterval = 30 * time.Second
+	// taskStallWindow and cancelStalledTask are read by running schedulers,
+	// see SetTaskStallDetection.
+	taskStallWindow   atomic.Int64
+	cancelStalledTask atomic.Bool
+	// NoExecutorGracePeriod is the grace period for tasks waiting for eligible
+	// executor nodes, if there is still no eligible node to run subtasks of
+	// the task after it, the task fails with ErrNoExecutorsAvailable.
+	// 0 means the task keeps waiting.
+	NoExecutorGracePeriod time.Duration
+	// MaxStepIterations is the max number of iterations of a step refined by
+	// StepRefiner, the task switches to the next step after it even if the step
+	// doesn't converge.
+	MaxStepIterations = 100
+
+	// ErrNoExecutorsAvailable is the error when there is no eligible executor
+	// node to run subtasks of the task for NoExecutorGracePeriod.
+	ErrNoExecutorsAvailable = errors.New("no executors available")
+	// ErrSubtaskMetaBudgetExceeded is the error when the total bytes of metas of
+	// subtasks of the task exceed proto.ExtraParams.SubtaskMetaBudget.
+	ErrSubtaskMetaBudgetExceeded = errors.New("subtask meta budget exceeded")
 )
 
+// NewRetrySQLBackoffer creates the backoffer shared by the sites which retry
+// SQL on the task tables.
+func NewRetrySQLBackoffer() backoff.Backoffer {
+	return backoff.NewExponential(RetrySQLInterval, 2, RetrySQLMaxInterval)
+}
+
 // Scheduler manages the lifetime of a task
 // including submitting subtasks and updating the status of a task.
 type Scheduler interface {
@@ -88,11 +121,48 @@ type BaseScheduler struct {
 	balanceSubtaskTick int
 	// rand is for generating random selection of nodes.
 	rand *rand.Rand
+	// lastProgress records the last subtask state change of the task, it's
+	// used to detect stalled task, see checkStalled.
+	lastProgress struct {
+		step        proto.Step
+		cntByStates map[proto.SubtaskState]int64
+		time        time.Time
+		reported    bool
+	}
+	// noExecutorSince is the time since when there is no eligible executor node
+	// for the task, it's zero if there are, see NoExecutorGracePeriod.
+	noExecutorSince time.Time
+	// poked is set when the task is poked by operator, the whole task is
+	// reloaded on next refresh, see Poke.
+	poked  atomic.Bool
+	pokeCh chan struct{}
 }
 
 // MockOwnerChange mock owner change in tests.
 var MockOwnerChange func()
 
+// TaskStateObserver is notified each time a scheduler sees its task enter a
+// new state, it's used to collect the state history of tasks in tests.
+type TaskStateObserver func(task *proto.Task)
+
+var taskStateObserver = struct {
+	syncutil.RWMutex
+	o TaskStateObserver
+}{}
+
+// SetTaskStateObserver sets the observer of task state changes, nil means no-op.
+func SetTaskStateObserver(observer TaskStateObserver) {
+	taskStateObserver.Lock()
+	defer taskStateObserver.Unlock()
+	taskStateObserver.o = observer
+}
+
+func getTaskStateObserver() TaskStateObserver {
+	taskStateObserver.RLock()
+	defer taskStateObserver.RUnlock()
+	return taskStateObserver.o
+}
+
 // NewBaseScheduler creates a new BaseScheduler.
 func NewBaseScheduler(ctx context.Context, task *proto.Task, param Param) *BaseScheduler {
 	logger := log.L().With(zap.Int64("task-id", task.ID), zap.Stringer("task-type", task.Type), zap.Bool("allocated-slots", param.allocatedSlots))
@@ -104,11 +174,23 @@ func NewBaseScheduler(ctx context.Context, task *proto.Task, param Param) *BaseS
 		Param:  param,
 		logger: logger,
 		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		pokeCh: make(chan struct{}, 1),
 	}
-	s.task.Store(task)
+	s.storeTask(task)
 	return s
 }
 
+// Poke forces the scheduler to reload the whole task and re-evaluate it
+// immediately instead of waiting for the next tick, it's used to re-drive a
+// stuck task, see storage.TaskManager.PokeTask.
+func (s *BaseScheduler) Poke() {
+	s.poked.Store(true)
+	select {
+	case s.pokeCh <- struct{}{}:
+	default:
+	}
+}
+
 // Init implements the Scheduler interface.
 func (*BaseScheduler) Init() error {
 	return nil
@@ -126,6 +208,18 @@ func (s *BaseScheduler) ScheduleTask() {
 func (*BaseScheduler) Close() {
 }
 
+// storeTask stores the task, and notifies the TaskStateObserver if the task
+// enters a new state.
+func (s *BaseScheduler) storeTask(task *proto.Task) {
+	old := s.task.Swap(task)
+	if old != nil && old.State == task.State {
+		return
+	}
+	if observer := getTaskStateObserver(); observer != nil {
+		observer(task)
+	}
+}
+
 // GetTask implements the Scheduler interface.
 func (s *BaseScheduler) GetTask() *proto.Task {
 	return s.task.Load()
@@ -134,26 +228,44 @@ func (s *BaseScheduler) GetTask() *proto.Task {
 // refreshTaskIfNeeded fetch task state from tidb_global_task table.
 func (s *BaseScheduler) refreshTaskIfNeeded() error {
 	task := s.GetTask()
+	poked := s.poked.Swap(false)
 	// we only query the base fields of task to reduce memory usage, other fields
 	// are refreshed when needed.
-	newTaskBase, err := s.taskMgr.GetTaskBaseByID(s.ctx, task.ID)
+	var newTaskBase *proto.TaskBase
+	err := s.retryOnTransientErr(func(ctx context.Context) (err error) {
+		newTaskBase, err = s.taskMgr.GetTaskBaseByID(ctx, task.ID)
+		return err
+	})
 	if err != nil {
+		if poked {
+			s.poked.Store(true)
+		}
 		return err
 	}
 	// state might be changed by user to pausing/resuming/cancelling, or
 	// in case of network partition, state/step/meta might be changed by other scheduler,
 	// in both cases we refresh the whole task object.
-	if newTaskBase.State != task.State || newTaskBase.Step != task.Step {
-		s.logger.Info("task state/step changed by user or other scheduler",
+	// if the task is poked, we refresh it too, in case the in-memory task is
+	// stale and the task gets stuck.
+	if poked || newTaskBase.State != task.State || newTaskBase.Step != task.Step {
+		s.logger.Info("task state/step changed by user or other scheduler, or task poked",
+			zap.Bool("poked", poked),
 			zap.Stringer("old-state", task.State),
 			zap.Stringer("new-state", newTaskBase.State),
 			zap.String("old-step", proto.Step2Str(task.Type, task.Step)),
 			zap.String("new-step", proto.Step2Str(task.Type, newTaskBase.Step)))
-		newTask, err := s.taskMgr.GetTaskByID(s.ctx, task.ID)
+		var newTask *proto.Task
+		err = s.retryOnTransientErr(func(ctx context.Context) (err error) {
+			newTask, err = s.taskMgr.GetTaskByID(ctx, task.ID)
+			return err
+		})
 		if err != nil {
+			if poked {
+				s.poked.Store(true)
+			}
 			return err
 		}
-		s.task.Store(newTask)
+		s.storeTask(newTask)
 	}
 	return nil
 }
@@ -168,107 +280,112 @@ func (s *BaseScheduler) scheduleTask() {
 			s.logger.Info("schedule task exits")
 			return
 		case <-ticker.C:
-			err := s.refreshTaskIfNeeded()
-			if err != nil {
-				if errors.Cause(err) == storage.ErrTaskNotFound {
-					// this can happen when task is reverted/succeed, but before
-					// we reach here, cleanup routine move it to history.
-					return
-				}
-				s.logger.Error("refresh task failed", zap.Error(err))
-				continue
+		case <-s.pokeCh:
+		}
+		err := s.refreshTaskIfNeeded()
+		if err != nil {
+			if errors.Cause(err) == storage.ErrTaskNotFound {
+				// this can happen when task is reverted/succeed, but before
+				// we reach here, cleanup routine move it to history.
+				return
 			}
-			task := *s.GetTask()
-			// TODO: refine failpoints below.
-			failpoint.Inject("exitScheduler", func() {
-				failpoint.Return()
-			})
-			failpoint.Inject("cancelTaskAfterRefreshTask", func(val failpoint.Value) {
-				if val.(bool) && task.State == proto.TaskStateRunning {
-					err := s.taskMgr.CancelTask(s.ctx, task.ID)
-					if err != nil {
-						s.logger.Error("cancel task failed", zap.Error(err))
-					}
-				}
-			})
-
-			failpoint.Inject("pausePendingTask", func(val failpoint.Value) {
-				if val.(bool) && task.State == proto.TaskStatePending {
-					_, err := s.taskMgr.PauseTask(s.ctx, task.Key)
-					if err != nil {
-						s.logger.Error("pause task failed", zap.Error(err))
-					}
-					task.State = proto.TaskStatePausing
-					s.task.Store(&task)
-				}
-			})
-
-			failpoint.Inject("pauseTaskAfterRefreshTask", func(val failpoint.Value) {
-				if val.(bool) && task.State == proto.TaskStateRunning {
-					_, err := s.taskMgr.PauseTask(s.ctx, task.Key)
-					if err != nil {
-						s.logger.Error("pause task failed", zap.Error(err))
-					}
-					task.State = proto.TaskStatePausing
-					s.task.Store(&task)
-				}
-			})
-
-			switch task.State {
-			case proto.TaskStateCancelling:
-				err = s.onCancelling()
-			case proto.TaskStatePausing:
-				err = s.onPausing()
-			case proto.TaskStatePaused:
-				err = s.onPaused()
-				// close the scheduler.
-				if err == nil {
-					return
+			s.logger.Error("refresh task failed", zap.Error(err))
+			continue
+		}
+		task := *s.GetTask()
+		// TODO: refine failpoints below.
+		failpoint.Inject("exitScheduler", func() {
+			failpoint.Return()
+		})
+		failpoint.Inject("cancelTaskAfterRefreshTask", func(val failpoint.Value) {
+			if val.(bool) && task.State == proto.TaskStateRunning {
+				err := s.taskMgr.CancelTask(s.ctx, task.ID)
+				if err != nil {
+					s.logger.Error("cancel task failed", zap.Error(err))
 				}
-			case proto.TaskStateResuming:
-				// Case with 2 nodes.
-				// Here is the timeline
-				// 1. task in pausing state.
-				// 2. node1 and node2 start schedulers with task in pausing state without allocatedSlots.
-				// 3. node1's scheduler transfer the node from pausing to paused state.
-				// 4. resume the task.
-				// 5. node2 scheduler call refreshTask and get task with resuming state.
-				if !s.allocatedSlots {
-					s.logger.Info("scheduler exit since not allocated slots", zap.Stringer("state", task.State))
-					return
+			}
+		})
+
+		failpoint.Inject("pausePendingTask", func(val failpoint.Value) {
+			if val.(bool) && task.State == proto.TaskStatePending {
+				_, err := s.taskMgr.PauseTask(s.ctx, task.Key)
+				if err != nil {
+					s.logger.Error("pause task failed", zap.Error(err))
 				}
-				err = s.onResuming()
-			case proto.TaskStateReverting:
-				err = s.onReverting()
-			case proto.TaskStatePending:
-				err = s.onPending()
-			case proto.TaskStateRunning:
-				// Case with 2 nodes.
-				// Here is the timeline
-				// 1. task in pausing state.
-				// 2. node1 and node2 start schedulers with task in pausing state without allocatedSlots.
-				// 3. node1's scheduler transfer the node from pausing to paused state.
-				// 4. resume the task.
-				// 5. node1 start another scheduler and transfer the node from resuming to running state.
-				// 6. node2 scheduler call refreshTask and get task with running state.
-				if !s.allocatedSlots {
-					s.logger.Info("scheduler exit since not allocated slots", zap.Stringer("state", task.State))
-					return
+				task.State = proto.TaskStatePausing
+				s.storeTask(&task)
+			}
+		})
+
+		failpoint.Inject("pauseTaskAfterRefreshTask", func(val failpoint.Value) {
+			if val.(bool) && task.State == proto.TaskStateRunning {
+				_, err := s.taskMgr.PauseTask(s.ctx, task.Key)
+				if err != nil {
+					s.logger.Error("pause task failed", zap.Error(err))
 				}
-				err = s.onRunning()
-			case proto.TaskStateSucceed, proto.TaskStateReverted, proto.TaskStateFailed:
-				s.onFinished()
+				task.State = proto.TaskStatePausing
+				s.storeTask(&task)
+			}
+		})
+
+		switch task.State {
+		case proto.TaskStateCancelling:
+			err = s.onCancelling()
+		case proto.TaskStatePausing:
+			err = s.onPausing()
+		case proto.TaskStatePaused:
+			err = s.onPaused()
+			// close the scheduler.
+			if err == nil {
 				return
 			}
-			if err != nil {
-				s.logger.Info("schedule task meet err, reschedule it", zap.Error(err))
+		case proto.TaskStateResuming:
+			// Case with 2 nodes.
+			// Here is the timeline
+			// 1. task in pausing state.
+			// 2. node1 and node2 start schedulers with task in pausing state without allocatedSlots.
+			// 3. node1's scheduler transfer the node from pausing to paused state.
+			// 4. resume the task.
+			// 5. node2 scheduler call refreshTask and get task with resuming state.
+			if !s.allocatedSlots {
+				s.logger.Info("scheduler exit since not allocated slots", zap.Stringer("state", task.State))
+				return
 			}
-
-			failpoint.Inject("mockOwnerChange", func() {
-				MockOwnerChange()
-				time.Sleep(time.Second)
-			})
+			err = s.onResuming()
+		case proto.TaskStateReverting:
+			err = s.onReverting()
+		case proto.TaskStatePending:
+			err = s.onPending()
+		case proto.TaskStateInitializing:
+			err = s.onInitializing()
+		case proto.TaskStateRunning:
+			// Case with 2 nodes.
+			// Here is the timeline
+			// 1. task in pausing state.
+			// 2. node1 and node2 start schedulers with task in pausing state without allocatedSlots.
+			// 3. node1's scheduler transfer the node from pausing to paused state.
+			// 4. resume the task.
+			// 5. node1 start another scheduler and transfer the node from resuming to running state.
+			// 6. node2 scheduler call refreshTask and get task with running state.
+			if !s.allocatedSlots {
+				s.logger.Info("scheduler exit since not allocated slots", zap.Stringer("state", task.State))
+				return
+			}
+			err = s.onRunning()
+		default:
+			if task.State.IsTerminal() {
+				s.onFinished()
+				return
+			}
+		}
+		if err != nil {
+			s.logger.Info("schedule task meet err, reschedule it", zap.Error(err))
 		}
+
+		failpoint.Inject("mockOwnerChange", func() {
+			MockOwnerChange()
+			time.Sleep(time.Second)
+		})
 	}
 }
 
@@ -284,23 +401,26 @@ func (s *BaseScheduler) onCancelling() error {
 func (s *BaseScheduler) onPausing() error {
 	task := *s.GetTask()
 	s.logger.Info("on pausing state", zap.Stringer("state", task.State), zap.String("step", proto.Step2Str(task.Type, task.Step)))
-	cntByStates, err := s.taskMgr.GetSubtaskCntGroupByStates(s.ctx, task.ID, task.Step)
+	cntByStates, err := s.getSubtaskCntGroupByStates(task.ID, task.Step)
 	if err != nil {
 		s.logger.Warn("check task failed", zap.Error(err))
 		return err
 	}
-	runningPendingCnt := cntByStates[proto.SubtaskStateRunning] + cntByStates[proto.SubtaskStatePending]
+	runningPendingCnt := cntByStates[proto.SubtaskStateRunning] + cntByStates[proto.SubtaskStatePending] +
+		cntByStates[proto.SubtaskStateRetrying]
 	if runningPendingCnt > 0 {
 		s.logger.Debug("on pausing state, this task keeps current state", zap.Stringer("state", task.State))
 		return nil
 	}
 
 	s.logger.Info("all running subtasks paused, update the task to paused state")
-	if err = s.taskMgr.PausedTask(s.ctx, task.ID); err != nil {
+	if err = s.retryOnTransientErr(func(ctx context.Context) error {
+		return s.taskMgr.PausedTask(ctx, task.ID)
+	}); err != nil {
 		return err
 	}
 	task.State = proto.TaskStatePaused
-	s.task.Store(&task)
+	s.storeTask(&task)
 	return nil
 }
 
@@ -323,7 +443,7 @@ func (s *BaseScheduler) onPaused() error {
 func (s *BaseScheduler) onResuming() error {
 	task := *s.GetTask()
 	s.logger.Info("on resuming state", zap.Stringer("state", task.State), zap.String("step", proto.Step2Str(task.Type, task.Step)))
-	cntByStates, err := s.taskMgr.GetSubtaskCntGroupByStates(s.ctx, task.ID, task.Step)
+	cntByStates, err := s.getSubtaskCntGroupByStates(task.ID, task.Step)
 	if err != nil {
 		s.logger.Warn("check task failed", zap.Error(err))
 		return err
@@ -331,36 +451,43 @@ func (s *BaseScheduler) onResuming() error {
 	if cntByStates[proto.SubtaskStatePaused] == 0 {
 		// Finish the resuming process.
 		s.logger.Info("all paused tasks converted to pending state, update the task to running state")
-		if err = s.taskMgr.ResumedTask(s.ctx, task.ID); err != nil {
+		if err = s.retryOnTransientErr(func(ctx context.Context) error {
+			return s.taskMgr.ResumedTask(ctx, task.ID)
+		}); err != nil {
 			return err
 		}
 		task.State = proto.TaskStateRunning
-		s.task.Store(&task)
+		s.storeTask(&task)
 		return nil
 	}
 
-	return s.taskMgr.ResumeSubtasks(s.ctx, task.ID)
+	return s.retryOnTransientErr(func(ctx context.Context) error {
+		return s.taskMgr.ResumeSubtasks(ctx, task.ID)
+	})
 }
 
 // handle task in reverting state, check all revert subtasks finishes.
 func (s *BaseScheduler) onReverting() error {
 	task := *s.GetTask()
 	s.logger.Debug("on reverting state", zap.Stringer("state", task.State), zap.String("step", proto.Step2Str(task.Type, task.Step)))
-	cntByStates, err := s.taskMgr.GetSubtaskCntGroupByStates(s.ctx, task.ID, task.Step)
+	cntByStates, err := s.getSubtaskCntGroupByStates(task.ID, task.Step)
 	if err != nil {
 		s.logger.Warn("check task failed", zap.Error(err))
 		return err
 	}
-	runnableSubtaskCnt := cntByStates[proto.SubtaskStatePending] + cntByStates[proto.SubtaskStateRunning]
+	runnableSubtaskCnt := cntByStates[proto.SubtaskStatePending] + cntByStates[proto.SubtaskStateRunning] +
+		cntByStates[proto.SubtaskStateRetrying]
 	if runnableSubtaskCnt == 0 {
 		if err = s.OnDone(s.ctx, s, &task); err != nil {
 			return errors.Trace(err)
 		}
-		if err = s.taskMgr.RevertedTask(s.ctx, task.ID); err != nil {
+		if err = s.retryOnTransientErr(func(ctx context.Context) error {
+			return s.taskMgr.RevertedTask(ctx, task.ID)
+		}); err != nil {
 			return errors.Trace(err)
 		}
 		task.State = proto.TaskStateReverted
-		s.task.Store(&task)
+		s.storeTask(&task)
 		return nil
 	}
 	// Wait all subtasks in this step finishes.
@@ -371,8 +498,24 @@ func (s *BaseScheduler) onReverting() error {
 
 // handle task in pending state, schedule subtasks.
 func (s *BaseScheduler) onPending() error {
-	task := s.GetTask()
+	task := *s.GetTask()
 	s.logger.Debug("on pending state", zap.Stringer("state", task.State), zap.String("step", proto.Step2Str(task.Type, task.Step)))
+	if err := s.retryOnTransientErr(func(ctx context.Context) error {
+		return s.taskMgr.InitializeTask(ctx, task.ID)
+	}); err != nil {
+		return err
+	}
+	task.State = proto.TaskStateInitializing
+	s.storeTask(&task)
+	return s.onInitializing()
+}
+
+// handle task in initializing state, do the initial planning, the task switches
+// to running once subtasks of the first step are created, and if the planning
+// fails, the task is reverted from initializing state.
+func (s *BaseScheduler) onInitializing() error {
+	task := s.GetTask()
+	s.logger.Debug("on initializing state", zap.Stringer("state", task.State), zap.String("step", proto.Step2Str(task.Type, task.Step)))
 	return s.switch2NextStep()
 }
 
@@ -384,13 +527,30 @@ func (s *BaseScheduler) onRunning() error {
 		zap.Stringer("state", task.State),
 		zap.String("step", proto.Step2Str(task.Type, task.Step)))
 	// check current step finishes.
-	cntByStates, err := s.taskMgr.GetSubtaskCntGroupByStates(s.ctx, task.ID, task.Step)
+	cntByStates, err := s.getSubtaskCntGroupByStates(task.ID, task.Step)
 	if err != nil {
 		s.logger.Warn("check task failed", zap.Error(err))
 		return err
 	}
 	if cntByStates[proto.SubtaskStateFailed] > 0 || cntByStates[proto.SubtaskStateCanceled] > 0 {
-		subTaskErrs, err := s.taskMgr.GetSubtaskErrors(s.ctx, task.ID)
+		if threshold, ok := s.getSuccessThreshold(task); ok {
+			if !s.isStepFinished(cntByStates) {
+				// in collect-errors mode, wait all subtasks in this step finishes.
+				s.OnTick(s.ctx, task)
+				return nil
+			}
+			if s.isSuccessRatioReached(cntByStates, threshold) {
+				s.logger.Warn("some subtasks failed, but success ratio reaches threshold",
+					zap.Int64("succeed-cnt", cntByStates[proto.SubtaskStateSucceed]),
+					zap.Float64("threshold", threshold))
+				return s.switch2NextStep()
+			}
+		}
+		var subTaskErrs []error
+		err = s.retryOnTransientErr(func(ctx context.Context) (err error) {
+			subTaskErrs, err = s.taskMgr.GetSubtaskErrors(ctx, task.ID)
+			return err
+		})
 		if err != nil {
 			s.logger.Warn("collect subtask error failed", zap.Error(err))
 			return err
@@ -401,21 +561,112 @@ func (s *BaseScheduler) onRunning() error {
 			return s.revertTask(subTaskErrs[0])
 		}
 	} else if s.isStepSucceed(cntByStates) {
+		refined, err := s.refineStep()
+		if err != nil || refined {
+			return err
+		}
 		return s.switch2NextStep()
 	}
 
+	if window, cancel := GetTaskStallDetection(); s.checkStalled(task, cntByStates, window) && cancel {
+		return s.revertTask(errors.Errorf("task makes no progress in %s", window))
+	}
 	// Wait all subtasks in this step finishes.
 	s.OnTick(s.ctx, task)
 	s.logger.Debug("on running state, this task keeps current state", zap.Stringer("state", task.State))
 	return nil
 }
 
+// SetTaskStallDetection sets the window to detect stalled tasks, if the subtask
+// states of current step of a running task don't change within it, the task is
+// considered stalled, and a warning is reported. 0 means disabled. if cancel is
+// true, the stalled task is reverted automatically.
+// it takes effect on running schedulers too.
+func SetTaskStallDetection(window time.Duration, cancel bool) {
+	taskStallWindow.Store(int64(window))
+	cancelStalledTask.Store(cancel)
+}
+
+// GetTaskStallDetection returns the window to detect stalled tasks and whether
+// to revert them automatically, see SetTaskStallDetection.
+func GetTaskStallDetection() (window time.Duration, cancel bool) {
+	return time.Duration(taskStallWindow.Load()), cancelStalledTask.Load()
+}
+
+// checkStalled returns true if the subtask states of current step of the task
+// don't change within window, the stall is reported once.
+func (s *BaseScheduler) checkStalled(task *proto.Task, cntByStates map[proto.SubtaskState]int64, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+	now := time.Now()
+	p := &s.lastProgress
+	if p.time.IsZero() || p.step != task.Step || !maps.Equal(p.cntByStates, cntByStates) {
+		p.step, p.cntByStates, p.time, p.reported = task.Step, cntByStates, now, false
+		return false
+	}
+	stalledDur := now.Sub(p.time)
+	if stalledDur < window {
+		return false
+	}
+	if !p.reported {
+		p.reported = true
+		s.logger.Warn("task makes no progress, it might be stalled",
+			zap.String("step", proto.Step2Str(task.Type, task.Step)),
+			zap.Duration("stalled-duration", stalledDur),
+			zap.Any("subtask-cnt-by-states", cntByStates))
+		metrics.DistTaskStalledCounter.WithLabelValues(task.Type.String()).Inc()
+	}
+	return true
+}
+
 func (s *BaseScheduler) onFinished() {
 	task := s.GetTask()
 	metrics.UpdateMetricsForFinishTask(task)
 	s.logger.Debug("schedule task, task is finished", zap.Stringer("state", task.State))
 }
 
+// childTasksDone returns whether the task can finish as all its child tasks are
+// done, it's always true if the task doesn't wait for children, see
+// proto.ExtraParams.WaitForChildren.
+func (s *BaseScheduler) childTasksDone(task *proto.Task) (bool, error) {
+	if !task.ExtraParams.WaitForChildren {
+		return true, nil
+	}
+	getter, ok := s.taskMgr.(ChildTaskGetter)
+	if !ok {
+		return true, nil
+	}
+	children, err := getter.GetChildTasks(s.ctx, task.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, child := range children {
+		if !child.IsDone() {
+			s.logger.Debug("wait for child task to finish",
+				zap.Int64("child-task-id", child.ID), zap.Stringer("child-state", child.State))
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// generationFrozen returns whether the subtask generation of the task is
+// frozen, it's read from storage, as it can be toggled at runtime, see
+// proto.ExtraParams.FreezeGeneration.
+func (s *BaseScheduler) generationFrozen(taskID int64) (bool, error) {
+	checker, ok := s.taskMgr.(GenerationFreezeChecker)
+	if !ok {
+		return false, nil
+	}
+	var frozen bool
+	err := s.retryOnTransientErr(func(ctx context.Context) (err error) {
+		frozen, err = checker.IsTaskGenerationFrozen(ctx, taskID)
+		return err
+	})
+	return frozen, err
+}
+
 func (s *BaseScheduler) switch2NextStep() error {
 	task := *s.GetTask()
 	nextStep := s.GetNextStep(&task.TaskBase)
@@ -424,15 +675,60 @@ func (s *BaseScheduler) switch2NextStep() error {
 		zap.String("next-step", proto.Step2Str(task.Type, nextStep)))
 
 	if nextStep == proto.StepDone {
+		done, err := s.childTasksDone(&task)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !done {
+			// the task is checked again in the next round.
+			return nil
+		}
+		if evaluator, ok := s.Extension.(SuccessEvaluator); ok {
+			taskErr, err := s.evaluateSuccess(evaluator, &task)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if taskErr != nil {
+				s.logger.Warn("task is evaluated as not succeed, revert it", zap.Error(taskErr))
+				return s.revertTask(taskErr)
+			}
+		}
 		if err := s.OnDone(s.ctx, s, &task); err != nil {
 			return errors.Trace(err)
 		}
-		if err := s.taskMgr.SucceedTask(s.ctx, task.ID); err != nil {
+		partialErr, err := s.getPartialSuccessErr(&task)
+		if err != nil {
 			return errors.Trace(err)
 		}
+		if partialErr != nil {
+			if err := s.retryOnTransientErr(func(ctx context.Context) error {
+				return s.taskMgr.PartialSucceedTask(ctx, task.ID, partialErr)
+			}); err != nil {
+				return errors.Trace(err)
+			}
+			task.Error = partialErr
+			task.State = proto.TaskStatePartialSuccess
+		} else {
+			if err := s.retryOnTransientErr(func(ctx context.Context) error {
+				return s.taskMgr.SucceedTask(ctx, task.ID)
+			}); err != nil {
+				return errors.Trace(err)
+			}
+			task.State = proto.TaskStateSucceed
+		}
 		task.Step = nextStep
-		task.State = proto.TaskStateSucceed
-		s.task.Store(&task)
+		s.storeTask(&task)
+		return nil
+	}
+
+	frozen, err := s.generationFrozen(task.ID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if frozen {
+		s.logger.Debug("subtask generation is frozen, wait for it to be unfrozen",
+			zap.String("next-step", proto.Step2Str(task.Type, nextStep)))
+		// the task is checked again in the next round.
 		return nil
 	}
 
@@ -442,22 +738,39 @@ func (s *BaseScheduler) switch2NextStep() error {
 	}
 	s.logger.Info("eligible instances", zap.Int("num", len(eligibleNodes)))
 	if len(eligibleNodes) == 0 {
-		return errors.New("no available TiDB node to dispatch subtasks")
+		return s.onNoExecutor(&task)
 	}
+	s.noExecutorSince = time.Time{}
 
 	metas, err := s.OnNextSubtasksBatch(s.ctx, s, &task, eligibleNodes, nextStep)
 	if err != nil {
 		s.logger.Warn("generate part of subtasks failed", zap.Error(err))
 		return s.handlePlanErr(err)
 	}
+	budgetErr, err := s.checkSubtaskMetaBudget(&task, metas)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if budgetErr != nil {
+		s.logger.Warn("generated subtasks exceed meta budget, revert the task", zap.Error(budgetErr))
+		return s.revertTask(budgetErr)
+	}
 
 	if err = s.scheduleSubTask(&task, nextStep, metas, eligibleNodes); err != nil {
 		return err
 	}
 	task.Step = nextStep
 	task.State = proto.TaskStateRunning
+	task.ExtraParams.StepIteration = 0
 	// and OnNextSubtasksBatch might change meta of task.
-	s.task.Store(&task)
+	s.storeTask(&task)
+	if len(metas) == 0 {
+		// nothing to do in this step, advance to next step directly, if it's
+		// the first step, the task will succeed without running any subtask.
+		s.logger.Info("no subtask generated, skip the step",
+			zap.String("step", proto.Step2Str(task.Type, nextStep)))
+		return s.switch2NextStep()
+	}
 	return nil
 }
 
@@ -466,33 +779,10 @@ func (s *BaseScheduler) scheduleSubTask(
 	subtaskStep proto.Step,
 	metas [][]byte,
 	eligibleNodes []string) error {
-	s.logger.Info("schedule subtasks",
-		zap.Stringer("state", task.State),
-		zap.String("step", proto.Step2Str(task.Type, subtaskStep)),
-		zap.Int("concurrency", task.Concurrency),
-		zap.Int("subtasks", len(metas)))
-
-	// the scheduled node of the subtask might not be optimal, as we run all
-	// scheduler in parallel, and update might be called too many times when
-	// multiple tasks are switching to next step.
-	// balancer will assign the subtasks to the right instance according to
-	// the system load of all nodes.
-	if err := s.slotMgr.update(s.ctx, s.nodeMgr, s.taskMgr); err != nil {
+	subTasks, size, err := s.newSubtasks(task, subtaskStep, metas, eligibleNodes)
+	if err != nil {
 		return err
 	}
-	adjustedEligibleNodes := s.slotMgr.adjustEligibleNodes(eligibleNodes, task.Concurrency)
-	var size uint64
-	subTasks := make([]*proto.Subtask, 0, len(metas))
-	for i, meta := range metas {
-		// we assign the subtask to the instance in a round-robin way.
-		pos := i % len(adjustedEligibleNodes)
-		instanceID := adjustedEligibleNodes[pos]
-		s.logger.Debug("create subtasks", zap.String("instanceID", instanceID))
-		subTasks = append(subTasks, proto.NewSubtask(
-			subtaskStep, task.ID, task.Type, instanceID, task.Concurrency, meta, i+1))
-
-		size += uint64(len(meta))
-	}
 	failpoint.Inject("cancelBeforeUpdateTask", func() {
 		_ = s.taskMgr.CancelTask(s.ctx, task.ID)
 	})
@@ -509,8 +799,17 @@ func (s *BaseScheduler) scheduleSubTask(
 			zap.Uint64("size", size), zap.Uint64("limit", limit))
 		fn = s.taskMgr.SwitchTaskStepInBatch
 	}
+	if switcher, ok := s.taskMgr.(LimitedTaskStepSwitcher); ok {
+		if limiter := getSubtaskCreationLimiter(len(subTasks)); limiter != nil {
+			s.logger.Info("subtasks count exceed threshold, will insert in batch with limiter",
+				zap.Int("subtasks", len(subTasks)), zap.Int("batch-size", limiter.Burst()))
+			fn = func(ctx context.Context, task *proto.Task, nextState proto.TaskState, nextStep proto.Step, subtasks []*proto.Subtask) error {
+				return switcher.SwitchTaskStepWithLimiter(ctx, task, nextState, nextStep, subtasks, limiter)
+			}
+		}
+	}
 
-	backoffer := backoff.NewExponential(RetrySQLInterval, 2, RetrySQLMaxInterval)
+	backoffer := NewRetrySQLBackoffer()
 	return handle.RunWithRetry(s.ctx, RetrySQLTimes, backoffer, s.logger,
 		func(context.Context) (bool, error) {
 			err := fn(s.ctx, task, proto.TaskStateRunning, subtaskStep, subTasks)
@@ -522,23 +821,329 @@ func (s *BaseScheduler) scheduleSubTask(
 	)
 }
 
+// refineStep re-enqueues the refined subtasks of current step if the step
+// doesn't converge, see StepRefiner. it returns false if the task should switch
+// to the next step.
+func (s *BaseScheduler) refineStep() (refined bool, err error) {
+	refiner, ok := s.Extension.(StepRefiner)
+	if !ok {
+		return false, nil
+	}
+	switcher, ok := s.taskMgr.(StepRefineSwitcher)
+	if !ok {
+		return false, nil
+	}
+	task := *s.GetTask()
+	if task.Step == proto.StepInit {
+		return false, nil
+	}
+	iteration := task.ExtraParams.StepIteration + 1
+	if iteration >= MaxStepIterations {
+		s.logger.Warn("step reaches max iterations, switch to next step",
+			zap.String("step", proto.Step2Str(task.Type, task.Step)),
+			zap.Int("iterations", iteration))
+		return false, nil
+	}
+	metas, err := refiner.RefineStepSubtasks(s.ctx, s, &task, iteration)
+	if err != nil {
+		s.logger.Warn("refine subtasks failed", zap.Error(err))
+		return true, s.handlePlanErr(err)
+	}
+	if len(metas) == 0 {
+		s.logger.Info("step converges", zap.String("step", proto.Step2Str(task.Type, task.Step)),
+			zap.Int("iterations", iteration))
+		return false, nil
+	}
+	budgetErr, err := s.checkSubtaskMetaBudget(&task, metas)
+	if err != nil {
+		return false, err
+	}
+	if budgetErr != nil {
+		s.logger.Warn("refined subtasks exceed meta budget, revert the task", zap.Error(budgetErr))
+		return true, s.revertTask(budgetErr)
+	}
+
+	eligibleNodes, err := getEligibleNodes(s.ctx, s, s.nodeMgr.getManagedNodes())
+	if err != nil {
+		return false, err
+	}
+	if len(eligibleNodes) == 0 {
+		return true, s.onNoExecutor(&task)
+	}
+	subTasks, _, err := s.newSubtasks(&task, task.Step, metas, eligibleNodes)
+	if err != nil {
+		return false, err
+	}
+	if err = s.retryOnTransientErr(func(ctx context.Context) error {
+		return switcher.RefineStep(ctx, &task, subTasks)
+	}); err != nil {
+		return false, err
+	}
+	s.logger.Info("step is refined", zap.String("step", proto.Step2Str(task.Type, task.Step)),
+		zap.Int("iteration", iteration+1), zap.Int("subtasks", len(subTasks)))
+	// the step might be refined by other scheduler on network partition, so
+	// we reload the iteration from storage.
+	var newTask *proto.Task
+	if err = s.retryOnTransientErr(func(ctx context.Context) (err error) {
+		newTask, err = s.taskMgr.GetTaskByID(ctx, task.ID)
+		return err
+	}); err != nil {
+		return true, err
+	}
+	s.storeTask(newTask)
+	return true, nil
+}
+
+// checkSubtaskMetaBudget checks whether the total bytes of metas of subtasks of
+// the task exceed proto.ExtraParams.SubtaskMetaBudget after adding metas, it
+// returns the error to revert the task with if so. existing subtasks are only
+// counted if the storage implements SubtaskMetaSizeGetter.
+func (s *BaseScheduler) checkSubtaskMetaBudget(task *proto.Task, metas [][]byte) (budgetErr error, err error) {
+	budget := task.ExtraParams.SubtaskMetaBudget
+	if budget <= 0 {
+		return nil, nil
+	}
+	var size int64
+	for _, meta := range metas {
+		size += int64(len(meta))
+	}
+	if getter, ok := s.taskMgr.(SubtaskMetaSizeGetter); ok {
+		var existingSize int64
+		if err = s.retryOnTransientErr(func(ctx context.Context) (err error) {
+			existingSize, err = getter.GetSubtaskMetaSize(ctx, task.ID)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		size += existingSize
+	}
+	if size > budget {
+		return errors.Annotatef(ErrSubtaskMetaBudgetExceeded,
+			"total meta size of subtasks %d bytes, budget %d bytes", size, budget), nil
+	}
+	return nil, nil
+}
+
+// newSubtasks creates subtasks of the step from metas and places them on the
+// eligible nodes.
+func (s *BaseScheduler) newSubtasks(
+	task *proto.Task,
+	subtaskStep proto.Step,
+	metas [][]byte,
+	eligibleNodes []string) ([]*proto.Subtask, uint64, error) {
+	stepConcurrency := s.getStepConcurrency(task, subtaskStep)
+
+	s.logger.Info("schedule subtasks",
+		zap.Stringer("state", task.State),
+		zap.String("step", proto.Step2Str(task.Type, subtaskStep)),
+		zap.Int("concurrency", task.Concurrency),
+		zap.Int("step-concurrency", stepConcurrency),
+		zap.Int("subtasks", len(metas)))
+
+	// the scheduled node of the subtask might not be optimal, as we run all
+	// scheduler in parallel, and update might be called too many times when
+	// multiple tasks are switching to next step.
+	// balancer will assign the subtasks to the right instance according to
+	// the system load of all nodes.
+	if err := s.slotMgr.update(s.ctx, s.nodeMgr, s.taskMgr); err != nil {
+		return nil, 0, err
+	}
+	adjustedEligibleNodes := s.slotMgr.adjustEligibleNodes(eligibleNodes, stepConcurrency)
+	var size uint64
+	subTasks := make([]*proto.Subtask, 0, len(metas))
+	for i, meta := range metas {
+		// we assign the subtask to the instance in a round-robin way.
+		pos := i % len(adjustedEligibleNodes)
+		instanceID := adjustedEligibleNodes[pos]
+		s.logger.Debug("create subtasks", zap.String("instanceID", instanceID))
+		subTasks = append(subTasks, proto.NewSubtask(
+			subtaskStep, task.ID, task.Type, instanceID, stepConcurrency, meta, i+1))
+
+		size += uint64(len(meta))
+	}
+	if grouper, ok := s.Extension.(SubtaskGrouper); ok {
+		for _, subtask := range subTasks {
+			subtask.Group = grouper.GetSubtaskGroup(task, subtaskStep, subtask.Meta)
+		}
+	}
+	if serializer, ok := s.Extension.(SubtaskSerializer); ok {
+		for _, subtask := range subTasks {
+			subtask.SerialKey = serializer.GetSubtaskSerialKey(task, subtaskStep, subtask.Meta)
+		}
+	}
+	if weigher, ok := s.Extension.(SubtaskWeigher); ok {
+		for _, subtask := range subTasks {
+			subtask.Weight = weigher.GetSubtaskWeight(task, subtaskStep, subtask.Meta)
+		}
+	}
+	if hinter, ok := s.Extension.(SubtaskLocalityHinter); ok {
+		for _, subtask := range subTasks {
+			subtask.TargetStoreIDs, subtask.TargetRegionIDs = hinter.GetSubtaskLocality(task, subtaskStep, subtask.Meta)
+		}
+		s.placeSubtasksByLocality(subTasks, adjustedEligibleNodes)
+	}
+	s.placeSubtasksByResource(subTasks, adjustedEligibleNodes)
+	if err := s.applySubtaskAssignmentHook(task, subTasks, adjustedEligibleNodes); err != nil {
+		return nil, 0, err
+	}
+	return subTasks, size, nil
+}
+
+// evaluateSuccess evaluates whether the finished task succeeds, see
+// SuccessEvaluator, it returns the error to revert the task with if not.
+func (s *BaseScheduler) evaluateSuccess(evaluator SuccessEvaluator, task *proto.Task) (taskErr error, err error) {
+	var subtasks []*proto.Subtask
+	if err = s.retryOnTransientErr(func(ctx context.Context) (err error) {
+		subtasks, err = s.taskMgr.GetFinishedSubtasksWithHistory(ctx, task.ID)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(subtasks, func(a, b *proto.Subtask) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	summaries := make([]string, 0, len(subtasks))
+	for _, subtask := range subtasks {
+		if subtask.State == proto.SubtaskStateSucceed {
+			summaries = append(summaries, subtask.Summary)
+		}
+	}
+	state, evalErr := evaluator.EvaluateSuccess(s.ctx, task, summaries)
+	switch state {
+	case proto.TaskStateSucceed:
+		return nil, nil
+	case proto.TaskStateReverting:
+		if evalErr == nil {
+			evalErr = errors.New("task is evaluated as not succeed")
+		}
+		return evalErr, nil
+	default:
+		if evalErr == nil {
+			evalErr = errors.Errorf("unexpected evaluated task state %s", state)
+		}
+		return nil, evalErr
+	}
+}
+
+// onNoExecutor handles the case that there is no eligible executor node to run
+// subtasks of the task, the task keeps waiting by default, or fails after
+// waiting for NoExecutorGracePeriod.
+func (s *BaseScheduler) onNoExecutor(task *proto.Task) error {
+	noExecutorErr := errors.New("no available TiDB node to dispatch subtasks")
+	gracePeriod := NoExecutorGracePeriod
+	if gracePeriod <= 0 {
+		return noExecutorErr
+	}
+	now := time.Now()
+	if s.noExecutorSince.IsZero() {
+		s.noExecutorSince = now
+	}
+	if now.Sub(s.noExecutorSince) < gracePeriod {
+		return noExecutorErr
+	}
+	s.logger.Warn("no eligible executor node for the task during the grace period, fail it",
+		zap.Duration("grace-period", gracePeriod))
+	if task.Step != proto.StepInit {
+		// subtasks of previous steps might need cleanup, so revert it.
+		return s.revertTask(ErrNoExecutorsAvailable)
+	}
+	if err := s.retryOnTransientErr(func(ctx context.Context) error {
+		return s.taskMgr.FailTask(ctx, task.ID, task.State, ErrNoExecutorsAvailable)
+	}); err != nil {
+		return err
+	}
+	task.State = proto.TaskStateFailed
+	task.Error = ErrNoExecutorsAvailable
+	s.storeTask(task)
+	return nil
+}
+
 func (s *BaseScheduler) handlePlanErr(err error) error {
 	task := *s.GetTask()
 	s.logger.Warn("generate plan failed", zap.Error(err), zap.Stringer("state", task.State))
-	if s.IsRetryableErr(err) {
+	if !task.ExtraParams.NoAutoRetry && (s.IsRetryableErr(err) || storage.IsTransientErr(err)) {
 		return err
 	}
 	return s.revertTask(err)
 }
 
+// retryOnTransientErr runs the storage operation f, and retries it when it
+// meets transient errors, such as deadlock and connection reset, so the task
+// isn't reverted or rescheduled because of them, see storage.IsTransientErr.
+func (s *BaseScheduler) retryOnTransientErr(f func(ctx context.Context) error) error {
+	backoffer := NewRetrySQLBackoffer()
+	return handle.RunWithRetry(s.ctx, RetrySQLTimes, backoffer, s.logger,
+		func(ctx context.Context) (bool, error) {
+			err := f(ctx)
+			return storage.IsTransientErr(err), err
+		},
+	)
+}
+
+// getSubtaskCntGroupByStates returns the count of subtasks of the step in each
+// state, subtasks cancelled with their group are not counted, as they're not
+// failure of the task, see GroupCanceledSubtaskCounter, so are subtasks
+// cancelled with their step if the step can be skipped, see
+// StepCanceledSubtaskCounter.
+func (s *BaseScheduler) getSubtaskCntGroupByStates(taskID int64, step proto.Step) (cntByStates map[proto.SubtaskState]int64, err error) {
+	err = s.retryOnTransientErr(func(ctx context.Context) error {
+		cntByStates, err = s.taskMgr.GetSubtaskCntGroupByStates(ctx, taskID, step)
+		return err
+	})
+	if err != nil || cntByStates[proto.SubtaskStateCanceled] == 0 {
+		return cntByStates, err
+	}
+	var ignoredCnt int64
+	if counter, ok := s.taskMgr.(GroupCanceledSubtaskCounter); ok {
+		var groupCanceledCnt int64
+		err = s.retryOnTransientErr(func(ctx context.Context) error {
+			groupCanceledCnt, err = counter.GetGroupCanceledSubtaskCnt(ctx, taskID, step)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		ignoredCnt += groupCanceledCnt
+	}
+	if counter, ok := s.taskMgr.(StepCanceledSubtaskCounter); ok &&
+		s.getStepFailureMode(step) == proto.StepFailureModeSkip {
+		var stepCanceledCnt int64
+		err = s.retryOnTransientErr(func(ctx context.Context) error {
+			stepCanceledCnt, err = counter.GetStepCanceledSubtaskCnt(ctx, taskID, step)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		ignoredCnt += stepCanceledCnt
+	}
+	if cntByStates[proto.SubtaskStateCanceled] -= ignoredCnt; cntByStates[proto.SubtaskStateCanceled] <= 0 {
+		delete(cntByStates, proto.SubtaskStateCanceled)
+	}
+	return cntByStates, nil
+}
+
+// getStepFailureMode returns the failure mode of the step of the task, see
+// StepFailureModeGetter.
+func (s *BaseScheduler) getStepFailureMode(step proto.Step) proto.StepFailureMode {
+	if getter, ok := s.Extension.(StepFailureModeGetter); ok {
+		if mode := getter.GetStepFailureMode(&s.GetTask().TaskBase, step); mode != "" {
+			return mode
+		}
+	}
+	return proto.StepFailureModeRevert
+}
+
 func (s *BaseScheduler) revertTask(taskErr error) error {
 	task := *s.GetTask()
-	if err := s.taskMgr.RevertTask(s.ctx, task.ID, task.State, taskErr); err != nil {
+	if err := s.retryOnTransientErr(func(ctx context.Context) error {
+		return s.taskMgr.RevertTask(ctx, task.ID, task.State, taskErr)
+	}); err != nil {
 		return err
 	}
 	task.State = proto.TaskStateReverting
 	task.Error = taskErr
-	s.task.Store(&task)
+	s.storeTask(&task)
 	return nil
 }
 
@@ -612,6 +1217,64 @@ func (*BaseScheduler) isStepSucceed(cntByStates map[proto.SubtaskState]int64) bo
 	return len(cntByStates) == 0 || (len(cntByStates) == 1 && ok)
 }
 
+func (*BaseScheduler) isStepFinished(cntByStates map[proto.SubtaskState]int64) bool {
+	return cntByStates[proto.SubtaskStatePending] == 0 && cntByStates[proto.SubtaskStateRunning] == 0 &&
+		cntByStates[proto.SubtaskStateRetrying] == 0 && cntByStates[proto.SubtaskStatePaused] == 0
+}
+
+func (*BaseScheduler) isSuccessRatioReached(cntByStates map[proto.SubtaskState]int64, threshold float64) bool {
+	var total int64
+	for _, cnt := range cntByStates {
+		total += cnt
+	}
+	return float64(cntByStates[proto.SubtaskStateSucceed]) >= threshold*float64(total)
+}
+
+// getSuccessThreshold returns the success threshold of current step, ok is
+// false if the step doesn't run in collect-errors mode.
+func (s *BaseScheduler) getSuccessThreshold(task *proto.Task) (threshold float64, ok bool) {
+	ext, ok := s.Extension.(PartialSuccessExtension)
+	if !ok {
+		return 0, false
+	}
+	threshold = ext.GetSuccessThreshold(&task.TaskBase)
+	return threshold, threshold > 0 && threshold < 1
+}
+
+// getStepConcurrency returns the concurrency of subtasks of the step.
+func (s *BaseScheduler) getStepConcurrency(task *proto.Task, step proto.Step) int {
+	ext, ok := s.Extension.(StepConcurrencyExtension)
+	if !ok {
+		return task.Concurrency
+	}
+	concurrency := ext.StepConcurrency(task, step)
+	if concurrency <= 0 || concurrency > task.Concurrency {
+		return task.Concurrency
+	}
+	return concurrency
+}
+
+// getPartialSuccessErr returns a non-nil error which contains errors of failed
+// subtasks if the task tolerated some failed subtasks.
+func (s *BaseScheduler) getPartialSuccessErr(task *proto.Task) (error, error) {
+	if _, ok := s.Extension.(PartialSuccessExtension); !ok {
+		return nil, nil
+	}
+	subTaskErrs, err := s.taskMgr.GetSubtaskErrors(s.ctx, task.ID)
+	if err != nil || len(subTaskErrs) == 0 {
+		return nil, err
+	}
+	shownErrs := subTaskErrs[:min(len(subTaskErrs), maxPartialSuccessErrCnt)]
+	errMsgs := make([]string, 0, len(shownErrs))
+	for _, e := range shownErrs {
+		if e != nil {
+			errMsgs = append(errMsgs, e.Error())
+		}
+	}
+	return errors.Errorf("task partially succeeded, %d subtasks failed: %s",
+		len(subTaskErrs), strings.Join(errMsgs, "; ")), nil
+}
+
 // IsCancelledErr checks if the error is a cancelled error.
 func IsCancelledErr(err error) bool {
 	return strings.Contains(err.Error(), taskCancelMsg)
@@ -620,8 +1283,11 @@ func IsCancelledErr(err error) bool {
 // getEligibleNodes returns the eligible(live) nodes for the task.
 // if the task can only be scheduled to some specific nodes, return them directly,
 // we don't care liveliness of them.
+// if the task has a node allowlist, only nodes in it are eligible, the result
+// might be empty if none of them is available.
 func getEligibleNodes(ctx context.Context, sch Scheduler, managedNodes []string) ([]string, error) {
-	serverNodes, err := sch.GetEligibleInstances(ctx, sch.GetTask())
+	task := sch.GetTask()
+	serverNodes, err := sch.GetEligibleInstances(ctx, task)
 	if err != nil {
 		return nil, err
 	}
@@ -629,5 +1295,18 @@ func getEligibleNodes(ctx context.Context, sch Scheduler, managedNodes []string)
 	if len(serverNodes) == 0 {
 		serverNodes = managedNodes
 	}
+	if allowlist := task.ExtraParams.NodeAllowlist; len(allowlist) > 0 {
+		serverNodes = filterNodesByAllowlist(serverNodes, allowlist)
+	}
 	return serverNodes, nil
 }
+
+func filterNodesByAllowlist(nodes []string, allowlist []string) []string {
+	res := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if slices.Contains(allowlist, node) {
+			res = append(res, node)
+		}
+	}
+	return res
+}
@@ -17,6 +17,7 @@ package scheduler
 import (
 	"context"
 	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/pingcap/errors"
@@ -26,6 +27,7 @@ import (
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	"github.com/pingcap/tidb/pkg/metrics"
 	tidbutil "github.com/pingcap/tidb/pkg/util"
+	"github.com/pingcap/tidb/pkg/util/backoff"
 	"github.com/pingcap/tidb/pkg/util/intest"
 	"github.com/pingcap/tidb/pkg/util/syncutil"
 	"go.uber.org/zap"
@@ -40,8 +42,16 @@ var (
 	// DefaultCleanUpInterval is the interval of cleanup routine.
 	DefaultCleanUpInterval        = 10 * time.Minute
 	defaultCollectMetricsInterval = 5 * time.Second
+	// resumeTaskCheckInterval is the interval to check whether paused tasks
+	// should be resumed automatically.
+	resumeTaskCheckInterval = 10 * time.Second
 )
 
+// UnsupportedTaskTypeStatus is the status message of tasks whose type has no
+// scheduler registered, such as after a downgrade, they're kept in storage and
+// skipped until the type is supported again.
+const UnsupportedTaskTypeStatus = "unsupported task type"
+
 // WaitTaskFinished is used to sync the test.
 var WaitTaskFinished = make(chan struct{})
 
@@ -68,6 +78,13 @@ func (sm *Manager) hasScheduler(taskID int64) bool {
 	return ok
 }
 
+func (sm *Manager) getScheduler(taskID int64) (Scheduler, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	scheduler, ok := sm.mu.schedulerMap[taskID]
+	return scheduler, ok
+}
+
 func (sm *Manager) delScheduler(taskID int64) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -114,6 +131,19 @@ type Manager struct {
 	logger   *zap.Logger
 
 	finishCh chan struct{}
+	// maxConcurrentTask is the max number of tasks scheduled concurrently by
+	// this manager, excess tasks are kept pending. 0 means proto.MaxConcurrentTask.
+	maxConcurrentTask atomic.Int32
+	// taskSelector selects the order to start schedulers of tasks, nil means
+	// FIFOTaskSelector.
+	taskSelector atomic.Pointer[TaskSelector]
+	// now returns the current time, it's injectable for test.
+	now func() time.Time
+	// cleanupBackoffer is used to backoff the retry of failed cleanup rounds.
+	cleanupBackoffer backoff.Backoffer
+	// unsupportedTasks is the IDs of tasks flagged with UnsupportedTaskTypeStatus
+	// by this manager, it's only accessed in scheduleTaskLoop.
+	unsupportedTasks map[int64]struct{}
 
 	mu struct {
 		syncutil.RWMutex
@@ -147,12 +177,51 @@ func NewManager(ctx context.Context, taskMgr TaskManager, serverID string) *Mana
 		}),
 		logger:   logger,
 		finishCh: make(chan struct{}, proto.MaxConcurrentTask),
+		now:      time.Now,
+
+		cleanupBackoffer: backoff.NewExponential(RetrySQLInterval, 2, DefaultCleanUpInterval),
+		unsupportedTasks: make(map[int64]struct{}),
 	}
 	schedulerManager.mu.schedulerMap = make(map[int64]Scheduler)
 
 	return schedulerManager
 }
 
+// SetMaxConcurrentTask sets the max number of tasks scheduled concurrently
+// across all task types, it guards the cluster against too many tasks
+// submitted at once, and tasks beyond the limit are kept pending.
+// n <= 0 or n > proto.MaxConcurrentTask means proto.MaxConcurrentTask.
+func (sm *Manager) SetMaxConcurrentTask(n int) {
+	if n <= 0 || n > proto.MaxConcurrentTask {
+		n = 0
+	}
+	sm.maxConcurrentTask.Store(int32(n))
+}
+
+func (sm *Manager) getMaxConcurrentTask() int {
+	if n := int(sm.maxConcurrentTask.Load()); n > 0 {
+		return n
+	}
+	return proto.MaxConcurrentTask
+}
+
+// SetTaskSelector sets the TaskSelector which decides the order to start
+// schedulers of schedulable tasks, nil means FIFOTaskSelector.
+func (sm *Manager) SetTaskSelector(selector TaskSelector) {
+	if selector == nil {
+		sm.taskSelector.Store(nil)
+		return
+	}
+	sm.taskSelector.Store(&selector)
+}
+
+func (sm *Manager) getTaskSelector() TaskSelector {
+	if selector := sm.taskSelector.Load(); selector != nil {
+		return *selector
+	}
+	return FIFOTaskSelector{}
+}
+
 // Start the schedulerManager, start the scheduleTaskLoop to start multiple schedulers.
 func (sm *Manager) Start() {
 	// init cached managed nodes
@@ -162,6 +231,7 @@ func (sm *Manager) Start() {
 	sm.wg.Run(sm.gcSubtaskHistoryTableLoop)
 	sm.wg.Run(sm.cleanupTaskLoop)
 	sm.wg.Run(sm.collectLoop)
+	sm.wg.Run(sm.resumeTaskLoop)
 	sm.wg.Run(func() {
 		sm.nodeMgr.maintainLiveNodesLoop(sm.ctx, sm.taskMgr)
 	})
@@ -209,10 +279,11 @@ func (sm *Manager) scheduleTaskLoop() {
 		case <-handle.TaskChangedCh:
 		}
 
-		taskCnt := sm.getSchedulerCount()
-		if taskCnt >= proto.MaxConcurrentTask {
+		sm.pokeTasks()
+		taskCnt, maxTaskCnt := sm.getSchedulerCount(), sm.getMaxConcurrentTask()
+		if taskCnt >= maxTaskCnt {
 			sm.logger.Debug("scheduled tasks reached limit",
-				zap.Int("current", taskCnt), zap.Int("max", proto.MaxConcurrentTask))
+				zap.Int("current", taskCnt), zap.Int("max", maxTaskCnt))
 			continue
 		}
 
@@ -235,19 +306,29 @@ func (sm *Manager) getSchedulableTasks() ([]*proto.TaskBase, error) {
 		return nil, err
 	}
 
+	deferredTasks, err := sm.getDeferredTasks(tasks)
+	if err != nil {
+		sm.logger.Warn("get deferred tasks failed", zap.Error(err))
+		return nil, err
+	}
+	now := sm.now()
 	schedulableTasks := make([]*proto.TaskBase, 0, len(tasks))
 	for _, task := range tasks {
 		if sm.hasScheduler(task.ID) {
 			continue
 		}
+		if startAfter, ok := deferredTasks[task.ID]; ok && now.Before(startAfter) {
+			continue
+		}
+		if !canDriveTaskType(task.Type, sm.serverID) {
+			continue
+		}
 		// we check it before start scheduler, so no need to check it again.
 		// see startScheduler.
-		// this should not happen normally, unless user modify system table
-		// directly.
+		// this should not happen normally, unless the cluster is downgraded
+		// or user modify system table directly.
 		if getSchedulerFactory(task.Type) == nil {
-			sm.logger.Warn("unknown task type", zap.Int64("task-id", task.ID),
-				zap.Stringer("task-type", task.Type))
-			sm.failTask(task.ID, task.State, errors.New("unknown task type"))
+			sm.flagUnsupportedTask(task)
 			continue
 		}
 		schedulableTasks = append(schedulableTasks, task)
@@ -255,6 +336,67 @@ func (sm *Manager) getSchedulableTasks() ([]*proto.TaskBase, error) {
 	return schedulableTasks, nil
 }
 
+// getDeferredTasks returns the start time of the pending tasks which are
+// deferred, see proto.ExtraParams.StartAfter.
+func (sm *Manager) getDeferredTasks(tasks []*proto.TaskBase) (map[int64]time.Time, error) {
+	getter, ok := sm.taskMgr.(DeferredTaskGetter)
+	if !ok {
+		return nil, nil
+	}
+	if !slices.ContainsFunc(tasks, func(task *proto.TaskBase) bool {
+		return task.State == proto.TaskStatePending
+	}) {
+		return nil, nil
+	}
+	return getter.GetDeferredTasks(sm.ctx)
+}
+
+// pokeTasks forces the schedulers of the tasks poked by operator to re-evaluate
+// them immediately, poked tasks without scheduler are scheduled as usual.
+func (sm *Manager) pokeTasks() {
+	taker, ok := sm.taskMgr.(PokedTaskTaker)
+	if !ok {
+		return
+	}
+	taskIDs, err := taker.TakePokedTasks(sm.ctx)
+	if err != nil {
+		sm.logger.Warn("take poked tasks failed", zap.Error(err))
+		return
+	}
+	for _, taskID := range taskIDs {
+		scheduler, ok := sm.getScheduler(taskID)
+		if !ok {
+			sm.logger.Info("poked task has no scheduler", zap.Int64("task-id", taskID))
+			continue
+		}
+		poker, ok := scheduler.(interface{ Poke() })
+		if !ok {
+			continue
+		}
+		sm.logger.Info("poke task", zap.Int64("task-id", taskID))
+		poker.Poke()
+	}
+}
+
+// flagUnsupportedTask flags the task whose type has no scheduler registered
+// with UnsupportedTaskTypeStatus, the task is skipped instead of failed, so it
+// can continue after the type is supported again.
+func (sm *Manager) flagUnsupportedTask(task *proto.TaskBase) {
+	if _, ok := sm.unsupportedTasks[task.ID]; ok {
+		return
+	}
+	sm.logger.Warn("unsupported task type, skip scheduling the task",
+		zap.Int64("task-id", task.ID), zap.Stringer("task-type", task.Type))
+	if setter, ok := sm.taskMgr.(TaskStatusMessageSetter); ok {
+		if err := setter.SetTaskStatusMessage(sm.ctx, task.ID, UnsupportedTaskTypeStatus); err != nil {
+			sm.logger.Warn("flag task of unsupported type failed",
+				zap.Int64("task-id", task.ID), zap.Error(err))
+			return
+		}
+	}
+	sm.unsupportedTasks[task.ID] = struct{}{}
+}
+
 func (sm *Manager) startSchedulers(schedulableTasks []*proto.TaskBase) error {
 	if len(schedulableTasks) == 0 {
 		return nil
@@ -263,23 +405,33 @@ func (sm *Manager) startSchedulers(schedulableTasks []*proto.TaskBase) error {
 		sm.logger.Warn("update used slot failed", zap.Error(err))
 		return err
 	}
-	for _, task := range schedulableTasks {
+	maxTaskCnt := sm.getMaxConcurrentTask()
+	selector := sm.getTaskSelector()
+	remainingTasks := slices.Clone(schedulableTasks)
+	for len(remainingTasks) > 0 {
+		idx := selector.SelectTask(remainingTasks)
+		if idx < 0 || idx >= len(remainingTasks) {
+			sm.logger.Warn("task selector returns invalid index, fallback to task order",
+				zap.Int("index", idx), zap.Int("task-count", len(remainingTasks)))
+			idx = 0
+		}
+		task := remainingTasks[idx]
+		remainingTasks = slices.Delete(remainingTasks, idx, idx+1)
 		taskCnt := sm.getSchedulerCount()
-		if taskCnt >= proto.MaxConcurrentTask {
+		if taskCnt >= maxTaskCnt {
 			break
 		}
 		var reservedExecID string
 		allocateSlots := true
 		var ok bool
-		switch task.State {
-		case proto.TaskStatePending, proto.TaskStateRunning, proto.TaskStateResuming:
+		if task.State.IsRunningLike() {
 			reservedExecID, ok = sm.slotMgr.canReserve(task)
 			if !ok {
 				// task of lower rank might be able to be scheduled.
 				continue
 			}
-		// reverting/cancelling/pausing
-		default:
+		} else {
+			// reverting/cancelling/pausing
 			allocateSlots = false
 			sm.logger.Info("start scheduler without allocating slots",
 				zap.Int64("task-id", task.ID), zap.Stringer("state", task.State))
@@ -292,6 +444,31 @@ func (sm *Manager) startSchedulers(schedulableTasks []*proto.TaskBase) error {
 	return nil
 }
 
+// migrateTaskMeta migrates the meta of the task to the current version of the
+// task type if it's older, see proto.RegisterMetaVersion. the task fails if the
+// meta can't be migrated.
+func (sm *Manager) migrateTaskMeta(task *proto.Task) error {
+	version, migrate := proto.GetMetaVersion(task.Type)
+	oldVersion := task.ExtraParams.GetMetaVersion()
+	if migrate == nil || oldVersion >= version {
+		return nil
+	}
+	meta, err := migrate(oldVersion, task.Meta)
+	if err != nil {
+		err = errors.Annotatef(err, "migrate task meta from version %d to %d", oldVersion, version)
+		sm.failTask(task.ID, task.State, err)
+		return err
+	}
+	if err = sm.taskMgr.MigrateTaskMeta(sm.ctx, task.ID, task.ExtraParams.MetaVersion, version, meta); err != nil {
+		return err
+	}
+	sm.logger.Info("task meta migrated", zap.Int64("task-id", task.ID),
+		zap.Int("old-version", oldVersion), zap.Int("version", version))
+	task.Meta = meta
+	task.ExtraParams.MetaVersion = version
+	return nil
+}
+
 func (sm *Manager) failTask(id int64, currState proto.TaskState, err error) {
 	if err2 := sm.taskMgr.FailTask(sm.ctx, id, currState, err); err2 != nil {
 		sm.logger.Warn("failed to update task state to failed",
@@ -335,6 +512,20 @@ func (sm *Manager) startScheduler(basicTask *proto.TaskBase, allocateSlots bool,
 		return
 	}
 
+	if task.ExtraParams.StatusMessage == UnsupportedTaskTypeStatus {
+		// the type is supported again.
+		if setter, ok := sm.taskMgr.(TaskStatusMessageSetter); ok {
+			if err = setter.SetTaskStatusMessage(sm.ctx, task.ID, ""); err != nil {
+				sm.logger.Warn("clear unsupported task type status failed",
+					zap.Int64("task-id", task.ID), zap.Error(err))
+			}
+		}
+	}
+	if err = sm.migrateTaskMeta(task); err != nil {
+		sm.logger.Error("migrate task meta failed", zap.Int64("task-id", task.ID), zap.Error(err))
+		return
+	}
+
 	schedulerFactory := getSchedulerFactory(task.Type)
 	scheduler := schedulerFactory(sm.ctx, task, Param{
 		taskMgr:        sm.taskMgr,
@@ -348,6 +539,12 @@ func (sm *Manager) startScheduler(basicTask *proto.TaskBase, allocateSlots bool,
 		sm.failTask(task.ID, task.State, err)
 		return
 	}
+	if updater, ok := sm.taskMgr.(TaskOwnerUpdater); ok {
+		// it's only used for observability, so we don't fail the task on error.
+		if err = updater.UpdateTaskOwner(sm.ctx, task.ID, sm.serverID); err != nil {
+			sm.logger.Warn("update task owner failed", zap.Int64("task-id", task.ID), zap.Error(err))
+		}
+	}
 	sm.addScheduler(task.ID, scheduler)
 	if allocateSlots {
 		sm.slotMgr.reserve(basicTask, reservedExecID)
@@ -373,15 +570,24 @@ func (sm *Manager) cleanupTaskLoop() {
 	sm.logger.Info("cleanup loop start")
 	ticker := time.NewTicker(DefaultCleanUpInterval)
 	defer ticker.Stop()
+	// a failed cleanup round is retried with backoff, instead of waiting for
+	// the next tick.
+	var retryCh <-chan time.Time
+	failCnt := 0
 	for {
 		select {
 		case <-sm.ctx.Done():
 			sm.logger.Info("cleanup loop exits")
 			return
 		case <-sm.finishCh:
-			sm.doCleanupTask()
 		case <-ticker.C:
-			sm.doCleanupTask()
+		case <-retryCh:
+		}
+		if err := sm.doCleanupTask(); err != nil {
+			retryCh = time.After(sm.cleanupBackoffer.Backoff(failCnt))
+			failCnt++
+		} else {
+			retryCh, failCnt = nil, 0
 		}
 	}
 }
@@ -393,43 +599,92 @@ var WaitCleanUpFinished = make(chan struct{}, 1)
 // For example:
 //
 //	tasks with global sort should clean up tmp files stored on S3.
-func (sm *Manager) doCleanupTask() {
+//
+// it returns error if some task is left to clean up, so it's retried.
+func (sm *Manager) doCleanupTask() error {
 	tasks, err := sm.taskMgr.GetTasksInStates(
 		sm.ctx,
 		proto.TaskStateFailed,
 		proto.TaskStateReverted,
 		proto.TaskStateSucceed,
+		proto.TaskStatePartialSuccess,
 	)
 	if err != nil {
 		sm.logger.Warn("get task in states failed", zap.Error(err))
-		return
+		return err
 	}
-	if len(tasks) == 0 {
-		return
+	var cleanUpErr error
+	if len(tasks) > 0 {
+		sm.logger.Info("cleanup routine start")
+		cleanUpErr, err = sm.cleanupFinishedTasks(tasks)
+		if err != nil {
+			sm.logger.Warn("cleanup routine failed", zap.Error(err))
+			return err
+		}
 	}
-	sm.logger.Info("cleanup routine start")
-	err = sm.cleanupFinishedTasks(tasks)
+	// tasks archived before their cleanup finishes, including those left by a
+	// crash after archiving, are cleaned up here.
+	cleanedCnt, err := sm.cleanupArchivedTasks()
 	if err != nil {
-		sm.logger.Warn("cleanup routine failed", zap.Error(err))
-		return
+		sm.logger.Warn("cleanup archived tasks failed", zap.Error(err))
+		return err
+	}
+	if len(tasks) == 0 && cleanedCnt == 0 {
+		return nil
 	}
 	failpoint.Inject("WaitCleanUpFinished", func() {
 		WaitCleanUpFinished <- struct{}{}
 	})
 	sm.logger.Info("cleanup routine success")
+	return cleanUpErr
 }
 
-func (sm *Manager) cleanupFinishedTasks(tasks []*proto.Task) error {
+// shouldCleanUp returns whether the cleanup routine runs for the finished task,
+// see RevertCleanUpController.
+func shouldCleanUp(cleanup CleanUpRoutine, task *proto.Task) bool {
+	if task.State != proto.TaskStateFailed && task.State != proto.TaskStateReverted {
+		return true
+	}
+	controller, ok := cleanup.(RevertCleanUpController)
+	return !ok || controller.CleanUpOnRevert()
+}
+
+// cleanUpAfterArchive returns whether the cleanup routine runs after the task
+// is moved to history, see CleanUpAfterArchive.
+func (sm *Manager) cleanUpAfterArchive(cleanup CleanUpRoutine, task *proto.Task) bool {
+	if task.ExtraParams.Ephemeral {
+		return false
+	}
+	if _, ok := sm.taskMgr.(ArchivedTaskCleaner); !ok {
+		return false
+	}
+	controller, ok := cleanup.(CleanUpOrderController)
+	return ok && controller.CleanUpOrder() == CleanUpAfterArchive
+}
+
+// cleanupFinishedTasks runs the cleanup routine of tasks and moves the cleaned
+// ones to history, cleanUpErr is the first error of the cleanup routines, the
+// failed tasks are left in the table to retry.
+func (sm *Manager) cleanupFinishedTasks(tasks []*proto.Task) (cleanUpErr error, err error) {
 	cleanedTasks := make([]*proto.Task, 0)
-	var firstErr error
 	for _, task := range tasks {
 		sm.logger.Info("cleanup task", zap.Int64("task-id", task.ID))
 		cleanupFactory := getSchedulerCleanUpFactory(task.Type)
 		if cleanupFactory != nil {
 			cleanup := cleanupFactory()
-			err := cleanup.CleanUp(sm.ctx, task)
-			if err != nil {
-				firstErr = err
+			if !shouldCleanUp(cleanup, task) {
+				sm.logger.Info("skip cleanup for reverted task", zap.Int64("task-id", task.ID),
+					zap.Stringer("state", task.State))
+				cleanedTasks = append(cleanedTasks, task)
+				continue
+			}
+			if sm.cleanUpAfterArchive(cleanup, task) {
+				// the mark is archived with the task, see cleanupArchivedTasks.
+				task.ExtraParams.CleanUpPending = true
+				cleanedTasks = append(cleanedTasks, task)
+				continue
+			}
+			if cleanUpErr = cleanup.CleanUp(sm.ctx, task); cleanUpErr != nil {
 				break
 			}
 			cleanedTasks = append(cleanedTasks, task)
@@ -438,15 +693,116 @@ func (sm *Manager) cleanupFinishedTasks(tasks []*proto.Task) error {
 			cleanedTasks = append(cleanedTasks, task)
 		}
 	}
-	if firstErr != nil {
-		sm.logger.Warn("cleanup routine failed", zap.Error(errors.Trace(firstErr)))
+	if cleanUpErr != nil {
+		sm.logger.Warn("cleanup routine failed", zap.Error(errors.Trace(cleanUpErr)))
 	}
 
 	failpoint.Inject("mockTransferErr", func() {
-		failpoint.Return(errors.New("transfer err"))
+		failpoint.Return(nil, errors.New("transfer err"))
 	})
 
-	return sm.taskMgr.TransferTasks2History(sm.ctx, cleanedTasks)
+	if err = sm.taskMgr.TransferTasks2History(sm.ctx, cleanedTasks); err != nil {
+		return nil, err
+	}
+	sm.traceFinishedTasks(cleanedTasks)
+	return cleanUpErr, nil
+}
+
+// cleanupArchivedTasks runs the cleanup routine of the tasks which are moved to
+// history before cleanup, see CleanUpAfterArchive. the count of tasks cleaned up
+// is returned.
+func (sm *Manager) cleanupArchivedTasks() (int, error) {
+	cleaner, ok := sm.taskMgr.(ArchivedTaskCleaner)
+	if !ok {
+		return 0, nil
+	}
+	tasks, err := cleaner.GetCleanUpPendingTasks(sm.ctx)
+	if err != nil {
+		return 0, err
+	}
+	var cleanedCnt int
+	for _, task := range tasks {
+		cleanupFactory := getSchedulerCleanUpFactory(task.Type)
+		if cleanupFactory == nil {
+			// the task type might be unregistered on this node, keep the task
+			// pending until it's cleaned up by a node which supports it.
+			sm.logger.Warn("no cleanup routine for archived task", zap.Int64("task-id", task.ID),
+				zap.Stringer("task-type", task.Type))
+			continue
+		}
+		failpoint.Inject("mockCrashBeforeArchivedCleanUp", func() {
+			failpoint.Return(cleanedCnt, errors.New("mock crash before archived cleanup"))
+		})
+		sm.logger.Info("cleanup archived task", zap.Int64("task-id", task.ID))
+		if err = cleanupFactory().CleanUp(sm.ctx, task); err != nil {
+			return cleanedCnt, err
+		}
+		task.ExtraParams.CleanUpPending = false
+		if err = cleaner.FinishArchivedTaskCleanUp(sm.ctx, task); err != nil {
+			return cleanedCnt, err
+		}
+		cleanedCnt++
+	}
+	return cleanedCnt, nil
+}
+
+// traceFinishedTasks traces finished tasks with the registered TaskTracer,
+// failing to trace doesn't affect the cleanup of tasks.
+func (sm *Manager) traceFinishedTasks(tasks []*proto.Task) {
+	tracer := getTaskTracer()
+	if _, ok := tracer.(noopTaskTracer); ok {
+		return
+	}
+	for _, task := range tasks {
+		subtasks, err := sm.taskMgr.GetFinishedSubtasksWithHistory(sm.ctx, task.ID)
+		if err != nil {
+			sm.logger.Warn("get subtasks of finished task failed", zap.Int64("task-id", task.ID), zap.Error(err))
+			continue
+		}
+		tracer.TraceTask(sm.ctx, task, subtasks)
+	}
+}
+
+func (sm *Manager) resumeTaskLoop() {
+	sm.logger.Info("resume task loop start")
+	ticker := time.NewTicker(resumeTaskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sm.ctx.Done():
+			sm.logger.Info("resume task loop exits")
+			return
+		case <-ticker.C:
+			sm.resumeTasksOnTime()
+		}
+	}
+}
+
+// resumeTasksOnTime resumes paused tasks whose resume time is reached, see
+// storage.TaskManager.PauseUntil.
+func (sm *Manager) resumeTasksOnTime() {
+	tasks, err := sm.taskMgr.GetTasksInStates(sm.ctx, proto.TaskStatePaused)
+	if err != nil {
+		sm.logger.Warn("get paused tasks failed", zap.Error(err))
+		return
+	}
+	now := sm.now()
+	for _, task := range tasks {
+		resumeAt := task.ExtraParams.ResumeAt
+		if resumeAt == 0 || now.Unix() < resumeAt {
+			continue
+		}
+		found, err := sm.taskMgr.ResumeTask(sm.ctx, task.Key)
+		if err != nil {
+			sm.logger.Warn("resume task failed", zap.Int64("task-id", task.ID), zap.Error(err))
+			continue
+		}
+		if found {
+			sm.logger.Info("resume task automatically", zap.Int64("task-id", task.ID),
+				zap.Time("resume-at", time.Unix(resumeAt, 0)))
+			handle.NotifyTaskChange()
+		}
+	}
 }
 
 func (sm *Manager) collectLoop() {
@@ -472,6 +828,13 @@ func (sm *Manager) collect() {
 	}
 
 	subtaskCollector.subtaskInfo.Store(&subtasks)
+
+	tasks, err := sm.taskMgr.GetTopUnfinishedTasks(sm.ctx)
+	if err != nil {
+		sm.logger.Warn("get unfinished tasks failed", zap.Error(err))
+		return
+	}
+	subtaskCollector.taskInfo.Store(&tasks)
 }
 
 // MockScheduler mock one scheduler for one task, only used for tests.
@@ -16,12 +16,16 @@ package scheduler
 
 import (
 	"context"
+	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/failpoint"
 	"github.com/pingcap/tidb/pkg/disttask/framework/mock"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/util"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
 )
@@ -82,7 +86,8 @@ func TestSchedulerCleanupTask(t *testing.T) {
 		mgr.ctx,
 		proto.TaskStateFailed,
 		proto.TaskStateReverted,
-		proto.TaskStateSucceed).Return(tasks, nil)
+		proto.TaskStateSucceed,
+		proto.TaskStatePartialSuccess).Return(tasks, nil)
 
 	taskMgr.EXPECT().TransferTasks2History(mgr.ctx, tasks).Return(nil)
 	mgr.doCleanupTask()
@@ -95,7 +100,8 @@ func TestSchedulerCleanupTask(t *testing.T) {
 		mgr.ctx,
 		proto.TaskStateFailed,
 		proto.TaskStateReverted,
-		proto.TaskStateSucceed).Return(tasks, nil)
+		proto.TaskStateSucceed,
+		proto.TaskStatePartialSuccess).Return(tasks, nil)
 	taskMgr.EXPECT().TransferTasks2History(mgr.ctx, tasks).Return(mockErr)
 	mgr.doCleanupTask()
 	require.True(t, ctrl.Satisfied())
@@ -104,7 +110,8 @@ func TestSchedulerCleanupTask(t *testing.T) {
 		mgr.ctx,
 		proto.TaskStateFailed,
 		proto.TaskStateReverted,
-		proto.TaskStateSucceed).Return(tasks, nil)
+		proto.TaskStateSucceed,
+		proto.TaskStatePartialSuccess).Return(tasks, nil)
 	taskMgr.EXPECT().TransferTasks2History(mgr.ctx, tasks).Return(nil)
 	mgr.doCleanupTask()
 	require.True(t, ctrl.Satisfied())
@@ -112,6 +119,94 @@ func TestSchedulerCleanupTask(t *testing.T) {
 	require.NoError(t, failpoint.Disable("github.com/pingcap/tidb/pkg/disttask/framework/scheduler/WaitCleanUpFinished"))
 }
 
+type recordCleanupBackoffer struct {
+	retryCnts chan int
+}
+
+func (b *recordCleanupBackoffer) Backoff(retryCnt int) time.Duration {
+	b.retryCnts <- retryCnt
+	return time.Millisecond
+}
+
+func TestSchedulerCleanupTaskRetryWithBackoff(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	taskMgr := mock.NewMockTaskManager(ctrl)
+	mgr := NewManager(context.Background(), taskMgr, "1")
+	backoffer := &recordCleanupBackoffer{retryCnts: make(chan int, 10)}
+	mgr.cleanupBackoffer = backoffer
+
+	// fails twice, then succeeds, the retry stops after success.
+	mockErr := errors.New("get tasks err")
+	taskMgr.EXPECT().GetTasksInStates(gomock.Any(), gomock.Any()).Return(nil, mockErr).Times(2)
+	done := make(chan struct{})
+	taskMgr.EXPECT().GetTasksInStates(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(context.Context, ...any) ([]*proto.Task, error) {
+			close(done)
+			return nil, nil
+		})
+	var wg util.WaitGroupWrapper
+	wg.Run(mgr.cleanupTaskLoop)
+	mgr.finishCh <- struct{}{}
+	<-done
+	// wait a while to make sure no more retry.
+	time.Sleep(100 * time.Millisecond)
+	mgr.cancel()
+	wg.Wait()
+	close(backoffer.retryCnts)
+	var retryCnts []int
+	for cnt := range backoffer.retryCnts {
+		retryCnts = append(retryCnts, cnt)
+	}
+	require.Equal(t, []int{0, 1}, retryCnts)
+	require.True(t, ctrl.Satisfied())
+}
+
+type revertCleanUpRoutine struct {
+	cleanUpOnRevert bool
+	cleanedIDs      *[]int64
+}
+
+func (r *revertCleanUpRoutine) CleanUp(_ context.Context, task *proto.Task) error {
+	*r.cleanedIDs = append(*r.cleanedIDs, task.ID)
+	return nil
+}
+
+func (r *revertCleanUpRoutine) CleanUpOnRevert() bool {
+	return r.cleanUpOnRevert
+}
+
+func TestSchedulerCleanupRevertedTask(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	taskMgr := mock.NewMockTaskManager(ctrl)
+	mgr := NewManager(context.Background(), taskMgr, "1")
+	t.Cleanup(ClearSchedulerCleanUpFactory)
+
+	tasks := []*proto.Task{
+		{TaskBase: proto.TaskBase{ID: 1, Type: proto.TaskTypeExample, State: proto.TaskStateSucceed}},
+		{TaskBase: proto.TaskBase{ID: 2, Type: proto.TaskTypeExample, State: proto.TaskStateReverted}},
+		{TaskBase: proto.TaskBase{ID: 3, Type: proto.TaskTypeExample, State: proto.TaskStateFailed}},
+		{TaskBase: proto.TaskBase{ID: 4, Type: proto.TaskTypeExample, State: proto.TaskStatePartialSuccess}},
+	}
+	for _, cleanUpOnRevert := range []bool{true, false} {
+		var cleanedIDs []int64
+		RegisterSchedulerCleanUpFactory(proto.TaskTypeExample, func() CleanUpRoutine {
+			return &revertCleanUpRoutine{cleanUpOnRevert: cleanUpOnRevert, cleanedIDs: &cleanedIDs}
+		})
+		taskMgr.EXPECT().GetTasksInStates(gomock.Any(), gomock.Any()).Return(tasks, nil)
+		// tasks are transferred to history table whether cleanup runs or not.
+		taskMgr.EXPECT().TransferTasks2History(gomock.Any(), tasks).Return(nil)
+		mgr.doCleanupTask()
+		require.True(t, ctrl.Satisfied())
+		if cleanUpOnRevert {
+			require.Equal(t, []int64{1, 2, 3, 4}, cleanedIDs)
+		} else {
+			require.Equal(t, []int64{1, 4}, cleanedIDs)
+		}
+	}
+}
+
 func TestManagerSchedulerNotAllocateSlots(t *testing.T) {
 	// the tests make sure allocatedSlots correct.
 	require.NoError(t, failpoint.Enable("github.com/pingcap/tidb/pkg/disttask/framework/scheduler/exitScheduler", "return()"))
@@ -162,3 +257,360 @@ func TestManagerSchedulerNotAllocateSlots(t *testing.T) {
 	mgr.schedulerWG.Wait()
 	require.NoError(t, failpoint.Disable("github.com/pingcap/tidb/pkg/disttask/framework/scheduler/exitScheduler"))
 }
+
+func TestManagerResumeTasksOnTime(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	taskMgr := mock.NewMockTaskManager(ctrl)
+	mgr := NewManager(context.Background(), taskMgr, "1")
+	now := time.Unix(1700000000, 0)
+	mgr.now = func() time.Time { return now }
+
+	resumeAt := now.Add(time.Hour)
+	tasks := []*proto.Task{
+		{TaskBase: proto.TaskBase{ID: 1, Key: "key1", State: proto.TaskStatePaused},
+			ExtraParams: proto.ExtraParams{ResumeAt: resumeAt.Unix()}},
+		// paused manually, never resumed automatically.
+		{TaskBase: proto.TaskBase{ID: 2, Key: "key2", State: proto.TaskStatePaused}},
+	}
+	taskMgr.EXPECT().GetTasksInStates(gomock.Any(), proto.TaskStatePaused).Return(tasks, nil).Times(2)
+	// not reached yet.
+	mgr.resumeTasksOnTime()
+	now = resumeAt.Add(-time.Second)
+	mgr.resumeTasksOnTime()
+	require.True(t, ctrl.Satisfied())
+
+	// advance the clock past the resume time.
+	now = resumeAt.Add(time.Second)
+	taskMgr.EXPECT().GetTasksInStates(gomock.Any(), proto.TaskStatePaused).Return(tasks, nil)
+	taskMgr.EXPECT().ResumeTask(gomock.Any(), "key1").Return(true, nil)
+	mgr.resumeTasksOnTime()
+	require.True(t, ctrl.Satisfied())
+}
+
+type deferredTaskManager struct {
+	*mock.MockTaskManager
+	deferredTasks map[int64]time.Time
+}
+
+func (m *deferredTaskManager) GetDeferredTasks(context.Context) (map[int64]time.Time, error) {
+	return m.deferredTasks, nil
+}
+
+func TestManagerDeferredTask(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	now := time.Unix(1700000000, 0)
+	startAfter := now.Add(time.Hour)
+	taskMgr := &deferredTaskManager{
+		MockTaskManager: mock.NewMockTaskManager(ctrl),
+		deferredTasks:   map[int64]time.Time{1: startAfter},
+	}
+	taskMgr.EXPECT().GetUsedSlotsOnNodes(gomock.Any()).Return(nil, nil).AnyTimes()
+	mgr := NewManager(context.Background(), taskMgr, "1")
+	mgr.now = func() time.Time { return now }
+	mgr.slotMgr.updateCapacity(16)
+	mgr.nodeMgr.managedNodes.Store(&[]string{":4000"})
+
+	var scheduled atomic.Bool
+	RegisterSchedulerFactory(proto.TaskTypeExample,
+		func(ctx context.Context, task *proto.Task, param Param) Scheduler {
+			mockScheduler := mock.NewMockScheduler(ctrl)
+			mockScheduler.EXPECT().GetTask().Return(task).AnyTimes()
+			mockScheduler.EXPECT().Init().Return(nil)
+			mockScheduler.EXPECT().ScheduleTask().Do(func() {
+				scheduled.Store(true)
+			})
+			mockScheduler.EXPECT().Close()
+			return mockScheduler
+		})
+	t.Cleanup(ClearSchedulerFactory)
+
+	deferredTask := &proto.TaskBase{ID: 1, Key: "key1", Type: proto.TaskTypeExample,
+		State: proto.TaskStatePending, Concurrency: 1}
+	tasks := []*proto.TaskBase{
+		deferredTask,
+		{ID: 2, Key: "key2", Type: proto.TaskTypeExample, State: proto.TaskStatePending, Concurrency: 1},
+	}
+	taskMgr.EXPECT().GetTopUnfinishedTasks(gomock.Any()).Return(tasks, nil).AnyTimes()
+	getSchedulableTaskIDs := func() []int64 {
+		schedulableTasks, err := mgr.getSchedulableTasks()
+		require.NoError(t, err)
+		ids := make([]int64, 0, len(schedulableTasks))
+		for _, task := range schedulableTasks {
+			ids = append(ids, task.ID)
+		}
+		return ids
+	}
+
+	// the deferred task stays pending until the clock passes startAfter.
+	require.Equal(t, []int64{2}, getSchedulableTaskIDs())
+	now = startAfter.Add(-time.Second)
+	require.Equal(t, []int64{2}, getSchedulableTaskIDs())
+
+	now = startAfter.Add(time.Second)
+	require.Equal(t, []int64{1, 2}, getSchedulableTaskIDs())
+	taskMgr.EXPECT().GetTaskByID(gomock.Any(), int64(1)).Return(&proto.Task{TaskBase: *deferredTask}, nil)
+	require.NoError(t, mgr.startSchedulers([]*proto.TaskBase{deferredTask}))
+	<-mgr.finishCh
+	mgr.schedulerWG.Wait()
+	require.True(t, scheduled.Load())
+}
+
+func TestManagerTaskTypeServers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	var pinnedType proto.TaskType = "pinned"
+	factory := func(ctx context.Context, task *proto.Task, param Param) Scheduler {
+		return NewBaseScheduler(ctx, task, param)
+	}
+	RegisterSchedulerFactory(proto.TaskTypeExample, factory)
+	RegisterSchedulerFactory(pinnedType, factory)
+	t.Cleanup(ClearSchedulerFactory)
+	SetTaskTypeServers(pinnedType, "s1")
+	t.Cleanup(func() {
+		SetTaskTypeServers(pinnedType)
+	})
+
+	tasks := []*proto.TaskBase{
+		{ID: 1, Key: "key1", Type: pinnedType, State: proto.TaskStatePending},
+		{ID: 2, Key: "key2", Type: proto.TaskTypeExample, State: proto.TaskStatePending},
+	}
+	getSchedulableTaskIDs := func(serverID string) []int64 {
+		taskMgr := mock.NewMockTaskManager(ctrl)
+		taskMgr.EXPECT().GetTopUnfinishedTasks(gomock.Any()).Return(tasks, nil)
+		mgr := NewManager(context.Background(), taskMgr, serverID)
+		schedulableTasks, err := mgr.getSchedulableTasks()
+		require.NoError(t, err)
+		ids := make([]int64, 0, len(schedulableTasks))
+		for _, task := range schedulableTasks {
+			ids = append(ids, task.ID)
+		}
+		return ids
+	}
+	// only s1 drives tasks of the pinned type, tasks of other types are not affected.
+	require.Equal(t, []int64{1, 2}, getSchedulableTaskIDs("s1"))
+	require.Equal(t, []int64{2}, getSchedulableTaskIDs("s2"))
+
+	// remove the pinning.
+	SetTaskTypeServers(pinnedType)
+	require.Equal(t, []int64{1, 2}, getSchedulableTaskIDs("s2"))
+}
+
+type pokedTaskManager struct {
+	*mock.MockTaskManager
+	pokedTasks []int64
+}
+
+func (m *pokedTaskManager) TakePokedTasks(context.Context) ([]int64, error) {
+	taskIDs := m.pokedTasks
+	m.pokedTasks = nil
+	return taskIDs, nil
+}
+
+func TestManagerPokeTask(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	taskMgr := &pokedTaskManager{MockTaskManager: mock.NewMockTaskManager(ctrl)}
+	mgr := NewManager(context.Background(), taskMgr, "1")
+	task := &proto.Task{
+		TaskBase: proto.TaskBase{ID: 1, Key: "key1", Type: proto.TaskTypeExample,
+			State: proto.TaskStateRunning, Step: proto.StepOne},
+		Meta: []byte("stale"),
+	}
+	sch := NewBaseScheduler(context.Background(), task, Param{taskMgr: taskMgr})
+	mgr.addScheduler(task.ID, sch)
+	isWoken := func() bool {
+		select {
+		case <-sch.pokeCh:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// not poked, state/step not changed, the task is not reloaded.
+	mgr.pokeTasks()
+	require.False(t, isWoken())
+	taskMgr.EXPECT().GetTaskBaseByID(gomock.Any(), task.ID).Return(&task.TaskBase, nil)
+	require.NoError(t, sch.refreshTaskIfNeeded())
+	require.True(t, ctrl.Satisfied())
+
+	// poked tasks without scheduler are skipped, the scheduler of the poked
+	// task is woken up and reloads the whole task on next loop.
+	taskMgr.pokedTasks = []int64{2, task.ID}
+	mgr.pokeTasks()
+	require.True(t, isWoken())
+	require.Empty(t, taskMgr.pokedTasks)
+	newTask := *task
+	newTask.Meta = []byte("fresh")
+	taskMgr.EXPECT().GetTaskBaseByID(gomock.Any(), task.ID).Return(&task.TaskBase, nil)
+	taskMgr.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(&newTask, nil)
+	require.NoError(t, sch.refreshTaskIfNeeded())
+	require.Equal(t, []byte("fresh"), sch.GetTask().Meta)
+	require.True(t, ctrl.Satisfied())
+
+	// the poke is kept if the reload fails.
+	sch.Poke()
+	require.True(t, isWoken())
+	taskMgr.EXPECT().GetTaskBaseByID(gomock.Any(), task.ID).Return(nil, errors.New("some err"))
+	require.ErrorContains(t, sch.refreshTaskIfNeeded(), "some err")
+	taskMgr.EXPECT().GetTaskBaseByID(gomock.Any(), task.ID).Return(&task.TaskBase, nil)
+	taskMgr.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(&newTask, nil)
+	require.NoError(t, sch.refreshTaskIfNeeded())
+	require.True(t, ctrl.Satisfied())
+
+	// the poke is consumed.
+	taskMgr.EXPECT().GetTaskBaseByID(gomock.Any(), task.ID).Return(&task.TaskBase, nil)
+	require.NoError(t, sch.refreshTaskIfNeeded())
+	require.True(t, ctrl.Satisfied())
+}
+
+func TestManagerMaxConcurrentTask(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	taskMgr := mock.NewMockTaskManager(ctrl)
+	taskMgr.EXPECT().GetUsedSlotsOnNodes(gomock.Any()).Return(nil, nil).AnyTimes()
+	mgr := NewManager(context.Background(), taskMgr, "1")
+	mgr.slotMgr.updateCapacity(16)
+	mgr.nodeMgr.managedNodes.Store(&[]string{":4000"})
+	mgr.SetMaxConcurrentTask(2)
+
+	var running, maxRunning atomic.Int32
+	finishChs := make(map[int64]chan struct{}, 5)
+	tasks := make([]*proto.TaskBase, 0, 5)
+	for i := int64(1); i <= 5; i++ {
+		task := &proto.TaskBase{ID: i, Concurrency: 1, Type: proto.TaskTypeExample, State: proto.TaskStatePending}
+		tasks = append(tasks, task)
+		finishChs[i] = make(chan struct{})
+		taskMgr.EXPECT().GetTaskByID(gomock.Any(), i).Return(&proto.Task{TaskBase: *task}, nil)
+	}
+	RegisterSchedulerFactory(proto.TaskTypeExample,
+		func(ctx context.Context, task *proto.Task, param Param) Scheduler {
+			mockScheduler := mock.NewMockScheduler(ctrl)
+			mockScheduler.EXPECT().GetTask().Return(task).AnyTimes()
+			mockScheduler.EXPECT().Init().Return(nil)
+			mockScheduler.EXPECT().ScheduleTask().Do(func() {
+				cnt := running.Add(1)
+				for {
+					old := maxRunning.Load()
+					if cnt <= old || maxRunning.CompareAndSwap(old, cnt) {
+						break
+					}
+				}
+				<-finishChs[task.ID]
+				running.Add(-1)
+			})
+			mockScheduler.EXPECT().Close()
+			return mockScheduler
+		})
+	t.Cleanup(ClearSchedulerFactory)
+
+	started := make(map[int64]struct{}, len(tasks))
+	startPendingTasks := func() {
+		pendingTasks := make([]*proto.TaskBase, 0, len(tasks))
+		for _, task := range tasks {
+			if _, ok := started[task.ID]; !ok {
+				pendingTasks = append(pendingTasks, task)
+			}
+		}
+		require.NoError(t, mgr.startSchedulers(pendingTasks))
+		for _, task := range pendingTasks {
+			if mgr.hasScheduler(task.ID) {
+				started[task.ID] = struct{}{}
+			}
+		}
+		require.LessOrEqual(t, mgr.getSchedulerCount(), 2)
+	}
+
+	startPendingTasks()
+	require.Len(t, started, 2)
+	for i := int64(1); i <= 5; i++ {
+		close(finishChs[i])
+		<-mgr.finishCh
+		require.Eventually(t, func() bool {
+			return !mgr.hasScheduler(i)
+		}, 5*time.Second, 10*time.Millisecond)
+		startPendingTasks()
+	}
+	mgr.schedulerWG.Wait()
+	require.Len(t, started, 5)
+	require.EqualValues(t, 2, maxRunning.Load())
+
+	// out of range value falls back to the default.
+	mgr.SetMaxConcurrentTask(0)
+	require.Equal(t, proto.MaxConcurrentTask, mgr.getMaxConcurrentTask())
+	mgr.SetMaxConcurrentTask(proto.MaxConcurrentTask + 1)
+	require.Equal(t, proto.MaxConcurrentTask, mgr.getMaxConcurrentTask())
+}
+
+type flaggedTaskSelector struct {
+	flaggedKey string
+}
+
+func (s *flaggedTaskSelector) SelectTask(tasks []*proto.TaskBase) int {
+	for i, task := range tasks {
+		if task.Key == s.flaggedKey {
+			return i
+		}
+	}
+	return 0
+}
+
+func TestManagerTaskSelector(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	taskMgr := mock.NewMockTaskManager(ctrl)
+	taskMgr.EXPECT().GetUsedSlotsOnNodes(gomock.Any()).Return(nil, nil).AnyTimes()
+	mgr := NewManager(context.Background(), taskMgr, "1")
+	mgr.slotMgr.updateCapacity(16)
+	mgr.nodeMgr.managedNodes.Store(&[]string{":4000"})
+	mgr.SetMaxConcurrentTask(1)
+
+	finishCh := make(chan struct{})
+	var startedIDs []int64
+	RegisterSchedulerFactory(proto.TaskTypeExample,
+		func(ctx context.Context, task *proto.Task, param Param) Scheduler {
+			startedIDs = append(startedIDs, task.ID)
+			mockScheduler := mock.NewMockScheduler(ctrl)
+			mockScheduler.EXPECT().GetTask().Return(task).AnyTimes()
+			mockScheduler.EXPECT().Init().Return(nil)
+			mockScheduler.EXPECT().ScheduleTask().Do(func() {
+				<-finishCh
+			})
+			mockScheduler.EXPECT().Close()
+			return mockScheduler
+		})
+	t.Cleanup(ClearSchedulerFactory)
+	tasks := make([]*proto.TaskBase, 0, 3)
+	for i := int64(1); i <= 3; i++ {
+		tasks = append(tasks, &proto.TaskBase{ID: i, Key: fmt.Sprintf("key%d", i),
+			Concurrency: 1, Type: proto.TaskTypeExample, State: proto.TaskStatePending})
+	}
+	startAndWait := func(expectedID int64) {
+		taskMgr.EXPECT().GetTaskByID(gomock.Any(), expectedID).Return(&proto.Task{TaskBase: *tasks[expectedID-1]}, nil)
+		require.NoError(t, mgr.startSchedulers(tasks))
+		require.True(t, mgr.hasScheduler(expectedID))
+		require.Equal(t, 1, mgr.getSchedulerCount())
+		finishCh <- struct{}{}
+		<-mgr.finishCh
+		require.Eventually(t, func() bool {
+			return !mgr.hasScheduler(expectedID)
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// the flagged task is started first.
+	mgr.SetTaskSelector(&flaggedTaskSelector{flaggedKey: "key3"})
+	startAndWait(3)
+	// no flagged task, tasks are started in task order.
+	mgr.SetTaskSelector(&flaggedTaskSelector{flaggedKey: "key4"})
+	startAndWait(1)
+	// FIFO by default.
+	mgr.SetTaskSelector(nil)
+	require.Equal(t, FIFOTaskSelector{}, mgr.getTaskSelector())
+	startAndWait(1)
+	mgr.schedulerWG.Wait()
+	require.Equal(t, []int64{3, 1, 1}, startedIDs)
+}
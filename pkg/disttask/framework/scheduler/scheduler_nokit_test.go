@@ -30,6 +30,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/tikv/client-go/v2/util"
 	"go.uber.org/mock/gomock"
+	"golang.org/x/time/rate"
 )
 
 func createScheduler(task *proto.Task, allocatedSlots bool, taskMgr TaskManager, ctrl *gomock.Controller) *BaseScheduler {
@@ -144,6 +145,252 @@ func TestSchedulerOnNextStage(t *testing.T) {
 	require.True(t, ctrl.Satisfied())
 }
 
+func TestSchedulerFailTaskWithoutExecutors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	taskMgr := mock.NewMockTaskManager(ctrl)
+	schExt := schmock.NewMockExtension(ctrl)
+	task := proto.Task{
+		TaskBase: proto.TaskBase{
+			ID:    1,
+			State: proto.TaskStateInitializing,
+			Step:  proto.StepInit,
+		},
+	}
+	cloneTask := task
+	sch := createScheduler(&cloneTask, true, taskMgr, ctrl)
+	sch.Extension = schExt
+
+	bak := NoExecutorGracePeriod
+	t.Cleanup(func() {
+		NoExecutorGracePeriod = bak
+	})
+	NoExecutorGracePeriod = 100 * time.Millisecond
+	// keep waiting within the grace period.
+	schExt.EXPECT().GetNextStep(gomock.Any()).Return(proto.StepOne)
+	schExt.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return(nil, nil)
+	require.ErrorContains(t, sch.Switch2NextStep(), "no available TiDB node to dispatch subtasks")
+	require.True(t, ctrl.Satisfied())
+	require.Equal(t, proto.TaskStateInitializing, sch.GetTask().State)
+	// fail the task after the grace period.
+	time.Sleep(NoExecutorGracePeriod)
+	schExt.EXPECT().GetNextStep(gomock.Any()).Return(proto.StepOne)
+	schExt.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return(nil, nil)
+	taskMgr.EXPECT().FailTask(gomock.Any(), task.ID, proto.TaskStateInitializing, ErrNoExecutorsAvailable).Return(nil)
+	require.NoError(t, sch.Switch2NextStep())
+	require.True(t, ctrl.Satisfied())
+	require.Equal(t, proto.TaskStateFailed, sch.GetTask().State)
+	require.ErrorIs(t, sch.GetTask().Error, ErrNoExecutorsAvailable)
+	require.ErrorContains(t, sch.GetTask().Error, "no executors available")
+}
+
+type resourceCheckExtension struct {
+	*schmock.MockExtension
+}
+
+// CanRun implements SubtaskResourceChecker.CanRun.
+func (*resourceCheckExtension) CanRun(subtask *proto.Subtask, res *proto.NodeResource) bool {
+	if string(subtask.Meta) == "memory-heavy" {
+		return res.MemAvailable >= 8<<30
+	}
+	return true
+}
+
+type fakeNodeResourceReporter map[string]*proto.NodeResource
+
+// GetNodeResources implements NodeResourceReporter.GetNodeResources.
+func (r fakeNodeResourceReporter) GetNodeResources(context.Context, []string) (map[string]*proto.NodeResource, error) {
+	return r, nil
+}
+
+func TestSchedulerPlaceSubtasksByResource(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	taskMgr := mock.NewMockTaskManager(ctrl)
+	schExt := schmock.NewMockExtension(ctrl)
+	task := proto.Task{
+		TaskBase: proto.TaskBase{
+			ID:          1,
+			State:       proto.TaskStatePending,
+			Step:        proto.StepInit,
+			Concurrency: 1,
+		},
+	}
+	sch := createScheduler(&task, true, taskMgr, ctrl)
+	sch.Extension = &resourceCheckExtension{MockExtension: schExt}
+	SetNodeResourceReporter(fakeNodeResourceReporter{
+		":4000": {CPUCount: 8, MemTotal: 16 << 30, MemAvailable: 1 << 30},
+		":4001": {CPUCount: 8, MemTotal: 16 << 30, MemAvailable: 12 << 30},
+	})
+	t.Cleanup(func() {
+		SetNodeResourceReporter(nil)
+	})
+
+	// the memory-heavy subtask is scheduled to :4000 in round-robin, but it
+	// doesn't have enough memory.
+	schExt.EXPECT().GetNextStep(gomock.Any()).Return(proto.StepOne)
+	schExt.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return([]string{":4000", ":4001"}, nil)
+	schExt.EXPECT().OnNextSubtasksBatch(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return([][]byte{[]byte("memory-heavy"), []byte("light"), []byte("light")}, nil)
+	taskMgr.EXPECT().GetUsedSlotsOnNodes(gomock.Any()).Return(nil, nil)
+	var subtasks []*proto.Subtask
+	taskMgr.EXPECT().SwitchTaskStep(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ *proto.Task, _ proto.TaskState, _ proto.Step, sts []*proto.Subtask) error {
+			subtasks = sts
+			return nil
+		})
+	require.NoError(t, sch.Switch2NextStep())
+	require.True(t, ctrl.Satisfied())
+	require.Len(t, subtasks, 3)
+	require.Equal(t, ":4001", subtasks[0].ExecID)
+	require.Equal(t, ":4001", subtasks[1].ExecID)
+	require.Equal(t, ":4000", subtasks[2].ExecID)
+}
+
+type localityHintExtension struct {
+	*schmock.MockExtension
+}
+
+// GetSubtaskLocality implements SubtaskLocalityHinter.GetSubtaskLocality.
+func (*localityHintExtension) GetSubtaskLocality(_ *proto.Task, _ proto.Step, meta []byte) (storeIDs, regionIDs []uint64) {
+	var id uint64
+	if _, err := fmt.Sscanf(string(meta), "store-%d", &id); err == nil {
+		return []uint64{id}, nil
+	}
+	if _, err := fmt.Sscanf(string(meta), "region-%d", &id); err == nil {
+		return nil, []uint64{id}
+	}
+	return nil, nil
+}
+
+type fakeLocalityReporter struct {
+	nodeStores   map[string][]uint64
+	regionStores map[uint64][]uint64
+}
+
+// GetNodeStores implements LocalityReporter.GetNodeStores.
+func (r *fakeLocalityReporter) GetNodeStores(context.Context, []string) (map[string][]uint64, error) {
+	return r.nodeStores, nil
+}
+
+// GetRegionStores implements LocalityReporter.GetRegionStores.
+func (r *fakeLocalityReporter) GetRegionStores(context.Context, []uint64) (map[uint64][]uint64, error) {
+	return r.regionStores, nil
+}
+
+func TestSchedulerPlaceSubtasksByLocality(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	taskMgr := mock.NewMockTaskManager(ctrl)
+	schExt := schmock.NewMockExtension(ctrl)
+	task := proto.Task{
+		TaskBase: proto.TaskBase{
+			ID:          1,
+			State:       proto.TaskStatePending,
+			Step:        proto.StepInit,
+			Concurrency: 1,
+		},
+	}
+	sch := createScheduler(&task, true, taskMgr, ctrl)
+	sch.Extension = &localityHintExtension{MockExtension: schExt}
+	SetLocalityReporter(&fakeLocalityReporter{
+		nodeStores: map[string][]uint64{
+			":4000": {1},
+			":4001": {2},
+			":4002": {3},
+		},
+		regionStores: map[uint64][]uint64{
+			10: {3, 4},
+		},
+	})
+	t.Cleanup(func() {
+		SetLocalityReporter(nil)
+	})
+
+	// in round-robin, subtasks are scheduled to :4000, :4001, :4002, :4000, :4001.
+	schExt.EXPECT().GetNextStep(gomock.Any()).Return(proto.StepOne)
+	schExt.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return([]string{":4000", ":4001", ":4002"}, nil)
+	schExt.EXPECT().OnNextSubtasksBatch(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return([][]byte{[]byte("store-2"), []byte("store-3"), []byte("store-1"), []byte("region-10"), []byte("none")}, nil)
+	taskMgr.EXPECT().GetUsedSlotsOnNodes(gomock.Any()).Return(nil, nil)
+	var subtasks []*proto.Subtask
+	taskMgr.EXPECT().SwitchTaskStep(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ *proto.Task, _ proto.TaskState, _ proto.Step, sts []*proto.Subtask) error {
+			subtasks = sts
+			return nil
+		})
+	require.NoError(t, sch.Switch2NextStep())
+	require.True(t, ctrl.Satisfied())
+	require.Len(t, subtasks, 5)
+	require.Equal(t, []uint64{2}, subtasks[0].TargetStoreIDs)
+	require.Equal(t, []uint64{10}, subtasks[3].TargetRegionIDs)
+	execIDs := make([]string, 0, len(subtasks))
+	for _, subtask := range subtasks {
+		execIDs = append(execIDs, subtask.ExecID)
+	}
+	// subtasks are placed on the node co-located with their data, the one
+	// without hint is kept on the scheduled node.
+	require.Equal(t, []string{":4001", ":4002", ":4000", ":4002", ":4001"}, execIDs)
+}
+
+type limitedTaskManager struct {
+	*mock.MockTaskManager
+	limiter  *rate.Limiter
+	subtasks []*proto.Subtask
+}
+
+// SwitchTaskStepWithLimiter implements LimitedTaskStepSwitcher.SwitchTaskStepWithLimiter.
+func (m *limitedTaskManager) SwitchTaskStepWithLimiter(_ context.Context, _ *proto.Task, _ proto.TaskState,
+	_ proto.Step, subtasks []*proto.Subtask, limiter *rate.Limiter) error {
+	m.limiter, m.subtasks = limiter, subtasks
+	return nil
+}
+
+func TestSchedulerSubtaskCreationLimiter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	taskMgr := &limitedTaskManager{MockTaskManager: mock.NewMockTaskManager(ctrl)}
+	schExt := schmock.NewMockExtension(ctrl)
+	task := proto.Task{
+		TaskBase: proto.TaskBase{
+			ID:          1,
+			State:       proto.TaskStatePending,
+			Step:        proto.StepInit,
+			Concurrency: 1,
+		},
+	}
+	sch := createScheduler(&task, true, taskMgr, ctrl)
+	sch.Extension = schExt
+	limiter := rate.NewLimiter(rate.Every(time.Second), 100)
+	SetSubtaskCreationLimiter(2, limiter)
+	t.Cleanup(func() {
+		SetSubtaskCreationLimiter(0, nil)
+	})
+	switchStep := func(subtaskCnt int) {
+		metas := make([][]byte, 0, subtaskCnt)
+		for i := 0; i < subtaskCnt; i++ {
+			metas = append(metas, []byte(fmt.Sprintf("%d", i)))
+		}
+		schExt.EXPECT().GetNextStep(gomock.Any()).Return(proto.StepOne)
+		schExt.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return([]string{":4000"}, nil)
+		schExt.EXPECT().OnNextSubtasksBatch(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(metas, nil)
+		taskMgr.EXPECT().GetUsedSlotsOnNodes(gomock.Any()).Return(nil, nil)
+		require.NoError(t, sch.Switch2NextStep())
+		require.True(t, ctrl.Satisfied())
+	}
+
+	// subtasks not exceeding the threshold are created without limit.
+	taskMgr.EXPECT().SwitchTaskStep(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+	switchStep(2)
+	require.Nil(t, taskMgr.limiter)
+
+	// subtasks exceeding the threshold are created with the limiter.
+	switchStep(3)
+	require.Same(t, limiter, taskMgr.limiter)
+	require.Len(t, taskMgr.subtasks, 3)
+}
+
 func TestGetEligibleNodes(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -169,6 +416,35 @@ func TestGetEligibleNodes(t *testing.T) {
 	require.True(t, ctrl.Satisfied())
 }
 
+func TestGetEligibleNodesWithAllowlist(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := context.Background()
+	mockSch := mock.NewMockScheduler(ctrl)
+	task := &proto.Task{TaskBase: proto.TaskBase{ID: 1}}
+	task.ExtraParams.NodeAllowlist = []string{":4001", ":4002"}
+	mockSch.EXPECT().GetTask().Return(task).AnyTimes()
+
+	mockSch.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return(nil, nil)
+	nodes, err := getEligibleNodes(ctx, mockSch, []string{":4000", ":4001"})
+	require.NoError(t, err)
+	require.Equal(t, []string{":4001"}, nodes)
+	require.True(t, ctrl.Satisfied())
+
+	mockSch.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return([]string{":4000", ":4002"}, nil)
+	nodes, err = getEligibleNodes(ctx, mockSch, []string{":4000", ":4001"})
+	require.NoError(t, err)
+	require.Equal(t, []string{":4002"}, nodes)
+	require.True(t, ctrl.Satisfied())
+
+	// none of the allowlisted nodes is alive.
+	mockSch.EXPECT().GetEligibleInstances(gomock.Any(), gomock.Any()).Return(nil, nil)
+	nodes, err = getEligibleNodes(ctx, mockSch, []string{":4000"})
+	require.NoError(t, err)
+	require.Empty(t, nodes)
+	require.True(t, ctrl.Satisfied())
+}
+
 func TestSchedulerIsStepSucceed(t *testing.T) {
 	s := &BaseScheduler{}
 	require.True(t, s.isStepSucceed(nil))
@@ -440,16 +716,28 @@ func TestSchedulerMaintainTaskFields(t *testing.T) {
 		// revert task back
 		scheduler.task.Store(&schTask)
 
+		// retryable plan error, but the task is not retried automatically.
+		noRetryTask := schTask
+		noRetryTask.ExtraParams.NoAutoRetry = true
+		scheduler.task.Store(&noRetryTask)
+		schExt.EXPECT().OnNextSubtasksBatch(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, errors.New("plan err"))
+		taskMgr.EXPECT().RevertTask(gomock.Any(), task.ID, gomock.Any(), gomock.Any()).Return(nil)
+		require.NoError(t, scheduler.switch2NextStep())
+		require.Equal(t, proto.TaskStateReverting, scheduler.GetTask().State)
+		require.True(t, ctrl.Satisfied())
+		scheduler.task.Store(&schTask)
+
 		// switch to next step, but update failed
 		schExt.EXPECT().OnNextSubtasksBatch(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			Return(nil, nil)
+			Return([][]byte{[]byte("meta")}, nil)
 		taskMgr.EXPECT().GetUsedSlotsOnNodes(gomock.Any()).Return(nil, fmt.Errorf("update err"))
 		require.ErrorContains(t, scheduler.switch2NextStep(), "update err")
 		require.Equal(t, *scheduler.GetTask(), task)
 		require.True(t, ctrl.Satisfied())
 		// switch to next step successfully
 		schExt.EXPECT().OnNextSubtasksBatch(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
-			Return(nil, nil)
+			Return([][]byte{[]byte("meta")}, nil)
 		taskMgr.EXPECT().GetUsedSlotsOnNodes(gomock.Any()).Return(nil, nil)
 		taskMgr.EXPECT().SwitchTaskStep(gomock.Any(), gomock.Any(), proto.TaskStateRunning, proto.StepOne, gomock.Any()).Return(nil)
 		require.NoError(t, scheduler.switch2NextStep())
@@ -471,6 +759,22 @@ func TestSchedulerMaintainTaskFields(t *testing.T) {
 		tmpTask.State = proto.TaskStateSucceed
 		tmpTask.Step = proto.StepDone
 		require.Equal(t, *scheduler.GetTask(), tmpTask)
+		require.True(t, ctrl.Satisfied())
+
+		// no subtask generated, skip the step and the task succeeds directly.
+		scheduler.task.Store(&schTask)
+		schExt.EXPECT().OnNextSubtasksBatch(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, nil)
+		taskMgr.EXPECT().GetUsedSlotsOnNodes(gomock.Any()).Return(nil, nil)
+		taskMgr.EXPECT().SwitchTaskStep(gomock.Any(), gomock.Any(), proto.TaskStateRunning, proto.StepOne, gomock.Any()).Return(nil)
+		schExt.EXPECT().OnDone(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+		taskMgr.EXPECT().SucceedTask(gomock.Any(), task.ID).Return(nil)
+		require.NoError(t, scheduler.switch2NextStep())
+		tmpTask = task
+		tmpTask.State = proto.TaskStateSucceed
+		tmpTask.Step = proto.StepDone
+		require.Equal(t, *scheduler.GetTask(), tmpTask)
+		require.True(t, ctrl.Satisfied())
 	})
 
 	t.Run("test revertTask", func(t *testing.T) {
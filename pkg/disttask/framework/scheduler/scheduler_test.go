@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"slices"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -128,18 +130,17 @@ func TestTaskFailInManager(t *testing.T) {
 	schManager.Start()
 	defer schManager.Stop()
 
-	// unknown task type
-	taskID, err := mgr.CreateTask(ctx, "test", "test-type", 1, nil)
+	// unsupported task type, the task is flagged and skipped.
+	unsupportedTaskID, err := mgr.CreateTask(ctx, "test", "test-type", 1, nil)
 	require.NoError(t, err)
 	require.Eventually(t, func() bool {
-		task, err := mgr.GetTaskByID(ctx, taskID)
+		task, err := mgr.GetTaskByID(ctx, unsupportedTaskID)
 		require.NoError(t, err)
-		return task.State == proto.TaskStateFailed &&
-			strings.Contains(task.Error.Error(), "unknown task type")
+		return task.ExtraParams.StatusMessage == scheduler.UnsupportedTaskTypeStatus
 	}, time.Second*10, time.Millisecond*300)
 
-	// scheduler init error
-	taskID, err = mgr.CreateTask(ctx, "test2", proto.TaskTypeExample, 1, nil)
+	// scheduler init error, other tasks are still driven.
+	taskID, err := mgr.CreateTask(ctx, "test2", proto.TaskTypeExample, 1, nil)
 	require.NoError(t, err)
 	require.Eventually(t, func() bool {
 		task, err := mgr.GetTaskByID(ctx, taskID)
@@ -147,6 +148,13 @@ func TestTaskFailInManager(t *testing.T) {
 		return task.State == proto.TaskStateFailed &&
 			strings.Contains(task.Error.Error(), "mock scheduler init error")
 	}, time.Second*10, time.Millisecond*300)
+	task, err := mgr.GetTaskByID(ctx, unsupportedTaskID)
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskStatePending, task.State)
+	require.NoError(t, task.Error)
+	desc, err := mgr.DescribeTask(ctx, unsupportedTaskID)
+	require.NoError(t, err)
+	require.Contains(t, desc, "status message: "+scheduler.UnsupportedTaskTypeStatus)
 }
 
 func checkSchedule(t *testing.T, taskCnt int, isSucc, isCancel, isSubtaskCancel, isPauseAndResume bool) {
@@ -375,12 +383,19 @@ func TestVerifyTaskStateTransform(t *testing.T) {
 		{proto.TaskStateRunning, proto.TaskStateRunning, true},
 		{proto.TaskStatePending, proto.TaskStateRunning, true},
 		{proto.TaskStatePending, proto.TaskStateReverting, false},
+		{proto.TaskStatePending, proto.TaskStateInitializing, true},
+		{proto.TaskStateInitializing, proto.TaskStateRunning, true},
+		{proto.TaskStateInitializing, proto.TaskStateReverting, true},
+		{proto.TaskStateInitializing, proto.TaskStatePending, false},
 		{proto.TaskStateRunning, proto.TaskStateReverting, true},
 		{proto.TaskStateReverting, proto.TaskStateReverted, true},
 		{proto.TaskStateReverting, proto.TaskStateSucceed, false},
 		{proto.TaskStateRunning, proto.TaskStatePausing, true},
 		{proto.TaskStateRunning, proto.TaskStateResuming, false},
 		{proto.TaskStateCancelling, proto.TaskStateRunning, false},
+		{proto.TaskStateRunning, proto.TaskStatePartialSuccess, true},
+		{proto.TaskStatePending, proto.TaskStatePartialSuccess, false},
+		{proto.TaskStatePartialSuccess, proto.TaskStateRunning, false},
 	}
 	for _, tc := range testCases {
 		require.Equal(t, tc.expect, scheduler.VerifyTaskStateTransform(tc.oldState, tc.newState))
@@ -498,3 +513,80 @@ func TestManagerScheduleLoop(t *testing.T) {
 		return err == nil && len(taskKeys) == 0
 	}, time.Second*10, time.Millisecond*100)
 }
+
+// faultInjectingTaskManager injects transient errors into some storage calls
+// of the scheduler.
+type faultInjectingTaskManager struct {
+	*storage.TaskManager
+	cntErrs     atomic.Int32
+	succeedErrs atomic.Int32
+}
+
+func (m *faultInjectingTaskManager) GetSubtaskCntGroupByStates(ctx context.Context, taskID int64, step proto.Step) (map[proto.SubtaskState]int64, error) {
+	if m.cntErrs.Add(-1) >= 0 {
+		return nil, errors.Annotate(syscall.ECONNRESET, "mock connection reset")
+	}
+	return m.TaskManager.GetSubtaskCntGroupByStates(ctx, taskID, step)
+}
+
+func (m *faultInjectingTaskManager) SucceedTask(ctx context.Context, taskID int64) error {
+	if m.succeedErrs.Add(-1) >= 0 {
+		return errors.Trace(kv.ErrTxnRetryable)
+	}
+	return m.TaskManager.SucceedTask(ctx, taskID)
+}
+
+func TestSchedulerRetryTransientStorageErr(t *testing.T) {
+	testkit.EnableFailPoint(t, "github.com/pingcap/tidb/pkg/domain/MockDisableDistTask", "return(true)")
+	store := testkit.CreateMockStore(t)
+	gtk := testkit.NewTestKit(t, store)
+	pool := pools.NewResourcePool(func() (pools.Resource, error) {
+		return gtk.Session(), nil
+	}, 1, 1, time.Second)
+	defer pool.Close()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx := util.WithInternalSourceType(context.Background(), "scheduler")
+
+	require.True(t, storage.IsTransientErr(errors.Annotate(syscall.ECONNRESET, "mock")))
+	require.True(t, storage.IsTransientErr(errors.Trace(kv.ErrTxnRetryable)))
+	require.False(t, storage.IsTransientErr(errors.New("mock error")))
+	require.False(t, storage.IsTransientErr(nil))
+
+	mgr := storage.NewTaskManager(pool)
+	storage.SetTaskManager(mgr)
+	faultMgr := &faultInjectingTaskManager{TaskManager: mgr}
+	ext := getNumberExampleSchedulerExt(ctrl)
+	sch := scheduler.NewManager(ctx, faultMgr, "host:port")
+	scheduler.RegisterSchedulerFactory(proto.TaskTypeExample,
+		func(ctx context.Context, task *proto.Task, param scheduler.Param) scheduler.Scheduler {
+			baseScheduler := scheduler.NewBaseScheduler(ctx, task, param)
+			baseScheduler.Extension = ext
+			return baseScheduler
+		})
+	require.NoError(t, mgr.InitMeta(ctx, ":4000", "background"))
+	sch.Start()
+	defer sch.Stop()
+
+	taskID, err := mgr.CreateTask(ctx, "key1", proto.TaskTypeExample, 0, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		cntByStates, err := mgr.GetSubtaskCntGroupByStates(ctx, taskID, proto.StepOne)
+		require.NoError(t, err)
+		return int64(subtaskCnt) == cntByStates[proto.SubtaskStatePending]
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// inject transient errors when checking the subtasks and finishing the task.
+	faultMgr.cntErrs.Store(2)
+	faultMgr.succeedErrs.Store(2)
+	for i := 1; i <= subtaskCnt; i++ {
+		require.NoError(t, mgr.UpdateSubtaskStateAndError(ctx, ":4000", int64(i), proto.SubtaskStateSucceed, nil))
+	}
+	require.Eventually(t, func() bool {
+		task, err := mgr.GetTaskByIDWithHistory(ctx, taskID)
+		require.NoError(t, err)
+		return task.State == proto.TaskStateSucceed
+	}, 10*time.Second, 100*time.Millisecond)
+	require.LessOrEqual(t, faultMgr.cntErrs.Load(), int32(0))
+	require.LessOrEqual(t, faultMgr.succeedErrs.Load(), int32(0))
+}
@@ -0,0 +1,52 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"slices"
+
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/util/syncutil"
+)
+
+var taskTypeServers = struct {
+	syncutil.RWMutex
+	m map[proto.TaskType][]string
+}{
+	m: make(map[proto.TaskType][]string),
+}
+
+// SetTaskTypeServers pins the driving of tasks of the type to the scheduler
+// managers on serverIDs for operational isolation, scheduler managers on other
+// servers don't start schedulers for them, so such tasks are kept pending until
+// one of serverIDs drives them. empty serverIDs removes the pinning.
+func SetTaskTypeServers(tp proto.TaskType, serverIDs ...string) {
+	taskTypeServers.Lock()
+	defer taskTypeServers.Unlock()
+	if len(serverIDs) == 0 {
+		delete(taskTypeServers.m, tp)
+		return
+	}
+	taskTypeServers.m[tp] = slices.Clone(serverIDs)
+}
+
+// canDriveTaskType returns whether the scheduler manager on serverID can drive
+// tasks of the type, see SetTaskTypeServers.
+func canDriveTaskType(tp proto.TaskType, serverID string) bool {
+	taskTypeServers.RLock()
+	defer taskTypeServers.RUnlock()
+	serverIDs, ok := taskTypeServers.m[tp]
+	return !ok || slices.Contains(serverIDs, serverID)
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"bytes"
+	"math/big"
+)
+
+// splitKeyExtraBytes is the number of bytes appended to keys when interpolating
+// split points, so short keys like "a" and "b" can still be split.
+const splitKeyExtraBytes = 8
+
+// KeyRangeSize is a key range with its estimated data size, such as a region.
+type KeyRangeSize struct {
+	StartKey []byte
+	EndKey   []byte
+	Size     int64
+}
+
+// SplitKeyRange splits [start, end) into at most parts continuous ranges of
+// balanced key space, split points are interpolated between start and end.
+// an empty end means the range is unbounded.
+// it returns nil if the range is empty, and fewer ranges than parts if there
+// are not enough distinct keys between start and end, such as a single-key range.
+// Extensions can use it to generate subtasks in OnNextSubtasksBatch.
+func SplitKeyRange(start, end []byte, parts int) [][2][]byte {
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return nil
+	}
+	if parts <= 1 {
+		return [][2][]byte{{start, end}}
+	}
+
+	prefixLen := commonPrefixLen(start, end)
+	width := max(len(start), len(end)) - prefixLen + splitKeyExtraBytes
+	lower := keySuffixToInt(start[prefixLen:], width)
+	var upper *big.Int
+	if len(end) == 0 {
+		upper = new(big.Int).Lsh(big.NewInt(1), uint(width*8))
+	} else {
+		upper = keySuffixToInt(end[prefixLen:], width)
+	}
+	diff := new(big.Int).Sub(upper, lower)
+
+	res := make([][2][]byte, 0, parts)
+	rangeStart, last := start, lower
+	for i := 1; i < parts; i++ {
+		point := new(big.Int).Mul(diff, big.NewInt(int64(i)))
+		point.Quo(point, big.NewInt(int64(parts)))
+		point.Add(point, lower)
+		if point.Cmp(last) <= 0 {
+			continue
+		}
+		last = point
+		splitKey := intToKey(start[:prefixLen], point, width)
+		res = append(res, [2][]byte{rangeStart, splitKey})
+		rangeStart = splitKey
+	}
+	return append(res, [2][]byte{rangeStart, end})
+}
+
+// SplitKeyRangeBySize merges sorted and continuous ranges into at most parts
+// ranges with balanced total size. if all sizes are 0, ranges are balanced by
+// count.
+func SplitKeyRangeBySize(ranges []KeyRangeSize, parts int) [][2][]byte {
+	if len(ranges) == 0 {
+		return nil
+	}
+	parts = max(parts, 1)
+	var total int64
+	for _, r := range ranges {
+		total += r.Size
+	}
+	byCount := total == 0
+	if byCount {
+		total = int64(len(ranges))
+	}
+
+	res := make([][2][]byte, 0, min(parts, len(ranges)))
+	rangeStart := ranges[0].StartKey
+	var acc int64
+	for _, r := range ranges[:len(ranges)-1] {
+		if byCount {
+			acc++
+		} else {
+			acc += r.Size
+		}
+		cut := len(res) + 1
+		if cut < parts && acc*int64(parts) >= total*int64(cut) {
+			res = append(res, [2][]byte{rangeStart, r.EndKey})
+			rangeStart = r.EndKey
+		}
+	}
+	return append(res, [2][]byte{rangeStart, ranges[len(ranges)-1].EndKey})
+}
+
+func commonPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// keySuffixToInt pads the key suffix with 0 to width bytes, and converts it to
+// a big endian integer.
+func keySuffixToInt(suffix []byte, width int) *big.Int {
+	buf := make([]byte, width)
+	copy(buf, suffix)
+	return new(big.Int).SetBytes(buf)
+}
+
+// intToKey converts the integer back to a key, trailing zeros are trimmed, it
+// doesn't change the order between split points, see SplitKeyRange.
+func intToKey(prefix []byte, v *big.Int, width int) []byte {
+	buf := v.FillBytes(make([]byte, width))
+	buf = bytes.TrimRight(buf, "\x00")
+	key := make([]byte, 0, len(prefix)+len(buf))
+	key = append(key, prefix...)
+	return append(key, buf...)
+}
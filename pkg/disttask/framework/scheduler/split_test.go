@@ -0,0 +1,141 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func checkContinuousRanges(t *testing.T, start, end []byte, ranges [][2][]byte) {
+	t.Helper()
+	require.NotEmpty(t, ranges)
+	require.Equal(t, start, ranges[0][0])
+	require.Equal(t, end, ranges[len(ranges)-1][1])
+	for i, r := range ranges {
+		if len(r[1]) > 0 {
+			require.Less(t, bytes.Compare(r[0], r[1]), 0, "range %d", i)
+		}
+		if i > 0 {
+			require.Equal(t, ranges[i-1][1], r[0], "range %d", i)
+		}
+	}
+}
+
+func TestSplitKeyRange(t *testing.T) {
+	// empty range
+	require.Nil(t, SplitKeyRange([]byte("b"), []byte("a"), 4))
+	require.Nil(t, SplitKeyRange([]byte("a"), []byte("a"), 4))
+	// no need to split
+	require.Equal(t, [][2][]byte{{[]byte("a"), []byte("b")}}, SplitKeyRange([]byte("a"), []byte("b"), 1))
+	require.Equal(t, [][2][]byte{{[]byte("a"), []byte("b")}}, SplitKeyRange([]byte("a"), []byte("b"), 0))
+	// single-key range cannot be split.
+	require.Equal(t, [][2][]byte{{[]byte("a"), []byte("a\x00")}}, SplitKeyRange([]byte("a"), []byte("a\x00"), 4))
+
+	// balanced splits of integer keys.
+	encode := func(v uint64) []byte {
+		return binary.BigEndian.AppendUint64([]byte("t"), v)
+	}
+	start, end := encode(0), encode(1000)
+	ranges := SplitKeyRange(start, end, 4)
+	checkContinuousRanges(t, start, end, ranges)
+	require.Equal(t, [][2][]byte{
+		{encode(0), encode(250)},
+		{encode(250), encode(500)},
+		{encode(500), encode(750)},
+		{encode(750), encode(1000)},
+	}, ranges)
+	// fewer distinct keys than parts.
+	start, end = encode(0), encode(0)[:8]
+	end = append(end, 3)
+	ranges = SplitKeyRange(start, end, 10)
+	checkContinuousRanges(t, start, end, ranges)
+	require.LessOrEqual(t, len(ranges), 10)
+
+	// short keys are split too.
+	start, end = []byte("a"), []byte("b")
+	ranges = SplitKeyRange(start, end, 4)
+	checkContinuousRanges(t, start, end, ranges)
+	require.Len(t, ranges, 4)
+	require.Equal(t, []byte("a\x40"), ranges[1][0])
+	require.Equal(t, []byte("a\x80"), ranges[2][0])
+	require.Equal(t, []byte("a\xc0"), ranges[3][0])
+	// keys with different length.
+	start, end = []byte("a\x00\x01"), []byte("a\x01")
+	ranges = SplitKeyRange(start, end, 3)
+	checkContinuousRanges(t, start, end, ranges)
+	require.Len(t, ranges, 3)
+
+	// empty start and end means the whole key space.
+	ranges = SplitKeyRange(nil, nil, 4)
+	checkContinuousRanges(t, nil, nil, ranges)
+	require.Len(t, ranges, 4)
+	require.Equal(t, []byte("\x40"), ranges[1][0])
+	require.Equal(t, []byte("\x80"), ranges[2][0])
+	require.Equal(t, []byte("\xc0"), ranges[3][0])
+	// unbounded end.
+	start = []byte("\xf0")
+	ranges = SplitKeyRange(start, nil, 2)
+	checkContinuousRanges(t, start, nil, ranges)
+	require.Equal(t, []byte("\xf8"), ranges[1][0])
+}
+
+func TestSplitKeyRangeBySize(t *testing.T) {
+	require.Nil(t, SplitKeyRangeBySize(nil, 4))
+
+	ranges := []KeyRangeSize{
+		{StartKey: []byte("a"), EndKey: []byte("b"), Size: 10},
+		{StartKey: []byte("b"), EndKey: []byte("c"), Size: 10},
+		{StartKey: []byte("c"), EndKey: []byte("d"), Size: 40},
+		{StartKey: []byte("d"), EndKey: []byte("e"), Size: 20},
+		{StartKey: []byte("e"), EndKey: []byte("f"), Size: 20},
+	}
+	require.Equal(t, [][2][]byte{{[]byte("a"), []byte("f")}}, SplitKeyRangeBySize(ranges, 1))
+	require.Equal(t, [][2][]byte{{[]byte("a"), []byte("f")}}, SplitKeyRangeBySize(ranges, 0))
+	require.Equal(t, [][2][]byte{
+		{[]byte("a"), []byte("d")},
+		{[]byte("d"), []byte("f")},
+	}, SplitKeyRangeBySize(ranges, 2))
+	// ranges are not split, so the part containing the big range is larger.
+	require.Equal(t, [][2][]byte{
+		{[]byte("a"), []byte("d")},
+		{[]byte("d"), []byte("e")},
+		{[]byte("e"), []byte("f")},
+	}, SplitKeyRangeBySize(ranges, 4))
+	require.Equal(t, [][2][]byte{
+		{[]byte("a"), []byte("c")},
+		{[]byte("c"), []byte("d")},
+		{[]byte("d"), []byte("e")},
+		{[]byte("e"), []byte("f")},
+	}, SplitKeyRangeBySize(ranges, 5))
+	// at most one part for each range.
+	res := SplitKeyRangeBySize(ranges, 10)
+	checkContinuousRanges(t, []byte("a"), []byte("f"), res)
+	require.Len(t, res, 5)
+
+	// balanced by count when all sizes are 0.
+	for i := range ranges {
+		ranges[i].Size = 0
+	}
+	require.Equal(t, [][2][]byte{
+		{[]byte("a"), []byte("d")},
+		{[]byte("d"), []byte("f")},
+	}, SplitKeyRangeBySize(ranges, 2))
+	// single range
+	require.Equal(t, [][2][]byte{{[]byte("a"), []byte("b")}}, SplitKeyRangeBySize(ranges[:1], 4))
+}
@@ -22,20 +22,31 @@ import (
 func VerifyTaskStateTransform(from, to proto.TaskState) bool {
 	rules := map[proto.TaskState][]proto.TaskState{
 		proto.TaskStatePending: {
+			proto.TaskStateInitializing,
 			proto.TaskStateRunning,
 			proto.TaskStateCancelling,
 			proto.TaskStatePausing,
 			proto.TaskStateSucceed,
 			proto.TaskStateFailed,
 		},
+		proto.TaskStateInitializing: {
+			proto.TaskStateRunning,
+			proto.TaskStateReverting,
+			proto.TaskStateCancelling,
+			proto.TaskStatePausing,
+			proto.TaskStateSucceed,
+			proto.TaskStateFailed,
+		},
 		proto.TaskStateRunning: {
 			proto.TaskStateSucceed,
 			proto.TaskStateReverting,
 			proto.TaskStateFailed,
 			proto.TaskStateCancelling,
 			proto.TaskStatePausing,
+			proto.TaskStatePartialSuccess,
 		},
-		proto.TaskStateSucceed: {},
+		proto.TaskStateSucceed:        {},
+		proto.TaskStatePartialSuccess: {},
 		proto.TaskStateReverting: {
 			proto.TaskStateReverted,
 			// no revert_failed now
@@ -0,0 +1,49 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"github.com/pingcap/tidb/pkg/util/syncutil"
+	"golang.org/x/time/rate"
+)
+
+var subtaskCreationLimiter = struct {
+	syncutil.RWMutex
+	threshold int
+	limiter   *rate.Limiter
+}{}
+
+// SetSubtaskCreationLimiter sets the limiter to pace the creation of subtasks,
+// when a step creates more than threshold subtasks, they're inserted in batches
+// of limiter.Burst() subtasks, and the limiter is shared by all schedulers, so
+// planning steps with lots of subtasks doesn't spike the storage load. nil
+// limiter means subtasks are created without limit.
+func SetSubtaskCreationLimiter(threshold int, limiter *rate.Limiter) {
+	subtaskCreationLimiter.Lock()
+	defer subtaskCreationLimiter.Unlock()
+	subtaskCreationLimiter.threshold = threshold
+	subtaskCreationLimiter.limiter = limiter
+}
+
+// getSubtaskCreationLimiter returns the limiter to create subtaskCnt subtasks,
+// nil if they should be created without limit.
+func getSubtaskCreationLimiter(subtaskCnt int) *rate.Limiter {
+	subtaskCreationLimiter.RLock()
+	defer subtaskCreationLimiter.RUnlock()
+	if subtaskCnt <= subtaskCreationLimiter.threshold {
+		return nil
+	}
+	return subtaskCreationLimiter.limiter
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/util/syncutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const otelInstrumentationName = "github.com/pingcap/tidb/pkg/disttask/framework"
+
+// TaskTracer traces the lifecycle of finished tasks, it's called by the
+// scheduler manager after the task is moved to history table.
+type TaskTracer interface {
+	// TraceTask traces the task and its finished subtasks of all steps.
+	TraceTask(ctx context.Context, task *proto.Task, subtasks []*proto.Subtask)
+}
+
+type noopTaskTracer struct{}
+
+// TraceTask implements TaskTracer.TraceTask.
+func (noopTaskTracer) TraceTask(context.Context, *proto.Task, []*proto.Subtask) {}
+
+var taskTracer = struct {
+	syncutil.RWMutex
+	t TaskTracer
+}{
+	t: noopTaskTracer{},
+}
+
+// SetTaskTracer sets the tracer of finished tasks, nil means no-op.
+func SetTaskTracer(tracer TaskTracer) {
+	if tracer == nil {
+		tracer = noopTaskTracer{}
+	}
+	taskTracer.Lock()
+	defer taskTracer.Unlock()
+	taskTracer.t = tracer
+}
+
+func getTaskTracer() TaskTracer {
+	taskTracer.RLock()
+	defer taskTracer.RUnlock()
+	return taskTracer.t
+}
+
+// OTelTaskTracer exports the lifecycle of tasks as OpenTelemetry spans, each
+// task is a span from its creation to completion, and each subtask is a child
+// span of it from its start to finish.
+type OTelTaskTracer struct {
+	tracer trace.Tracer
+}
+
+// NewOTelTaskTracer creates a new OTelTaskTracer.
+func NewOTelTaskTracer(tp trace.TracerProvider) *OTelTaskTracer {
+	return &OTelTaskTracer{tracer: tp.Tracer(otelInstrumentationName)}
+}
+
+// TraceTask implements TaskTracer.TraceTask.
+func (t *OTelTaskTracer) TraceTask(ctx context.Context, task *proto.Task, subtasks []*proto.Subtask) {
+	taskCtx, taskSpan := t.tracer.Start(ctx, "task",
+		trace.WithTimestamp(task.CreateTime),
+		trace.WithAttributes(
+			attribute.String("task.type", task.Type.String()),
+			attribute.Int64("task.id", task.ID),
+			attribute.String("task.key", task.Key),
+			attribute.String("task.state", task.State.String()),
+		))
+	for _, subtask := range subtasks {
+		startTime := subtask.StartTime
+		if startTime.IsZero() {
+			startTime = subtask.CreateTime
+		}
+		_, span := t.tracer.Start(taskCtx, "subtask",
+			trace.WithTimestamp(startTime),
+			trace.WithAttributes(
+				attribute.String("task.type", task.Type.String()),
+				attribute.Int64("task.id", task.ID),
+				attribute.String("step", proto.Step2Str(task.Type, subtask.Step)),
+				attribute.Int64("subtask.id", subtask.ID),
+				attribute.String("subtask.exec_id", subtask.ExecID),
+				attribute.String("subtask.state", subtask.State.String()),
+			))
+		if subtask.State != proto.SubtaskStateSucceed {
+			span.SetStatus(codes.Error, subtask.State.String())
+		}
+		span.End(trace.WithTimestamp(subtask.UpdateTime))
+	}
+	switch task.State {
+	case proto.TaskStateSucceed, proto.TaskStatePartialSuccess:
+	default:
+		desc := task.State.String()
+		if task.Error != nil {
+			desc = task.Error.Error()
+		}
+		taskSpan.SetStatus(codes.Error, desc)
+	}
+	taskSpan.End(trace.WithTimestamp(task.StateUpdateTime))
+}
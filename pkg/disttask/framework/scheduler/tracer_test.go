@@ -0,0 +1,137 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/disttask/framework/mock"
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/mock/gomock"
+)
+
+type recordTaskTracer struct {
+	tasks    []*proto.Task
+	subtasks [][]*proto.Subtask
+}
+
+func (r *recordTaskTracer) TraceTask(_ context.Context, task *proto.Task, subtasks []*proto.Subtask) {
+	r.tasks = append(r.tasks, task)
+	r.subtasks = append(r.subtasks, subtasks)
+}
+
+func spanAttrs(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	res := make(map[attribute.Key]attribute.Value, len(span.Attributes))
+	for _, kv := range span.Attributes {
+		res[kv.Key] = kv.Value
+	}
+	return res
+}
+
+func TestOTelTaskTracer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer func() {
+		require.NoError(t, tp.Shutdown(context.Background()))
+	}()
+	tracer := NewOTelTaskTracer(tp)
+
+	now := time.Now()
+	task := &proto.Task{TaskBase: proto.TaskBase{
+		ID: 1, Key: "key1", Type: proto.TaskTypeExample, State: proto.TaskStateSucceed,
+		CreateTime: now.Add(-time.Minute),
+	}, StateUpdateTime: now}
+	subtasks := []*proto.Subtask{
+		{SubtaskBase: proto.SubtaskBase{ID: 1, Step: proto.StepOne, State: proto.SubtaskStateSucceed, ExecID: "a",
+			StartTime: now.Add(-50 * time.Second)}, UpdateTime: now.Add(-40 * time.Second)},
+		{SubtaskBase: proto.SubtaskBase{ID: 2, Step: proto.StepTwo, State: proto.SubtaskStateSucceed, ExecID: "b",
+			StartTime: now.Add(-30 * time.Second)}, UpdateTime: now.Add(-20 * time.Second)},
+	}
+	tracer.TraceTask(context.Background(), task, subtasks)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	// child spans end before the parent span.
+	taskSpan := spans[2]
+	require.Equal(t, "task", taskSpan.Name)
+	require.False(t, taskSpan.Parent.IsValid())
+	require.True(t, task.CreateTime.Equal(taskSpan.StartTime))
+	require.True(t, task.StateUpdateTime.Equal(taskSpan.EndTime))
+	require.Equal(t, codes.Unset, taskSpan.Status.Code)
+	attrs := spanAttrs(taskSpan)
+	require.Equal(t, proto.TaskTypeExample.String(), attrs["task.type"].AsString())
+	require.Equal(t, int64(1), attrs["task.id"].AsInt64())
+	for i, span := range spans[:2] {
+		require.Equal(t, "subtask", span.Name)
+		require.Equal(t, taskSpan.SpanContext.TraceID(), span.SpanContext.TraceID())
+		require.Equal(t, taskSpan.SpanContext.SpanID(), span.Parent.SpanID())
+		require.True(t, subtasks[i].StartTime.Equal(span.StartTime))
+		require.True(t, subtasks[i].UpdateTime.Equal(span.EndTime))
+		attrs = spanAttrs(span)
+		require.Equal(t, proto.TaskTypeExample.String(), attrs["task.type"].AsString())
+		require.Equal(t, int64(1), attrs["task.id"].AsInt64())
+		require.Equal(t, proto.Step2Str(task.Type, subtasks[i].Step), attrs["step"].AsString())
+		require.Equal(t, subtasks[i].ID, attrs["subtask.id"].AsInt64())
+	}
+
+	// failed task and subtask are marked as error.
+	exporter.Reset()
+	task.State = proto.TaskStateReverted
+	subtasks[1].State = proto.SubtaskStateFailed
+	tracer.TraceTask(context.Background(), task, subtasks)
+	spans = exporter.GetSpans()
+	require.Len(t, spans, 3)
+	require.Equal(t, codes.Unset, spans[0].Status.Code)
+	require.Equal(t, codes.Error, spans[1].Status.Code)
+	require.Equal(t, codes.Error, spans[2].Status.Code)
+}
+
+func TestManagerTraceFinishedTasks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	taskMgr := mock.NewMockTaskManager(ctrl)
+	mgr := NewManager(context.Background(), taskMgr, "1")
+	tasks := []*proto.Task{{TaskBase: proto.TaskBase{ID: 1}}}
+	expectCleanup := func() {
+		taskMgr.EXPECT().GetTasksInStates(mgr.ctx, proto.TaskStateFailed, proto.TaskStateReverted,
+			proto.TaskStateSucceed, proto.TaskStatePartialSuccess).Return(tasks, nil)
+		taskMgr.EXPECT().TransferTasks2History(mgr.ctx, tasks).Return(nil)
+	}
+
+	// no tracer registered, subtasks are not loaded.
+	expectCleanup()
+	mgr.doCleanupTask()
+	require.True(t, ctrl.Satisfied())
+
+	tracer := &recordTaskTracer{}
+	SetTaskTracer(tracer)
+	t.Cleanup(func() {
+		SetTaskTracer(nil)
+	})
+	subtasks := []*proto.Subtask{{SubtaskBase: proto.SubtaskBase{ID: 1}}}
+	expectCleanup()
+	taskMgr.EXPECT().GetFinishedSubtasksWithHistory(mgr.ctx, int64(1)).Return(subtasks, nil)
+	mgr.doCleanupTask()
+	require.True(t, ctrl.Satisfied())
+	require.Equal(t, tasks, tracer.tasks)
+	require.Equal(t, [][]*proto.Subtask{subtasks}, tracer.subtasks)
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/sessionctx"
+	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/sqlexec"
+)
+
+// taskStateArchiveVersion is the version of the archive format, it's bumped
+// when the format is changed incompatibly.
+const taskStateArchiveVersion = 1
+
+type archiveColumnKind int
+
+const (
+	// archiveColumnPlain columns are archived as their string representation.
+	archiveColumnPlain archiveColumnKind = iota
+	// archiveColumnBinary columns are archived in hex, as they might contain
+	// arbitrary bytes.
+	archiveColumnBinary
+	// archiveColumnTime columns are archived as unix timestamp, so they're not
+	// affected by the time zone of the session.
+	archiveColumnTime
+)
+
+type archiveColumn struct {
+	name string
+	kind archiveColumnKind
+}
+
+var (
+	archiveTaskColumns = []archiveColumn{
+		{name: "id"}, {name: "task_key"}, {name: "type"}, {name: "dispatcher_id"},
+		{name: "state"}, {name: "priority"}, {name: "create_time", kind: archiveColumnTime},
+		{name: "start_time", kind: archiveColumnTime}, {name: "state_update_time", kind: archiveColumnTime},
+		{name: "end_time", kind: archiveColumnTime}, {name: "meta", kind: archiveColumnBinary},
+		{name: "concurrency"}, {name: "step"}, {name: "error", kind: archiveColumnBinary},
+		{name: "extra_params"},
+	}
+	archiveSubtaskColumns = []archiveColumn{
+		{name: "id"}, {name: "step"}, {name: "namespace"}, {name: "task_key"},
+		{name: "ddl_physical_tid"}, {name: "type"}, {name: "exec_id"},
+		{name: "exec_expired", kind: archiveColumnTime}, {name: "state"},
+		{name: "checkpoint", kind: archiveColumnBinary}, {name: "concurrency"},
+		{name: "create_time", kind: archiveColumnTime}, {name: "start_time"},
+		{name: "state_update_time"}, {name: "end_time", kind: archiveColumnTime},
+		{name: "meta", kind: archiveColumnBinary}, {name: "ordinal"},
+		{name: "error", kind: archiveColumnBinary}, {name: "summary"}, {name: "group_name"},
+		{name: "serial_key"}, {name: "weight"},
+	}
+)
+
+// archivedRow is a row of the archive, it maps column name to the archived
+// value of the column, nil means NULL.
+type archivedRow map[string]*string
+
+// taskStateArchive is the portable archive of the state of a task.
+type taskStateArchive struct {
+	Version  int           `json:"version"`
+	Task     archivedRow   `json:"task"`
+	Subtasks []archivedRow `json:"subtasks"`
+}
+
+func archiveSelectExprs(columns []archiveColumn) string {
+	exprs := make([]string, 0, len(columns))
+	for _, col := range columns {
+		switch col.kind {
+		case archiveColumnBinary:
+			exprs = append(exprs, "hex("+col.name+")")
+		case archiveColumnTime:
+			exprs = append(exprs, "cast(unix_timestamp("+col.name+") as char)")
+		case archiveColumnPlain:
+			exprs = append(exprs, "cast("+col.name+" as char)")
+		}
+	}
+	return strings.Join(exprs, ", ")
+}
+
+func archiveInsertSQL(table string, columns []archiveColumn) string {
+	names := make([]string, 0, len(columns))
+	markers := make([]string, 0, len(columns))
+	for _, col := range columns {
+		names = append(names, col.name)
+		switch col.kind {
+		case archiveColumnBinary:
+			markers = append(markers, "unhex(%?)")
+		case archiveColumnTime:
+			markers = append(markers, "from_unixtime(%?)")
+		case archiveColumnPlain:
+			markers = append(markers, "%?")
+		}
+	}
+	return "insert into " + table + "(" + strings.Join(names, ", ") + ") values (" +
+		strings.Join(markers, ", ") + ")"
+}
+
+func row2ArchivedRow(r chunk.Row, columns []archiveColumn) archivedRow {
+	row := make(archivedRow, len(columns))
+	for i, col := range columns {
+		if r.IsNull(i) {
+			row[col.name] = nil
+			continue
+		}
+		v := r.GetString(i)
+		row[col.name] = &v
+	}
+	return row
+}
+
+func archivedRow2Args(row archivedRow, columns []archiveColumn) []any {
+	args := make([]any, 0, len(columns))
+	for _, col := range columns {
+		if v := row[col.name]; v != nil {
+			args = append(args, *v)
+		} else {
+			args = append(args, nil)
+		}
+	}
+	return args
+}
+
+// ExportTaskState exports the state of the task, including the task and all its
+// subtasks, to w as a portable archive, it can be imported by ImportTaskState
+// to reproduce the task offline. The task is usually paused before exporting,
+// so its state is stable.
+func (mgr *TaskManager) ExportTaskState(ctx context.Context, taskID int64, w io.Writer) error {
+	archive := taskStateArchive{Version: taskStateArchiveVersion}
+	err := mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `select `+
+			archiveSelectExprs(archiveTaskColumns)+` from mysql.tidb_global_task where id = %?`, taskID)
+		if err != nil {
+			return err
+		}
+		if len(rs) == 0 {
+			return ErrTaskNotFound
+		}
+		archive.Task = row2ArchivedRow(rs[0], archiveTaskColumns)
+		rs, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `select `+
+			archiveSelectExprs(archiveSubtaskColumns)+` from mysql.tidb_background_subtask
+			where task_key = %? order by id`, taskID)
+		if err != nil {
+			return err
+		}
+		archive.Subtasks = make([]archivedRow, 0, len(rs))
+		for _, r := range rs {
+			archive.Subtasks = append(archive.Subtasks, row2ArchivedRow(r, archiveSubtaskColumns))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Trace(json.NewEncoder(w).Encode(&archive))
+}
+
+// ImportTaskState imports the task state exported by ExportTaskState, the IDs
+// of the task and subtasks are kept, so it's expected to be imported into a
+// store for testing, such as an in-memory store, which doesn't have the task.
+func (mgr *TaskManager) ImportTaskState(ctx context.Context, r io.Reader) (taskID int64, err error) {
+	var archive taskStateArchive
+	if err = json.NewDecoder(r).Decode(&archive); err != nil {
+		return 0, errors.Annotate(err, "decode task state archive")
+	}
+	if archive.Version != taskStateArchiveVersion {
+		return 0, errors.Errorf("unsupported task state archive version %d", archive.Version)
+	}
+	idStr := archive.Task["id"]
+	if idStr == nil {
+		return 0, errors.New("task id not found in task state archive")
+	}
+	if taskID, err = strconv.ParseInt(*idStr, 10, 64); err != nil {
+		return 0, errors.Trace(err)
+	}
+	err = mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			archiveInsertSQL("mysql.tidb_global_task", archiveTaskColumns),
+			archivedRow2Args(archive.Task, archiveTaskColumns)...)
+		if err != nil {
+			return err
+		}
+		for _, subtask := range archive.Subtasks {
+			_, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+				archiveInsertSQL("mysql.tidb_background_subtask", archiveSubtaskColumns),
+				archivedRow2Args(subtask, archiveSubtaskColumns)...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return taskID, nil
+}
@@ -15,6 +15,7 @@
 package storage
 
 import (
+	"encoding/json"
 	"strconv"
 	"time"
 
@@ -65,9 +66,23 @@ func Row2Task(r chunk.Row) *proto.Task {
 			task.Error = stdErr
 		}
 	}
+	if !r.IsNull(13) {
+		if err := json.Unmarshal([]byte(r.GetJSON(13).String()), &task.ExtraParams); err != nil {
+			logutil.BgLogger().Error("unmarshal task extra params", zap.Error(err))
+		}
+	}
 	return task
 }
 
+// decodeSubtaskErr decodes the serialized subtask error into its message.
+func decodeSubtaskErr(errBytes []byte) string {
+	stdErr := errors.Normalize("")
+	if err := stdErr.UnmarshalJSON(errBytes); err != nil {
+		return string(errBytes)
+	}
+	return stdErr.Error()
+}
+
 // row2BasicSubTask converts a row to a subtask with basic info
 func row2BasicSubTask(r chunk.Row) *proto.SubtaskBase {
 	taskIDStr := r.GetString(2)
@@ -88,6 +103,10 @@ func row2BasicSubTask(r chunk.Row) *proto.SubtaskBase {
 		ts := r.GetInt64(9)
 		startTime = time.Unix(ts, 0)
 	}
+	var leaseExpireTime time.Time
+	if !r.IsNull(10) {
+		leaseExpireTime, _ = r.GetTime(10).GoTime(time.Local)
+	}
 
 	subtask := &proto.SubtaskBase{
 		ID:          r.GetInt64(0),
@@ -100,6 +119,8 @@ func row2BasicSubTask(r chunk.Row) *proto.SubtaskBase {
 		CreateTime:  createTime,
 		Ordinal:     ordinal,
 		StartTime:   startTime,
+
+		LeaseExpireTime: leaseExpireTime,
 	}
 	return subtask
 }
@@ -113,13 +134,39 @@ func Row2SubTask(r chunk.Row) *proto.Subtask {
 	// subtask defines update time as bigint, to ensure backward compatible,
 	// we keep it that way, and we convert it here.
 	var updateTime time.Time
-	if !r.IsNull(10) {
-		ts := r.GetInt64(10)
+	if !r.IsNull(11) {
+		ts := r.GetInt64(11)
 		updateTime = time.Unix(ts, 0)
 	}
 
 	subtask.UpdateTime = updateTime
-	subtask.Meta = r.GetBytes(11)
-	subtask.Summary = r.GetJSON(12).String()
+	subtask.Meta = r.GetBytes(12)
+	subtask.Summary = r.GetJSON(13).String()
+	if !r.IsNull(14) {
+		subtask.Group = r.GetString(14)
+	}
+	if !r.IsNull(15) {
+		subtask.EndTime, _ = r.GetTime(15).GoTime(time.Local)
+	}
+	if !r.IsNull(16) {
+		subtask.SerialKey = r.GetString(16)
+	}
+	if !r.IsNull(17) {
+		subtask.Weight = r.GetInt64(17)
+	}
+	if !r.IsNull(13) {
+		var summary struct {
+			NextRetryTime int64              `json:"next_retry_time"`
+			Metrics       map[string]float64 `json:"metrics"`
+		}
+		if err := json.Unmarshal([]byte(subtask.Summary), &summary); err != nil {
+			logutil.BgLogger().Warn("unmarshal subtask summary failed", zap.Error(err))
+		} else {
+			if subtask.State == proto.SubtaskStateRetrying && summary.NextRetryTime > 0 {
+				subtask.NextRetryTime = time.UnixMilli(summary.NextRetryTime)
+			}
+			subtask.Metrics = summary.Metrics
+		}
+	}
 	return subtask
 }
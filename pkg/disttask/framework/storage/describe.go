@@ -0,0 +1,277 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+)
+
+// maxDescribeSubtaskErrCnt is the max number of subtask errors shown in the
+// result of DescribeTask.
+const maxDescribeSubtaskErrCnt = 3
+
+// DescribeTask returns a human-readable multi-line summary of the task, it
+// contains the state, step, progress of current step and recent errors of the
+// task, finished tasks in history table are also supported.
+func (mgr *TaskManager) DescribeTask(ctx context.Context, taskID int64) (string, error) {
+	task, err := mgr.GetTaskByIDWithHistory(ctx, taskID)
+	if err != nil {
+		return "", err
+	}
+	cntByStates, err := mgr.getSubtaskCntGroupByStatesWithHistory(ctx, taskID, task.Step)
+	if err != nil {
+		return "", err
+	}
+	subtaskErrs, err := mgr.getRecentSubtaskErrors(ctx, taskID, maxDescribeSubtaskErrCnt)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "id: %d\n", task.ID)
+	fmt.Fprintf(&sb, "key: %s\n", task.Key)
+	fmt.Fprintf(&sb, "type: %s\n", task.Type)
+	fmt.Fprintf(&sb, "state: %s\n", task.State)
+	fmt.Fprintf(&sb, "step: %s\n", proto.Step2Str(task.Type, task.Step))
+	fmt.Fprintf(&sb, "priority: %d\n", task.Priority)
+	fmt.Fprintf(&sb, "concurrency: %d\n", task.Concurrency)
+	fmt.Fprintf(&sb, "create time: %s\n", formatDescribeTime(task.CreateTime))
+	fmt.Fprintf(&sb, "start time: %s\n", formatDescribeTime(task.StartTime))
+	fmt.Fprintf(&sb, "state update time: %s\n", formatDescribeTime(task.StateUpdateTime))
+	fmt.Fprintf(&sb, "progress: %s\n", formatDescribeProgress(cntByStates))
+	if task.State == proto.TaskStateReverting || task.State == proto.TaskStateReverted {
+		fmt.Fprintf(&sb, "revert progress: %s\n", proto.NewRevertProgress(cntByStates))
+	}
+	if msg := task.ExtraParams.StatusMessage; msg != "" {
+		fmt.Fprintf(&sb, "status message: %s\n", msg)
+	}
+	if task.Error != nil {
+		fmt.Fprintf(&sb, "error: %s\n", task.Error.Error())
+	}
+	if len(subtaskErrs) > 0 {
+		sb.WriteString("recent subtask errors:\n")
+		for _, e := range subtaskErrs {
+			fmt.Fprintf(&sb, "  - %s\n", e)
+		}
+	}
+	return sb.String(), nil
+}
+
+// GetRevertProgress returns the progress of reverting the task, see
+// proto.RevertProgress, finished tasks in history table are also supported.
+func (mgr *TaskManager) GetRevertProgress(ctx context.Context, taskID int64) (*proto.RevertProgress, error) {
+	task, err := mgr.GetTaskBaseByIDWithHistory(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	cntByStates, err := mgr.getSubtaskCntGroupByStatesWithHistory(ctx, taskID, task.Step)
+	if err != nil {
+		return nil, err
+	}
+	return proto.NewRevertProgress(cntByStates), nil
+}
+
+// DiagnosePendingTask returns human-readable reasons why the task isn't running,
+// such as it's paused or no node has enough free slots for it, the conditions
+// are checked in the same way as the scheduler manager does. Empty result means
+// nothing blocks the task, or the task isn't pending.
+// Note: the max concurrent task count can be changed by the scheduler manager,
+// we use the default value proto.MaxConcurrentTask here.
+func (mgr *TaskManager) DiagnosePendingTask(ctx context.Context, taskID int64) ([]string, error) {
+	task, err := mgr.GetTaskByID(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	switch task.State {
+	case proto.TaskStatePausing, proto.TaskStatePaused:
+		if resumeAt := task.ExtraParams.ResumeAt; resumeAt > 0 {
+			return []string{fmt.Sprintf("task is %s, it will be resumed at %s",
+				task.State, formatDescribeTime(time.Unix(resumeAt, 0)))}, nil
+		}
+		return []string{fmt.Sprintf("task is %s, it's waiting to be resumed manually", task.State)}, nil
+	case proto.TaskStatePending:
+	default:
+		return nil, nil
+	}
+
+	var reasons []string
+	if msg := task.ExtraParams.StatusMessage; msg != "" {
+		reasons = append(reasons, "scheduler reports: "+msg)
+	}
+	if startAfter := task.ExtraParams.StartAfter; startAfter > 0 && time.Now().Unix() < startAfter {
+		reasons = append(reasons, fmt.Sprintf("task is deferred, it will be started after %s",
+			formatDescribeTime(time.Unix(startAfter, 0))))
+	}
+	nodes, err := mgr.GetManagedNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if allowlist := task.ExtraParams.NodeAllowlist; len(allowlist) > 0 {
+		nodes = slices.DeleteFunc(nodes, func(n proto.ManagedNode) bool {
+			return !slices.Contains(allowlist, n.ID)
+		})
+		if len(nodes) == 0 {
+			reasons = append(reasons, fmt.Sprintf("none of the allowed nodes [%s] is available",
+				strings.Join(allowlist, ", ")))
+		}
+	} else if len(nodes) == 0 {
+		reasons = append(reasons, "no node is available to run the task")
+	}
+
+	scheduledTasks, err := mgr.getScheduledTasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(scheduledTasks) >= proto.MaxConcurrentTask {
+		reasons = append(reasons, fmt.Sprintf("max concurrent task count %d is reached",
+			proto.MaxConcurrentTask))
+	}
+	if len(nodes) == 0 {
+		return reasons, nil
+	}
+
+	var capacity int
+	for _, n := range nodes {
+		if n.CPUCount > 0 {
+			capacity = n.CPUCount
+			break
+		}
+	}
+	reservedForHigherRank := 0
+	for _, t := range scheduledTasks {
+		if t.State.IsRunningLike() && t.Compare(&task.TaskBase) < 0 {
+			reservedForHigherRank += t.Concurrency
+		}
+	}
+	if task.Concurrency+reservedForHigherRank <= capacity {
+		return reasons, nil
+	}
+	usedSlots, err := mgr.GetUsedSlotsOnNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		if usedSlots[n.ID]+task.Concurrency <= capacity {
+			return reasons, nil
+		}
+	}
+	reasons = append(reasons, fmt.Sprintf(
+		"no node has enough free slots, the task requires %d slots, slot capacity of node is %d, %d slots are reserved by tasks of higher rank",
+		task.Concurrency, capacity, reservedForHigherRank))
+	return reasons, nil
+}
+
+// getScheduledTasks returns the unfinished tasks which have left pending state,
+// the scheduler manager runs a scheduler for each of them.
+func (mgr *TaskManager) getScheduledTasks(ctx context.Context) ([]*proto.TaskBase, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`select `+basicTaskColumns+` from mysql.tidb_global_task t
+		where state in (%?, %?, %?, %?, %?, %?)`,
+		proto.TaskStateInitializing,
+		proto.TaskStateRunning,
+		proto.TaskStateReverting,
+		proto.TaskStateCancelling,
+		proto.TaskStatePausing,
+		proto.TaskStateResuming,
+	)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*proto.TaskBase, 0, len(rs))
+	for _, r := range rs {
+		tasks = append(tasks, row2TaskBasic(r))
+	}
+	return tasks, nil
+}
+
+// getSubtaskCntGroupByStatesWithHistory is like GetSubtaskCntGroupByStates, but
+// subtasks in history table are counted too, including compacted ones.
+func (mgr *TaskManager) getSubtaskCntGroupByStatesWithHistory(ctx context.Context, taskID int64, step proto.Step) (map[proto.SubtaskState]int64, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `
+		select state, cast(sum(cnt) as signed) from (
+			select state, 1 cnt from mysql.tidb_background_subtask where task_key = %? and step = %?
+			union all
+			select state, cast(ifnull(summary->>'$.compacted_count', 1) as signed) cnt
+			from mysql.tidb_background_subtask_history where task_key = %? and step = %?
+		) t group by state`,
+		taskID, step, taskID, step)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[proto.SubtaskState]int64, len(rs))
+	for _, r := range rs {
+		res[proto.SubtaskState(r.GetString(0))] = r.GetInt64(1)
+	}
+	return res, nil
+}
+
+// getRecentSubtaskErrors returns errors of at most limit subtasks which are
+// updated most recently.
+func (mgr *TaskManager) getRecentSubtaskErrors(ctx context.Context, taskID int64, limit int) ([]string, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `
+		select error from (
+			select error, state_update_time from mysql.tidb_background_subtask
+			where task_key = %? and error is not null
+			union all
+			select error, state_update_time from mysql.tidb_background_subtask_history
+			where task_key = %? and error is not null
+		) t order by state_update_time desc limit %?`,
+		taskID, taskID, limit)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(rs))
+	for _, r := range rs {
+		errBytes := r.GetBytes(0)
+		if len(errBytes) == 0 {
+			continue
+		}
+		res = append(res, decodeSubtaskErr(errBytes))
+	}
+	return res, nil
+}
+
+func formatDescribeTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.DateTime)
+}
+
+func formatDescribeProgress(cntByStates map[proto.SubtaskState]int64) string {
+	var total int64
+	states := make([]string, 0, len(cntByStates))
+	for state, cnt := range cntByStates {
+		total += cnt
+		states = append(states, string(state))
+	}
+	if total == 0 {
+		return "no subtask"
+	}
+	slices.Sort(states)
+	parts := make([]string, 0, len(states))
+	for _, state := range states {
+		parts = append(parts, fmt.Sprintf("%s: %d", state, cntByStates[proto.SubtaskState(state)]))
+	}
+	return fmt.Sprintf("%d/%d subtasks succeed (%s)",
+		cntByStates[proto.SubtaskStateSucceed], total, strings.Join(parts, ", "))
+}
@@ -16,40 +16,145 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/failpoint"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	"github.com/pingcap/tidb/pkg/sessionctx"
 	"github.com/pingcap/tidb/pkg/util/sqlexec"
 )
 
+// SubtaskCompactionThreshold is the max number of subtasks of a task which are
+// moved to the history table as is, if a task has more subtasks than it, they
+// are compacted into one aggregated row for each step and state, see
+// compactSubtasks2History. 0 means no compaction, which is the default, so the
+// history table keeps one row for each subtask unless it's enabled explicitly.
+var SubtaskCompactionThreshold int64
+
+// maxCompactedErrSampleCnt is the max number of subtask errors kept in the
+// summary of an aggregated row.
+const maxCompactedErrSampleCnt = 3
+
+// CompactedSubtaskSummary is the summary of an aggregated row of compacted
+// subtasks in the history table.
+type CompactedSubtaskSummary struct {
+	// CompactedCount is the number of subtasks compacted into the row.
+	CompactedCount int64    `json:"compacted_count"`
+	ErrorSamples   []string `json:"error_samples,omitempty"`
+}
+
 // TransferSubtasks2HistoryWithSession transfer the selected subtasks into tidb_background_subtask_history table by taskID.
 func (*TaskManager) TransferSubtasks2HistoryWithSession(ctx context.Context, se sessionctx.Context, taskID int64) error {
 	exec := se.GetSQLExecutor()
-	_, err := sqlexec.ExecSQL(ctx, exec, `insert into mysql.tidb_background_subtask_history select * from mysql.tidb_background_subtask where task_key = %?`, taskID)
+	compacted, err := compactSubtasks2History(ctx, exec, taskID)
 	if err != nil {
 		return err
 	}
+	if !compacted {
+		_, err = sqlexec.ExecSQL(ctx, exec, `insert into mysql.tidb_background_subtask_history select * from mysql.tidb_background_subtask where task_key = %?`, taskID)
+		if err != nil {
+			return err
+		}
+	}
 	// delete taskID subtask
 	_, err = sqlexec.ExecSQL(ctx, exec, "delete from mysql.tidb_background_subtask where task_key = %?", taskID)
 	return err
 }
 
+// compactSubtasks2History inserts aggregated rows of subtasks of the task into
+// history table if the subtask count exceeds SubtaskCompactionThreshold, one
+// row for each step and state, the subtask count and samples of subtask errors
+// are kept in the summary of the row, see CompactedSubtaskSummary.
+// returns whether the subtasks are compacted, the caller should delete the
+// original subtasks.
+func compactSubtasks2History(ctx context.Context, exec sqlexec.SQLExecutor, taskID int64) (bool, error) {
+	threshold := SubtaskCompactionThreshold
+	if threshold <= 0 {
+		return false, nil
+	}
+	rs, err := sqlexec.ExecSQL(ctx, exec, `
+		select step, state, count(1) from mysql.tidb_background_subtask
+		where task_key = %? group by step, state`, taskID)
+	if err != nil {
+		return false, err
+	}
+	var total int64
+	for _, r := range rs {
+		total += r.GetInt64(2)
+	}
+	if total <= threshold {
+		return false, nil
+	}
+
+	for _, r := range rs {
+		step, state, cnt := r.GetInt64(0), r.GetString(1), r.GetInt64(2)
+		errRows, err := sqlexec.ExecSQL(ctx, exec, `
+			select error from mysql.tidb_background_subtask
+			where task_key = %? and step = %? and state = %? and error is not null
+			order by id limit %?`, taskID, step, state, maxCompactedErrSampleCnt)
+		if err != nil {
+			return false, err
+		}
+		summary := CompactedSubtaskSummary{CompactedCount: cnt}
+		// the first error is also kept in the error column as is.
+		var firstErr []byte
+		for _, er := range errRows {
+			errBytes := er.GetBytes(0)
+			if len(errBytes) == 0 {
+				continue
+			}
+			if firstErr == nil {
+				firstErr = errBytes
+			}
+			summary.ErrorSamples = append(summary.ErrorSamples, decodeSubtaskErr(errBytes))
+		}
+		summaryBytes, err := json.Marshal(summary)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		_, err = sqlexec.ExecSQL(ctx, exec, `
+			insert into mysql.tidb_background_subtask_history(
+				step, task_key, type, exec_id, state, checkpoint, concurrency, create_time,
+				start_time, state_update_time, end_time, error, summary, weight)
+			select step, task_key, min(type), '', state, '', max(concurrency), min(create_time),
+				min(start_time), max(state_update_time), max(end_time), %?, %?, sum(ifnull(weight, 1))
+			from mysql.tidb_background_subtask
+			where task_key = %? and step = %? and state = %?
+			group by step, task_key, state`,
+			firstErr, string(summaryBytes), taskID, step, state)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
 // TransferTasks2History transfer the selected tasks into tidb_global_task_history table by taskIDs.
+// ephemeral tasks and their subtasks are deleted directly without being moved
+// to history tables, see proto.ExtraParams.Ephemeral.
 func (mgr *TaskManager) TransferTasks2History(ctx context.Context, tasks []*proto.Task) error {
 	if len(tasks) == 0 {
 		return nil
 	}
 	taskIDStrs := make([]string, 0, len(tasks))
+	historyTaskIDStrs := make([]string, 0, len(tasks))
 	for _, task := range tasks {
-		taskIDStrs = append(taskIDStrs, fmt.Sprintf("%d", task.ID))
+		idStr := fmt.Sprintf("%d", task.ID)
+		taskIDStrs = append(taskIDStrs, idStr)
+		if !task.ExtraParams.Ephemeral {
+			historyTaskIDStrs = append(historyTaskIDStrs, idStr)
+		}
 	}
 	return mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
 		// sensitive data in meta might be redacted, need update first.
 		exec := se.GetSQLExecutor()
 		for _, t := range tasks {
+			if t.ExtraParams.Ephemeral {
+				continue
+			}
 			_, err := sqlexec.ExecSQL(ctx, exec, `
 				update mysql.tidb_global_task
 				set meta= %?, state_update_time = CURRENT_TIMESTAMP()
@@ -57,21 +162,41 @@ func (mgr *TaskManager) TransferTasks2History(ctx context.Context, tasks []*prot
 			if err != nil {
 				return err
 			}
+			// the mark is archived in the same txn, so the cleanup is not lost
+			// if the node crashes after the task is archived.
+			if t.ExtraParams.CleanUpPending {
+				_, err = sqlexec.ExecSQL(ctx, exec, `
+					update mysql.tidb_global_task
+					set extra_params = json_set(ifnull(extra_params, json_object()), '$.cleanup_pending', cast('true' as json))
+					where id = %?`, t.ID)
+				if err != nil {
+					return err
+				}
+			}
 		}
-		_, err := sqlexec.ExecSQL(ctx, exec, `
-			insert into mysql.tidb_global_task_history
-			select * from mysql.tidb_global_task
-			where id in(`+strings.Join(taskIDStrs, `, `)+`)`)
-		if err != nil {
-			return err
+		if len(historyTaskIDStrs) > 0 {
+			_, err := sqlexec.ExecSQL(ctx, exec, `
+				insert into mysql.tidb_global_task_history
+				select * from mysql.tidb_global_task
+				where id in(`+strings.Join(historyTaskIDStrs, `, `)+`)`)
+			if err != nil {
+				return err
+			}
 		}
 
-		_, err = sqlexec.ExecSQL(ctx, exec, `
+		_, err := sqlexec.ExecSQL(ctx, exec, `
 			delete from mysql.tidb_global_task
 			where id in(`+strings.Join(taskIDStrs, `, `)+`)`)
 
 		for _, t := range tasks {
-			err = mgr.TransferSubtasks2HistoryWithSession(ctx, se, t.ID)
+			if t.ExtraParams.Ephemeral {
+				_, err = sqlexec.ExecSQL(ctx, exec, "delete from mysql.tidb_background_subtask where task_key = %?", t.ID)
+			} else {
+				err = mgr.TransferSubtasks2HistoryWithSession(ctx, se, t.ID)
+				if err == nil && t.ExtraParams.PurgeSubtaskSummary {
+					err = purgeSubtaskSummaries(ctx, exec, t.ID)
+				}
+			}
 			if err != nil {
 				return err
 			}
@@ -80,6 +205,41 @@ func (mgr *TaskManager) TransferTasks2History(ctx context.Context, tasks []*prot
 	})
 }
 
+// GetCleanUpPendingTasks implements the scheduler.ArchivedTaskCleaner interface.
+func (mgr *TaskManager) GetCleanUpPendingTasks(ctx context.Context) ([]*proto.Task, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`select `+TaskColumns+` from mysql.tidb_global_task_history t
+		where ifnull(extra_params->>'$.cleanup_pending', 'false') = 'true'
+		order by id`)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*proto.Task, 0, len(rs))
+	for _, r := range rs {
+		tasks = append(tasks, Row2Task(r))
+	}
+	return tasks, nil
+}
+
+// FinishArchivedTaskCleanUp implements the scheduler.ArchivedTaskCleaner interface.
+func (mgr *TaskManager) FinishArchivedTaskCleanUp(ctx context.Context, task *proto.Task) error {
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_global_task_history
+		set meta = %?, extra_params = json_remove(extra_params, '$.cleanup_pending')
+		where id = %?`, task.Meta, task.ID)
+	return err
+}
+
+// purgeSubtaskSummaries clears summaries of subtasks of the task in history
+// table, see proto.ExtraParams.PurgeSubtaskSummary. summaries of aggregated rows
+// are kept, as they hold the count of compacted subtasks.
+func purgeSubtaskSummaries(ctx context.Context, exec sqlexec.SQLExecutor, taskID int64) error {
+	_, err := sqlexec.ExecSQL(ctx, exec, `
+		update mysql.tidb_background_subtask_history set summary = json_object()
+		where task_key = %? and json_extract(summary, '$.compacted_count') is null`, taskID)
+	return err
+}
+
 // GCSubtasks deletes the history subtask which is older than the given days.
 func (mgr *TaskManager) GCSubtasks(ctx context.Context) error {
 	subtaskHistoryKeepSeconds := defaultSubtaskKeepDays * 24 * 60 * 60
@@ -94,3 +254,45 @@ func (mgr *TaskManager) GCSubtasks(ctx context.Context) error {
 	)
 	return err
 }
+
+// ReplayTask creates a new task with the key, which has the same type, meta,
+// concurrency and input extra params as the finished task in the history table,
+// it's used to re-run the exact inputs of a historical task, such as for
+// regression tests. the state of the original run kept in extra params, such as
+// the cancel mode and the consumed retries, is not copied, see replayParams.
+func (mgr *TaskManager) ReplayTask(ctx context.Context, historicalTaskID int64, newKey string) (int64, error) {
+	var taskID int64
+	err := mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `select `+TaskColumns+`
+			from mysql.tidb_global_task_history t where id = %?`, historicalTaskID)
+		if err != nil {
+			return err
+		}
+		if len(rs) == 0 {
+			return errors.Annotatef(ErrTaskNotFound, "task %d not found in history", historicalTaskID)
+		}
+		task := Row2Task(rs[0])
+		taskID, err = mgr.CreateTaskWithSession(ctx, se, newKey, task.Type, task.Concurrency, task.Meta, replayParams(task.ExtraParams))
+		return err
+	})
+	return taskID, err
+}
+
+// replayParams returns the extra params of the task which replays a task with
+// params p, only the inputs given when the task is submitted are copied, the
+// state of the original run, such as whether it's poked or frozen, the step
+// iteration and the pending cleanup, starts from scratch.
+// new input params should be added here too.
+func replayParams(p proto.ExtraParams) proto.ExtraParams {
+	return proto.ExtraParams{
+		Seed:                p.Seed,
+		NodeAllowlist:       p.NodeAllowlist,
+		Ephemeral:           p.Ephemeral,
+		PurgeSubtaskSummary: p.PurgeSubtaskSummary,
+		RetryBudget:         p.RetryBudget,
+		NoAutoRetry:         p.NoAutoRetry,
+		MetaVersion:         p.MetaVersion,
+		TimeoutSeconds:      p.TimeoutSeconds,
+		SubtaskMetaBudget:   p.SubtaskMetaBudget,
+	}
+}
@@ -150,11 +150,11 @@ func (mgr *TaskManager) GetUsedSlotsOnNodes(ctx context.Context) (map[string]int
 		from (
 			select exec_id, task_key, max(concurrency) concurrency
 			from mysql.tidb_background_subtask
-			where state in (%?, %?)
+			where state in (%?, %?, %?)
 			group by exec_id, task_key
 		) a
 		group by exec_id`,
-		proto.SubtaskStatePending, proto.SubtaskStateRunning,
+		proto.SubtaskStatePending, proto.SubtaskStateRunning, proto.SubtaskStateRetrying,
 	)
 	if err != nil {
 		return nil, err
@@ -16,17 +16,79 @@ package storage
 
 import (
 	"context"
+	"strconv"
+	"strings"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	"github.com/pingcap/tidb/pkg/sessionctx"
 	"github.com/pingcap/tidb/pkg/util/sqlexec"
 )
 
+// checkSubtaskStateTransform checks whether the subtask owned by execID can be
+// updated to state to, the subtask row is locked until the txn ends.
+// found is false if the subtask doesn't exist or isn't owned by execID.
+func checkSubtaskStateTransform(ctx context.Context, exec sqlexec.SQLExecutor, id int64, execID string, to proto.SubtaskState) (found bool, err error) {
+	rs, err := sqlexec.ExecSQL(ctx, exec, `select state from mysql.tidb_background_subtask
+		where id = %? and exec_id = %? for update`, id, execID)
+	if err != nil {
+		return false, err
+	}
+	if len(rs) == 0 {
+		return false, nil
+	}
+	from := proto.SubtaskState(rs[0].GetString(0))
+	if !proto.VerifySubtaskStateTransform(from, to) {
+		return true, errors.Annotatef(ErrInvalidSubtaskStateTransform,
+			"subtask %d from %s to %s", id, from, to)
+	}
+	return true, nil
+}
+
+// checkSerialKeyAvailable checks that no other subtask with the same serial key
+// of the subtask is running, subtasks with the same serial key are locked until
+// the txn ends, so concurrent starts of them are serialized.
+func checkSerialKeyAvailable(ctx context.Context, exec sqlexec.SQLExecutor, id int64) error {
+	rs, err := sqlexec.ExecSQL(ctx, exec, `select task_key, serial_key from mysql.tidb_background_subtask
+		where id = %?`, id)
+	if err != nil {
+		return err
+	}
+	if len(rs) == 0 || rs[0].IsNull(1) {
+		return nil
+	}
+	taskKey, serialKey := rs[0].GetString(0), rs[0].GetString(1)
+	rs, err = sqlexec.ExecSQL(ctx, exec, `select id, state from mysql.tidb_background_subtask
+		where task_key = %? and serial_key = %? for update`, taskKey, serialKey)
+	if err != nil {
+		return err
+	}
+	for _, r := range rs {
+		if r.GetInt64(0) != id && proto.SubtaskState(r.GetString(1)) == proto.SubtaskStateRunning {
+			return errors.Annotatef(ErrSubtaskSerialKeyBusy,
+				"subtask %d with serial key %s is running", r.GetInt64(0), serialKey)
+		}
+	}
+	return nil
+}
+
 // StartSubtask updates the subtask state to running.
+// it returns ErrSubtaskSerialKeyBusy if another subtask with the same serial key
+// is running.
 func (mgr *TaskManager) StartSubtask(ctx context.Context, subtaskID int64, execID string) error {
 	err := mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
 		vars := se.GetSessionVars()
-		_, err := sqlexec.ExecSQL(ctx,
+		found, err := checkSubtaskStateTransform(ctx, se.GetSQLExecutor(), subtaskID, execID, proto.SubtaskStateRunning)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrSubtaskNotFound
+		}
+		if err = checkSerialKeyAvailable(ctx, se.GetSQLExecutor(), subtaskID); err != nil {
+			return err
+		}
+		_, err = sqlexec.ExecSQL(ctx,
 			se.GetSQLExecutor(),
 			`update mysql.tidb_background_subtask
 			 set state = %?, start_time = unix_timestamp(), state_update_time = unix_timestamp()
@@ -47,11 +109,17 @@ func (mgr *TaskManager) StartSubtask(ctx context.Context, subtaskID int64, execI
 
 // FinishSubtask updates the subtask meta and mark state to succeed.
 func (mgr *TaskManager) FinishSubtask(ctx context.Context, execID string, id int64, meta []byte) error {
-	_, err := mgr.ExecuteSQLWithNewSession(ctx, `update mysql.tidb_background_subtask
-		set meta = %?, state = %?, state_update_time = unix_timestamp(), end_time = CURRENT_TIMESTAMP()
-		where id = %? and exec_id = %?`,
-		meta, proto.SubtaskStateSucceed, id, execID)
-	return err
+	return mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		found, err := checkSubtaskStateTransform(ctx, se.GetSQLExecutor(), id, execID, proto.SubtaskStateSucceed)
+		if err != nil || !found {
+			return err
+		}
+		_, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `update mysql.tidb_background_subtask
+			set meta = %?, state = %?, state_update_time = unix_timestamp(), end_time = CURRENT_TIMESTAMP()
+			where id = %? and exec_id = %?`,
+			meta, proto.SubtaskStateSucceed, id, execID)
+		return err
+	})
 }
 
 // FailSubtask update the task's subtask state to failed and set the err.
@@ -68,14 +136,15 @@ func (mgr *TaskManager) FailSubtask(ctx context.Context, execID string, taskID i
 		end_time = CURRENT_TIMESTAMP()
 		where exec_id = %? and
 		task_key = %? and
-		state in (%?, %?)
+		state in (%?, %?, %?)
 		limit 1;`,
 		proto.SubtaskStateFailed,
 		serializeErr(err),
 		execID,
 		taskID,
 		proto.SubtaskStatePending,
-		proto.SubtaskStateRunning)
+		proto.SubtaskStateRunning,
+		proto.SubtaskStateRetrying)
 	return err1
 }
 
@@ -89,20 +158,86 @@ func (mgr *TaskManager) CancelSubtask(ctx context.Context, execID string, taskID
 		end_time = CURRENT_TIMESTAMP()
 		where exec_id = %? and
 		task_key = %? and
-		state in (%?, %?)
+		state in (%?, %?, %?)
 		limit 1;`,
 		proto.SubtaskStateCanceled,
 		execID,
 		taskID,
 		proto.SubtaskStatePending,
-		proto.SubtaskStateRunning)
+		proto.SubtaskStateRunning,
+		proto.SubtaskStateRetrying)
 	return err1
 }
 
-// PauseSubtasks update all running/pending subtasks to pasued state.
+// CancelSubtaskGroup cancels the unfinished subtasks of the group of the task,
+// subtasks of other groups keep running. subtasks cancelled this way are marked
+// in summary, so the scheduler doesn't take them as failure of the task, see
+// GetGroupCanceledSubtaskCnt. running subtasks of the group are stopped by the
+// task executor when it finds the subtask is not running any more.
+func (mgr *TaskManager) CancelSubtaskGroup(ctx context.Context, taskID int64, group string) error {
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_background_subtask
+		set state = %?,
+		summary = json_set(ifnull(summary, json_object()), '$.group_canceled', true),
+		state_update_time = unix_timestamp(),
+		end_time = CURRENT_TIMESTAMP()
+		where task_key = %? and group_name = %? and state in (%?, %?, %?, %?)`,
+		proto.SubtaskStateCanceled, taskID, group, proto.SubtaskStatePending,
+		proto.SubtaskStateRunning, proto.SubtaskStateRetrying, proto.SubtaskStatePaused)
+	return err
+}
+
+// CancelStepSubtasks cancels the unfinished subtasks of the step of the task,
+// such as for partial rollback during debugging, the task is not failed
+// directly, the scheduler decides what to do next by the failure mode of the
+// step, see proto.StepFailureMode. subtasks cancelled this way are marked in
+// summary, see GetStepCanceledSubtaskCnt.
+func (mgr *TaskManager) CancelStepSubtasks(ctx context.Context, taskID int64, step proto.Step) error {
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_background_subtask
+		set state = %?, error = %?,
+		summary = json_set(ifnull(summary, json_object()), '$.step_canceled', true),
+		state_update_time = unix_timestamp(),
+		end_time = CURRENT_TIMESTAMP()
+		where task_key = %? and step = %? and state in (%?, %?, %?, %?)`,
+		proto.SubtaskStateCanceled, serializeErr(errors.Errorf("subtasks of step %d are cancelled", step)),
+		taskID, step, proto.SubtaskStatePending, proto.SubtaskStateRunning,
+		proto.SubtaskStateRetrying, proto.SubtaskStatePaused)
+	return err
+}
+
+// GetStepCanceledSubtaskCnt returns the count of subtasks of the step of the
+// task which are cancelled by CancelStepSubtasks.
+func (mgr *TaskManager) GetStepCanceledSubtaskCnt(ctx context.Context, taskID int64, step proto.Step) (int64, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`select count(1) from mysql.tidb_background_subtask
+		where task_key = %? and step = %? and state = %?
+		and json_extract(summary, '$.step_canceled') = true`,
+		taskID, step, proto.SubtaskStateCanceled)
+	if err != nil {
+		return 0, err
+	}
+	return rs[0].GetInt64(0), nil
+}
+
+// GetGroupCanceledSubtaskCnt returns the count of subtasks of the step of the
+// task which are cancelled by CancelSubtaskGroup.
+func (mgr *TaskManager) GetGroupCanceledSubtaskCnt(ctx context.Context, taskID int64, step proto.Step) (int64, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`select count(1) from mysql.tidb_background_subtask
+		where task_key = %? and step = %? and state = %?
+		and json_extract(summary, '$.group_canceled') = true`,
+		taskID, step, proto.SubtaskStateCanceled)
+	if err != nil {
+		return 0, err
+	}
+	return rs[0].GetInt64(0), nil
+}
+
+// PauseSubtasks update all running/pending/retrying subtasks to pasued state.
 func (mgr *TaskManager) PauseSubtasks(ctx context.Context, execID string, taskID int64) error {
 	_, err := mgr.ExecuteSQLWithNewSession(ctx,
-		`update mysql.tidb_background_subtask set state = "paused" where task_key = %? and state in ("running", "pending") and exec_id = %?`, taskID, execID)
+		`update mysql.tidb_background_subtask set state = "paused" where task_key = %? and state in ("running", "pending", "retrying") and exec_id = %?`, taskID, execID)
 	return err
 }
 
@@ -136,12 +271,81 @@ func (mgr *TaskManager) RunningSubtasksBack2Pending(ctx context.Context, subtask
 }
 
 // UpdateSubtaskStateAndError updates the subtask state.
+// it returns ErrInvalidSubtaskStateTransform if the subtask cannot be updated
+// to state from its current state.
 func (mgr *TaskManager) UpdateSubtaskStateAndError(
 	ctx context.Context,
 	execID string,
 	id int64, state proto.SubtaskState, subTaskErr error) error {
-	_, err := mgr.ExecuteSQLWithNewSession(ctx, `update mysql.tidb_background_subtask
-		set state = %?, error = %?, state_update_time = unix_timestamp() where id = %? and exec_id = %?`,
-		state, serializeErr(subTaskErr), id, execID)
-	return err
+	return mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		found, err := checkSubtaskStateTransform(ctx, se.GetSQLExecutor(), id, execID, state)
+		if err != nil || !found {
+			return err
+		}
+		_, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `update mysql.tidb_background_subtask
+			set state = %?, error = %?, state_update_time = unix_timestamp() where id = %? and exec_id = %?`,
+			state, serializeErr(subTaskErr), id, execID)
+		return err
+	})
+}
+
+// RequeueSubtaskWithMeta resets the failed or canceled subtask to pending with
+// the corrected meta, so it's executed again, it's used when the subtask fails
+// due to a bad parameter in its meta. subtasks in other states can't be
+// requeued, and ErrInvalidSubtaskStateTransform is returned, to avoid rerunning
+// succeeded subtasks or changing the meta of a subtask being executed.
+// the task should be paused before requeue, otherwise the scheduler might
+// revert the task on the failed subtask.
+func (mgr *TaskManager) RequeueSubtaskWithMeta(ctx context.Context, subtaskID int64, newMeta []byte) error {
+	return mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `select state from mysql.tidb_background_subtask
+			where id = %? for update`, subtaskID)
+		if err != nil {
+			return err
+		}
+		if len(rs) == 0 {
+			return ErrSubtaskNotFound
+		}
+		state := proto.SubtaskState(rs[0].GetString(0))
+		if state != proto.SubtaskStateFailed && state != proto.SubtaskStateCanceled {
+			return errors.Annotatef(ErrInvalidSubtaskStateTransform,
+				"requeue subtask %d in state %s", subtaskID, state)
+		}
+		_, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `update mysql.tidb_background_subtask
+			set meta = %?, state = %?, error = null, end_time = null, state_update_time = unix_timestamp()
+			where id = %?`,
+			newMeta, proto.SubtaskStatePending, subtaskID)
+		return err
+	})
+}
+
+// UpdateSubtasksState updates the state of the subtasks in ids from from to to
+// in a single statement, so the change is visible all at once, such as on step
+// advancement or bulk reassignment. subtasks not in state from are skipped, and
+// the number of subtasks changed is returned.
+// ErrInvalidSubtaskStateTransform is returned if from can't be updated to to.
+func (mgr *TaskManager) UpdateSubtasksState(ctx context.Context, ids []int64, from, to proto.SubtaskState) (int, error) {
+	if !proto.VerifySubtaskStateTransform(from, to) {
+		return 0, errors.Annotatef(ErrInvalidSubtaskStateTransform, "subtasks from %s to %s", from, to)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	idStrs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		idStrs = append(idStrs, strconv.FormatInt(id, 10))
+	}
+	var changed int
+	err := mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `update mysql.tidb_background_subtask
+			set state = %?, state_update_time = unix_timestamp()
+			where state = %? and id in (`+strings.Join(idStrs, ", ")+`)`,
+			to, from)
+		if err != nil {
+			return err
+		}
+		changed = int(se.GetSessionVars().StmtCtx.AffectedRows())
+		return nil
+	})
+	return changed, err
 }
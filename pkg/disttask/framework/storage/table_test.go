@@ -15,13 +15,22 @@
 package storage_test
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"math"
 	"slices"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/ngaut/pools"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	"github.com/pingcap/tidb/pkg/disttask/framework/storage"
@@ -33,6 +42,7 @@ import (
 	"github.com/pingcap/tidb/pkg/util/sqlexec"
 	"github.com/stretchr/testify/require"
 	"github.com/tikv/client-go/v2/util"
+	"golang.org/x/time/rate"
 )
 
 func checkTaskStateStep(t *testing.T, task *proto.Task, state proto.TaskState, step proto.Step) {
@@ -346,6 +356,403 @@ func TestSwitchTaskStepInBatch(t *testing.T) {
 	require.ErrorContains(t, err, "expected 1, got 2")
 }
 
+func TestGetSubtasksByTaskIDPagination(t *testing.T) {
+	store, tm, ctx := testutil.InitTableTest(t)
+	tk := testkit.NewTestKit(t, store)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	taskID, err := tm.CreateTask(ctx, "key1", proto.TaskTypeExample, 4, []byte("test"))
+	require.NoError(t, err)
+	const subtaskCnt = 1000
+	metas := make([][]byte, 0, subtaskCnt)
+	for i := 0; i < subtaskCnt; i++ {
+		metas = append(metas, []byte(fmt.Sprintf("%d", i)))
+	}
+	require.NoError(t, tm.InsertSubtasks(ctx, taskID, proto.StepOne, metas))
+	// subtasks with odd ordinal succeed.
+	tk.MustExec(fmt.Sprintf(`update mysql.tidb_background_subtask set state = "succeed"
+		where task_key = %d and ordinal %% 2 = 1`, taskID))
+
+	allSubtasks, total, err := tm.GetSubtasksByTaskID(ctx, taskID, 0, 0)
+	require.NoError(t, err)
+	require.EqualValues(t, subtaskCnt, total)
+	require.Len(t, allSubtasks, subtaskCnt)
+	require.True(t, slices.IsSortedFunc(allSubtasks, func(a, b *proto.Subtask) int {
+		return cmp.Compare(a.ID, b.ID)
+	}))
+	checkPage := func(offset, limit int, expected []*proto.Subtask, expectedTotal int64, states ...proto.SubtaskState) {
+		subtasks, total, err := tm.GetSubtasksByTaskID(ctx, taskID, offset, limit, states...)
+		require.NoError(t, err)
+		require.Equal(t, expectedTotal, total)
+		require.Len(t, subtasks, len(expected))
+		for i, subtask := range subtasks {
+			require.Equal(t, expected[i].ID, subtask.ID)
+		}
+	}
+	checkPage(0, 100, allSubtasks[:100], subtaskCnt)
+	checkPage(500, 100, allSubtasks[500:600], subtaskCnt)
+	checkPage(950, 100, allSubtasks[950:], subtaskCnt)
+	checkPage(1000, 100, nil, subtaskCnt)
+	checkPage(900, 0, allSubtasks[900:], subtaskCnt)
+
+	var succeedSubtasks []*proto.Subtask
+	for _, subtask := range allSubtasks {
+		if subtask.State == proto.SubtaskStateSucceed {
+			succeedSubtasks = append(succeedSubtasks, subtask)
+		}
+	}
+	require.Len(t, succeedSubtasks, subtaskCnt/2)
+	checkPage(0, 100, succeedSubtasks[:100], subtaskCnt/2, proto.SubtaskStateSucceed)
+	checkPage(450, 100, succeedSubtasks[450:], subtaskCnt/2, proto.SubtaskStateSucceed)
+	checkPage(0, 10, allSubtasks[:10], subtaskCnt, proto.SubtaskStatePending, proto.SubtaskStateSucceed)
+	checkPage(0, 10, nil, 0, proto.SubtaskStateFailed)
+
+	// subtasks moved to history table are included.
+	tk.MustExec(fmt.Sprintf(`insert into mysql.tidb_background_subtask_history
+		select * from mysql.tidb_background_subtask where task_key = %d and ordinal <= 500`, taskID))
+	tk.MustExec(fmt.Sprintf(`delete from mysql.tidb_background_subtask where task_key = %d and ordinal <= 500`, taskID))
+	checkPage(400, 200, allSubtasks[400:600], subtaskCnt)
+}
+
+func TestSwitchTaskStepWithLimiter(t *testing.T) {
+	testkit.EnableFailPoint(t, "github.com/pingcap/tidb/pkg/domain/MockDisableDistTask", "return(true)")
+	testkit.EnableFailPoint(t, "github.com/pingcap/tidb/pkg/util/cpu/mockNumCpu", "return(8)")
+	store := testkit.CreateMockStore(t)
+	// multiple sessions, so subtasks can be checked and executed while creating.
+	pool := pools.NewResourcePool(func() (pools.Resource, error) {
+		return testkit.NewSession(t, store), nil
+	}, 4, 4, time.Second)
+	t.Cleanup(pool.Close)
+	tm := storage.NewTaskManager(pool)
+	storage.SetTaskManager(tm)
+	ctx := util.WithInternalSourceType(context.Background(), "table_test")
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	prepare := func(taskKey string, subtaskCnt int) (*proto.Task, []*proto.Subtask) {
+		taskID, err := tm.CreateTask(ctx, taskKey, "test", 4, []byte("test"))
+		require.NoError(t, err)
+		task, err := tm.GetTaskByID(ctx, taskID)
+		require.NoError(t, err)
+		subtasks := make([]*proto.Subtask, subtaskCnt)
+		for i := 0; i < len(subtasks); i++ {
+			subtasks[i] = proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+				":4000", 11, []byte(fmt.Sprintf("%d", i)), i+1)
+		}
+		return task, subtasks
+	}
+	// a running task with subtasks already created.
+	task1, subtasks1 := prepare("key1", 2)
+	require.NoError(t, tm.SwitchTaskStep(ctx, task1, proto.TaskStateRunning, proto.StepOne, subtasks1))
+	createdSubtasks, err := tm.GetAllSubtasksByStepAndState(ctx, task1.ID, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Len(t, createdSubtasks, 2)
+
+	// 10 subtasks are inserted in batches of 2, one batch per 200ms, the first
+	// batch is inserted immediately.
+	limiter := rate.NewLimiter(rate.Every(100*time.Millisecond), 2)
+	startTime := time.Unix(time.Now().Unix(), 0)
+	task2, subtasks2 := prepare("key2", 10)
+	start := time.Now()
+	errCh := make(chan error)
+	go func() {
+		errCh <- tm.SwitchTaskStepWithLimiter(ctx, task2, proto.TaskStateRunning, proto.StepOne, subtasks2, limiter)
+	}()
+	// subtasks are created gradually, and the task is switched after all of them
+	// are created.
+	require.Eventually(t, func() bool {
+		cntByStates, err := tm.GetSubtaskCntGroupByStates(ctx, task2.ID, proto.StepOne)
+		require.NoError(t, err)
+		cnt := cntByStates[proto.SubtaskStatePending]
+		return cnt > 0 && cnt < 10
+	}, 5*time.Second, 10*time.Millisecond)
+	task, err := tm.GetTaskByID(ctx, task2.ID)
+	require.NoError(t, err)
+	checkTaskStateStep(t, task, proto.TaskStatePending, proto.StepInit)
+	// subtasks already created are executed while creating.
+	for _, subtask := range createdSubtasks {
+		require.NoError(t, tm.StartSubtask(ctx, subtask.ID, ":4000"))
+		require.NoError(t, tm.FinishSubtask(ctx, ":4000", subtask.ID, nil))
+	}
+	cntByStates, err := tm.GetSubtaskCntGroupByStates(ctx, task1.ID, proto.StepOne)
+	require.NoError(t, err)
+	require.Equal(t, map[proto.SubtaskState]int64{proto.SubtaskStateSucceed: 2}, cntByStates)
+	select {
+	case err = <-errCh:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "switch task step with limiter is not finished")
+	}
+	require.GreaterOrEqual(t, time.Since(start), 700*time.Millisecond)
+	task2, err = tm.GetTaskByID(ctx, task2.ID)
+	require.NoError(t, err)
+	checkAfterSwitchStep(t, startTime, task2, subtasks2, proto.StepOne)
+}
+
+func TestCancelSubtaskGroup(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	taskID, err := tm.CreateTask(ctx, "key1", "test", 4, []byte("test"))
+	require.NoError(t, err)
+	task, err := tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	subtasks := make([]*proto.Subtask, 6)
+	for i := 0; i < len(subtasks); i++ {
+		subtasks[i] = proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+			":4000", 11, []byte(fmt.Sprintf("%d", i)), i+1)
+		subtasks[i].Group = fmt.Sprintf("g%d", i%2+1)
+	}
+	require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+	createdSubtasks, err := tm.GetAllSubtasksByStepAndState(ctx, taskID, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Len(t, createdSubtasks, 6)
+	subtasksByGroup := make(map[string][]*proto.Subtask)
+	for _, subtask := range createdSubtasks {
+		subtasksByGroup[subtask.Group] = append(subtasksByGroup[subtask.Group], subtask)
+	}
+	require.Len(t, subtasksByGroup["g1"], 3)
+	require.Len(t, subtasksByGroup["g2"], 3)
+	// start one subtask of each group.
+	require.NoError(t, tm.StartSubtask(ctx, subtasksByGroup["g1"][0].ID, ":4000"))
+	require.NoError(t, tm.StartSubtask(ctx, subtasksByGroup["g2"][0].ID, ":4000"))
+
+	require.NoError(t, tm.CancelSubtaskGroup(ctx, taskID, "g1"))
+	getStates := func() map[int64]proto.SubtaskState {
+		subtasks, err := tm.GetSubtasksWithHistory(ctx, taskID, proto.StepOne)
+		require.NoError(t, err)
+		states := make(map[int64]proto.SubtaskState, len(subtasks))
+		for _, subtask := range subtasks {
+			states[subtask.ID] = subtask.State
+		}
+		return states
+	}
+	states := getStates()
+	for _, subtask := range subtasksByGroup["g1"] {
+		require.Equal(t, proto.SubtaskStateCanceled, states[subtask.ID])
+	}
+	g2Subtasks := subtasksByGroup["g2"]
+	require.Equal(t, proto.SubtaskStateRunning, states[g2Subtasks[0].ID])
+	for _, subtask := range g2Subtasks[1:] {
+		require.Equal(t, proto.SubtaskStatePending, states[subtask.ID])
+	}
+	cnt, err := tm.GetGroupCanceledSubtaskCnt(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, cnt)
+	cntByStates, err := tm.GetSubtaskCntGroupByStates(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.Equal(t, map[proto.SubtaskState]int64{
+		proto.SubtaskStateCanceled: 3,
+		proto.SubtaskStateRunning:  1,
+		proto.SubtaskStatePending:  2,
+	}, cntByStates)
+	// the other group keeps running.
+	require.NoError(t, tm.FinishSubtask(ctx, ":4000", g2Subtasks[0].ID, nil))
+	// cancel a group which doesn't exist is a no-op.
+	require.NoError(t, tm.CancelSubtaskGroup(ctx, taskID, "g3"))
+	cnt, err = tm.GetGroupCanceledSubtaskCnt(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, cnt)
+}
+
+func TestSubtaskSerialKey(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	require.NoError(t, tm.InitMeta(ctx, ":4001", ""))
+	taskID, err := tm.CreateTask(ctx, "key1", "test", 4, []byte("test"))
+	require.NoError(t, err)
+	task, err := tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	// serial keys are interleaved, and subtasks with the same key are on
+	// different nodes.
+	subtasks := make([]*proto.Subtask, 5)
+	for i := 0; i < len(subtasks); i++ {
+		subtasks[i] = proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+			fmt.Sprintf(":%d", 4000+i/2), 11, []byte(fmt.Sprintf("%d", i)), i+1)
+		if i < 4 {
+			subtasks[i].SerialKey = fmt.Sprintf("p%d", i%2+1)
+		}
+	}
+	require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+	createdSubtasks, err := tm.GetSubtasksWithHistory(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, createdSubtasks, 5)
+	slices.SortFunc(createdSubtasks, func(a, b *proto.Subtask) int {
+		return a.Ordinal - b.Ordinal
+	})
+	for i, subtask := range createdSubtasks {
+		require.Equal(t, subtasks[i].SerialKey, subtask.SerialKey)
+	}
+	p1OnNode1, p2OnNode1 := createdSubtasks[0], createdSubtasks[1]
+	p1OnNode2, p2OnNode2 := createdSubtasks[2], createdSubtasks[3]
+	noKeySubtask := createdSubtasks[4]
+
+	require.NoError(t, tm.StartSubtask(ctx, p1OnNode1.ID, ":4000"))
+	// the pending subtask with the same key on other node can't be started.
+	err = tm.StartSubtask(ctx, p1OnNode2.ID, ":4001")
+	require.ErrorIs(t, err, storage.ErrSubtaskSerialKeyBusy)
+	next, err := tm.GetFirstSubtaskInStates(ctx, ":4001", taskID, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Equal(t, p2OnNode2.ID, next.ID)
+	// different keys run in parallel.
+	require.NoError(t, tm.StartSubtask(ctx, p2OnNode2.ID, ":4001"))
+	err = tm.StartSubtask(ctx, p2OnNode1.ID, ":4000")
+	require.ErrorIs(t, err, storage.ErrSubtaskSerialKeyBusy)
+	next, err = tm.GetFirstSubtaskInStates(ctx, ":4000", taskID, proto.StepOne,
+		proto.SubtaskStatePending, proto.SubtaskStateRunning)
+	require.NoError(t, err)
+	require.Equal(t, p1OnNode1.ID, next.ID)
+	next, err = tm.GetFirstSubtaskInStates(ctx, ":4002", taskID, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Equal(t, noKeySubtask.ID, next.ID)
+	require.NoError(t, tm.StartSubtask(ctx, noKeySubtask.ID, ":4002"))
+
+	// after the running one finishes, the other subtask with the same key can start.
+	require.NoError(t, tm.FinishSubtask(ctx, ":4000", p1OnNode1.ID, nil))
+	require.NoError(t, tm.StartSubtask(ctx, p1OnNode2.ID, ":4001"))
+	require.NoError(t, tm.FinishSubtask(ctx, ":4001", p2OnNode2.ID, nil))
+	require.NoError(t, tm.StartSubtask(ctx, p2OnNode1.ID, ":4000"))
+	cntByStates, err := tm.GetSubtaskCntGroupByStates(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.Equal(t, map[proto.SubtaskState]int64{
+		proto.SubtaskStateSucceed: 2,
+		proto.SubtaskStateRunning: 3,
+	}, cntByStates)
+}
+
+func TestRequeueSubtaskWithMeta(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	taskID, err := tm.CreateTask(ctx, "key1", "test", 4, []byte("test"))
+	require.NoError(t, err)
+	testutil.CreateSubTask(t, tm, taskID, proto.StepOne, ":4000", []byte("bad"), proto.TaskTypeExample, 11)
+	subtask, err := tm.GetFirstSubtaskInStates(ctx, ":4000", taskID, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bad"), subtask.Meta)
+
+	// pending or running subtask can't be requeued.
+	err = tm.RequeueSubtaskWithMeta(ctx, subtask.ID, []byte("good"))
+	require.ErrorIs(t, err, storage.ErrInvalidSubtaskStateTransform)
+	require.NoError(t, tm.StartSubtask(ctx, subtask.ID, ":4000"))
+	err = tm.RequeueSubtaskWithMeta(ctx, subtask.ID, []byte("good"))
+	require.ErrorIs(t, err, storage.ErrInvalidSubtaskStateTransform)
+	require.NoError(t, tm.FailSubtask(ctx, ":4000", taskID, errors.New("bad meta")))
+	subtaskErrs, err := tm.GetSubtaskErrors(ctx, taskID)
+	require.NoError(t, err)
+	require.Len(t, subtaskErrs, 1)
+	require.ErrorContains(t, subtaskErrs[0], "bad meta")
+
+	// requeue the failed subtask with the fixed meta, and it succeeds then.
+	require.NoError(t, tm.RequeueSubtaskWithMeta(ctx, subtask.ID, []byte("good")))
+	subtask, err = tm.GetFirstSubtaskInStates(ctx, ":4000", taskID, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Equal(t, []byte("good"), subtask.Meta)
+	subtaskErrs, err = tm.GetSubtaskErrors(ctx, taskID)
+	require.NoError(t, err)
+	require.Empty(t, subtaskErrs)
+	require.NoError(t, tm.StartSubtask(ctx, subtask.ID, ":4000"))
+	require.NoError(t, tm.FinishSubtask(ctx, ":4000", subtask.ID, []byte("good")))
+	subtask, err = tm.GetFirstSubtaskInStates(ctx, ":4000", taskID, proto.StepOne, proto.SubtaskStateSucceed)
+	require.NoError(t, err)
+	require.Equal(t, []byte("good"), subtask.Meta)
+
+	// succeeded subtask can't be requeued.
+	err = tm.RequeueSubtaskWithMeta(ctx, subtask.ID, []byte("other"))
+	require.ErrorIs(t, err, storage.ErrInvalidSubtaskStateTransform)
+	err = tm.RequeueSubtaskWithMeta(ctx, subtask.ID+100, []byte("other"))
+	require.ErrorIs(t, err, storage.ErrSubtaskNotFound)
+}
+
+func TestSubtaskLatencyPercentiles(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	taskID, err := tm.CreateTask(ctx, "key1", "test", 4, []byte("test"))
+	require.NoError(t, err)
+	task, err := tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	subtasks := make([]*proto.Subtask, 11)
+	for i := 0; i < len(subtasks); i++ {
+		subtasks[i] = proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+			":4000", 11, []byte(fmt.Sprintf("%d", i)), i+1)
+	}
+	require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+	latencies, err := tm.GetSubtaskLatencyPercentiles(ctx, taskID, proto.StepOne, 50)
+	require.NoError(t, err)
+	require.Nil(t, latencies)
+
+	createdSubtasks, err := tm.GetAllSubtasksByStepAndState(ctx, taskID, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Len(t, createdSubtasks, 11)
+	// the last subtask is left running, it's not counted.
+	startTime := time.Unix(time.Now().Unix(), 0)
+	for i, subtask := range createdSubtasks {
+		require.NoError(t, tm.StartSubtask(ctx, subtask.ID, ":4000"))
+		if i < 10 {
+			require.NoError(t, tm.FinishSubtask(ctx, ":4000", subtask.ID, nil))
+		}
+	}
+	gotSubtasks, err := tm.GetSubtasksWithHistory(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, gotSubtasks, 11)
+	for _, subtask := range gotSubtasks {
+		require.GreaterOrEqual(t, subtask.StartTime, startTime)
+		if subtask.State == proto.SubtaskStateRunning {
+			require.True(t, subtask.EndTime.IsZero())
+			continue
+		}
+		require.Equal(t, proto.SubtaskStateSucceed, subtask.State)
+		require.GreaterOrEqual(t, subtask.EndTime, subtask.StartTime)
+	}
+
+	// subtasks take 1s to 10s to finish.
+	for i, subtask := range createdSubtasks[:10] {
+		_, err = tm.ExecuteSQLWithNewSession(ctx, `update mysql.tidb_background_subtask
+			set start_time = unix_timestamp(end_time) - %? where id = %?`, i+1, subtask.ID)
+		require.NoError(t, err)
+	}
+	latencies, err = tm.GetSubtaskLatencyPercentiles(ctx, taskID, proto.StepOne, 10, 50, 90, 99, 100)
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{time.Second, 5 * time.Second, 9 * time.Second,
+		10 * time.Second, 10 * time.Second}, latencies)
+	// subtasks in history table are counted too.
+	require.NoError(t, testutil.TransferSubTasks2History(ctx, tm, taskID))
+	latencies, err = tm.GetSubtaskLatencyPercentiles(ctx, taskID, proto.StepOne, 50)
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{5 * time.Second}, latencies)
+}
+
+func TestInsertSubtasks(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+
+	require.ErrorIs(t, tm.InsertSubtasks(ctx, 1, proto.StepOne, [][]byte{[]byte("0")}), storage.ErrTaskNotFound)
+	taskID, err := tm.CreateTask(ctx, "key1", proto.TaskTypeExample, 4, []byte("test"))
+	require.NoError(t, err)
+	const subtaskCnt = 10000
+	metas := make([][]byte, 0, subtaskCnt)
+	for i := 0; i < subtaskCnt; i++ {
+		metas = append(metas, []byte(fmt.Sprintf("%d", i)))
+	}
+	require.NoError(t, tm.InsertSubtasks(ctx, taskID, proto.StepOne, metas))
+
+	cntByStates, err := tm.GetSubtaskCntGroupByStates(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.Equal(t, map[proto.SubtaskState]int64{proto.SubtaskStatePending: subtaskCnt}, cntByStates)
+	cntByStates, err = tm.GetSubtaskCntGroupByStates(ctx, taskID, proto.StepTwo)
+	require.NoError(t, err)
+	require.Empty(t, cntByStates)
+	subtasks, err := tm.GetAllSubtasksByStepAndState(ctx, taskID, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Len(t, subtasks, subtaskCnt)
+	slices.SortFunc(subtasks, func(i, j *proto.Subtask) int {
+		return cmp.Compare(i.Ordinal, j.Ordinal)
+	})
+	for i, subtask := range subtasks {
+		require.Equal(t, proto.StepOne, subtask.Step)
+		require.Equal(t, proto.TaskTypeExample, subtask.Type)
+		require.Equal(t, ":4000", subtask.ExecID)
+		require.Equal(t, 4, subtask.Concurrency)
+		require.Equal(t, i+1, subtask.Ordinal)
+		require.Equal(t, metas[i], subtask.Meta)
+	}
+}
+
 func TestGetTopUnfinishedTasks(t *testing.T) {
 	_, gm, ctx := testutil.InitTableTest(t)
 
@@ -415,6 +822,47 @@ func TestGetTopUnfinishedTasks(t *testing.T) {
 	require.Equal(t, []string{"key/6", "key/5", "key/1", "key/2", "key/3", "key/4", "key/8", "key/9"}, taskKeys)
 }
 
+func TestGetTasksByOwner(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+
+	taskIDs := make([]int64, 0, 4)
+	for i := 0; i < 4; i++ {
+		taskID, err := tm.CreateTask(ctx, fmt.Sprintf("key%d", i), proto.TaskTypeExample, 1, nil)
+		require.NoError(t, err)
+		taskIDs = append(taskIDs, taskID)
+	}
+	getOwnedTaskIDs := func(serverID string) []int64 {
+		tasks, err := tm.GetTasksByOwner(ctx, serverID)
+		require.NoError(t, err)
+		ids := make([]int64, 0, len(tasks))
+		for _, task := range tasks {
+			require.Equal(t, serverID, task.SchedulerID)
+			ids = append(ids, task.ID)
+		}
+		return ids
+	}
+	require.Empty(t, getOwnedTaskIDs(":4000"))
+
+	require.NoError(t, tm.UpdateTaskOwner(ctx, taskIDs[0], ":4000"))
+	require.NoError(t, tm.UpdateTaskOwner(ctx, taskIDs[1], ":4001"))
+	require.NoError(t, tm.UpdateTaskOwner(ctx, taskIDs[2], ":4000"))
+	require.Equal(t, []int64{taskIDs[0], taskIDs[2]}, getOwnedTaskIDs(":4000"))
+	require.Equal(t, []int64{taskIDs[1]}, getOwnedTaskIDs(":4001"))
+	require.Empty(t, getOwnedTaskIDs(":4002"))
+
+	// owner changed, such as the owner of the cluster changed.
+	require.NoError(t, tm.UpdateTaskOwner(ctx, taskIDs[0], ":4001"))
+	require.Equal(t, []int64{taskIDs[2]}, getOwnedTaskIDs(":4000"))
+	require.Equal(t, []int64{taskIDs[0], taskIDs[1]}, getOwnedTaskIDs(":4001"))
+
+	// finished tasks are not returned.
+	task, err := tm.GetTaskByID(ctx, taskIDs[2])
+	require.NoError(t, err)
+	require.NoError(t, tm.FailTask(ctx, task.ID, task.State, errors.New("mock err")))
+	require.Empty(t, getOwnedTaskIDs(":4000"))
+}
+
 func TestGetUsedSlotsOnNodes(t *testing.T) {
 	_, sm, ctx := testutil.InitTableTest(t)
 
@@ -690,6 +1138,336 @@ func TestGetSubtaskCntByStates(t *testing.T) {
 	require.Equal(t, int64(1), cntByStates[proto.SubtaskStateFailed])
 }
 
+func TestDescribeTask(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+
+	_, err := tm.DescribeTask(ctx, 1)
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+
+	taskID, err := tm.CreateTask(ctx, "key1", proto.TaskTypeExample, 4, []byte("test"))
+	require.NoError(t, err)
+	task, err := tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	subtasks := make([]*proto.Subtask, 3)
+	for i := 0; i < len(subtasks); i++ {
+		subtasks[i] = proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+			":4000", 4, []byte(fmt.Sprintf("%d", i)), i+1)
+	}
+	require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+	subtasks, err = tm.GetSubtasksWithHistory(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.NoError(t, tm.StartSubtask(ctx, subtasks[0].ID, ":4000"))
+	require.NoError(t, tm.FinishSubtask(ctx, ":4000", subtasks[0].ID, nil))
+	require.NoError(t, tm.StartSubtask(ctx, subtasks[1].ID, ":4000"))
+	require.NoError(t, tm.UpdateSubtaskStateAndError(ctx, ":4000", subtasks[1].ID,
+		proto.SubtaskStateFailed, errors.New("mock subtask error")))
+
+	desc, err := tm.DescribeTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Contains(t, desc, fmt.Sprintf("id: %d\n", taskID))
+	require.Contains(t, desc, "key: key1\n")
+	require.Contains(t, desc, "type: Example\n")
+	require.Contains(t, desc, "state: running\n")
+	require.Contains(t, desc, "step: one\n")
+	require.Contains(t, desc, "concurrency: 4\n")
+	require.Contains(t, desc, "progress: 1/3 subtasks succeed (failed: 1, pending: 1, succeed: 1)\n")
+	require.Contains(t, desc, "recent subtask errors:\n  - ")
+	require.Contains(t, desc, "mock subtask error\n")
+	require.NotContains(t, desc, "\nerror: ")
+	require.NotContains(t, desc, "status message: ")
+}
+
+func TestGetWeightedTaskProgress(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+
+	_, err := tm.GetWeightedTaskProgress(ctx, 1)
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+
+	taskID, err := tm.CreateTask(ctx, "key1", proto.TaskTypeExample, 4, []byte("test"))
+	require.NoError(t, err)
+	progress, err := tm.GetWeightedTaskProgress(ctx, taskID)
+	require.NoError(t, err)
+	require.Zero(t, progress)
+
+	task, err := tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	// the last subtask has the default weight.
+	weights := []int64{1, 1, 6, 0}
+	subtasks := make([]*proto.Subtask, len(weights))
+	for i, w := range weights {
+		subtasks[i] = proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+			":4000", 4, []byte(fmt.Sprintf("%d", i)), i+1)
+		subtasks[i].Weight = w
+	}
+	require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+	subtasks, err = tm.GetSubtasksWithHistory(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	slices.SortFunc(subtasks, func(a, b *proto.Subtask) int {
+		return cmp.Compare(a.Ordinal, b.Ordinal)
+	})
+	for i, subtask := range subtasks {
+		require.Equal(t, weights[i], subtask.Weight)
+	}
+
+	// 2 of 4 subtasks succeed, but they're only 2 of total weight 9.
+	for _, subtask := range subtasks[:2] {
+		require.NoError(t, tm.StartSubtask(ctx, subtask.ID, ":4000"))
+		require.NoError(t, tm.FinishSubtask(ctx, ":4000", subtask.ID, nil))
+	}
+	progress, err = tm.GetWeightedTaskProgress(ctx, taskID)
+	require.NoError(t, err)
+	require.InDelta(t, 2.0/9, progress, 1e-9)
+	require.Less(t, progress, 2.0/4)
+
+	require.NoError(t, tm.StartSubtask(ctx, subtasks[2].ID, ":4000"))
+	require.NoError(t, tm.FinishSubtask(ctx, ":4000", subtasks[2].ID, nil))
+	progress, err = tm.GetWeightedTaskProgress(ctx, taskID)
+	require.NoError(t, err)
+	require.InDelta(t, 8.0/9, progress, 1e-9)
+	require.Greater(t, progress, 3.0/4)
+
+	// subtasks in history table are counted too.
+	require.NoError(t, tm.StartSubtask(ctx, subtasks[3].ID, ":4000"))
+	require.NoError(t, tm.FinishSubtask(ctx, ":4000", subtasks[3].ID, nil))
+	require.NoError(t, testutil.TransferSubTasks2History(ctx, tm, taskID))
+	progress, err = tm.GetWeightedTaskProgress(ctx, taskID)
+	require.NoError(t, err)
+	require.InDelta(t, 1.0, progress, 1e-9)
+}
+
+func TestDiagnosePendingTask(t *testing.T) {
+	store, tm, ctx := testutil.InitTableTest(t)
+	tk := testkit.NewTestKit(t, store)
+
+	_, err := tm.DiagnosePendingTask(ctx, 1)
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+
+	// no node.
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	bigTaskID, err := tm.CreateTask(ctx, "big", proto.TaskTypeExample, 4, nil)
+	require.NoError(t, err)
+	tk.MustExec(`delete from mysql.dist_framework_meta`)
+	reasons, err := tm.DiagnosePendingTask(ctx, bigTaskID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"no node is available to run the task"}, reasons)
+
+	// nothing blocks the task.
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	tk.MustExec(`update mysql.dist_framework_meta set cpu_count = 8`)
+	reasons, err = tm.DiagnosePendingTask(ctx, bigTaskID)
+	require.NoError(t, err)
+	require.Empty(t, reasons)
+
+	// no allowed node.
+	taskID, err := tm.CreateTaskWithParams(ctx, "allowlist", proto.TaskTypeExample, 1, nil,
+		proto.ExtraParams{NodeAllowlist: []string{"tidb-1", "tidb-2"}})
+	require.NoError(t, err)
+	reasons, err = tm.DiagnosePendingTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"none of the allowed nodes [tidb-1, tidb-2] is available"}, reasons)
+
+	// paused.
+	taskID, err = tm.CreateTask(ctx, "pause", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	found, err := tm.PauseTask(ctx, "pause")
+	require.NoError(t, err)
+	require.True(t, found)
+	reasons, err = tm.DiagnosePendingTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"task is pausing, it's waiting to be resumed manually"}, reasons)
+	require.NoError(t, tm.PausedTask(ctx, taskID))
+	reasons, err = tm.DiagnosePendingTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"task is paused, it's waiting to be resumed manually"}, reasons)
+	taskID, err = tm.CreateTask(ctx, "pause-until", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	resumeAt := time.Now().Add(time.Hour)
+	found, err = tm.PauseUntil(ctx, taskID, resumeAt)
+	require.NoError(t, err)
+	require.True(t, found)
+	reasons, err = tm.DiagnosePendingTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"task is pausing, it will be resumed at " +
+		time.Unix(resumeAt.Unix(), 0).Format(time.DateTime)}, reasons)
+
+	// flagged by scheduler.
+	taskID, err = tm.CreateTask(ctx, "flagged", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, tm.SetTaskStatusMessage(ctx, taskID, "unsupported task type"))
+	reasons, err = tm.DiagnosePendingTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"scheduler reports: unsupported task type"}, reasons)
+
+	// no enough slots, the big task of higher rank is running.
+	taskID, err = tm.CreateTask(ctx, "no-slots", proto.TaskTypeExample, 8, nil)
+	require.NoError(t, err)
+	reasons, err = tm.DiagnosePendingTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Empty(t, reasons)
+	tk.MustExec(fmt.Sprintf(`update mysql.tidb_global_task set state = 'running' where id = %d`, bigTaskID))
+	testutil.InsertSubtask(t, tm, bigTaskID, proto.StepOne, ":4000", proto.EmptyMeta, proto.SubtaskStateRunning, proto.TaskTypeExample, 4)
+	reasons, err = tm.DiagnosePendingTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"no node has enough free slots, the task requires 8 slots, " +
+		"slot capacity of node is 8, 4 slots are reserved by tasks of higher rank"}, reasons)
+	// running task isn't diagnosed.
+	reasons, err = tm.DiagnosePendingTask(ctx, bigTaskID)
+	require.NoError(t, err)
+	require.Empty(t, reasons)
+
+	// max concurrent task count is reached, the big task and the pausing task
+	// are scheduled.
+	bak := proto.MaxConcurrentTask
+	proto.MaxConcurrentTask = 2
+	t.Cleanup(func() {
+		proto.MaxConcurrentTask = bak
+	})
+	reasons, err = tm.DiagnosePendingTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"max concurrent task count 2 is reached",
+		"no node has enough free slots, the task requires 8 slots, " +
+			"slot capacity of node is 8, 4 slots are reserved by tasks of higher rank",
+	}, reasons)
+}
+
+func TestSetTaskStatusMessage(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+
+	taskID, err := tm.CreateTask(ctx, "key1", proto.TaskTypeExample, 4, []byte("test"))
+	require.NoError(t, err)
+	require.NoError(t, tm.SetTaskStatusMessage(ctx, taskID, "merging SST files"))
+	task, err := tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, "merging SST files", task.ExtraParams.StatusMessage)
+	desc, err := tm.DescribeTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Contains(t, desc, "status message: merging SST files\n")
+
+	// other extra params are kept.
+	require.NoError(t, tm.CancelTask(ctx, taskID))
+	require.NoError(t, tm.SetTaskStatusMessage(ctx, taskID, "ingesting"))
+	task, err = tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, "ingesting", task.ExtraParams.StatusMessage)
+	require.Equal(t, proto.CancelModeForce, task.ExtraParams.CancelMode)
+
+	// clear the message.
+	require.NoError(t, tm.SetTaskStatusMessage(ctx, taskID, ""))
+	task, err = tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	require.Empty(t, task.ExtraParams.StatusMessage)
+	require.Equal(t, proto.CancelModeForce, task.ExtraParams.CancelMode)
+	desc, err = tm.DescribeTask(ctx, taskID)
+	require.NoError(t, err)
+	require.NotContains(t, desc, "status message: ")
+}
+
+func TestConsumeRetryBudget(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+
+	// task without budget.
+	taskID, err := tm.CreateTask(ctx, "key1", proto.TaskTypeExample, 4, []byte("test"))
+	require.NoError(t, err)
+	consumed, err := tm.ConsumeRetryBudget(ctx, taskID)
+	require.NoError(t, err)
+	require.False(t, consumed)
+
+	taskID, err = tm.CreateTaskWithParams(ctx, "key2", proto.TaskTypeExample, 4, []byte("test"),
+		proto.ExtraParams{RetryBudget: 3, StatusMessage: "importing"})
+	require.NoError(t, err)
+	for i := 1; i <= 3; i++ {
+		consumed, err = tm.ConsumeRetryBudget(ctx, taskID)
+		require.NoError(t, err)
+		require.True(t, consumed)
+		task, err := tm.GetTaskByID(ctx, taskID)
+		require.NoError(t, err)
+		require.Equal(t, i, task.ExtraParams.SubtaskRetries)
+	}
+	// the budget is exhausted.
+	consumed, err = tm.ConsumeRetryBudget(ctx, taskID)
+	require.NoError(t, err)
+	require.False(t, consumed)
+	task, err := tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, 3, task.ExtraParams.RetryBudget)
+	require.Equal(t, 3, task.ExtraParams.SubtaskRetries)
+	require.Equal(t, "importing", task.ExtraParams.StatusMessage)
+}
+
+func TestSubtaskCompaction(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	// compaction is off by default.
+	require.EqualValues(t, 0, storage.SubtaskCompactionThreshold)
+	storage.SubtaskCompactionThreshold = 1000
+	t.Cleanup(func() {
+		storage.SubtaskCompactionThreshold = 0
+	})
+
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	taskID, err := tm.CreateTask(ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	task, err := tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	subtasks := make([]*proto.Subtask, 2000)
+	for i := 0; i < len(subtasks); i++ {
+		subtasks[i] = proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+			":4000", 1, proto.EmptyMeta, i+1)
+	}
+	require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+	subtasks, err = testutil.GetSubtasksByTaskID(ctx, tm, taskID)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 2000)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, tm.UpdateSubtaskStateAndError(ctx, ":4000", subtasks[i].ID,
+			proto.SubtaskStateFailed, errors.Errorf("mock subtask error %d", i)))
+	}
+	_, err = tm.ExecuteSQLWithNewSession(ctx, `update mysql.tidb_background_subtask
+		set state = %? where task_key = %? and state = %?`,
+		proto.SubtaskStateSucceed, taskID, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.NoError(t, tm.TransferTasks2History(ctx, []*proto.Task{task}))
+
+	// one aggregated row for each state.
+	num, err := testutil.GetSubtasksFromHistoryByTaskID(ctx, tm, taskID)
+	require.NoError(t, err)
+	require.Equal(t, 2, num)
+	rs, err := tm.ExecuteSQLWithNewSession(ctx, `select summary from mysql.tidb_background_subtask_history
+		where task_key = %? and state = %?`, taskID, proto.SubtaskStateFailed)
+	require.NoError(t, err)
+	require.Len(t, rs, 1)
+	var summary storage.CompactedSubtaskSummary
+	require.NoError(t, json.Unmarshal([]byte(rs[0].GetJSON(0).String()), &summary))
+	require.EqualValues(t, 10, summary.CompactedCount)
+	require.Len(t, summary.ErrorSamples, 3)
+	require.Contains(t, summary.ErrorSamples[0], "mock subtask error 0")
+
+	desc, err := tm.DescribeTask(ctx, taskID)
+	require.NoError(t, err)
+	require.Contains(t, desc, "progress: 1990/2000 subtasks succeed (failed: 10, succeed: 1990)\n")
+	require.Contains(t, desc, "mock subtask error 0\n")
+
+	// tasks with fewer subtasks are not compacted.
+	taskID, err = tm.CreateTask(ctx, "key2", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	task, err = tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	subtasks = make([]*proto.Subtask, 5)
+	for i := 0; i < len(subtasks); i++ {
+		subtasks[i] = proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+			":4000", 1, proto.EmptyMeta, i+1)
+	}
+	require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+	require.NoError(t, tm.TransferTasks2History(ctx, []*proto.Task{task}))
+	num, err = testutil.GetSubtasksFromHistoryByTaskID(ctx, tm, taskID)
+	require.NoError(t, err)
+	require.Equal(t, 5, num)
+}
+
 func TestDistFrameworkMeta(t *testing.T) {
 	_, sm, ctx := testutil.InitTableTest(t)
 
@@ -834,6 +1612,53 @@ func TestSubtaskHistoryTable(t *testing.T) {
 	require.Equal(t, 1, historySubTasksCnt)
 }
 
+func TestTaskMatrix(t *testing.T) {
+	_, gm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, gm.InitMeta(ctx, ":4000", ""))
+
+	matrix, err := gm.TaskMatrix(ctx)
+	require.NoError(t, err)
+	require.Empty(t, matrix)
+
+	createTask := func(key string, tp proto.TaskType) int64 {
+		taskID, err := gm.CreateTask(ctx, key, tp, 1, nil)
+		require.NoError(t, err)
+		return taskID
+	}
+	createTask("example-1", proto.TaskTypeExample)
+	createTask("example-2", proto.TaskTypeExample)
+	taskID := createTask("example-3", proto.TaskTypeExample)
+	require.NoError(t, gm.CancelTask(ctx, taskID))
+	taskID = createTask("example-4", proto.TaskTypeExample)
+	require.NoError(t, gm.FailTask(ctx, taskID, proto.TaskStatePending, errors.New("mock err")))
+	createTask("import-1", proto.ImportInto)
+	taskID = createTask("import-2", proto.ImportInto)
+	require.NoError(t, gm.FailTask(ctx, taskID, proto.TaskStatePending, errors.New("mock err")))
+	taskID = createTask("backfill-1", proto.Backfill)
+	require.NoError(t, gm.FailTask(ctx, taskID, proto.TaskStatePending, errors.New("mock err")))
+	// tasks in history table are counted too.
+	task, err := gm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	require.NoError(t, gm.TransferTasks2History(ctx, []*proto.Task{task}))
+
+	matrix, err = gm.TaskMatrix(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[proto.TaskType]map[proto.TaskState]int{
+		proto.TaskTypeExample: {
+			proto.TaskStatePending:    2,
+			proto.TaskStateCancelling: 1,
+			proto.TaskStateFailed:     1,
+		},
+		proto.ImportInto: {
+			proto.TaskStatePending: 1,
+			proto.TaskStateFailed:  1,
+		},
+		proto.Backfill: {
+			proto.TaskStateFailed: 1,
+		},
+	}, matrix)
+}
+
 func TestTaskHistoryTable(t *testing.T) {
 	_, gm, ctx := testutil.InitTableTest(t)
 
@@ -883,6 +1708,141 @@ func TestTaskHistoryTable(t *testing.T) {
 	num, err = testutil.GetTasksFromHistory(ctx, gm)
 	require.NoError(t, err)
 	require.Equal(t, 3, num)
+
+	// ephemeral task is deleted directly, normal task is moved to history.
+	_, err = gm.CreateTask(ctx, "4", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	_, err = gm.CreateTaskWithParams(ctx, "5", proto.TaskTypeExample, 1, nil, proto.ExtraParams{Ephemeral: true})
+	require.NoError(t, err)
+	tasks, err = gm.GetTasksInStates(ctx, proto.TaskStatePending)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(tasks))
+	for _, task := range tasks {
+		testutil.InsertSubtask(t, gm, task.ID, proto.StepOne, "tidb1", proto.EmptyMeta, proto.SubtaskStateSucceed, proto.TaskTypeExample, 1)
+	}
+	require.NoError(t, gm.TransferTasks2History(ctx, tasks))
+	num, err = testutil.GetTasksFromHistory(ctx, gm)
+	require.NoError(t, err)
+	require.Equal(t, 4, num)
+	task, err = gm.GetTaskByKeyWithHistory(ctx, "4")
+	require.NoError(t, err)
+	require.False(t, task.ExtraParams.Ephemeral)
+	num, err = testutil.GetSubtasksFromHistoryByTaskID(ctx, gm, task.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, num)
+	_, err = gm.GetTaskByKeyWithHistory(ctx, "5")
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+	for _, task := range tasks {
+		if !task.ExtraParams.Ephemeral {
+			continue
+		}
+		num, err = testutil.GetSubtasksFromHistoryByTaskID(ctx, gm, task.ID)
+		require.NoError(t, err)
+		require.Equal(t, 0, num)
+		cntByStates, err := gm.GetSubtaskCntGroupByStates(ctx, task.ID, proto.StepOne)
+		require.NoError(t, err)
+		require.Empty(t, cntByStates)
+	}
+}
+
+func TestReplayTask(t *testing.T) {
+	_, gm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, gm.InitMeta(ctx, ":4000", ""))
+
+	inputParams := proto.ExtraParams{
+		Seed:                123,
+		NodeAllowlist:       []string{":4000"},
+		PurgeSubtaskSummary: true,
+		RetryBudget:         10,
+		NoAutoRetry:         true,
+		MetaVersion:         2,
+		TimeoutSeconds:      3600,
+		SubtaskMetaBudget:   1024,
+	}
+	taskID, err := gm.CreateTaskWithParams(ctx, "key1", proto.TaskTypeExample, 2, []byte("meta"), inputParams)
+	require.NoError(t, err)
+	// the state of the run is kept in extra params too.
+	runParams := inputParams
+	runParams.ResumeAt = time.Now().Unix()
+	runParams.StartAfter = time.Now().Unix()
+	runParams.TraceContext = map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	runParams.CancelMode = proto.CancelModeGraceful
+	runParams.StatusMessage = "merging SST files"
+	runParams.SubtaskRetries = 3
+	runParams.ParentTaskID = 100
+	runParams.WaitForChildren = true
+	runParams.FreezeGeneration = true
+	runParams.StepIteration = 5
+	runParams.Poked = true
+	runParams.CleanUpPending = true
+	bs, err := json.Marshal(runParams)
+	require.NoError(t, err)
+	require.NoError(t, gm.WithNewSession(func(se sessionctx.Context) error {
+		_, err := se.GetSQLExecutor().ExecuteInternal(ctx, `
+				update mysql.tidb_global_task set state = %?, extra_params = %? where id = %?`,
+			proto.TaskStateReverted, string(bs), taskID)
+		return err
+	}))
+	task, err := gm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, runParams, task.ExtraParams)
+	require.NoError(t, gm.TransferTasks2History(ctx, []*proto.Task{task}))
+
+	_, err = gm.ReplayTask(ctx, taskID+100, "key2")
+	require.ErrorIs(t, err, storage.ErrTaskNotFound)
+	replayedID, err := gm.ReplayTask(ctx, taskID, "key2")
+	require.NoError(t, err)
+	replayed, err := gm.GetTaskByID(ctx, replayedID)
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskStatePending, replayed.State)
+	require.Equal(t, proto.TaskTypeExample, replayed.Type)
+	require.Equal(t, 2, replayed.Concurrency)
+	require.Equal(t, []byte("meta"), replayed.Meta)
+	require.Equal(t, inputParams, replayed.ExtraParams)
+}
+
+func TestPurgeSubtaskSummary(t *testing.T) {
+	_, gm, ctx := testutil.InitTableTest(t)
+
+	require.NoError(t, gm.InitMeta(ctx, ":4000", ""))
+	_, err := gm.CreateTask(ctx, "keep", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	_, err = gm.CreateTaskWithParams(ctx, "purge", proto.TaskTypeExample, 1, nil, proto.ExtraParams{PurgeSubtaskSummary: true})
+	require.NoError(t, err)
+	tasks, err := gm.GetTasksInStates(ctx, proto.TaskStatePending)
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	for _, task := range tasks {
+		for i := 0; i < 2; i++ {
+			testutil.InsertSubtask(t, gm, task.ID, proto.StepOne, "tidb1", proto.EmptyMeta, proto.SubtaskStateSucceed, proto.TaskTypeExample, 1)
+		}
+		subtasks, err := gm.GetSubtasksWithHistory(ctx, task.ID, proto.StepOne)
+		require.NoError(t, err)
+		for _, subtask := range subtasks {
+			require.NoError(t, gm.UpdateSubtaskRowCount(ctx, subtask.ID, 100))
+		}
+	}
+	require.NoError(t, gm.TransferTasks2History(ctx, tasks))
+
+	for _, task := range tasks {
+		historyTask, err := gm.GetTaskByIDWithHistory(ctx, task.ID)
+		require.NoError(t, err)
+		require.Equal(t, task.ExtraParams.PurgeSubtaskSummary, historyTask.ExtraParams.PurgeSubtaskSummary)
+		num, err := testutil.GetSubtasksFromHistoryByTaskID(ctx, gm, task.ID)
+		require.NoError(t, err)
+		require.Equal(t, 2, num)
+		subtasks, err := gm.GetSubtasksWithHistory(ctx, task.ID, proto.StepOne)
+		require.NoError(t, err)
+		require.Len(t, subtasks, 2)
+		for _, subtask := range subtasks {
+			require.Equal(t, proto.SubtaskStateSucceed, subtask.State)
+			if task.ExtraParams.PurgeSubtaskSummary {
+				require.Equal(t, "{}", subtask.Summary)
+			} else {
+				require.Contains(t, subtask.Summary, "row_count")
+			}
+		}
+	}
 }
 
 func TestPauseAndResume(t *testing.T) {
@@ -915,6 +1875,82 @@ func TestPauseAndResume(t *testing.T) {
 	require.Equal(t, int64(2), cntByStates[proto.SubtaskStatePending])
 }
 
+func TestExportAndImportTaskState(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+
+	taskID, err := tm.CreateTask(ctx, "key1", proto.TaskTypeExample, 4, []byte("test"))
+	require.NoError(t, err)
+	task, err := tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	subtasks := make([]*proto.Subtask, 3)
+	for i := 0; i < len(subtasks); i++ {
+		// binary meta
+		subtasks[i] = proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+			":4000", 4, []byte{0, 0xff, byte(i)}, i+1)
+	}
+	require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+	// pause the task before exporting.
+	found, err := tm.PauseTask(ctx, "key1")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.NoError(t, tm.PauseSubtasks(ctx, ":4000", taskID))
+	require.NoError(t, tm.PausedTask(ctx, taskID))
+	task, err = tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	checkTaskStateStep(t, task, proto.TaskStatePaused, proto.StepOne)
+	subtasks, err = tm.GetSubtasksWithHistory(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 3)
+
+	var buf bytes.Buffer
+	require.ErrorIs(t, tm.ExportTaskState(ctx, taskID+1, &buf), storage.ErrTaskNotFound)
+	require.NoError(t, tm.ExportTaskState(ctx, taskID, &buf))
+	archive := buf.Bytes()
+
+	// import into another in-memory store.
+	_, tm2, ctx2 := testutil.InitTableTest(t)
+	gotTaskID, err := tm2.ImportTaskState(ctx2, bytes.NewReader(archive))
+	require.NoError(t, err)
+	require.Equal(t, taskID, gotTaskID)
+	gotTask, err := tm2.GetTaskByID(ctx2, gotTaskID)
+	require.NoError(t, err)
+	require.Equal(t, task.Key, gotTask.Key)
+	require.Equal(t, task.Type, gotTask.Type)
+	require.Equal(t, task.Concurrency, gotTask.Concurrency)
+	require.Equal(t, task.Priority, gotTask.Priority)
+	require.Equal(t, task.Meta, gotTask.Meta)
+	require.Equal(t, task.ExtraParams, gotTask.ExtraParams)
+	require.True(t, task.CreateTime.Equal(gotTask.CreateTime))
+	require.True(t, task.StartTime.Equal(gotTask.StartTime))
+	require.True(t, task.StateUpdateTime.Equal(gotTask.StateUpdateTime))
+	checkTaskStateStep(t, gotTask, proto.TaskStatePaused, proto.StepOne)
+	gotSubtasks, err := tm2.GetSubtasksWithHistory(ctx2, gotTaskID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, gotSubtasks, len(subtasks))
+	sortByID := func(i, j *proto.Subtask) int {
+		return cmp.Compare(i.ID, j.ID)
+	}
+	slices.SortFunc(subtasks, sortByID)
+	slices.SortFunc(gotSubtasks, sortByID)
+	for i, subtask := range subtasks {
+		got := gotSubtasks[i]
+		require.Equal(t, subtask.ID, got.ID)
+		require.Equal(t, subtask.Step, got.Step)
+		require.Equal(t, subtask.Type, got.Type)
+		require.Equal(t, proto.SubtaskStatePaused, got.State)
+		require.Equal(t, subtask.ExecID, got.ExecID)
+		require.Equal(t, subtask.Concurrency, got.Concurrency)
+		require.Equal(t, subtask.Ordinal, got.Ordinal)
+		require.Equal(t, subtask.Meta, got.Meta)
+		require.True(t, subtask.CreateTime.Equal(got.CreateTime))
+	}
+
+	// the task already exists.
+	_, err = tm2.ImportTaskState(ctx2, bytes.NewReader(archive))
+	require.ErrorIs(t, err, kv.ErrKeyExists)
+}
+
 func TestCancelAndExecIdChanged(t *testing.T) {
 	sm, ctx, cancel := testutil.InitTableTestWithCancel(t)
 
@@ -1110,6 +2146,44 @@ func TestSubtasksState(t *testing.T) {
 	endTime, err = testutil.GetSubtaskEndTime(ctx, sm, subtask.ID)
 	require.NoError(t, err)
 	require.Greater(t, endTime, ts)
+
+	// 4. test RetrySubtask, only running subtask can be retried.
+	testutil.CreateSubTask(t, sm, 5, proto.StepInit, "for_test2", []byte("test"), proto.TaskTypeExample, 11)
+	subtask, err = sm.GetFirstSubtaskInStates(ctx, "for_test2", 5, proto.StepInit, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	nextRetryTime := time.UnixMilli(time.Now().Add(time.Minute).UnixMilli())
+	require.NoError(t, sm.RetrySubtask(ctx, "for_test2", subtask.ID, nextRetryTime))
+	subtask, err = sm.GetFirstSubtaskInStates(ctx, "for_test2", 5, proto.StepInit, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.True(t, subtask.NextRetryTime.IsZero())
+	require.NoError(t, sm.StartSubtask(ctx, subtask.ID, "for_test2"))
+	require.NoError(t, sm.RetrySubtask(ctx, "for_test2", subtask.ID, nextRetryTime))
+	subtask, err = sm.GetFirstSubtaskInStates(ctx, "for_test2", 5, proto.StepInit, proto.SubtaskStateRetrying)
+	require.NoError(t, err)
+	require.Equal(t, proto.SubtaskStateRetrying, subtask.State)
+	require.True(t, nextRetryTime.Equal(subtask.NextRetryTime))
+	ok, err := sm.HasSubtasksInStates(ctx, "for_test2", 5, proto.StepInit, proto.SubtaskStateRetrying)
+	require.NoError(t, err)
+	require.True(t, ok)
+	// retrying subtask is started again after backoff.
+	require.NoError(t, sm.StartSubtask(ctx, subtask.ID, "for_test2"))
+	subtask, err = sm.GetFirstSubtaskInStates(ctx, "for_test2", 5, proto.StepInit, proto.SubtaskStateRunning)
+	require.NoError(t, err)
+	require.True(t, subtask.NextRetryTime.IsZero())
+
+	// 5. test illegal state transforms are rejected, and state is unchanged.
+	require.NoError(t, sm.FinishSubtask(ctx, "for_test2", subtask.ID, []byte{}))
+	require.ErrorIs(t, sm.StartSubtask(ctx, subtask.ID, "for_test2"), storage.ErrInvalidSubtaskStateTransform)
+	for _, state := range []proto.SubtaskState{proto.SubtaskStatePending, proto.SubtaskStateRunning,
+		proto.SubtaskStateRetrying, proto.SubtaskStatePaused, proto.SubtaskStateFailed, proto.SubtaskStateCanceled} {
+		require.ErrorIs(t, sm.UpdateSubtaskStateAndError(ctx, "for_test2", subtask.ID, state, nil),
+			storage.ErrInvalidSubtaskStateTransform)
+	}
+	// transform to the same state is allowed.
+	require.NoError(t, sm.FinishSubtask(ctx, "for_test2", subtask.ID, []byte{}))
+	subtask, err = sm.GetFirstSubtaskInStates(ctx, "for_test2", 5, proto.StepInit, proto.SubtaskStateSucceed)
+	require.NoError(t, err)
+	require.Equal(t, proto.SubtaskStateSucceed, subtask.State)
 }
 
 func checkBasicTaskEq(t *testing.T, expectedTask, task *proto.TaskBase) {
@@ -1176,3 +2250,274 @@ func TestGetActiveTaskExecInfo(t *testing.T) {
 	checkBasicTaskEq(t, &tasks[3].TaskBase, taskExecInfos[2].TaskBase)
 	require.Equal(t, 8, taskExecInfos[2].SubtaskConcurrency)
 }
+
+func TestUpdateSubtasksState(t *testing.T) {
+	_, sm, ctx := testutil.InitTableTest(t)
+	for i := 0; i < 5; i++ {
+		testutil.CreateSubTask(t, sm, 1, proto.StepOne, ":4000", []byte("test"), proto.TaskTypeExample, 1)
+	}
+	testutil.CreateSubTask(t, sm, 2, proto.StepOne, ":4000", []byte("test"), proto.TaskTypeExample, 1)
+	subtasks, err := sm.GetSubtasksByExecIDAndStepAndStates(ctx, ":4000", 1, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 5)
+	ids := make([]int64, 0, len(subtasks))
+	for _, st := range subtasks {
+		ids = append(ids, st.ID)
+	}
+	require.NoError(t, sm.StartSubtask(ctx, ids[0], ":4000"))
+	require.NoError(t, sm.StartSubtask(ctx, ids[1], ":4000"))
+
+	// only subtasks in the from state are changed, non-existent ids are skipped.
+	changed, err := sm.UpdateSubtasksState(ctx, append(slices.Clone(ids), 1000), proto.SubtaskStatePending, proto.SubtaskStateCanceled)
+	require.NoError(t, err)
+	require.Equal(t, 3, changed)
+	subtasks, err = sm.GetSubtasksByExecIDAndStepAndStates(ctx, ":4000", 1, proto.StepOne, proto.SubtaskStateRunning)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 2)
+	subtasks, err = sm.GetSubtasksByExecIDAndStepAndStates(ctx, ":4000", 1, proto.StepOne, proto.SubtaskStateCanceled)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 3)
+	// subtasks not in ids are untouched.
+	subtasks, err = sm.GetSubtasksByExecIDAndStepAndStates(ctx, ":4000", 2, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Len(t, subtasks, 1)
+
+	// nothing left in the from state.
+	changed, err = sm.UpdateSubtasksState(ctx, ids, proto.SubtaskStatePending, proto.SubtaskStateCanceled)
+	require.NoError(t, err)
+	require.Zero(t, changed)
+	changed, err = sm.UpdateSubtasksState(ctx, nil, proto.SubtaskStateRunning, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Zero(t, changed)
+
+	// invalid transform.
+	_, err = sm.UpdateSubtasksState(ctx, ids, proto.SubtaskStateSucceed, proto.SubtaskStatePending)
+	require.ErrorIs(t, err, storage.ErrInvalidSubtaskStateTransform)
+}
+
+func TestGetFirstSubtasksInStates(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	taskID, err := tm.CreateTask(ctx, "key1", proto.TaskTypeExample, 4, []byte("test"))
+	require.NoError(t, err)
+	task, err := tm.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	subtasks := make([]*proto.Subtask, 50)
+	for i := 0; i < len(subtasks); i++ {
+		subtasks[i] = proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+			":4000", 4, []byte(fmt.Sprintf("%d", i)), i+1)
+	}
+	require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+
+	// at most limit candidates are fetched.
+	candidates, err := tm.GetFirstSubtasksInStates(ctx, ":4000", taskID, proto.StepOne, 5, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Len(t, candidates, 5)
+	for _, st := range candidates {
+		require.Equal(t, proto.SubtaskStatePending, st.State)
+		require.Equal(t, ":4000", st.ExecID)
+	}
+	candidates, err = tm.GetFirstSubtasksInStates(ctx, ":4000", taskID, proto.StepOne, 100, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Len(t, candidates, 50)
+	candidates, err = tm.GetFirstSubtasksInStates(ctx, ":4001", taskID, proto.StepOne, 5, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.Empty(t, candidates)
+
+	first, err := tm.GetFirstSubtaskInStates(ctx, ":4000", taskID, proto.StepOne, proto.SubtaskStatePending)
+	require.NoError(t, err)
+	require.NotNil(t, first)
+	require.Equal(t, proto.SubtaskStatePending, first.State)
+}
+
+func TestGetDeferredTasks(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	startAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	deferredID, err := tm.CreateTaskWithParams(ctx, "key1", proto.TaskTypeExample, 1, nil,
+		proto.ExtraParams{StartAfter: startAfter.Unix()})
+	require.NoError(t, err)
+	_, err = tm.CreateTask(ctx, "key2", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	deferredTasks, err := tm.GetDeferredTasks(ctx)
+	require.NoError(t, err)
+	require.Len(t, deferredTasks, 1)
+	require.True(t, startAfter.Equal(deferredTasks[deferredID]))
+
+	// only pending tasks are deferred.
+	task, err := tm.GetTaskByID(ctx, deferredID)
+	require.NoError(t, err)
+	require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, nil))
+	deferredTasks, err = tm.GetDeferredTasks(ctx)
+	require.NoError(t, err)
+	require.Empty(t, deferredTasks)
+}
+
+func TestPokeTask(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	id1, err := tm.CreateTask(ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	id2, err := tm.CreateTask(ctx, "key2", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, tm.PokeTask(ctx, id2+100), storage.ErrTaskNotFound)
+	taskIDs, err := tm.TakePokedTasks(ctx)
+	require.NoError(t, err)
+	require.Empty(t, taskIDs)
+
+	// poke a task twice is ok.
+	require.NoError(t, tm.PokeTask(ctx, id1))
+	require.NoError(t, tm.PokeTask(ctx, id1))
+	task, err := tm.GetTaskByID(ctx, id1)
+	require.NoError(t, err)
+	require.True(t, task.ExtraParams.Poked)
+	taskIDs, err = tm.TakePokedTasks(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int64{id1}, taskIDs)
+
+	// the poke flag is cleared once taken.
+	task, err = tm.GetTaskByID(ctx, id1)
+	require.NoError(t, err)
+	require.False(t, task.ExtraParams.Poked)
+	taskIDs, err = tm.TakePokedTasks(ctx)
+	require.NoError(t, err)
+	require.Empty(t, taskIDs)
+}
+
+type uuidTaskIDGenerator struct {
+	ids []int64
+}
+
+func (g *uuidTaskIDGenerator) NextTaskID(context.Context) (int64, error) {
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return 0, err
+	}
+	// the random bits of the UUID, without the sign bit.
+	id := int64(binary.BigEndian.Uint64(u[8:]) & math.MaxInt64)
+	g.ids = append(g.ids, id)
+	return id, nil
+}
+
+func TestTaskIDGenerator(t *testing.T) {
+	_, tm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+	gen := &uuidTaskIDGenerator{}
+	storage.SetTaskIDGenerator(gen)
+	t.Cleanup(func() {
+		storage.SetTaskIDGenerator(nil)
+	})
+
+	taskIDs := make(map[int64]struct{}, 5)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		taskID, err := tm.CreateTask(ctx, key, proto.TaskTypeExample, 1, nil)
+		require.NoError(t, err)
+		require.Positive(t, taskID)
+		require.Equal(t, gen.ids[i], taskID)
+		taskIDs[taskID] = struct{}{}
+
+		task, err := tm.GetTaskByID(ctx, taskID)
+		require.NoError(t, err)
+		require.Equal(t, key, task.Key)
+		task, err = tm.GetTaskByKey(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, taskID, task.ID)
+	}
+	require.Len(t, taskIDs, 5)
+
+	// fallback to the auto-increment ID.
+	storage.SetTaskIDGenerator(nil)
+	taskID, err := tm.CreateTask(ctx, "key5", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	require.NotContains(t, taskIDs, taskID)
+	require.Len(t, gen.ids, 5)
+}
+
+func TestListTasksConsistentSnapshot(t *testing.T) {
+	testkit.EnableFailPoint(t, "github.com/pingcap/tidb/pkg/domain/MockDisableDistTask", "return(true)")
+	testkit.EnableFailPoint(t, "github.com/pingcap/tidb/pkg/util/cpu/mockNumCpu", "return(8)")
+	store := testkit.CreateMockStore(t)
+	// multiple sessions, so listing and updating run concurrently.
+	pool := pools.NewResourcePool(func() (pools.Resource, error) {
+		return testkit.NewSession(t, store), nil
+	}, 4, 4, time.Second)
+	t.Cleanup(pool.Close)
+	tm := storage.NewTaskManager(pool)
+	ctx := util.WithInternalSourceType(context.Background(), "table_test")
+	require.NoError(t, tm.InitMeta(ctx, ":4000", ""))
+
+	const taskCnt, subtaskCnt = 10, 4
+	taskIDs := make([]int64, 0, taskCnt)
+	for i := 0; i < taskCnt; i++ {
+		taskID, err := tm.CreateTask(ctx, fmt.Sprintf("key%d", i), proto.TaskTypeExample, 1, nil)
+		require.NoError(t, err)
+		task, err := tm.GetTaskByID(ctx, taskID)
+		require.NoError(t, err)
+		subtasks := make([]*proto.Subtask, 0, subtaskCnt)
+		for j := 0; j < subtaskCnt; j++ {
+			subtasks = append(subtasks, proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample,
+				":4000", 1, nil, j+1))
+		}
+		require.NoError(t, tm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+		taskIDs = append(taskIDs, taskID)
+	}
+
+	// finish the subtasks and the task in the same transaction, one task after
+	// another, while listing the tasks.
+	var (
+		wg        sync.WaitGroup
+		done      atomic.Bool
+		updateErr error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer done.Store(true)
+		for _, taskID := range taskIDs {
+			updateErr = tm.WithNewTxn(ctx, func(se sessionctx.Context) error {
+				_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `update mysql.tidb_background_subtask
+					set state = %? where task_key = %?`, proto.SubtaskStateSucceed, taskID)
+				if err != nil {
+					return err
+				}
+				_, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `update mysql.tidb_global_task
+					set state = %? where id = %?`, proto.TaskStateSucceed, taskID)
+				return err
+			})
+			if updateErr != nil {
+				return
+			}
+		}
+	}()
+	checkConsistent := func(items []*storage.TaskListItem) {
+		for _, item := range items {
+			switch item.State {
+			case proto.TaskStateRunning:
+				require.Equal(t, map[proto.SubtaskState]int64{proto.SubtaskStatePending: subtaskCnt},
+					item.SubtaskCntByStates, "task %d", item.ID)
+			case proto.TaskStateSucceed:
+				require.Equal(t, map[proto.SubtaskState]int64{proto.SubtaskStateSucceed: subtaskCnt},
+					item.SubtaskCntByStates, "task %d", item.ID)
+			default:
+				require.FailNow(t, "unexpected task state", "task %d in state %s", item.ID, item.State)
+			}
+		}
+	}
+	for !done.Load() {
+		items, err := tm.ListTasks(ctx)
+		require.NoError(t, err)
+		require.Len(t, items, taskCnt)
+		checkConsistent(items)
+	}
+	wg.Wait()
+	require.NoError(t, updateErr)
+
+	items, err := tm.ListTasks(ctx, proto.TaskStateSucceed)
+	require.NoError(t, err)
+	require.Len(t, items, taskCnt)
+	checkConsistent(items)
+	items, err = tm.ListTasks(ctx, proto.TaskStateRunning)
+	require.NoError(t, err)
+	require.Empty(t, items)
+}
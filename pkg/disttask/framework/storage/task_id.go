@@ -0,0 +1,50 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+
+	"github.com/pingcap/tidb/pkg/util/syncutil"
+)
+
+// TaskIDGenerator generates the ID of new tasks, such as snowflake IDs or IDs
+// derived from UUIDs, so task IDs don't leak the creation order and don't
+// conflict across clusters. the ID must be positive and unique among tasks in
+// both the task table and the history table.
+type TaskIDGenerator interface {
+	// NextTaskID returns the ID of the next task.
+	NextTaskID(ctx context.Context) (int64, error)
+}
+
+var taskIDGenerator struct {
+	syncutil.RWMutex
+	gen TaskIDGenerator
+}
+
+// SetTaskIDGenerator sets the TaskIDGenerator used to create tasks, nil means
+// the auto-increment ID of the task table. it should be set before any task is
+// created, since explicit IDs also move the auto-increment ID forward.
+func SetTaskIDGenerator(gen TaskIDGenerator) {
+	taskIDGenerator.Lock()
+	defer taskIDGenerator.Unlock()
+	taskIDGenerator.gen = gen
+}
+
+func getTaskIDGenerator() TaskIDGenerator {
+	taskIDGenerator.RLock()
+	defer taskIDGenerator.RUnlock()
+	return taskIDGenerator.gen
+}
@@ -16,6 +16,7 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	"github.com/pingcap/tidb/pkg/sessionctx"
@@ -24,24 +25,36 @@ import (
 
 // CancelTask cancels task.
 func (mgr *TaskManager) CancelTask(ctx context.Context, taskID int64) error {
+	return mgr.CancelTaskWithMode(ctx, taskID, proto.CancelModeForce)
+}
+
+// CancelTaskWithMode cancels the task with the mode, the mode is recorded in
+// the extra params of the task, and task executors handle the running subtasks
+// according to it, see proto.CancelMode.
+func (mgr *TaskManager) CancelTaskWithMode(ctx context.Context, taskID int64, mode proto.CancelMode) error {
 	_, err := mgr.ExecuteSQLWithNewSession(ctx,
 		`update mysql.tidb_global_task
 		 set state = %?,
-			 state_update_time = CURRENT_TIMESTAMP()
-		 where id = %? and state in (%?, %?)`,
-		proto.TaskStateCancelling, taskID, proto.TaskStatePending, proto.TaskStateRunning,
+			 state_update_time = CURRENT_TIMESTAMP(),
+			 extra_params = json_set(ifnull(extra_params, json_object()), '$.cancel_mode', %?)
+		 where id = %? and state in (%?, %?, %?)`,
+		proto.TaskStateCancelling, mode, taskID, proto.TaskStatePending, proto.TaskStateInitializing,
+		proto.TaskStateRunning,
 	)
 	return err
 }
 
-// CancelTaskByKeySession cancels task by key using input session.
+// CancelTaskByKeySession cancels task by key using input session, the task is
+// cancelled with proto.CancelModeForce, see CancelTaskWithMode.
 func (*TaskManager) CancelTaskByKeySession(ctx context.Context, se sessionctx.Context, taskKey string) error {
 	_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
 		`update mysql.tidb_global_task
 		 set state = %?,
-			 state_update_time = CURRENT_TIMESTAMP()
-		 where task_key = %? and state in (%?, %?)`,
-		proto.TaskStateCancelling, taskKey, proto.TaskStatePending, proto.TaskStateRunning)
+			 state_update_time = CURRENT_TIMESTAMP(),
+			 extra_params = json_set(ifnull(extra_params, json_object()), '$.cancel_mode', %?)
+		 where task_key = %? and state in (%?, %?, %?)`,
+		proto.TaskStateCancelling, proto.CancelModeForce, taskKey, proto.TaskStatePending,
+		proto.TaskStateInitializing, proto.TaskStateRunning)
 	return err
 }
 
@@ -59,6 +72,19 @@ func (mgr *TaskManager) FailTask(ctx context.Context, taskID int64, currentState
 	return err
 }
 
+// InitializeTask implements the scheduler.TaskManager interface.
+func (mgr *TaskManager) InitializeTask(ctx context.Context, taskID int64) error {
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_global_task
+		 set state = %?,
+			 start_time = CURRENT_TIMESTAMP(),
+			 state_update_time = CURRENT_TIMESTAMP()
+		 where id = %? and state = %?`,
+		proto.TaskStateInitializing, taskID, proto.TaskStatePending,
+	)
+	return err
+}
+
 // RevertTask implements the scheduler.TaskManager interface.
 func (mgr *TaskManager) RevertTask(ctx context.Context, taskID int64, taskState proto.TaskState, taskErr error) error {
 	_, err := mgr.ExecuteSQLWithNewSession(ctx, `
@@ -92,9 +118,39 @@ func (mgr *TaskManager) PauseTask(ctx context.Context, taskKey string) (bool, er
 		_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
 			`update mysql.tidb_global_task
 			 set state = %?,
-				 state_update_time = CURRENT_TIMESTAMP()
-			 where task_key = %? and state in (%?, %?)`,
-			proto.TaskStatePausing, taskKey, proto.TaskStatePending, proto.TaskStateRunning,
+				 state_update_time = CURRENT_TIMESTAMP(),
+				 extra_params = json_remove(extra_params, '$.resume_at')
+			 where task_key = %? and state in (%?, %?, %?)`,
+			proto.TaskStatePausing, taskKey, proto.TaskStatePending, proto.TaskStateInitializing,
+			proto.TaskStateRunning,
+		)
+		if err != nil {
+			return err
+		}
+		if se.GetSessionVars().StmtCtx.AffectedRows() != 0 {
+			found = true
+		}
+		return err
+	})
+	if err != nil {
+		return found, err
+	}
+	return found, nil
+}
+
+// PauseUntil pauses the task, and the scheduler resumes it automatically at
+// resumeAt.
+func (mgr *TaskManager) PauseUntil(ctx context.Context, taskID int64, resumeAt time.Time) (bool, error) {
+	found := false
+	err := mgr.WithNewSession(func(se sessionctx.Context) error {
+		_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			`update mysql.tidb_global_task
+			 set state = %?,
+				 state_update_time = CURRENT_TIMESTAMP(),
+				 extra_params = json_set(ifnull(extra_params, json_object()), '$.resume_at', %?)
+			 where id = %? and state in (%?, %?, %?)`,
+			proto.TaskStatePausing, resumeAt.Unix(), taskID, proto.TaskStatePending,
+			proto.TaskStateInitializing, proto.TaskStateRunning,
 		)
 		if err != nil {
 			return err
@@ -174,3 +230,18 @@ func (mgr *TaskManager) SucceedTask(ctx context.Context, taskID int64) error {
 		return err
 	})
 }
+
+// PartialSucceedTask update task state from running to partial_success.
+func (mgr *TaskManager) PartialSucceedTask(ctx context.Context, taskID int64, taskErr error) error {
+	_, err := mgr.ExecuteSQLWithNewSession(ctx, `
+		update mysql.tidb_global_task
+		set state = %?,
+			step = %?,
+			error = %?,
+			state_update_time = CURRENT_TIMESTAMP(),
+			end_time = CURRENT_TIMESTAMP()
+		where id = %? and state = %?`,
+		proto.TaskStatePartialSuccess, proto.StepDone, serializeErr(taskErr), taskID, proto.TaskStateRunning,
+	)
+	return err
+}
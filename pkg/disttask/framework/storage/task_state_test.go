@@ -17,6 +17,7 @@ package storage_test
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
 	"github.com/pingcap/tidb/pkg/disttask/framework/testutil"
@@ -110,6 +111,30 @@ func TestTaskState(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, proto.TaskStateRunning, task.State)
 
+	// 7.1 pause task until some time, the resume time is cleared when paused
+	// again manually.
+	resumeAt := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	found, err = gm.PauseUntil(ctx, id, resumeAt)
+	require.NoError(t, err)
+	require.True(t, found)
+	task, err = gm.GetTaskByID(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskStatePausing, task.State)
+	require.Equal(t, resumeAt.Unix(), task.ExtraParams.ResumeAt)
+	found, err = gm.PauseUntil(ctx, id, resumeAt)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.NoError(t, gm.PausedTask(ctx, id))
+	_, err = gm.ResumeTask(ctx, "key5")
+	require.NoError(t, err)
+	require.NoError(t, gm.ResumedTask(ctx, id))
+	found, err = gm.PauseTask(ctx, "key5")
+	require.NoError(t, err)
+	require.True(t, found)
+	task, err = gm.GetTaskByID(ctx, id)
+	require.NoError(t, err)
+	require.Zero(t, task.ExtraParams.ResumeAt)
+
 	// 8. succeed task
 	id, err = gm.CreateTask(ctx, "key6", "test", 4, []byte("test"))
 	require.NoError(t, err)
@@ -125,4 +150,40 @@ func TestTaskState(t *testing.T) {
 	task, err = gm.GetTaskByID(ctx, id)
 	require.NoError(t, err)
 	checkTaskStateStep(t, task, proto.TaskStateSucceed, proto.StepDone)
+
+	// 9. initialize task, and switch it to running after initial planning.
+	id, err = gm.CreateTask(ctx, "key7", "test", 4, []byte("test"))
+	require.NoError(t, err)
+	require.NoError(t, gm.InitializeTask(ctx, id))
+	task, err = gm.GetTaskByID(ctx, id)
+	require.NoError(t, err)
+	checkTaskStateStep(t, task, proto.TaskStateInitializing, proto.StepInit)
+	require.False(t, task.StartTime.IsZero())
+	require.NoError(t, gm.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, nil))
+	task, err = gm.GetTaskByID(ctx, id)
+	require.NoError(t, err)
+	checkTaskStateStep(t, task, proto.TaskStateRunning, proto.StepOne)
+	// only pending task can be initialized.
+	require.NoError(t, gm.InitializeTask(ctx, id))
+	task, err = gm.GetTaskByID(ctx, id)
+	require.NoError(t, err)
+	checkTaskStateStep(t, task, proto.TaskStateRunning, proto.StepOne)
+
+	// 10. initializing task can be cancelled and paused.
+	id, err = gm.CreateTask(ctx, "key8", "test", 4, []byte("test"))
+	require.NoError(t, err)
+	require.NoError(t, gm.InitializeTask(ctx, id))
+	require.NoError(t, gm.CancelTask(ctx, id))
+	task, err = gm.GetTaskByID(ctx, id)
+	require.NoError(t, err)
+	checkTaskStateStep(t, task, proto.TaskStateCancelling, proto.StepInit)
+	id, err = gm.CreateTask(ctx, "key9", "test", 4, []byte("test"))
+	require.NoError(t, err)
+	require.NoError(t, gm.InitializeTask(ctx, id))
+	found, err = gm.PauseTask(ctx, "key9")
+	require.NoError(t, err)
+	require.True(t, found)
+	task, err = gm.GetTaskByID(ctx, id)
+	require.NoError(t, err)
+	checkTaskStateStep(t, task, proto.TaskStatePausing, proto.StepInit)
 }
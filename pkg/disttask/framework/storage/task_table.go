@@ -16,21 +16,30 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
+	goerrors "errors"
+	"math"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/ngaut/pools"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/failpoint"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/errno"
 	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/parser/terror"
 	"github.com/pingcap/tidb/pkg/sessionctx"
 	"github.com/pingcap/tidb/pkg/sessionctx/variable"
 	"github.com/pingcap/tidb/pkg/util/chunk"
 	"github.com/pingcap/tidb/pkg/util/sqlexec"
 	"github.com/tikv/client-go/v2/util"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -39,18 +48,21 @@ const (
 	basicTaskColumns = `t.id, t.task_key, t.type, t.state, t.step, t.priority, t.concurrency, t.create_time`
 	// TaskColumns is the columns for task.
 	// TODO: dispatcher_id will update to scheduler_id later
-	TaskColumns = basicTaskColumns + `, t.start_time, t.state_update_time, t.meta, t.dispatcher_id, t.error`
+	TaskColumns = basicTaskColumns + `, t.start_time, t.state_update_time, t.meta, t.dispatcher_id, t.error, t.extra_params`
 	// InsertTaskColumns is the columns used in insert task.
-	InsertTaskColumns   = `task_key, type, state, priority, concurrency, step, meta, create_time`
-	basicSubtaskColumns = `id, step, task_key, type, exec_id, state, concurrency, create_time, ordinal, start_time`
+	InsertTaskColumns   = `task_key, type, state, priority, concurrency, step, meta, create_time, extra_params`
+	basicSubtaskColumns = `id, step, task_key, type, exec_id, state, concurrency, create_time, ordinal, start_time, exec_expired`
 	// SubtaskColumns is the columns for subtask.
-	SubtaskColumns = basicSubtaskColumns + `, state_update_time, meta, summary`
+	SubtaskColumns = basicSubtaskColumns + `, state_update_time, meta, summary, group_name, end_time, serial_key, weight`
 	// InsertSubtaskColumns is the columns used in insert subtask.
 	InsertSubtaskColumns = `step, task_key, exec_id, meta, state, type, concurrency, ordinal, create_time, checkpoint, summary`
 )
 
 var (
 	maxSubtaskBatchSize = 16 * units.MiB
+	// insertSubtaskBatchRows is the max number of subtasks inserted in one
+	// statement.
+	insertSubtaskBatchRows = 1000
 
 	// ErrUnstableSubtasks is the error when we detected that the subtasks are
 	// unstable, i.e. count, order and content of the subtasks are changed on
@@ -68,8 +80,49 @@ var (
 	// ErrSubtaskNotFound is the error when can't find subtask by subtask_id and execId,
 	// i.e. scheduler change the subtask's execId when subtask need to balance to other nodes.
 	ErrSubtaskNotFound = errors.New("subtask not found")
+
+	// ErrInvalidSubtaskStateTransform is the error when we update the subtask to
+	// a state which is not allowed from its current state, such as moving a
+	// succeed subtask back to running, see proto.VerifySubtaskStateTransform.
+	ErrInvalidSubtaskStateTransform = errors.New("invalid subtask state transform")
+
+	// ErrSubtaskSerialKeyBusy is the error when we start a subtask while another
+	// subtask of the task with the same serial key is running, see proto.Subtask.SerialKey.
+	ErrSubtaskSerialKeyBusy = errors.New("subtask serial key busy")
 )
 
+// transientErrCodes are the error codes of the transient errors of the
+// storage layer, the operation is expected to succeed if retried later.
+var transientErrCodes = map[uint16]struct{}{
+	errno.ErrLockDeadlock:        {},
+	errno.ErrWriteConflict:       {},
+	errno.ErrWriteConflictInTiDB: {},
+	errno.ErrTxnRetryable:        {},
+	errno.ErrPDServerTimeout:     {},
+	errno.ErrTiKVServerBusy:      {},
+	errno.ErrTiKVServerTimeout:   {},
+	errno.ErrResolveLockTimeout:  {},
+	errno.ErrRegionUnavailable:   {},
+	errno.ErrInfoSchemaChanged:   {},
+}
+
+// IsTransientErr checks whether the error returned by the storage layer is
+// transient, such as deadlock, write conflict and connection reset, callers
+// can retry the operation on such errors.
+func IsTransientErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	originErr := errors.Cause(err)
+	if tErr, ok := originErr.(*terror.Error); ok {
+		_, ok = transientErrCodes[terror.ToSQLError(tErr).Code]
+		return ok
+	}
+	return goerrors.Is(originErr, syscall.ECONNRESET) ||
+		goerrors.Is(originErr, syscall.ECONNREFUSED) ||
+		goerrors.Is(originErr, syscall.EPIPE)
+}
+
 // TaskExecInfo is the execution information of a task, on some exec node.
 type TaskExecInfo struct {
 	*proto.TaskBase
@@ -193,16 +246,21 @@ func (mgr *TaskManager) ExecuteSQLWithNewSession(ctx context.Context, sql string
 
 // CreateTask adds a new task to task table.
 func (mgr *TaskManager) CreateTask(ctx context.Context, key string, tp proto.TaskType, concurrency int, meta []byte) (taskID int64, err error) {
+	return mgr.CreateTaskWithParams(ctx, key, tp, concurrency, meta, proto.ExtraParams{})
+}
+
+// CreateTaskWithParams adds a new task with extra params to task table.
+func (mgr *TaskManager) CreateTaskWithParams(ctx context.Context, key string, tp proto.TaskType, concurrency int, meta []byte, extraParams proto.ExtraParams) (taskID int64, err error) {
 	err = mgr.WithNewSession(func(se sessionctx.Context) error {
 		var err2 error
-		taskID, err2 = mgr.CreateTaskWithSession(ctx, se, key, tp, concurrency, meta)
+		taskID, err2 = mgr.CreateTaskWithSession(ctx, se, key, tp, concurrency, meta, extraParams)
 		return err2
 	})
 	return
 }
 
 // CreateTaskWithSession adds a new task to task table with session.
-func (mgr *TaskManager) CreateTaskWithSession(ctx context.Context, se sessionctx.Context, key string, tp proto.TaskType, concurrency int, meta []byte) (taskID int64, err error) {
+func (mgr *TaskManager) CreateTaskWithSession(ctx context.Context, se sessionctx.Context, key string, tp proto.TaskType, concurrency int, meta []byte, extraParams proto.ExtraParams) (taskID int64, err error) {
 	cpuCount, err := mgr.getCPUCountOfManagedNode(ctx, se)
 	if err != nil {
 		return 0, err
@@ -210,20 +268,39 @@ func (mgr *TaskManager) CreateTaskWithSession(ctx context.Context, se sessionctx
 	if concurrency > cpuCount {
 		return 0, errors.Errorf("task concurrency(%d) larger than cpu count(%d) of managed node", concurrency, cpuCount)
 	}
-	_, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `
-			insert into mysql.tidb_global_task(`+InsertTaskColumns+`)
-			values (%?, %?, %?, %?, %?, %?, %?, CURRENT_TIMESTAMP())`,
-		key, tp, proto.TaskStatePending, proto.NormalPriority, concurrency, proto.StepInit, meta)
+	extraParamsBytes, err := json.Marshal(extraParams)
 	if err != nil {
-		return 0, err
+		return 0, errors.Trace(err)
 	}
+	if gen := getTaskIDGenerator(); gen != nil {
+		if taskID, err = gen.NextTaskID(ctx); err != nil {
+			return 0, errors.Annotate(err, "generate task ID")
+		}
+		if taskID <= 0 {
+			return 0, errors.Errorf("invalid generated task ID %d", taskID)
+		}
+		_, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `
+			insert into mysql.tidb_global_task(id, `+InsertTaskColumns+`)
+			values (%?, %?, %?, %?, %?, %?, %?, %?, CURRENT_TIMESTAMP(), %?)`,
+			taskID, key, tp, proto.TaskStatePending, proto.NormalPriority, concurrency, proto.StepInit, meta, string(extraParamsBytes))
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		_, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `
+			insert into mysql.tidb_global_task(`+InsertTaskColumns+`)
+			values (%?, %?, %?, %?, %?, %?, %?, CURRENT_TIMESTAMP(), %?)`,
+			key, tp, proto.TaskStatePending, proto.NormalPriority, concurrency, proto.StepInit, meta, string(extraParamsBytes))
+		if err != nil {
+			return 0, err
+		}
 
-	rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), "select @@last_insert_id")
-	if err != nil {
-		return 0, err
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), "select @@last_insert_id")
+		if err != nil {
+			return 0, err
+		}
+		taskID = int64(rs[0].GetUint64(0))
 	}
-
-	taskID = int64(rs[0].GetUint64(0))
 	failpoint.Inject("testSetLastTaskID", func() { TestLastTaskID.Store(taskID) })
 
 	return taskID, nil
@@ -233,10 +310,11 @@ func (mgr *TaskManager) CreateTaskWithSession(ctx context.Context, se sessionctx
 func (mgr *TaskManager) GetTopUnfinishedTasks(ctx context.Context) ([]*proto.TaskBase, error) {
 	rs, err := mgr.ExecuteSQLWithNewSession(ctx,
 		`select `+basicTaskColumns+` from mysql.tidb_global_task t
-		where state in (%?, %?, %?, %?, %?, %?)
+		where state in (%?, %?, %?, %?, %?, %?, %?)
 		order by priority asc, create_time asc, id asc
 		limit %?`,
 		proto.TaskStatePending,
+		proto.TaskStateInitializing,
 		proto.TaskStateRunning,
 		proto.TaskStateReverting,
 		proto.TaskStateCancelling,
@@ -261,11 +339,11 @@ func (mgr *TaskManager) GetTaskExecInfoByExecID(ctx context.Context, execID stri
 		`select `+basicTaskColumns+`, max(st.concurrency)
 			from mysql.tidb_global_task t join mysql.tidb_background_subtask st
 				on t.id = st.task_key and t.step = st.step
-			where t.state in (%?, %?, %?) and st.state in (%?, %?) and st.exec_id = %?
+			where t.state in (%?, %?, %?, %?) and st.state in (%?, %?, %?) and st.exec_id = %?
 			group by t.id
 			order by priority asc, create_time asc, id asc`,
-		proto.TaskStateRunning, proto.TaskStateReverting, proto.TaskStatePausing,
-		proto.SubtaskStatePending, proto.SubtaskStateRunning, execID)
+		proto.TaskStateRunning, proto.TaskStateCancelling, proto.TaskStateReverting, proto.TaskStatePausing,
+		proto.SubtaskStatePending, proto.SubtaskStateRunning, proto.SubtaskStateRetrying, execID)
 	if err != nil {
 		return nil, err
 	}
@@ -300,6 +378,333 @@ func (mgr *TaskManager) GetTasksInStates(ctx context.Context, states ...any) (ta
 	return task, nil
 }
 
+// TaskListItem is a task listed by ListTasks.
+type TaskListItem struct {
+	*proto.Task
+	// SubtaskCntByStates is the count of subtasks of current step of the task
+	// in each state.
+	SubtaskCntByStates map[proto.SubtaskState]int64
+}
+
+// ListTasks lists the tasks in the states with the subtask counts of their
+// current step, all tasks are listed if states is empty. tasks and subtask
+// counts are read in the same transaction, so they're from a consistent
+// snapshot, and the counts always match the listed state and step of the task
+// even if the task is updated concurrently.
+func (mgr *TaskManager) ListTasks(ctx context.Context, states ...proto.TaskState) ([]*TaskListItem, error) {
+	var (
+		stateCond string
+		args      []any
+	)
+	if len(states) > 0 {
+		stateCond = "where t.state in (" + strings.Repeat("%?,", len(states)-1) + "%?)"
+		for _, s := range states {
+			args = append(args, s)
+		}
+	}
+	var items []*TaskListItem
+	err := mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			"select "+TaskColumns+" from mysql.tidb_global_task t "+stateCond+" order by t.id", args...)
+		if err != nil {
+			return err
+		}
+		items = make([]*TaskListItem, 0, len(rs))
+		itemByID := make(map[int64]*TaskListItem, len(rs))
+		for _, r := range rs {
+			item := &TaskListItem{
+				Task:               Row2Task(r),
+				SubtaskCntByStates: make(map[proto.SubtaskState]int64),
+			}
+			items = append(items, item)
+			itemByID[item.ID] = item
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		rs, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `
+			select t.id, s.state, count(*)
+			from mysql.tidb_global_task t join mysql.tidb_background_subtask s
+			on s.task_key = t.id and s.step = t.step
+			`+stateCond+`
+			group by t.id, s.state`, args...)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if item, ok := itemByID[r.GetInt64(0)]; ok {
+				item.SubtaskCntByStates[proto.SubtaskState(r.GetString(1))] = r.GetInt64(2)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// TaskMatrix returns the count of tasks group by type and state, tasks in
+// history table are included.
+func (mgr *TaskManager) TaskMatrix(ctx context.Context) (map[proto.TaskType]map[proto.TaskState]int, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `
+		select type, state, count(*) from (
+			select type, state from mysql.tidb_global_task
+			union all
+			select type, state from mysql.tidb_global_task_history
+		) t group by type, state`)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[proto.TaskType]map[proto.TaskState]int)
+	for _, r := range rs {
+		tp := proto.TaskType(r.GetString(0))
+		if _, ok := res[tp]; !ok {
+			res[tp] = make(map[proto.TaskState]int)
+		}
+		res[tp][proto.TaskState(r.GetString(1))] = int(r.GetInt64(2))
+	}
+	return res, nil
+}
+
+// GetUnfinishedTaskCntByType returns the count of tasks of the task type which
+// are not in terminal states.
+func (mgr *TaskManager) GetUnfinishedTaskCntByType(ctx context.Context, tp proto.TaskType) (int, error) {
+	states := proto.TerminalStates()
+	args := make([]any, 0, len(states)+1)
+	args = append(args, tp)
+	for _, s := range states {
+		args = append(args, s)
+	}
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `
+		select count(1) from mysql.tidb_global_task
+		where type = %? and state not in (`+strings.Repeat("%?,", len(states)-1)+`%?)`,
+		args...)
+	if err != nil {
+		return 0, err
+	}
+	return int(rs[0].GetInt64(0)), nil
+}
+
+// GetLastFinishedTasksByType returns at most limit tasks of the task type which
+// finish most recently, the latest one first, tasks in history table are
+// included.
+func (mgr *TaskManager) GetLastFinishedTasksByType(ctx context.Context, tp proto.TaskType, limit int) ([]*proto.Task, error) {
+	states := proto.TerminalStates()
+	args := make([]any, 0, len(states)+3)
+	args = append(args, tp)
+	for _, s := range states {
+		args = append(args, s)
+	}
+	args = append(args, tp, limit)
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `
+		(select `+TaskColumns+`, t.end_time from mysql.tidb_global_task t
+		where type = %? and state in (`+strings.Repeat("%?,", len(states)-1)+`%?))
+		union all
+		(select `+TaskColumns+`, t.end_time from mysql.tidb_global_task_history t where type = %?)
+		order by end_time desc, id desc limit %?`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*proto.Task, 0, len(rs))
+	for _, r := range rs {
+		tasks = append(tasks, Row2Task(r))
+	}
+	return tasks, nil
+}
+
+// UpdateTaskOwner records serverID as the owner of the task, i.e. the server
+// whose scheduler drives the task now.
+func (mgr *TaskManager) UpdateTaskOwner(ctx context.Context, taskID int64, serverID string) error {
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_global_task set dispatcher_id = %? where id = %?`, serverID, taskID)
+	return err
+}
+
+// SetTaskStatusMessage sets the status message of the task, it describes the
+// current activity of the task, and it's shown in ExtraParams of the task and
+// DescribeTask. empty msg clears it.
+func (mgr *TaskManager) SetTaskStatusMessage(ctx context.Context, taskID int64, msg string) error {
+	if msg == "" {
+		_, err := mgr.ExecuteSQLWithNewSession(ctx,
+			`update mysql.tidb_global_task
+			set extra_params = json_remove(extra_params, '$.status_message')
+			where id = %?`, taskID)
+		return err
+	}
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_global_task
+		set extra_params = json_set(ifnull(extra_params, json_object()), '$.status_message', %?)
+		where id = %?`, msg, taskID)
+	return err
+}
+
+// SetTaskGenerationFrozen sets whether the subtask generation of the task is
+// frozen, see proto.ExtraParams.FreezeGeneration.
+func (mgr *TaskManager) SetTaskGenerationFrozen(ctx context.Context, taskID int64, frozen bool) error {
+	if !frozen {
+		_, err := mgr.ExecuteSQLWithNewSession(ctx,
+			`update mysql.tidb_global_task
+			set extra_params = json_remove(extra_params, '$.freeze_generation')
+			where id = %?`, taskID)
+		return err
+	}
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_global_task
+		set extra_params = json_set(ifnull(extra_params, json_object()), '$.freeze_generation', cast('true' as json))
+		where id = %?`, taskID)
+	return err
+}
+
+// IsTaskGenerationFrozen implements the scheduler.GenerationFreezeChecker interface.
+func (mgr *TaskManager) IsTaskGenerationFrozen(ctx context.Context, taskID int64) (bool, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`select ifnull(extra_params->>'$.freeze_generation', 'false') = 'true'
+		from mysql.tidb_global_task where id = %?`, taskID)
+	if err != nil {
+		return false, err
+	}
+	if len(rs) == 0 {
+		return false, ErrTaskNotFound
+	}
+	return rs[0].GetInt64(0) == 1, nil
+}
+
+// PokeTask pokes the task to force the owning scheduler to re-evaluate it on
+// its next loop, such as when the task gets stuck due to a scheduler bug, see
+// proto.ExtraParams.Poked. ErrTaskNotFound is returned if the task doesn't
+// exist or is already moved to history.
+func (mgr *TaskManager) PokeTask(ctx context.Context, taskID int64) error {
+	return mgr.WithNewSession(func(se sessionctx.Context) error {
+		_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			`update mysql.tidb_global_task
+			set extra_params = json_set(ifnull(extra_params, json_object()), '$.poked', cast('true' as json))
+			where id = %?`, taskID)
+		if err != nil {
+			return err
+		}
+		if se.GetSessionVars().StmtCtx.AffectedRows() > 0 {
+			return nil
+		}
+		// the task might be poked already.
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			`select 1 from mysql.tidb_global_task where id = %?`, taskID)
+		if err != nil {
+			return err
+		}
+		if len(rs) == 0 {
+			return ErrTaskNotFound
+		}
+		return nil
+	})
+}
+
+// TakePokedTasks implements the scheduler.PokedTaskTaker interface.
+func (mgr *TaskManager) TakePokedTasks(ctx context.Context) ([]int64, error) {
+	var taskIDs []int64
+	err := mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			`select id from mysql.tidb_global_task
+			where ifnull(extra_params->>'$.poked', 'false') = 'true' for update`)
+		if err != nil || len(rs) == 0 {
+			return err
+		}
+		taskIDs = make([]int64, 0, len(rs))
+		idStrs := make([]string, 0, len(rs))
+		for _, r := range rs {
+			taskIDs = append(taskIDs, r.GetInt64(0))
+			idStrs = append(idStrs, strconv.FormatInt(r.GetInt64(0), 10))
+		}
+		_, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			`update mysql.tidb_global_task
+			set extra_params = json_remove(extra_params, '$.poked')
+			where id in (`+strings.Join(idStrs, ", ")+`)`)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return taskIDs, nil
+}
+
+// GetDeferredTasks implements the scheduler.DeferredTaskGetter interface.
+func (mgr *TaskManager) GetDeferredTasks(ctx context.Context) (map[int64]time.Time, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`select id, cast(extra_params->>'$.start_after' as signed)
+		from mysql.tidb_global_task
+		where state = %? and cast(ifnull(extra_params->>'$.start_after', '0') as signed) > 0`,
+		proto.TaskStatePending)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int64]time.Time, len(rs))
+	for _, r := range rs {
+		res[r.GetInt64(0)] = time.Unix(r.GetInt64(1), 0)
+	}
+	return res, nil
+}
+
+// MigrateTaskMeta updates the meta of the task to the one migrated from
+// fromVersion to toVersion, see proto.RegisterMetaVersion. fromVersion is the
+// raw version in proto.ExtraParams.MetaVersion, the task is not changed if its
+// meta has been migrated by others.
+func (mgr *TaskManager) MigrateTaskMeta(ctx context.Context, taskID int64, fromVersion, toVersion int, meta []byte) error {
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_global_task
+		set meta = %?, extra_params = json_set(ifnull(extra_params, json_object()), '$.meta_version', %?)
+		where id = %? and cast(ifnull(extra_params->>'$.meta_version', '0') as signed) = %?`,
+		meta, toVersion, taskID, fromVersion)
+	return err
+}
+
+// ConsumeRetryBudget consumes one retry from the retry budget of the task, see
+// proto.ExtraParams.RetryBudget. it returns false if the budget is exhausted or
+// the task has no budget.
+func (mgr *TaskManager) ConsumeRetryBudget(ctx context.Context, taskID int64) (bool, error) {
+	consumed := false
+	err := mgr.WithNewSession(func(se sessionctx.Context) error {
+		_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			`update mysql.tidb_global_task
+			set extra_params = json_set(extra_params, '$.subtask_retries',
+				cast(ifnull(extra_params->>'$.subtask_retries', '0') as signed) + 1)
+			where id = %? and
+				cast(ifnull(extra_params->>'$.subtask_retries', '0') as signed) <
+				cast(ifnull(extra_params->>'$.retry_budget', '0') as signed)`, taskID)
+		if err != nil {
+			return err
+		}
+		consumed = se.GetSessionVars().StmtCtx.AffectedRows() > 0
+		return nil
+	})
+	return consumed, err
+}
+
+// GetTasksByOwner returns the unfinished tasks owned by the server, see
+// UpdateTaskOwner, it can be used to find tasks to drain before shutting down
+// a server. tasks are ordered by rank.
+func (mgr *TaskManager) GetTasksByOwner(ctx context.Context, serverID string) ([]*proto.Task, error) {
+	states := proto.TerminalStates()
+	args := make([]any, 0, len(states)+1)
+	args = append(args, serverID)
+	for _, s := range states {
+		args = append(args, s)
+	}
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx,
+		"select "+TaskColumns+" from mysql.tidb_global_task t "+
+			"where dispatcher_id = %? and state not in ("+strings.Repeat("%?,", len(states)-1)+"%?)"+
+			" order by priority asc, create_time asc, id asc", args...)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*proto.Task, 0, len(rs))
+	for _, r := range rs {
+		tasks = append(tasks, Row2Task(r))
+	}
+	return tasks, nil
+}
+
 // GetTaskByID gets the task by the task ID.
 func (mgr *TaskManager) GetTaskByID(ctx context.Context, taskID int64) (task *proto.Task, err error) {
 	rs, err := mgr.ExecuteSQLWithNewSession(ctx, "select "+TaskColumns+" from mysql.tidb_global_task t where id = %?", taskID)
@@ -354,6 +759,26 @@ func (mgr *TaskManager) GetTaskBaseByIDWithHistory(ctx context.Context, taskID i
 	return row2TaskBasic(rs[0]), nil
 }
 
+// GetChildTasks gets the child tasks of the task, see proto.ExtraParams.ParentTaskID,
+// tasks in history table are included.
+func (mgr *TaskManager) GetChildTasks(ctx context.Context, parentTaskID int64) ([]*proto.TaskBase, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `
+		select `+basicTaskColumns+` from mysql.tidb_global_task t
+		where cast(t.extra_params->>'$.parent_task_id' as signed) = %?
+		union all
+		select `+basicTaskColumns+` from mysql.tidb_global_task_history t
+		where cast(t.extra_params->>'$.parent_task_id' as signed) = %?
+		order by id`, parentTaskID, parentTaskID)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*proto.TaskBase, 0, len(rs))
+	for _, r := range rs {
+		tasks = append(tasks, row2TaskBasic(r))
+	}
+	return tasks, nil
+}
+
 // GetTaskByKey gets the task by the task key.
 func (mgr *TaskManager) GetTaskByKey(ctx context.Context, key string) (task *proto.Task, err error) {
 	rs, err := mgr.ExecuteSQLWithNewSession(ctx, "select "+TaskColumns+" from mysql.tidb_global_task t where task_key = %?", key)
@@ -416,30 +841,48 @@ func (mgr *TaskManager) GetSubtasksByExecIDAndStepAndStates(ctx context.Context,
 }
 
 // GetFirstSubtaskInStates gets the first subtask by given states.
+// subtasks not running are skipped if another subtask of the task with the same
+// serial key is running, as they can't be started now, see proto.Subtask.SerialKey.
 func (mgr *TaskManager) GetFirstSubtaskInStates(ctx context.Context, tidbID string, taskID int64, step proto.Step, states ...proto.SubtaskState) (*proto.Subtask, error) {
+	subtasks, err := mgr.GetFirstSubtasksInStates(ctx, tidbID, taskID, step, 1, states...)
+	if err != nil || len(subtasks) == 0 {
+		return nil, err
+	}
+	return subtasks[0], nil
+}
+
+// GetFirstSubtasksInStates is like GetFirstSubtaskInStates, but gets at most
+// limit subtasks.
+func (mgr *TaskManager) GetFirstSubtasksInStates(ctx context.Context, tidbID string, taskID int64, step proto.Step, limit int, states ...proto.SubtaskState) ([]*proto.Subtask, error) {
 	args := []any{tidbID, taskID, step}
 	for _, state := range states {
 		args = append(args, state)
 	}
+	args = append(args, proto.SubtaskStateRunning, taskID, proto.SubtaskStateRunning, limit)
 	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `select `+SubtaskColumns+` from mysql.tidb_background_subtask
 		where exec_id = %? and task_key = %? and step = %?
-		and state in (`+strings.Repeat("%?,", len(states)-1)+"%?) limit 1", args...)
+		and state in (`+strings.Repeat("%?,", len(states)-1)+`%?)
+		and (state = %? or serial_key is null or serial_key not in (
+			select serial_key from mysql.tidb_background_subtask
+			where task_key = %? and state = %? and serial_key is not null))
+		limit %?`, args...)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(rs) == 0 {
-		return nil, nil
+	subtasks := make([]*proto.Subtask, 0, len(rs))
+	for _, r := range rs {
+		subtasks = append(subtasks, Row2SubTask(r))
 	}
-	return Row2SubTask(rs[0]), nil
+	return subtasks, nil
 }
 
 // GetActiveSubtasks implements TaskManager.GetActiveSubtasks.
 func (mgr *TaskManager) GetActiveSubtasks(ctx context.Context, taskID int64) ([]*proto.SubtaskBase, error) {
 	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `
 		select `+basicSubtaskColumns+` from mysql.tidb_background_subtask
-		where task_key = %? and state in (%?, %?)`,
-		taskID, proto.SubtaskStatePending, proto.SubtaskStateRunning)
+		where task_key = %? and state in (%?, %?, %?)`,
+		taskID, proto.SubtaskStatePending, proto.SubtaskStateRunning, proto.SubtaskStateRetrying)
 	if err != nil {
 		return nil, err
 	}
@@ -468,6 +911,61 @@ func (mgr *TaskManager) GetAllSubtasksByStepAndState(ctx context.Context, taskID
 	return subtasks, nil
 }
 
+// GetSubtasksByTaskID gets a page of subtasks of the task ordered by ID, subtasks
+// in history table are included. it skips the first offset subtasks and returns
+// at most limit subtasks, limit <= 0 means no limit, if states is not empty,
+// only subtasks in the states are returned. total is the count of all subtasks
+// matched, so clients such as UI can paginate on tasks with lots of subtasks.
+func (mgr *TaskManager) GetSubtasksByTaskID(ctx context.Context, taskID int64, offset, limit int,
+	states ...proto.SubtaskState) (subtasks []*proto.Subtask, total int64, err error) {
+	where := "task_key = %?"
+	whereArgs := []any{taskID}
+	if len(states) > 0 {
+		where += " and state in (" + strings.Repeat("%?,", len(states)-1) + "%?)"
+		for _, state := range states {
+			whereArgs = append(whereArgs, state)
+		}
+	}
+	// both tables use the same where clause.
+	args := append(append([]any{}, whereArgs...), whereArgs...)
+	err = mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `select
+			(select count(1) from mysql.tidb_background_subtask where `+where+`) +
+			(select count(1) from mysql.tidb_background_subtask_history where `+where+`)`, args...)
+		if err != nil {
+			return err
+		}
+		total = rs[0].GetInt64(0)
+		sql := `select ` + SubtaskColumns + ` from (
+			select ` + SubtaskColumns + ` from mysql.tidb_background_subtask where ` + where + `
+			union all
+			select ` + SubtaskColumns + ` from mysql.tidb_background_subtask_history where ` + where + `
+			) t order by id`
+		pageArgs := args
+		if limit > 0 {
+			sql += " limit %?, %?"
+			pageArgs = append(pageArgs, max(offset, 0), limit)
+		} else if offset > 0 {
+			// MySQL doesn't support offset without limit.
+			sql += " limit %?, 18446744073709551615"
+			pageArgs = append(pageArgs, offset)
+		}
+		rs, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), sql, pageArgs...)
+		if err != nil {
+			return err
+		}
+		subtasks = make([]*proto.Subtask, 0, len(rs))
+		for _, r := range rs {
+			subtasks = append(subtasks, Row2SubTask(r))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return subtasks, total, nil
+}
+
 // GetSubtaskRowCount gets the subtask row count.
 func (mgr *TaskManager) GetSubtaskRowCount(ctx context.Context, taskID int64, step proto.Step) (int64, error) {
 	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `select
@@ -483,6 +981,73 @@ func (mgr *TaskManager) GetSubtaskRowCount(ctx context.Context, taskID int64, st
 	return rs[0].GetInt64(0), nil
 }
 
+// GetWeightedTaskProgress returns the progress of the current step of the task
+// in [0, 1], it's the total weight of succeed subtasks divided by the total
+// weight of all subtasks of the step, see proto.Subtask.Weight. subtasks in
+// history table are included too. it returns 0 if the step has no subtask.
+func (mgr *TaskManager) GetWeightedTaskProgress(ctx context.Context, taskID int64) (float64, error) {
+	task, err := mgr.GetTaskBaseByIDWithHistory(ctx, taskID)
+	if err != nil {
+		return 0, err
+	}
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `
+		select cast(ifnull(sum(if(state = %?, w, 0)), 0) as signed), cast(ifnull(sum(w), 0) as signed) from (
+			select state, ifnull(weight, 1) w
+			from mysql.tidb_background_subtask where task_key = %? and step = %?
+			union all
+			select state, ifnull(weight, cast(ifnull(summary->>'$.compacted_count', 1) as signed)) w
+			from mysql.tidb_background_subtask_history where task_key = %? and step = %?
+		) t`,
+		proto.SubtaskStateSucceed, taskID, task.Step, taskID, task.Step)
+	if err != nil {
+		return 0, err
+	}
+	if len(rs) == 0 || rs[0].GetInt64(1) == 0 {
+		return 0, nil
+	}
+	return float64(rs[0].GetInt64(0)) / float64(rs[0].GetInt64(1)), nil
+}
+
+// GetSubtaskLatencyPercentiles returns the percentiles of the latency of the
+// succeed subtasks of the step of the task, from start to end, subtasks in
+// history table are included too, except compacted ones. percentiles should be
+// in (0, 100], the result is in the same order as percentiles, and it's nil if
+// no subtask of the step succeeds.
+func (mgr *TaskManager) GetSubtaskLatencyPercentiles(ctx context.Context, taskID int64, step proto.Step, percentiles ...float64) ([]time.Duration, error) {
+	where := `task_key = %? and step = %? and state = %?
+		and start_time is not null and end_time is not null
+		and json_extract(summary, '$.compacted_count') is null`
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `
+		select unix_timestamp(end_time) - start_time from mysql.tidb_background_subtask where `+where+`
+		union all
+		select unix_timestamp(end_time) - start_time from mysql.tidb_background_subtask_history where `+where,
+		taskID, step, proto.SubtaskStateSucceed, taskID, step, proto.SubtaskStateSucceed)
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) == 0 {
+		return nil, nil
+	}
+	latencies := make([]int64, 0, len(rs))
+	for _, r := range rs {
+		latencies = append(latencies, max(r.GetInt64(0), 0))
+	}
+	return calcLatencyPercentiles(latencies, percentiles), nil
+}
+
+// calcLatencyPercentiles calculates the percentiles of latencies in seconds
+// using the nearest-rank method.
+func calcLatencyPercentiles(latencies []int64, percentiles []float64) []time.Duration {
+	slices.Sort(latencies)
+	res := make([]time.Duration, 0, len(percentiles))
+	for _, p := range percentiles {
+		rank := int(math.Ceil(p / 100 * float64(len(latencies))))
+		idx := min(max(rank-1, 0), len(latencies)-1)
+		res = append(res, time.Duration(latencies[idx])*time.Second)
+	}
+	return res
+}
+
 // UpdateSubtaskRowCount updates the subtask row count.
 func (mgr *TaskManager) UpdateSubtaskRowCount(ctx context.Context, subtaskID int64, rowCount int64) error {
 	_, err := mgr.ExecuteSQLWithNewSession(ctx,
@@ -492,6 +1057,120 @@ func (mgr *TaskManager) UpdateSubtaskRowCount(ctx context.Context, subtaskID int
 	return err
 }
 
+// GetSubtaskMetaSize implements the scheduler.SubtaskMetaSizeGetter interface.
+func (mgr *TaskManager) GetSubtaskMetaSize(ctx context.Context, taskID int64) (int64, error) {
+	rs, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`select cast(ifnull(sum(length(meta)), 0) as signed)
+		from mysql.tidb_background_subtask where task_key = %?`, taskID)
+	if err != nil {
+		return 0, err
+	}
+	return rs[0].GetInt64(0), nil
+}
+
+// ReportSubtaskMetric sets the custom metric of the subtask reported by the
+// step executor, such as rows skipped or bytes written, metrics are stored in
+// the summary of the subtask, see proto.Subtask.Metrics. reporting a metric
+// with the same name again overwrites the previous value.
+func (mgr *TaskManager) ReportSubtaskMetric(ctx context.Context, subtaskID int64, name string, value float64) error {
+	if name == "" {
+		return errors.New("subtask metric name is empty")
+	}
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_background_subtask
+		set summary = json_set(ifnull(summary, json_object()), '$.metrics',
+			json_merge_patch(ifnull(json_extract(summary, '$.metrics'), json_object()), json_object(%?, %?)))
+		where id = %?`,
+		name, value, subtaskID)
+	return err
+}
+
+// RetrySubtask updates the running subtask owned by execID to retrying state,
+// the subtask is retried at nextRetryTime.
+func (mgr *TaskManager) RetrySubtask(ctx context.Context, execID string, subtaskID int64, nextRetryTime time.Time) error {
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_background_subtask
+		set state = %?, state_update_time = unix_timestamp(),
+			summary = json_set(ifnull(summary, json_object()), '$.next_retry_time', %?)
+		where id = %? and exec_id = %? and state = %?`,
+		proto.SubtaskStateRetrying, nextRetryTime.UnixMilli(), subtaskID, execID, proto.SubtaskStateRunning)
+	return err
+}
+
+// ReassignSubtaskForRetry moves the running subtask owned by execID to another
+// managed node in pending state, so it's retried there, the node with the fewest
+// unfinished subtasks of the task is chosen. it returns the exec ID of the new
+// node, or empty if there is no other managed node.
+// the balancer might move the subtask again later as other pending subtasks,
+// such as when the new node is not eligible for the task.
+func (mgr *TaskManager) ReassignSubtaskForRetry(ctx context.Context, execID string, subtaskID int64) (string, error) {
+	var newExecID string
+	err := mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		nodes, err := mgr.getManagedNodesWithSession(ctx, se)
+		if err != nil {
+			return err
+		}
+		subtaskCnt := make(map[string]int64, len(nodes))
+		for _, node := range nodes {
+			if node.ID != execID {
+				subtaskCnt[node.ID] = 0
+			}
+		}
+		if len(subtaskCnt) == 0 {
+			return nil
+		}
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `
+			select exec_id, count(*) from mysql.tidb_background_subtask
+			where task_key = (select task_key from mysql.tidb_background_subtask where id = %?)
+				and state in (%?, %?, %?)
+			group by exec_id`,
+			subtaskID, proto.SubtaskStatePending, proto.SubtaskStateRunning, proto.SubtaskStateRetrying)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if _, ok := subtaskCnt[r.GetString(0)]; ok {
+				subtaskCnt[r.GetString(0)] = r.GetInt64(1)
+			}
+		}
+		// pick in the order of nodes, so the choice is stable on ties.
+		for _, node := range nodes {
+			cnt, ok := subtaskCnt[node.ID]
+			if ok && (newExecID == "" || cnt < subtaskCnt[newExecID]) {
+				newExecID = node.ID
+			}
+		}
+		_, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `
+			update mysql.tidb_background_subtask
+			set exec_id = %?, state = %?, state_update_time = unix_timestamp(), exec_expired = null
+			where id = %? and exec_id = %? and state = %?`,
+			newExecID, proto.SubtaskStatePending, subtaskID, execID, proto.SubtaskStateRunning)
+		if err != nil {
+			return err
+		}
+		if se.GetSessionVars().StmtCtx.AffectedRows() == 0 {
+			return ErrSubtaskNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return newExecID, nil
+}
+
+// RenewSubtaskLease renews the lease of the running subtask owned by execID to
+// ttl from now, exec_expired is stored in seconds, so ttl should be much larger
+// than 1s.
+func (mgr *TaskManager) RenewSubtaskLease(ctx context.Context, execID string, subtaskID int64, ttl time.Duration) error {
+	_, err := mgr.ExecuteSQLWithNewSession(ctx,
+		`update mysql.tidb_background_subtask
+		set exec_expired = date_add(CURRENT_TIMESTAMP(6), interval %? microsecond)
+		where id = %? and exec_id = %? and state = %?`,
+		ttl.Microseconds(), subtaskID, execID, proto.SubtaskStateRunning)
+	return err
+}
+
 // GetSubtaskCntGroupByStates gets the subtask count by states.
 func (mgr *TaskManager) GetSubtaskCntGroupByStates(ctx context.Context, taskID int64, step proto.Step) (map[proto.SubtaskState]int64, error) {
 	rs, err := mgr.ExecuteSQLWithNewSession(ctx, `
@@ -569,7 +1248,7 @@ func (mgr *TaskManager) UpdateSubtasksExecIDs(ctx context.Context, subtasks []*p
 		for _, subtask := range subtasks {
 			_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `
 				update mysql.tidb_background_subtask
-				set exec_id = %?
+				set exec_id = %?, exec_expired = null
 				where id = %? and state = %?`,
 				subtask.ExecID, subtask.ID, subtask.State)
 			if err != nil {
@@ -622,6 +1301,9 @@ func (*TaskManager) updateTaskStateStep(ctx context.Context, se sessionctx.Conte
 	if task.State == proto.TaskStatePending {
 		extraUpdateStr = `start_time = CURRENT_TIMESTAMP(),`
 	}
+	if task.ExtraParams.StepIteration > 0 && nextStep != task.Step {
+		extraUpdateStr += `extra_params = json_remove(extra_params, '$.step_iteration'),`
+	}
 	// TODO: during generating subtask, task meta might change, maybe move meta
 	// update to another place.
 	_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `
@@ -646,20 +1328,108 @@ func (*TaskManager) insertSubtasks(ctx context.Context, se sessionctx.Context, s
 		<-TestChannel
 		<-TestChannel
 	})
-	var (
-		sb         strings.Builder
-		markerList = make([]string, 0, len(subtasks))
-		args       = make([]any, 0, len(subtasks)*7)
-	)
-	sb.WriteString(`insert into mysql.tidb_background_subtask(` + InsertSubtaskColumns + `) values `)
-	for _, subtask := range subtasks {
-		markerList = append(markerList, "(%?, %?, %?, %?, %?, %?, %?, %?, CURRENT_TIMESTAMP(), '{}', '{}')")
-		args = append(args, subtask.Step, subtask.TaskID, subtask.ExecID, subtask.Meta,
-			proto.SubtaskStatePending, proto.Type2Int(subtask.Type), subtask.Concurrency, subtask.Ordinal)
-	}
-	sb.WriteString(strings.Join(markerList, ","))
-	_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), sb.String(), args...)
-	return err
+	// insert in chunks to avoid building a huge statement when there are lots
+	// of subtasks, they're still in the same transaction of se.
+	for start := 0; start < len(subtasks); start += insertSubtaskBatchRows {
+		batch := subtasks[start:min(start+insertSubtaskBatchRows, len(subtasks))]
+		var (
+			sb         strings.Builder
+			markerList = make([]string, 0, len(batch))
+			args       = make([]any, 0, len(batch)*11)
+		)
+		sb.WriteString(`insert into mysql.tidb_background_subtask(` + InsertSubtaskColumns + `, group_name, serial_key, weight) values `)
+		for _, subtask := range batch {
+			markerList = append(markerList, "(%?, %?, %?, %?, %?, %?, %?, %?, CURRENT_TIMESTAMP(), '{}', '{}', %?, %?, %?)")
+			var group, serialKey, weight any
+			if subtask.Group != "" {
+				group = subtask.Group
+			}
+			if subtask.SerialKey != "" {
+				serialKey = subtask.SerialKey
+			}
+			if subtask.Weight > 0 {
+				weight = subtask.Weight
+			}
+			args = append(args, subtask.Step, subtask.TaskID, subtask.ExecID, subtask.Meta,
+				proto.SubtaskStatePending, proto.Type2Int(subtask.Type), subtask.Concurrency, subtask.Ordinal, group, serialKey, weight)
+		}
+		sb.WriteString(strings.Join(markerList, ","))
+		if _, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), sb.String(), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertSubtasks inserts pending subtasks of the step of the task in one
+// transaction, one subtask for each meta, the subtasks are assigned to managed
+// nodes in a round-robin way, and balancer will move them to the right nodes
+// later. it's used to plan steps with lots of subtasks.
+func (mgr *TaskManager) InsertSubtasks(ctx context.Context, taskID int64, step proto.Step, metas [][]byte) error {
+	if len(metas) == 0 {
+		return nil
+	}
+	return mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			`select type, concurrency from mysql.tidb_global_task where id = %?`, taskID)
+		if err != nil {
+			return err
+		}
+		if len(rs) == 0 {
+			return ErrTaskNotFound
+		}
+		taskType := proto.TaskType(rs[0].GetString(0))
+		concurrency := int(rs[0].GetInt64(1))
+		nodes, err := mgr.getManagedNodesWithSession(ctx, se)
+		if err != nil {
+			return err
+		}
+		if len(nodes) == 0 {
+			return errors.New("no managed node to assign subtasks")
+		}
+		subtasks := make([]*proto.Subtask, 0, len(metas))
+		for i, meta := range metas {
+			subtasks = append(subtasks, proto.NewSubtask(
+				step, taskID, taskType, nodes[i%len(nodes)].ID, concurrency, meta, i+1))
+		}
+		return mgr.insertSubtasks(ctx, se, subtasks)
+	})
+}
+
+// RefineStep implements the scheduler.StepRefineSwitcher interface.
+// the ordinals of subtasks are shifted after the ones of the former iterations,
+// and the subtasks are not inserted if the step has been refined by others.
+func (mgr *TaskManager) RefineStep(ctx context.Context, task *proto.Task, subtasks []*proto.Subtask) error {
+	return mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		_, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `
+			update mysql.tidb_global_task
+			set extra_params = json_set(ifnull(extra_params, json_object()), '$.step_iteration', %?),
+				state_update_time = CURRENT_TIMESTAMP()
+			where id = %? and state = %? and step = %?
+				and cast(ifnull(extra_params->>'$.step_iteration', '0') as signed) = %?`,
+			task.ExtraParams.StepIteration+1, task.ID, task.State, task.Step, task.ExtraParams.StepIteration)
+		if err != nil {
+			return err
+		}
+		if se.GetSessionVars().StmtCtx.AffectedRows() == 0 {
+			// refined by others, or the task has changed.
+			return nil
+		}
+		rs, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(), `
+			select ifnull(max(ordinal), 0) from mysql.tidb_background_subtask
+			where task_key = %? and step = %?`, task.ID, task.Step)
+		if err != nil {
+			return err
+		}
+		maxOrdinal := int(rs[0].GetInt64(0))
+		refinedSubtasks := make([]*proto.Subtask, 0, len(subtasks))
+		for _, subtask := range subtasks {
+			refined := *subtask
+			refined.Ordinal += maxOrdinal
+			refinedSubtasks = append(refinedSubtasks, &refined)
+		}
+		return mgr.insertSubtasks(ctx, se, refinedSubtasks)
+	})
 }
 
 // SwitchTaskStepInBatch implements the scheduler.TaskManager interface.
@@ -669,6 +1439,41 @@ func (mgr *TaskManager) SwitchTaskStepInBatch(
 	nextState proto.TaskState,
 	nextStep proto.Step,
 	subtasks []*proto.Subtask,
+) error {
+	return mgr.switchTaskStepInBatch(ctx, task, nextState, nextStep, subtasks, 0, nil)
+}
+
+// SwitchTaskStepWithLimiter is similar to SwitchTaskStepInBatch, but subtasks
+// are inserted in batches of at most limiter.Burst() subtasks, and it waits on
+// the limiter before inserting each batch, so creating lots of subtasks is
+// spread over time instead of spiking the storage load. each batch is committed
+// separately, so it doesn't block executing subtasks already created, and the
+// task is switched to the next step after all subtasks are inserted.
+func (mgr *TaskManager) SwitchTaskStepWithLimiter(
+	ctx context.Context,
+	task *proto.Task,
+	nextState proto.TaskState,
+	nextStep proto.Step,
+	subtasks []*proto.Subtask,
+	limiter *rate.Limiter,
+) error {
+	return mgr.switchTaskStepInBatch(ctx, task, nextState, nextStep, subtasks, max(limiter.Burst(), 1),
+		func(batch []*proto.Subtask) error {
+			return limiter.WaitN(ctx, len(batch))
+		})
+}
+
+// switchTaskStepInBatch inserts subtasks in batches split by size, batches are
+// split further to at most maxBatchCnt subtasks if it's positive, and
+// beforeInsert is called before inserting each batch if it's not nil.
+func (mgr *TaskManager) switchTaskStepInBatch(
+	ctx context.Context,
+	task *proto.Task,
+	nextState proto.TaskState,
+	nextStep proto.Step,
+	subtasks []*proto.Subtask,
+	maxBatchCnt int,
+	beforeInsert func(batch []*proto.Subtask) error,
 ) error {
 	return mgr.WithNewSession(func(se sessionctx.Context) error {
 		// some subtasks may be inserted by other schedulers, we can skip them.
@@ -685,8 +1490,20 @@ func (mgr *TaskManager) SwitchTaskStepInBatch(
 		}
 		subtaskBatches := mgr.splitSubtasks(subtasks[existingTaskCnt:])
 		for _, batch := range subtaskBatches {
-			if err = mgr.insertSubtasks(ctx, se, batch); err != nil {
-				return err
+			for len(batch) > 0 {
+				curr := batch
+				if maxBatchCnt > 0 && len(curr) > maxBatchCnt {
+					curr = batch[:maxBatchCnt]
+				}
+				batch = batch[len(curr):]
+				if beforeInsert != nil {
+					if err = beforeInsert(curr); err != nil {
+						return err
+					}
+				}
+				if err = mgr.insertSubtasks(ctx, se, curr); err != nil {
+					return err
+				}
 			}
 		}
 		return mgr.updateTaskStateStep(ctx, se, task, nextState, nextStep)
@@ -731,7 +1548,47 @@ func serializeErr(err error) []byte {
 	return errBytes
 }
 
+// GetFinishedSubtasksWithHistory gets subtasks of all steps of the task which
+// are finished, i.e. succeed, failed or canceled, subtasks in history table are
+// included too.
+func (mgr *TaskManager) GetFinishedSubtasksWithHistory(ctx context.Context, taskID int64) ([]*proto.Subtask, error) {
+	var (
+		rs  []chunk.Row
+		err error
+	)
+	err = mgr.WithNewTxn(ctx, func(se sessionctx.Context) error {
+		rs, err = sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			`select `+SubtaskColumns+` from mysql.tidb_background_subtask
+			where task_key = %? and state in (%?, %?, %?)`,
+			taskID, proto.SubtaskStateSucceed, proto.SubtaskStateFailed, proto.SubtaskStateCanceled,
+		)
+		if err != nil {
+			return err
+		}
+		rsFromHistory, err := sqlexec.ExecSQL(ctx, se.GetSQLExecutor(),
+			`select `+SubtaskColumns+` from mysql.tidb_background_subtask_history
+			where task_key = %? and state in (%?, %?, %?)`,
+			taskID, proto.SubtaskStateSucceed, proto.SubtaskStateFailed, proto.SubtaskStateCanceled,
+		)
+		if err != nil {
+			return err
+		}
+		rs = append(rs, rsFromHistory...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	subtasks := make([]*proto.Subtask, 0, len(rs))
+	for _, r := range rs {
+		subtasks = append(subtasks, Row2SubTask(r))
+	}
+	return subtasks, nil
+}
+
 // GetSubtasksWithHistory gets the subtasks from tidb_global_task and tidb_global_task_history.
+// if subtasks of the task are compacted when moving to history table, the
+// aggregated rows are returned, see SubtaskCompactionThreshold.
 func (mgr *TaskManager) GetSubtasksWithHistory(ctx context.Context, taskID int64, step proto.Step) ([]*proto.Subtask, error) {
 	var (
 		rs  []chunk.Row
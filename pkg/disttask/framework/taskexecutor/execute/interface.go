@@ -48,6 +48,38 @@ type StepExecutor interface {
 	Cleanup(context.Context) error
 }
 
+// Prefetcher is an optional interface which can be implemented by StepExecutor.
+// executors that read remote data can prefetch the input of the next subtask
+// while the current one is running.
+type Prefetcher interface {
+	// Prefetch is called in background when the task executor starts running
+	// a subtask, nextSubtask is the next pending subtask on this node.
+	// ctx is cancelled when the running subtask finishes. Prefetch might not be
+	// called for every subtask, and nextSubtask might be run by other nodes
+	// after balance, error returned is only logged.
+	Prefetch(ctx context.Context, nextSubtask *proto.Subtask) error
+}
+
+// DoneChecker is an optional interface which can be implemented by StepExecutor.
+// executors of idempotent subtasks can implement it to skip subtasks whose work
+// is already done, such as by an earlier run before the task is resumed.
+type DoneChecker interface {
+	// IsAlreadyDone is called before running the subtask, if it returns true,
+	// the subtask is marked as succeed without calling RunSubtask and OnFinished.
+	// if it returns error, the subtask is run as usual.
+	IsAlreadyDone(ctx context.Context, subtask *proto.Subtask) (bool, error)
+}
+
+// ResourceEstimator is an optional interface which can be implemented by
+// StepExecutor. executors of subtasks which consume lots of resource can
+// implement it, the task executor reserves the estimated resource on the node
+// before starting the subtask, and releases it after the subtask finishes, so
+// subtasks of different tasks don't oversubscribe the node.
+type ResourceEstimator interface {
+	// EstimateResource returns the resource the subtask needs to run.
+	EstimateResource(subtask *proto.Subtask) proto.SubtaskResource
+}
+
 // SubtaskSummary contains the summary of a subtask.
 type SubtaskSummary struct {
 	RowCount int64
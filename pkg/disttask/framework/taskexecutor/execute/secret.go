@@ -0,0 +1,59 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execute
+
+import (
+	"context"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/util/syncutil"
+)
+
+// ErrNoSecretResolver is the error when resolving a secret but no
+// SecretResolver is set.
+var ErrNoSecretResolver = errors.New("no secret resolver")
+
+// SecretResolver resolves secret references stored in task meta, such as
+// reading the secret from a vault, it's pluggable by SetSecretResolver.
+type SecretResolver interface {
+	// ResolveSecret returns the secret of the reference.
+	ResolveSecret(ctx context.Context, ref proto.SecretRef) (string, error)
+}
+
+var secretResolver = struct {
+	syncutil.RWMutex
+	r SecretResolver
+}{}
+
+// SetSecretResolver sets the resolver of secret references, nil means unset.
+func SetSecretResolver(r SecretResolver) {
+	secretResolver.Lock()
+	defer secretResolver.Unlock()
+	secretResolver.r = r
+}
+
+// ResolveSecret resolves the secret reference, it's used by step executors to
+// get secrets when running subtasks, the secret should be kept in memory only.
+func ResolveSecret(ctx context.Context, ref proto.SecretRef) (string, error) {
+	secretResolver.RLock()
+	r := secretResolver.r
+	secretResolver.RUnlock()
+	if r == nil {
+		return "", ErrNoSecretResolver
+	}
+	secret, err := r.ResolveSecret(ctx, ref)
+	return secret, errors.Trace(err)
+}
@@ -16,13 +16,17 @@ package taskexecutor
 
 import (
 	"context"
+	"time"
 
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/disttask/framework/scheduler"
 	"github.com/pingcap/tidb/pkg/disttask/framework/storage"
 	"github.com/pingcap/tidb/pkg/disttask/framework/taskexecutor/execute"
 )
 
 // TaskTable defines the interface to access the task table.
+// storage.TaskManager is the implementation backed by system tables of TiDB,
+// an alternate storage can be plugged in by passing it to NewManager.
 type TaskTable interface {
 	// GetTaskExecInfoByExecID gets all task exec infos by given execID, if there's
 	// no executable subtask on the execID for some task, it's not returned.
@@ -48,6 +52,9 @@ type TaskTable interface {
 	FailSubtask(ctx context.Context, execID string, taskID int64, err error) error
 	// CancelSubtask update the task's subtasks' state to canceled.
 	CancelSubtask(ctx context.Context, exe string, taskID int64) error
+	// RetrySubtask updates the running subtask to retrying state, it's retried
+	// at nextRetryTime.
+	RetrySubtask(ctx context.Context, execID string, subtaskID int64, nextRetryTime time.Time) error
 	// FinishSubtask updates the subtask meta and mark state to succeed.
 	FinishSubtask(ctx context.Context, execID string, subtaskID int64, meta []byte) error
 	// PauseSubtasks update subtasks state to paused.
@@ -60,6 +67,43 @@ type TaskTable interface {
 	RunningSubtasksBack2Pending(ctx context.Context, subtasks []*proto.SubtaskBase) error
 }
 
+// SubtaskSummaryUpdater is an optional interface that TaskTable can implement
+// to persist the realtime summary of running subtasks, if the TaskTable doesn't
+// implement it, realtime summary of StepExecutor is ignored.
+type SubtaskSummaryUpdater interface {
+	// UpdateSubtaskRowCount updates the row count of the subtask.
+	UpdateSubtaskRowCount(ctx context.Context, subtaskID int64, rowCount int64) error
+}
+
+// SubtaskLeaseRenewer is an optional interface that TaskTable can implement to
+// renew the lease of running subtasks, so a long-running subtask is not taken
+// as dead by the scheduler, if the TaskTable doesn't implement it, running
+// subtasks have no lease and are only rescheduled when the node is dead.
+type SubtaskLeaseRenewer interface {
+	// RenewSubtaskLease renews the lease of the running subtask to ttl from now.
+	RenewSubtaskLease(ctx context.Context, execID string, subtaskID int64, ttl time.Duration) error
+}
+
+// RetryBudgetConsumer is an optional interface that TaskTable can implement to
+// share a retry budget between all subtasks of a task, see
+// proto.ExtraParams.RetryBudget, if the TaskTable doesn't implement it, the
+// retry budget of the task is ignored.
+type RetryBudgetConsumer interface {
+	// ConsumeRetryBudget consumes one retry from the retry budget of the task,
+	// it returns false if the budget is exhausted.
+	ConsumeRetryBudget(ctx context.Context, taskID int64) (bool, error)
+}
+
+// SubtaskRetryReassigner is an optional interface that TaskTable can implement
+// to retry subtasks on a different node, see RetryOnNewNode, if the TaskTable
+// doesn't implement it, subtasks are always retried on the same node.
+type SubtaskRetryReassigner interface {
+	// ReassignSubtaskForRetry moves the running subtask owned by execID to
+	// another managed node in pending state, it returns the exec ID of the new
+	// node, or empty if there is no other node.
+	ReassignSubtaskForRetry(ctx context.Context, execID string, subtaskID int64) (string, error)
+}
+
 // Pool defines the interface of a pool.
 type Pool interface {
 	Run(func()) error
@@ -106,6 +150,28 @@ type TaskExecutor interface {
 	IsRetryableError(err error) bool
 }
 
+// GracefulCanceler is an optional interface of TaskExecutor, it's used when the
+// task is cancelled in proto.CancelModeGraceful.
+type GracefulCanceler interface {
+	// CancelGracefully lets the running subtask finish, and stops the task
+	// executor without starting more subtasks.
+	CancelGracefully()
+}
+
+// SubtaskBatchGetter is an optional interface of TaskTable, task tables which
+// implement it let the task executor fetch up to SubtaskFetchLimit candidate
+// subtasks in one query, see TaskTable.GetFirstSubtaskInStates.
+type SubtaskBatchGetter interface {
+	// GetFirstSubtasksInStates gets at most limit subtasks by given states.
+	GetFirstSubtasksInStates(ctx context.Context, execID string, taskID int64, step proto.Step, limit int, states ...proto.SubtaskState) ([]*proto.Subtask, error)
+}
+
+// resourceReservationsSetter is implemented by BaseTaskExecutor and task
+// executors embedding it, Manager sets the resource reservations through it.
+type resourceReservationsSetter interface {
+	setResourceReservations(r *scheduler.ResourceReservations)
+}
+
 // Extension extends the TaskExecutor.
 // each task type should implement this interface.
 type Extension interface {
@@ -125,6 +191,34 @@ type Extension interface {
 	IsRetryableError(err error) bool
 }
 
+// SubtaskRetryClassifier is an optional interface that Extension can implement
+// to decide whether to retry a subtask on error, it's consulted instead of
+// Extension.IsRetryableError when a subtask fails, so deterministic failures,
+// such as bad input, can fail the subtask immediately without retrying.
+type SubtaskRetryClassifier interface {
+	// ShouldRetry returns whether the subtask should be retried on err.
+	ShouldRetry(subtask *proto.Subtask, err error) bool
+}
+
+// SubtaskContextEnricher is an optional interface that Extension can implement
+// to put task-type-specific dependencies, such as clients or buffers, into the
+// context passed to StepExecutor.RunSubtask.
+type SubtaskContextEnricher interface {
+	// EnrichSubtaskContext returns the context to run the subtask, it's called
+	// before each RunSubtask, the returned context must be derived from ctx.
+	EnrichSubtaskContext(ctx context.Context, subtask *proto.Subtask) context.Context
+}
+
+// StepExecutorGetter is an optional interface that Extension can implement to
+// provide a separate StepExecutor for each step, so multi-step task types don't
+// need a single executor switching on the step. if it's implemented,
+// Extension.GetStepExecutor is not called.
+type StepExecutorGetter interface {
+	// GetSubtaskExecutorForStep returns the step executor for subtasks of the
+	// step, step is always the current step of the task.
+	GetSubtaskExecutorForStep(task *proto.Task, step proto.Step) (execute.StepExecutor, error)
+}
+
 // EmptyStepExecutor is an empty Executor.
 // it can be used for the task that does not need to split into subtasks.
 type EmptyStepExecutor struct {
@@ -133,6 +227,13 @@ type EmptyStepExecutor struct {
 
 var _ execute.StepExecutor = &EmptyStepExecutor{}
 
+var _ TaskTable = &storage.TaskManager{}
+var _ SubtaskSummaryUpdater = &storage.TaskManager{}
+var _ SubtaskLeaseRenewer = &storage.TaskManager{}
+var _ RetryBudgetConsumer = &storage.TaskManager{}
+var _ SubtaskBatchGetter = &storage.TaskManager{}
+var _ SubtaskRetryReassigner = &storage.TaskManager{}
+
 // Init implements the StepExecutor interface.
 func (*EmptyStepExecutor) Init(context.Context) error {
 	return nil
@@ -16,7 +16,9 @@ package taskexecutor
 
 import (
 	"context"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/go-units"
@@ -31,7 +33,6 @@ import (
 	"github.com/pingcap/tidb/pkg/metrics"
 	"github.com/pingcap/tidb/pkg/sessionctx/variable"
 	tidbutil "github.com/pingcap/tidb/pkg/util"
-	"github.com/pingcap/tidb/pkg/util/backoff"
 	"github.com/pingcap/tidb/pkg/util/cgroup"
 	"github.com/pingcap/tidb/pkg/util/cpu"
 	"github.com/pingcap/tidb/pkg/util/intest"
@@ -49,11 +50,16 @@ var (
 	// MaxSubtaskCheckInterval is the max interval to check whether there are subtasks to run.
 	// exported for testing.
 	MaxSubtaskCheckInterval = 2 * time.Second
+	// SubtaskFetchLimit is the max number of candidate subtasks the task executor
+	// fetches from the task table in one query, the candidates are started one
+	// by one before fetching again, see SubtaskBatchGetter.
+	SubtaskFetchLimit       = 1
 	maxChecksWhenNoSubtask  = 7
 	recoverMetaInterval     = 90 * time.Second
 	unfinishedSubtaskStates = []proto.SubtaskState{
 		proto.SubtaskStatePending,
 		proto.SubtaskStateRunning,
+		proto.SubtaskStateRetrying,
 	}
 )
 
@@ -73,9 +79,15 @@ type Manager struct {
 	cancel      context.CancelFunc
 	logger      *zap.Logger
 	slotManager *slotManager
+	// fairSlotSharing indicates whether the slots of the node are shared fairly
+	// between runnable tasks, see SetFairSlotSharing.
+	fairSlotSharing atomic.Bool
 
 	totalCPU int
 	totalMem int64
+	// resourceReservations is shared by task executors and schedulers in this
+	// instance, see execute.ResourceEstimator.
+	resourceReservations *scheduler.ResourceReservations
 }
 
 // NewManager creates a new task executor Manager.
@@ -119,13 +131,25 @@ func NewManager(ctx context.Context, id string, taskTable TaskTable) (*Manager,
 		slotManager: newSlotManager(totalCPU),
 		totalCPU:    totalCPU,
 		totalMem:    int64(totalMem),
+
+		resourceReservations: scheduler.GetResourceReservations(),
 	}
+	m.resourceReservations.SetCapacity(id, totalCPU, totalMem)
 	m.ctx, m.cancel = context.WithCancel(ctx)
 	m.mu.taskExecutors = make(map[int64]TaskExecutor)
 
 	return m, nil
 }
 
+// SetFairSlotSharing sets whether the slots of the node are shared fairly between
+// runnable tasks. when enabled, each runnable task occupies at most
+// capacity/number-of-runnable-tasks slots regardless of its rank, and the running
+// tasks which occupy more are restarted with the fair share, so a task with
+// large concurrency can't take all slots of the node and starve other tasks.
+func (m *Manager) SetFairSlotSharing(enable bool) {
+	m.fairSlotSharing.Store(enable)
+}
+
 // InitMeta initializes the meta of the Manager.
 // not a must-success step before start manager,
 // manager will try to recover meta periodically.
@@ -164,7 +188,10 @@ func (m *Manager) Stop() {
 
 // handleTasksLoop handle tasks of interested states, including:
 //   - pending/running: start the task executor.
-//   - reverting: cancel the task executor, and mark running subtasks as Canceled.
+//   - cancelling: cancel the task executor, so running subtasks observe the
+//     cancellation before the scheduler reverts the task.
+//   - reverting: cancel the task executor, and mark pending/running subtasks as
+//     Canceled after the executor exits.
 //   - pausing: cancel the task executor, mark all pending/running subtasks of current
 //     node as paused.
 //
@@ -179,6 +206,7 @@ func (m *Manager) handleTasksLoop() {
 			m.logger.Info("handle tasks loop done")
 			return
 		case <-ticker.C:
+		case <-handle.TaskCancelledCh():
 		}
 
 		m.handleTasks()
@@ -203,6 +231,8 @@ func (m *Manager) handleTasks() {
 			if !m.isExecutorStarted(task.ID) {
 				executableTasks = append(executableTasks, task)
 			}
+		case proto.TaskStateCancelling:
+			m.handleCancellingTask(task.ID)
 		case proto.TaskStatePausing:
 			if err := m.handlePausingTask(task.ID); err != nil {
 				m.logErr(err)
@@ -221,6 +251,15 @@ func (m *Manager) handleTasks() {
 
 // handleExecutableTasks handles executable tasks.
 func (m *Manager) handleExecutableTasks(taskInfos []*storage.TaskExecInfo) {
+	// tasks are returned in rank order, we reorder them by type priority, and
+	// keep the rank order inside the same type priority.
+	slices.SortStableFunc(taskInfos, func(a, b *storage.TaskExecInfo) int {
+		return compareTask(a.TaskBase, b.TaskBase)
+	})
+	if m.fairSlotSharing.Load() {
+		m.handleExecutableTasksFairly(taskInfos)
+		return
+	}
 	for _, task := range taskInfos {
 		canAlloc, tasksNeedFree := m.slotManager.canAlloc(task.TaskBase)
 		if len(tasksNeedFree) > 0 {
@@ -237,6 +276,30 @@ func (m *Manager) handleExecutableTasks(taskInfos []*storage.TaskExecInfo) {
 	}
 }
 
+// handleExecutableTasksFairly handles executable tasks in round-robin manner,
+// each task takes the fair share of slots at most.
+func (m *Manager) handleExecutableTasksFairly(taskInfos []*storage.TaskExecInfo) {
+	m.mu.RLock()
+	runnableCnt := len(m.mu.taskExecutors) + len(taskInfos)
+	m.mu.RUnlock()
+	share := max(m.slotManager.capacity/runnableCnt, 1)
+	// running tasks which occupy more than the fair share are restarted with
+	// the fair share in later rounds.
+	if tasksNeedShrink := m.slotManager.tasksExceeding(share); len(tasksNeedShrink) > 0 {
+		m.cancelTaskExecutors(tasksNeedShrink)
+		return
+	}
+	for _, task := range taskInfos {
+		sharedTask := *task.TaskBase
+		sharedTask.Concurrency = min(sharedTask.Concurrency, share)
+		if canAlloc, _ := m.slotManager.canAlloc(&sharedTask); !canAlloc {
+			m.logger.Debug("no enough slots to run task", zap.Int64("task-id", task.ID))
+			continue
+		}
+		m.startTaskExecutor(&sharedTask)
+	}
+}
+
 // cancelRunningSubtaskOf cancels the running subtask of the task, the subtask
 // will switch to `canceled` state.
 func (m *Manager) cancelRunningSubtaskOf(taskID int64) {
@@ -261,11 +324,59 @@ func (m *Manager) handlePausingTask(taskID int64) error {
 	return m.taskTable.PauseSubtasks(m.ctx, m.id, taskID)
 }
 
+// handleRevertingTask cancels the task executor of the reverting task, and marks
+// pending/running subtasks of current node as canceled only after the executor
+// exits, i.e. after the step executor is cleaned up. so when the scheduler sees
+// no runnable subtask and marks the task as reverted, side effects of the
+// cleanup are already observable.
 func (m *Manager) handleRevertingTask(taskID int64) error {
-	m.cancelRunningSubtaskOf(taskID)
+	if m.cancelTaskExecutorOf(taskID) {
+		// running subtask is left as it is, we will cancel it on next round
+		// after the executor exits.
+		return nil
+	}
 	return m.taskTable.CancelSubtask(m.ctx, m.id, taskID)
 }
 
+// handleCancellingTask cancels the task executor of the cancelling task, so
+// running subtasks observe the cancellation without waiting for the scheduler
+// to revert the task, subtasks are marked as canceled after the task switches
+// to reverting, see handleRevertingTask.
+func (m *Manager) handleCancellingTask(taskID int64) {
+	m.cancelTaskExecutorOf(taskID)
+}
+
+// cancelTaskExecutorOf cancels the task executor of the task, it's cancelled
+// gracefully if the task is cancelled in proto.CancelModeGraceful. returns
+// false if there is no executor of the task.
+func (m *Manager) cancelTaskExecutorOf(taskID int64) bool {
+	m.mu.RLock()
+	executor, ok := m.mu.taskExecutors[taskID]
+	m.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if canceler, ok := executor.(GracefulCanceler); ok && m.isCancelledGracefully(taskID) {
+		m.logger.Info("stop executor of gracefully cancelled task", zap.Int64("task-id", taskID))
+		canceler.CancelGracefully()
+		return true
+	}
+	m.logger.Info("cancel task executor", zap.Int64("task-id", taskID))
+	executor.Cancel()
+	return true
+}
+
+// isCancelledGracefully checks whether the task is cancelled in
+// proto.CancelModeGraceful, we take it as force cancel if we fail to get it.
+func (m *Manager) isCancelledGracefully(taskID int64) bool {
+	task, err := m.taskTable.GetTaskByID(m.ctx, taskID)
+	if err != nil {
+		m.logErr(err)
+		return false
+	}
+	return task.ExtraParams.CancelMode == proto.CancelModeGraceful
+}
+
 // recoverMetaLoop recovers dist_framework_meta for the tidb node running the taskExecutor manager.
 // This is necessary when the TiDB node experiences a prolonged network partition
 // and the scheduler deletes `dist_framework_meta`.
@@ -309,6 +420,9 @@ func (m *Manager) startTaskExecutor(taskBase *proto.TaskBase) {
 		m.logger.Error("get task failed", zap.Int64("task-id", taskBase.ID), zap.Error(err))
 		return
 	}
+	// the task might be allocated fewer slots than its concurrency, see
+	// SetFairSlotSharing.
+	task.Concurrency = min(task.Concurrency, taskBase.Concurrency)
 	// runCtx only used in executor.Run, cancel in m.fetchAndFastCancelTasks.
 	factory := GetTaskExecutorFactory(task.Type)
 	if factory == nil {
@@ -317,6 +431,9 @@ func (m *Manager) startTaskExecutor(taskBase *proto.TaskBase) {
 		return
 	}
 	executor := factory(m.ctx, m.id, task, m.taskTable)
+	if setter, ok := executor.(resourceReservationsSetter); ok {
+		setter.setResourceReservations(m.resourceReservations)
+	}
 	err = executor.Init(m.ctx)
 	if err != nil {
 		m.failSubtask(err, task.ID, executor)
@@ -386,7 +503,7 @@ func (m *Manager) failSubtask(err error, taskID int64, taskExecutor TaskExecutor
 }
 
 func (m *Manager) runWithRetry(fn func() error, msg string) error {
-	backoffer := backoff.NewExponential(scheduler.RetrySQLInterval, 2, scheduler.RetrySQLMaxInterval)
+	backoffer := scheduler.NewRetrySQLBackoffer()
 	err1 := handle.RunWithRetry(m.ctx, scheduler.RetrySQLTimes, backoffer, m.logger,
 		func(_ context.Context) (bool, error) {
 			return true, fn()
@@ -97,10 +97,12 @@ func TestManageTaskExecutor(t *testing.T) {
 	require.ErrorContains(t, m.handlePausingTask(1), "pause failed")
 	require.True(t, ctrl.Satisfied())
 
-	// handle reverting
+	// handle reverting, subtasks are canceled only after the executor exits.
+	executor1.EXPECT().Cancel()
+	require.NoError(t, m.handleRevertingTask(1))
+	require.True(t, ctrl.Satisfied())
 	executor1.EXPECT().GetTaskBase().Return(&proto.TaskBase{ID: 1})
-	executor1.EXPECT().CancelRunningSubtask()
-	m.addTaskExecutor(executor1)
+	m.delTaskExecutor(executor1)
 	mockTaskTable.EXPECT().CancelSubtask(m.ctx, "test", int64(1)).Return(nil)
 	require.NoError(t, m.handleRevertingTask(1))
 	require.True(t, ctrl.Satisfied())
@@ -172,6 +174,206 @@ func TestHandleExecutableTasks(t *testing.T) {
 	require.False(t, m.isExecutorStarted(taskID))
 }
 
+func TestHandleExecutableTasksByTypePriority(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockTaskTable := mock.NewMockTaskTable(ctrl)
+	lowExecutor := mock.NewMockTaskExecutor(ctrl)
+	highExecutor := mock.NewMockTaskExecutor(ctrl)
+	ctx := context.Background()
+
+	// low priority task has higher rank, but it's claimed after the high priority one.
+	lowTask := &proto.TaskBase{ID: 1, State: proto.TaskStateRunning, Step: proto.StepOne, Type: "low", Concurrency: 8}
+	highTask := &proto.TaskBase{ID: 2, State: proto.TaskStateRunning, Step: proto.StepOne, Type: "high", Concurrency: 8}
+	lowExecutor.EXPECT().GetTaskBase().Return(lowTask).AnyTimes()
+	highExecutor.EXPECT().GetTaskBase().Return(highTask).AnyTimes()
+	RegisterTaskType("low",
+		func(ctx context.Context, id string, task *proto.Task, taskTable TaskTable) TaskExecutor {
+			return lowExecutor
+		})
+	RegisterTaskType("high",
+		func(ctx context.Context, id string, task *proto.Task, taskTable TaskTable) TaskExecutor {
+			return highExecutor
+		}, WithTypePriority(10))
+	t.Cleanup(ClearTaskExecutors)
+
+	m, err := NewManager(ctx, "test", mockTaskTable)
+	require.NoError(t, err)
+	m.slotManager.available.Store(8)
+
+	// only the high priority task can run, and it's not freed for the low one.
+	highCh := make(chan struct{})
+	highExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	highExecutor.EXPECT().Run(gomock.Any()).DoAndReturn(func(*proto.StepResource) {
+		<-highCh
+	})
+	mockTaskTable.EXPECT().GetTaskByID(gomock.Any(), highTask.ID).Return(&proto.Task{TaskBase: *highTask}, nil)
+	m.handleExecutableTasks([]*storage.TaskExecInfo{{TaskBase: lowTask}, {TaskBase: highTask}})
+	require.Eventually(t, func() bool {
+		return ctrl.Satisfied()
+	}, 5*time.Second, 100*time.Millisecond)
+	require.True(t, m.isExecutorStarted(highTask.ID))
+	require.False(t, m.isExecutorStarted(lowTask.ID))
+	m.handleExecutableTasks([]*storage.TaskExecInfo{{TaskBase: lowTask}})
+	require.False(t, m.isExecutorStarted(lowTask.ID))
+	close(highCh)
+	highExecutor.EXPECT().Close()
+	m.executorWG.Wait()
+	require.Equal(t, 8, m.slotManager.availableSlots())
+
+	// the running low priority task is freed for the high priority one.
+	lowCh := make(chan struct{})
+	lowExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	lowExecutor.EXPECT().Run(gomock.Any()).DoAndReturn(func(*proto.StepResource) {
+		<-lowCh
+	})
+	mockTaskTable.EXPECT().GetTaskByID(gomock.Any(), lowTask.ID).Return(&proto.Task{TaskBase: *lowTask}, nil)
+	m.handleExecutableTasks([]*storage.TaskExecInfo{{TaskBase: lowTask}})
+	require.Eventually(t, func() bool {
+		return ctrl.Satisfied()
+	}, 5*time.Second, 100*time.Millisecond)
+	require.True(t, m.isExecutorStarted(lowTask.ID))
+	lowExecutor.EXPECT().Cancel().Do(func() {
+		close(lowCh)
+	})
+	lowExecutor.EXPECT().Close()
+	m.handleExecutableTasks([]*storage.TaskExecInfo{{TaskBase: lowTask}, {TaskBase: highTask}})
+	m.executorWG.Wait()
+	require.True(t, ctrl.Satisfied())
+	require.False(t, m.isExecutorStarted(lowTask.ID))
+	require.Equal(t, 8, m.slotManager.availableSlots())
+}
+
+func TestHandleExecutableTasksWithTypeSlotLimit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockTaskTable := mock.NewMockTaskTable(ctrl)
+	slowExecutor := mock.NewMockTaskExecutor(ctrl)
+	fastExecutor := mock.NewMockTaskExecutor(ctrl)
+	ctx := context.Background()
+
+	// slow tasks have higher rank, but they can only occupy half of the slots.
+	slowTask1 := &proto.TaskBase{ID: 1, State: proto.TaskStateRunning, Step: proto.StepOne, Type: "slow", Concurrency: 8}
+	slowTask2 := &proto.TaskBase{ID: 2, State: proto.TaskStateRunning, Step: proto.StepOne, Type: "slow", Concurrency: 8}
+	fastTask := &proto.TaskBase{ID: 3, State: proto.TaskStateRunning, Step: proto.StepOne, Type: "fast", Concurrency: 8}
+	slowExecutor.EXPECT().GetTaskBase().Return(slowTask1).AnyTimes()
+	fastExecutor.EXPECT().GetTaskBase().Return(fastTask).AnyTimes()
+	RegisterTaskType("slow",
+		func(ctx context.Context, id string, task *proto.Task, taskTable TaskTable) TaskExecutor {
+			return slowExecutor
+		}, WithTypeSlotLimit(8))
+	RegisterTaskType("fast",
+		func(ctx context.Context, id string, task *proto.Task, taskTable TaskTable) TaskExecutor {
+			return fastExecutor
+		})
+	t.Cleanup(ClearTaskExecutors)
+
+	m, err := NewManager(ctx, "test", mockTaskTable)
+	require.NoError(t, err)
+	m.slotManager.available.Store(16)
+
+	slowCh, fastCh := make(chan struct{}), make(chan struct{})
+	slowExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	slowExecutor.EXPECT().Run(gomock.Any()).DoAndReturn(func(*proto.StepResource) {
+		<-slowCh
+	})
+	fastExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	fastExecutor.EXPECT().Run(gomock.Any()).DoAndReturn(func(*proto.StepResource) {
+		<-fastCh
+	})
+	mockTaskTable.EXPECT().GetTaskByID(gomock.Any(), slowTask1.ID).Return(&proto.Task{TaskBase: *slowTask1}, nil)
+	mockTaskTable.EXPECT().GetTaskByID(gomock.Any(), fastTask.ID).Return(&proto.Task{TaskBase: *fastTask}, nil)
+	m.handleExecutableTasks([]*storage.TaskExecInfo{{TaskBase: slowTask1}, {TaskBase: slowTask2}, {TaskBase: fastTask}})
+	require.Eventually(t, func() bool {
+		return ctrl.Satisfied()
+	}, 5*time.Second, 100*time.Millisecond)
+	require.True(t, m.isExecutorStarted(slowTask1.ID))
+	require.False(t, m.isExecutorStarted(slowTask2.ID))
+	require.True(t, m.isExecutorStarted(fastTask.ID))
+	require.Equal(t, 0, m.slotManager.availableSlots())
+
+	// the second slow task still can't run after the fast one finishes.
+	fastExecutor.EXPECT().Close()
+	close(fastCh)
+	require.Eventually(t, func() bool {
+		return !m.isExecutorStarted(fastTask.ID)
+	}, 5*time.Second, 100*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return m.slotManager.availableSlots() == 8
+	}, 5*time.Second, 100*time.Millisecond)
+	m.handleExecutableTasks([]*storage.TaskExecInfo{{TaskBase: slowTask2}})
+	require.False(t, m.isExecutorStarted(slowTask2.ID))
+
+	slowExecutor.EXPECT().Close()
+	close(slowCh)
+	m.executorWG.Wait()
+	require.True(t, ctrl.Satisfied())
+	require.Equal(t, 16, m.slotManager.availableSlots())
+}
+
+func TestHandleExecutableTasksWithFairSlotSharing(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockTaskTable := mock.NewMockTaskTable(ctrl)
+	executor1 := mock.NewMockTaskExecutor(ctrl)
+	executor2 := mock.NewMockTaskExecutor(ctrl)
+	ctx := context.Background()
+
+	// both tasks want all slots of the node.
+	task1 := &proto.TaskBase{ID: 1, State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type1", Concurrency: 16}
+	task2 := &proto.TaskBase{ID: 2, State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type2", Concurrency: 16}
+	executor1.EXPECT().GetTaskBase().Return(task1).AnyTimes()
+	executor2.EXPECT().GetTaskBase().Return(task2).AnyTimes()
+	var concurrency1, concurrency2 int
+	RegisterTaskType("type1",
+		func(ctx context.Context, id string, task *proto.Task, taskTable TaskTable) TaskExecutor {
+			concurrency1 = task.Concurrency
+			return executor1
+		})
+	RegisterTaskType("type2",
+		func(ctx context.Context, id string, task *proto.Task, taskTable TaskTable) TaskExecutor {
+			concurrency2 = task.Concurrency
+			return executor2
+		})
+	t.Cleanup(ClearTaskExecutors)
+
+	m, err := NewManager(ctx, "test", mockTaskTable)
+	require.NoError(t, err)
+	m.slotManager = newSlotManager(16)
+	m.SetFairSlotSharing(true)
+
+	ch1, ch2 := make(chan struct{}), make(chan struct{})
+	executor1.EXPECT().Init(gomock.Any()).Return(nil)
+	executor1.EXPECT().Run(gomock.Any()).DoAndReturn(func(resource *proto.StepResource) {
+		require.EqualValues(t, 8, resource.CPU.Capacity())
+		<-ch1
+	})
+	executor2.EXPECT().Init(gomock.Any()).Return(nil)
+	executor2.EXPECT().Run(gomock.Any()).DoAndReturn(func(resource *proto.StepResource) {
+		require.EqualValues(t, 8, resource.CPU.Capacity())
+		<-ch2
+	})
+	mockTaskTable.EXPECT().GetTaskByID(gomock.Any(), task1.ID).Return(&proto.Task{TaskBase: *task1}, nil)
+	mockTaskTable.EXPECT().GetTaskByID(gomock.Any(), task2.ID).Return(&proto.Task{TaskBase: *task2}, nil)
+	m.handleExecutableTasks([]*storage.TaskExecInfo{{TaskBase: task1}, {TaskBase: task2}})
+	require.Eventually(t, func() bool {
+		return ctrl.Satisfied()
+	}, 5*time.Second, 100*time.Millisecond)
+	require.True(t, m.isExecutorStarted(task1.ID))
+	require.True(t, m.isExecutorStarted(task2.ID))
+	require.Equal(t, 8, concurrency1)
+	require.Equal(t, 8, concurrency2)
+	require.Equal(t, 0, m.slotManager.availableSlots())
+
+	executor1.EXPECT().Close()
+	executor2.EXPECT().Close()
+	close(ch1)
+	close(ch2)
+	m.executorWG.Wait()
+	require.True(t, ctrl.Satisfied())
+	require.Equal(t, 16, m.slotManager.availableSlots())
+}
+
 func TestManager(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -272,18 +474,17 @@ func TestManagerHandleTasks(t *testing.T) {
 	m.handleTasks()
 	require.True(t, ctrl.Satisfied())
 
-	// task1 changed to reverting, executor will keep running, but context canceled
+	// task1 changed to reverting, executor will keep running, but context canceled,
+	// subtasks are not canceled until the executor exits.
 	task1.State = proto.TaskStateReverting
 	mockTaskTable.EXPECT().GetTaskExecInfoByExecID(m.ctx, m.id).
 		Return([]*storage.TaskExecInfo{{TaskBase: task1}}, nil)
-	mockInternalExecutor.EXPECT().CancelRunningSubtask()
-	mockTaskTable.EXPECT().CancelSubtask(m.ctx, m.id, task1.ID)
+	mockInternalExecutor.EXPECT().Cancel()
 	m.handleTasks()
 	require.True(t, ctrl.Satisfied())
 	require.True(t, m.isExecutorStarted(task1.ID))
 
-	// finish task1, executor will be closed
-	task1.State = proto.TaskStateReverted
+	// executor of task1 exits, executor will be closed
 	mockInternalExecutor.EXPECT().Close()
 	ch <- nil
 	require.Eventually(t, func() bool {
@@ -291,6 +492,13 @@ func TestManagerHandleTasks(t *testing.T) {
 	}, 5*time.Second, 100*time.Millisecond)
 	require.False(t, m.isExecutorStarted(task1.ID))
 
+	// subtasks of task1 are canceled after the executor exits.
+	mockTaskTable.EXPECT().GetTaskExecInfoByExecID(m.ctx, m.id).
+		Return([]*storage.TaskExecInfo{{TaskBase: task1}}, nil)
+	mockTaskTable.EXPECT().CancelSubtask(m.ctx, m.id, task1.ID)
+	m.handleTasks()
+	require.True(t, ctrl.Satisfied())
+
 	m.executorWG.Wait()
 }
 
@@ -16,16 +16,120 @@ package taskexecutor
 
 import (
 	"context"
+	"slices"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/util/backoff"
 )
 
 type taskTypeOptions struct {
+	// newSubtaskRetryBackoffer is used to create the backoffer used when the
+	// task executor meets retryable error, if it's nil, task executor retries
+	// after SubtaskCheckInterval.
+	newSubtaskRetryBackoffer func() backoff.Backoffer
+	// subtaskRetryJitter is the max ratio of the backoff of a retry extended
+	// randomly, see WithSubtaskRetryJitter.
+	subtaskRetryJitter float64
+	// stepSequence is the business steps of the task type.
+	stepSequence []proto.Step
+	// handledSteps is the steps the task executor claims to handle.
+	handledSteps []proto.Step
+	// typePriority is the priority of the task type, tasks of the type with
+	// higher priority are claimed first.
+	typePriority int
+	// typeSlotLimit is the max slots that tasks of the type can occupy on a
+	// node, 0 means no limit.
+	typeSlotLimit int
+	// subtaskRetryPolicy decides where a subtask is retried on retryable error,
+	// see WithSubtaskRetryPolicy.
+	subtaskRetryPolicy SubtaskRetryPolicy
 }
 
+// SubtaskRetryPolicy is the policy of where a subtask is retried when the task
+// executor meets retryable error.
+type SubtaskRetryPolicy int
+
+const (
+	// RetryOnSameNode retries the subtask on the node where it fails.
+	RetryOnSameNode SubtaskRetryPolicy = iota
+	// RetryOnNewNode reassigns the subtask to a different node on retry, it's
+	// useful when the failure is node-local, such as corrupted local data, so
+	// retrying on the same node is pointless. if there is no other node to
+	// run the subtask, it's retried on the same node.
+	RetryOnNewNode
+)
+
 // TaskTypeOption is the option of TaskType.
 type TaskTypeOption func(opts *taskTypeOptions)
 
+// WithSubtaskRetryBackoffer sets the backoff strategy used when the task
+// executor meets retryable error, fn is called once for each task executor
+// to create a new backoffer.
+func WithSubtaskRetryBackoffer(fn func() backoff.Backoffer) TaskTypeOption {
+	return func(opts *taskTypeOptions) {
+		opts.newSubtaskRetryBackoffer = fn
+	}
+}
+
+// WithSubtaskRetryJitter extends the backoff of each retry by a random duration
+// in [0, jitter*backoff), so subtasks which fail at the same time, such as on a
+// blip of the downstream, spread their retries out instead of retrying together.
+// it only takes effect together with WithSubtaskRetryBackoffer. default is 0,
+// which means no jitter.
+func WithSubtaskRetryJitter(jitter float64) TaskTypeOption {
+	return func(opts *taskTypeOptions) {
+		opts.subtaskRetryJitter = jitter
+	}
+}
+
+// WithStepSequence declares the business steps of the task type, it should be
+// the same as the steps returned by GetNextStep of the scheduler extension.
+// used together with WithHandledSteps to validate the registration.
+func WithStepSequence(steps ...proto.Step) TaskTypeOption {
+	return func(opts *taskTypeOptions) {
+		opts.stepSequence = steps
+	}
+}
+
+// WithHandledSteps declares the steps that the task executor can handle, i.e.
+// GetStepExecutor returns a step executor for them.
+// used together with WithStepSequence to validate the registration.
+func WithHandledSteps(steps ...proto.Step) TaskTypeOption {
+	return func(opts *taskTypeOptions) {
+		opts.handledSteps = steps
+	}
+}
+
+// WithTypePriority sets the priority of the task type, when there are tasks of
+// multiple types to run, the task executor manager claims tasks of the type with
+// higher priority first, and the rank of the task is only compared between tasks
+// of the same type priority. default is 0.
+func WithTypePriority(priority int) TaskTypeOption {
+	return func(opts *taskTypeOptions) {
+		opts.typePriority = priority
+	}
+}
+
+// WithTypeSlotLimit sets the max slots that tasks of the type can occupy on a
+// node, so tasks of one type can't monopolize the slots of the node and starve
+// tasks of other types. if the concurrency of a task is larger than the limit,
+// it can only run when no other task of the type is running. default is 0,
+// which means no limit.
+func WithTypeSlotLimit(limit int) TaskTypeOption {
+	return func(opts *taskTypeOptions) {
+		opts.typeSlotLimit = limit
+	}
+}
+
+// WithSubtaskRetryPolicy sets where a subtask is retried when the task executor
+// meets retryable error. default is RetryOnSameNode.
+func WithSubtaskRetryPolicy(policy SubtaskRetryPolicy) TaskTypeOption {
+	return func(opts *taskTypeOptions) {
+		opts.subtaskRetryPolicy = policy
+	}
+}
+
 var (
 	// key is task type
 	taskTypes             = make(map[proto.TaskType]taskTypeOptions)
@@ -35,11 +139,17 @@ var (
 type taskExecutorFactoryFn func(ctx context.Context, id string, task *proto.Task, taskTable TaskTable) TaskExecutor
 
 // RegisterTaskType registers the task type.
+// if both WithStepSequence and WithHandledSteps are specified, it panics when
+// some step in the sequence is not handled by the task executor, so forgetting
+// to handle a step is found on registration instead of at runtime.
 func RegisterTaskType(taskType proto.TaskType, factory taskExecutorFactoryFn, opts ...TaskTypeOption) {
 	var option taskTypeOptions
 	for _, opt := range opts {
 		opt(&option)
 	}
+	if err := option.validateSteps(taskType); err != nil {
+		panic(err.Error())
+	}
 	taskTypes[taskType] = option
 	taskExecutorFactories[taskType] = factory
 }
@@ -49,8 +159,29 @@ func GetTaskExecutorFactory(taskType proto.TaskType) taskExecutorFactoryFn {
 	return taskExecutorFactories[taskType]
 }
 
+func getTypePriority(taskType proto.TaskType) int {
+	return taskTypes[taskType].typePriority
+}
+
+func getTypeSlotLimit(taskType proto.TaskType) int {
+	return taskTypes[taskType].typeSlotLimit
+}
+
 // ClearTaskExecutors is only used in test
 func ClearTaskExecutors() {
 	taskTypes = make(map[proto.TaskType]taskTypeOptions)
 	taskExecutorFactories = make(map[proto.TaskType]taskExecutorFactoryFn)
 }
+
+func (opts *taskTypeOptions) validateSteps(taskType proto.TaskType) error {
+	if len(opts.stepSequence) == 0 || len(opts.handledSteps) == 0 {
+		return nil
+	}
+	for _, step := range opts.stepSequence {
+		if !slices.Contains(opts.handledSteps, step) {
+			return errors.Errorf("task type %s: step %s is not handled by the task executor",
+				taskType, proto.Step2Str(taskType, step))
+		}
+	}
+	return nil
+}
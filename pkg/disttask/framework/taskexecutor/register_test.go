@@ -39,3 +39,23 @@ func TestRegisterTaskType(t *testing.T) {
 	require.Len(t, taskTypes, 2)
 	require.Len(t, taskExecutorFactories, 2)
 }
+
+func TestRegisterTaskTypeValidateSteps(t *testing.T) {
+	ClearTaskExecutors()
+	t.Cleanup(ClearTaskExecutors)
+	factoryFn := func(ctx context.Context, id string, task *proto.Task, taskTable TaskTable) TaskExecutor {
+		return nil
+	}
+	require.PanicsWithValue(t, "task type Example: step two is not handled by the task executor", func() {
+		RegisterTaskType(proto.TaskTypeExample, factoryFn,
+			WithStepSequence(proto.StepOne, proto.StepTwo), WithHandledSteps(proto.StepOne))
+	})
+	require.Empty(t, taskExecutorFactories)
+
+	RegisterTaskType(proto.TaskTypeExample, factoryFn,
+		WithStepSequence(proto.StepOne, proto.StepTwo), WithHandledSteps(proto.StepOne, proto.StepTwo))
+	require.Len(t, taskExecutorFactories, 1)
+	// no validation if steps are not declared.
+	RegisterTaskType("test1", factoryFn, WithHandledSteps(proto.StepOne))
+	require.Len(t, taskExecutorFactories, 2)
+}
@@ -30,6 +30,9 @@ type slotManager struct {
 	// executorTasks is used to record the tasks that is running on the executor,
 	// the slice is sorted in reverse task order.
 	executorTasks []*proto.TaskBase
+	// typeUsedSlots is the slots occupied by tasks of each task type, it's used
+	// to check the slot limit of the task type, see WithTypeSlotLimit.
+	typeUsedSlots map[proto.TaskType]int
 
 	capacity int
 	// The number of slots that can be used by the executor.
@@ -41,12 +44,22 @@ func newSlotManager(capacity int) *slotManager {
 	sm := &slotManager{
 		taskID2Index:  make(map[int64]int),
 		executorTasks: make([]*proto.TaskBase, 0),
+		typeUsedSlots: make(map[proto.TaskType]int),
 		capacity:      capacity,
 	}
 	sm.available.Store(int32(capacity))
 	return sm
 }
 
+// compareTask compares two tasks by the priority of their task types first, then
+// by task rank. returns < 0 represents a should be claimed before b.
+func compareTask(a, b *proto.TaskBase) int {
+	if pa, pb := getTypePriority(a.Type), getTypePriority(b.Type); pa != pb {
+		return pb - pa
+	}
+	return a.Compare(b)
+}
+
 // subtasks inside a task will be run in serial, so they takes task.Concurrency slots.
 func (sm *slotManager) alloc(task *proto.TaskBase) {
 	sm.Lock()
@@ -54,11 +67,12 @@ func (sm *slotManager) alloc(task *proto.TaskBase) {
 
 	sm.executorTasks = append(sm.executorTasks, task)
 	slices.SortFunc(sm.executorTasks, func(a, b *proto.TaskBase) int {
-		return b.Compare(a)
+		return compareTask(b, a)
 	})
 	for index, slotInfo := range sm.executorTasks {
 		sm.taskID2Index[slotInfo.ID] = index
 	}
+	sm.typeUsedSlots[task.Type] += task.Concurrency
 	sm.available.Add(int32(-task.Concurrency))
 }
 
@@ -70,7 +84,12 @@ func (sm *slotManager) free(taskID int64) {
 	if !ok {
 		return
 	}
-	sm.available.Add(int32(sm.executorTasks[index].Concurrency))
+	task := sm.executorTasks[index]
+	sm.available.Add(int32(task.Concurrency))
+	sm.typeUsedSlots[task.Type] -= task.Concurrency
+	if sm.typeUsedSlots[task.Type] <= 0 {
+		delete(sm.typeUsedSlots, task.Type)
+	}
 	sm.executorTasks = append(sm.executorTasks[:index], sm.executorTasks[index+1:]...)
 
 	delete(sm.taskID2Index, taskID)
@@ -84,13 +103,18 @@ func (sm *slotManager) canAlloc(task *proto.TaskBase) (canAlloc bool, tasksNeedF
 	sm.RLock()
 	defer sm.RUnlock()
 
+	// freeing tasks of other types doesn't help if the task type reaches its
+	// slot limit, so we don't preempt in this case.
+	if !sm.withinTypeSlotLimit(task) {
+		return false, nil
+	}
 	if int(sm.available.Load()) >= task.Concurrency {
 		return true, nil
 	}
 
 	usedSlots := 0
 	for _, slotInfo := range sm.executorTasks {
-		if slotInfo.Compare(task) < 0 {
+		if compareTask(slotInfo, task) < 0 {
 			break
 		}
 		tasksNeedFree = append(tasksNeedFree, slotInfo)
@@ -103,6 +127,31 @@ func (sm *slotManager) canAlloc(task *proto.TaskBase) (canAlloc bool, tasksNeedF
 	return false, nil
 }
 
+// tasksExceeding returns the running tasks which occupy more slots than limit.
+func (sm *slotManager) tasksExceeding(limit int) []*proto.TaskBase {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	var tasks []*proto.TaskBase
+	for _, task := range sm.executorTasks {
+		if task.Concurrency > limit {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
+
+// withinTypeSlotLimit checks whether the task can run without exceeding the
+// slot limit of its task type, the caller should hold the lock.
+func (sm *slotManager) withinTypeSlotLimit(task *proto.TaskBase) bool {
+	limit := getTypeSlotLimit(task.Type)
+	if limit <= 0 {
+		return true
+	}
+	used := sm.typeUsedSlots[task.Type]
+	return used == 0 || used+task.Concurrency <= limit
+}
+
 func (sm *slotManager) availableSlots() int {
 	return int(sm.available.Load())
 }
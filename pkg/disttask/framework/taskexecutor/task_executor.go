@@ -16,10 +16,14 @@ package taskexecutor
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/docker/go-units"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/failpoint"
 	"github.com/pingcap/log"
@@ -46,6 +50,14 @@ var (
 	// updateSubtaskSummaryInterval is the interval for updating the subtask summary to
 	// subtask table.
 	updateSubtaskSummaryInterval = 3 * time.Second
+
+	// SubtaskLeaseRenewInterval is the interval for renewing the lease of the
+	// running subtask.
+	SubtaskLeaseRenewInterval = 10 * time.Second
+	// SubtaskLeaseMaxMissedRenewals is the number of renewals a running subtask
+	// can miss before the scheduler takes it as dead and reschedules it, i.e.
+	// the lease TTL is SubtaskLeaseRenewInterval * SubtaskLeaseMaxMissedRenewals.
+	SubtaskLeaseMaxMissedRenewals = 3
 )
 
 var (
@@ -63,6 +75,43 @@ var (
 	MockTiDBDown func(execID string, task *proto.TaskBase) bool
 )
 
+// SubtaskPanicError is the error of the subtask when the step executor panics
+// while running it, the panic is recovered so it doesn't crash the process, and
+// the subtask is failed with the error without retry, the stack of the panic is
+// kept in the error, so it's recorded on the subtask.
+type SubtaskPanicError struct {
+	Recovered any
+	Stack     string
+}
+
+// Error implements error.Error.
+func (e *SubtaskPanicError) Error() string {
+	return fmt.Sprintf("subtask panicked: %v\n%s", e.Recovered, e.Stack)
+}
+
+func isSubtaskPanicErr(err error) bool {
+	_, ok := errors.Cause(err).(*SubtaskPanicError)
+	return ok
+}
+
+// runSubtaskWithRecover runs the subtask, a panic of the step executor is
+// converted into SubtaskPanicError.
+func runSubtaskWithRecover(ctx context.Context, stepExecutor execute.StepExecutor, subtask *proto.Subtask) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &SubtaskPanicError{Recovered: r, Stack: string(debug.Stack())}
+		}
+	}()
+	return stepExecutor.RunSubtask(ctx, subtask)
+}
+
+// finishedSubtaskResult is the result of OnFinished of a subtask in an
+// execution epoch, see BaseTaskExecutor.finishedResults.
+type finishedSubtaskResult struct {
+	epoch int64
+	meta  []byte
+}
+
 // BaseTaskExecutor is the base implementation of TaskExecutor.
 type BaseTaskExecutor struct {
 	// id, it's the same as server id now, i.e. host:port.
@@ -77,6 +126,43 @@ type BaseTaskExecutor struct {
 	Extension
 
 	currSubtaskID atomic.Int64
+	// stopping is set when the task is cancelled gracefully, no more subtask
+	// is started after it's set, see CancelGracefully.
+	stopping atomic.Bool
+	// retryBackoffer is used to backoff when meet retryable error, see
+	// WithSubtaskRetryBackoffer. nil means use SubtaskCheckInterval.
+	retryBackoffer backoff.Backoffer
+	// retryJitter is the max ratio of the retry backoff extended randomly, see
+	// WithSubtaskRetryJitter.
+	retryJitter float64
+	// retryPolicy decides where the subtask is retried on retryable error, see
+	// WithSubtaskRetryPolicy.
+	retryPolicy SubtaskRetryPolicy
+	// metRetryableErr is set when the last RunStep meets retryable error.
+	metRetryableErr atomic.Bool
+	// retryingSubtaskID is the ID of the subtask which meets retryable error in
+	// the last RunStep, it's updated to retrying state during backoff.
+	retryingSubtaskID atomic.Int64
+	// retryBudget is the retry budget of the task, it's loaded in runStep, see
+	// proto.ExtraParams.RetryBudget.
+	retryBudget int
+	// noAutoRetry is loaded in runStep, see proto.ExtraParams.NoAutoRetry.
+	noAutoRetry bool
+	// claimEpochs is the execution epoch of subtasks, keyed by subtask ID, it's
+	// increased each time the subtask is started from pending or retrying state,
+	// re-running a subtask left in running state keeps the epoch.
+	// finishedResults is the result of OnFinished of subtasks, keyed by subtask
+	// ID, if the subtask runs again in the same epoch, such as the finished state
+	// fails to persist, OnFinished is not applied again, the recorded result is
+	// persisted instead. both are only accessed in runStep.
+	claimEpochs     map[int64]int64
+	finishedResults map[int64]finishedSubtaskResult
+	// subtaskCandidates are the subtasks fetched but not started yet in
+	// runStep, see SubtaskFetchLimit.
+	subtaskCandidates []*proto.Subtask
+	// resourceReserver is shared by task executors on the node, it's set by
+	// Manager, nil means subtasks are run without reserving resource.
+	resourceReserver *resourceReserver
 
 	mu struct {
 		sync.RWMutex
@@ -104,7 +190,15 @@ func NewBaseTaskExecutor(ctx context.Context, id string, task *proto.Task, taskT
 		ctx:       subCtx,
 		cancel:    cancelFunc,
 		logger:    logger,
+
+		claimEpochs:     make(map[int64]int64),
+		finishedResults: make(map[int64]finishedSubtaskResult),
+	}
+	if fn := taskTypes[task.Type].newSubtaskRetryBackoffer; fn != nil {
+		taskExecutorImpl.retryBackoffer = fn()
+		taskExecutorImpl.retryJitter = taskTypes[task.Type].subtaskRetryJitter
 	}
+	taskExecutorImpl.retryPolicy = taskTypes[task.Type].subtaskRetryPolicy
 	taskExecutorImpl.taskBase.Store(&task.TaskBase)
 	return taskExecutorImpl
 }
@@ -170,13 +264,13 @@ func (e *BaseTaskExecutor) checkBalanceSubtask(ctx context.Context) {
 
 func (e *BaseTaskExecutor) updateSubtaskSummaryLoop(
 	checkCtx, runStepCtx context.Context, stepExec execute.StepExecutor) {
-	taskMgr := e.taskTable.(*storage.TaskManager)
+	updater := e.taskTable.(SubtaskSummaryUpdater)
 	ticker := time.NewTicker(updateSubtaskSummaryInterval)
 	defer ticker.Stop()
 	curSubtaskID := e.currSubtaskID.Load()
 	update := func() {
 		summary := stepExec.RealtimeSummary()
-		err := taskMgr.UpdateSubtaskRowCount(runStepCtx, curSubtaskID, summary.RowCount)
+		err := updater.UpdateSubtaskRowCount(runStepCtx, curSubtaskID, summary.RowCount)
 		if err != nil {
 			e.logger.Info("update subtask row count failed", zap.Error(err))
 		}
@@ -192,6 +286,26 @@ func (e *BaseTaskExecutor) updateSubtaskSummaryLoop(
 	}
 }
 
+// renewSubtaskLeaseLoop renews the lease of the running subtask until ctx is done,
+// renew failure is not fatal, the subtask is only rescheduled after the lease
+// expires.
+func (e *BaseTaskExecutor) renewSubtaskLeaseLoop(ctx context.Context, renewer SubtaskLeaseRenewer, subtaskID int64) {
+	ttl := SubtaskLeaseRenewInterval * time.Duration(SubtaskLeaseMaxMissedRenewals)
+	ticker := time.NewTicker(SubtaskLeaseRenewInterval)
+	defer ticker.Stop()
+	for {
+		if err := renewer.RenewSubtaskLease(ctx, e.id, subtaskID, ttl); err != nil {
+			e.logger.Warn("renew subtask lease failed",
+				zap.Int64("subtask-id", subtaskID), zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 // Init implements the TaskExecutor interface.
 func (*BaseTaskExecutor) Init(_ context.Context) error {
 	return nil
@@ -211,12 +325,16 @@ func (e *BaseTaskExecutor) Run(resource *proto.StepResource) {
 	// 300ms + 600ms + 1.2s + 2s * 4 = 10.1s
 	backoffer := backoff.NewExponential(SubtaskCheckInterval, 2, MaxSubtaskCheckInterval)
 	checkInterval, noSubtaskCheckCnt := SubtaskCheckInterval, 0
+	retryCnt := 0
 	for {
 		select {
 		case <-e.ctx.Done():
 			return
 		case <-time.After(checkInterval):
 		}
+		if e.stopping.Load() {
+			return
+		}
 		if err = e.refreshTask(); err != nil {
 			if errors.Cause(err) == storage.ErrTaskNotFound {
 				return
@@ -247,6 +365,15 @@ func (e *BaseTaskExecutor) Run(resource *proto.StepResource) {
 		if err != nil {
 			e.logger.Error("failed to handle task", zap.Error(err))
 		}
+		if e.retryBackoffer != nil {
+			if e.metRetryableErr.Load() {
+				checkInterval = jitterBackoff(e.retryBackoffer.Backoff(retryCnt), e.retryJitter)
+				retryCnt++
+				e.markSubtaskRetrying(checkInterval)
+			} else {
+				retryCnt = 0
+			}
+		}
 	}
 }
 
@@ -292,12 +419,17 @@ func (e *BaseTaskExecutor) runStep(resource *proto.StepResource) (resErr error)
 		e.unregisterRunStepCancelFunc()
 	}()
 	e.resetError()
+	e.metRetryableErr.Store(false)
+	e.retryingSubtaskID.Store(0)
+	e.subtaskCandidates = nil
 	taskBase := e.taskBase.Load()
 	task, err := e.taskTable.GetTaskByID(e.ctx, taskBase.ID)
 	if err != nil {
 		e.onError(err)
 		return e.getError()
 	}
+	e.retryBudget = task.ExtraParams.RetryBudget
+	e.noAutoRetry = task.ExtraParams.NoAutoRetry
 	stepLogger := llog.BeginTask(e.logger.With(
 		zap.String("step", proto.Step2Str(task.Type, task.Step)),
 		zap.Float64("mem-limit-percent", gctuner.GlobalMemoryLimitTuner.GetPercentage()),
@@ -309,7 +441,7 @@ func (e *BaseTaskExecutor) runStep(resource *proto.StepResource) (resErr error)
 		stepLogger.End(zap.InfoLevel, resErr)
 	}()
 
-	stepExecutor, err := e.GetStepExecutor(task)
+	stepExecutor, err := e.getStepExecutor(task)
 	if err != nil {
 		e.onError(err)
 		return e.getError()
@@ -332,6 +464,15 @@ func (e *BaseTaskExecutor) runStep(resource *proto.StepResource) (resErr error)
 		}
 	}()
 
+	// subtasks are run with the trace context of the task, for end-to-end tracing.
+	subtaskCtx := handle.ContextWithTaskTrace(runStepCtx, task)
+	// and with the deadline of the task, so step executors can budget their
+	// work by the remaining time of the task.
+	if deadline, ok := task.Deadline(); ok {
+		var cancel context.CancelFunc
+		subtaskCtx, cancel = context.WithDeadline(subtaskCtx, deadline)
+		defer cancel()
+	}
 	for {
 		// check if any error occurs.
 		if err := e.getError(); err != nil {
@@ -340,9 +481,12 @@ func (e *BaseTaskExecutor) runStep(resource *proto.StepResource) (resErr error)
 		if runStepCtx.Err() != nil {
 			break
 		}
+		if e.stopping.Load() {
+			e.logger.Info("task is cancelled gracefully, stop starting subtasks")
+			break
+		}
 
-		subtask, err := e.taskTable.GetFirstSubtaskInStates(runStepCtx, e.id, task.ID, task.Step,
-			proto.SubtaskStatePending, proto.SubtaskStateRunning)
+		subtask, err := e.getNextSubtask(runStepCtx, task)
 		if err != nil {
 			e.logger.Warn("GetFirstSubtaskInStates meets error", zap.Error(err))
 			continue
@@ -351,46 +495,179 @@ func (e *BaseTaskExecutor) runStep(resource *proto.StepResource) (resErr error)
 			break
 		}
 
-		if subtask.State == proto.SubtaskStateRunning {
+		if subtask.State == proto.SubtaskStateRunning || subtask.State == proto.SubtaskStateRetrying {
 			if !e.IsIdempotent(subtask) {
 				e.logger.Info("subtask in running state and is not idempotent, fail it",
-					zap.Int64("subtask-id", subtask.ID))
+					zap.Int64("subtask-id", subtask.ID), zap.Stringer("state", subtask.State))
 				e.onError(ErrNonIdempotentSubtask)
 				e.updateSubtaskStateAndErrorImpl(runStepCtx, subtask.ExecID, subtask.ID, proto.SubtaskStateFailed, ErrNonIdempotentSubtask)
 				e.markErrorHandled()
 				break
 			}
 			e.logger.Info("subtask in running state and is idempotent",
-				zap.Int64("subtask-id", subtask.ID))
-		} else {
-			// subtask.State == proto.SubtaskStatePending
+				zap.Int64("subtask-id", subtask.ID), zap.Stringer("state", subtask.State))
+		}
+		release, ok := e.reserveResource(runStepCtx, stepExecutor, subtask)
+		if !ok {
+			continue
+		}
+		if subtask.State != proto.SubtaskStateRunning {
+			// subtask.State == proto.SubtaskStatePending or proto.SubtaskStateRetrying
+			if wait := time.Until(subtask.NextRetryTime); wait > 0 {
+				select {
+				case <-runStepCtx.Done():
+					release()
+					continue
+				case <-time.After(wait):
+				}
+			}
 			err := e.startSubtask(runStepCtx, subtask.ID)
 			if err != nil {
+				release()
 				e.logger.Warn("startSubtask meets error", zap.Error(err))
 				// should ignore ErrSubtaskNotFound
 				// since it only means that the subtask not owned by current task executor.
-				if err == storage.ErrSubtaskNotFound {
+				// ErrSubtaskSerialKeyBusy is ignored too, the subtask is started
+				// after the running one with the same serial key finishes.
+				if err == storage.ErrSubtaskNotFound || errors.Cause(err) == storage.ErrSubtaskSerialKeyBusy {
 					continue
 				}
 				e.onError(err)
 				continue
 			}
+			e.claimEpochs[subtask.ID]++
 		}
 
 		failpoint.Inject("cancelBeforeRunSubtask", func() {
 			runStepCancel(nil)
 		})
 
-		e.runSubtask(runStepCtx, stepExecutor, subtask)
+		if e.skipSubtaskIfDone(runStepCtx, stepExecutor, subtask) {
+			release()
+			continue
+		}
+		e.runSubtask(subtaskCtx, stepExecutor, subtask)
+		release()
 	}
 	return e.getError()
 }
 
+func (e *BaseTaskExecutor) setResourceReserver(r *resourceReserver) {
+	e.resourceReserver = r
+}
+
+// reserveResource reserves the resource the subtask needs on the node before
+// it's started, see execute.ResourceEstimator. it returns the function to
+// release the resource after the subtask finishes, and false if ctx is done
+// before the resource is reserved.
+func (e *BaseTaskExecutor) reserveResource(ctx context.Context, stepExecutor execute.StepExecutor, subtask *proto.Subtask) (release func(), ok bool) {
+	estimator, ok := stepExecutor.(execute.ResourceEstimator)
+	if !ok || e.resourceReserver == nil {
+		return func() {}, true
+	}
+	res := estimator.EstimateResource(subtask)
+	if !e.resourceReserver.reserve(subtask.ID, res) {
+		e.logger.Info("no enough resource on the node, wait for other subtasks to release it",
+			zap.Int64("subtask-id", subtask.ID), zap.Int("cpu", res.CPUCount),
+			zap.String("mem", units.BytesSize(float64(res.Mem))))
+		if !e.resourceReserver.waitReserve(ctx, subtask.ID, res) {
+			return nil, false
+		}
+	}
+	return func() {
+		e.resourceReserver.release(subtask.ID)
+	}, true
+}
+
+// getNextSubtask returns the next subtask of the current step of the task to
+// run on this node, subtasks which can't be started now are skipped, see
+// TaskTable.GetFirstSubtaskInStates. if the task table supports it, up to
+// SubtaskFetchLimit candidates are fetched at once, and returned one by one,
+// candidates which are changed after fetched fail to start and are skipped.
+func (e *BaseTaskExecutor) getNextSubtask(ctx context.Context, task *proto.Task) (*proto.Subtask, error) {
+	getter, ok := e.taskTable.(SubtaskBatchGetter)
+	if !ok || SubtaskFetchLimit <= 1 {
+		return e.taskTable.GetFirstSubtaskInStates(ctx, e.id, task.ID, task.Step, unfinishedSubtaskStates...)
+	}
+	if len(e.subtaskCandidates) == 0 {
+		subtasks, err := getter.GetFirstSubtasksInStates(ctx, e.id, task.ID, task.Step,
+			SubtaskFetchLimit, unfinishedSubtaskStates...)
+		if err != nil {
+			return nil, err
+		}
+		if len(subtasks) == 0 {
+			return nil, nil
+		}
+		e.subtaskCandidates = subtasks
+	}
+	subtask := e.subtaskCandidates[0]
+	e.subtaskCandidates = e.subtaskCandidates[1:]
+	return subtask, nil
+}
+
+// PeekNextSubtask returns the subtask that the task executor would claim next,
+// without claiming or running it, it's used to inspect the scheduling logic.
+// it returns nil if the task executor wouldn't run any subtask now, such as
+// the task is not running or the task executor is stopping.
+func (e *BaseTaskExecutor) PeekNextSubtask(ctx context.Context) (*proto.Subtask, error) {
+	if e.stopping.Load() {
+		return nil, nil
+	}
+	task, err := e.taskTable.GetTaskByID(ctx, e.taskBase.Load().ID)
+	if err != nil {
+		return nil, err
+	}
+	if task.State != proto.TaskStateRunning {
+		return nil, nil
+	}
+	return e.getNextSubtask(ctx, task)
+}
+
 func (e *BaseTaskExecutor) hasRealtimeSummary(stepExecutor execute.StepExecutor) bool {
-	_, ok := e.taskTable.(*storage.TaskManager)
+	_, ok := e.taskTable.(SubtaskSummaryUpdater)
 	return ok && stepExecutor.RealtimeSummary() != nil
 }
 
+// prefetchNextSubtask calls Prefetch for the next pending subtask of this node,
+// prefetch failure is not fatal.
+func (e *BaseTaskExecutor) prefetchNextSubtask(ctx context.Context, prefetcher execute.Prefetcher, subtask *proto.Subtask) {
+	next, err := e.taskTable.GetFirstSubtaskInStates(ctx, e.id, subtask.TaskID, subtask.Step,
+		proto.SubtaskStatePending)
+	if err != nil {
+		e.logger.Warn("get next subtask to prefetch failed", zap.Error(err))
+		return
+	}
+	if next == nil || next.ID == subtask.ID {
+		return
+	}
+	if err = prefetcher.Prefetch(ctx, next); err != nil {
+		e.logger.Warn("prefetch next subtask failed",
+			zap.Int64("subtask-id", next.ID), zap.Error(err))
+	}
+}
+
+// skipSubtaskIfDone marks the subtask as succeed without running it if the
+// step executor reports that it's already done, see execute.DoneChecker.
+// returns whether the subtask is skipped.
+func (e *BaseTaskExecutor) skipSubtaskIfDone(ctx context.Context, stepExecutor execute.StepExecutor, subtask *proto.Subtask) bool {
+	checker, ok := stepExecutor.(execute.DoneChecker)
+	if !ok {
+		return false
+	}
+	done, err := checker.IsAlreadyDone(ctx, subtask)
+	if err != nil {
+		e.logger.Warn("check whether subtask is done failed, run it",
+			zap.Int64("subtask-id", subtask.ID), zap.Error(err))
+		return false
+	}
+	if !done {
+		return false
+	}
+	e.logger.Info("subtask is already done, skip running it", zap.Int64("subtask-id", subtask.ID))
+	e.finishSubtask(ctx, subtask)
+	return true
+}
+
 func (e *BaseTaskExecutor) runSubtask(ctx context.Context, stepExecutor execute.StepExecutor, subtask *proto.Subtask) {
 	err := func() error {
 		e.currSubtaskID.Store(subtask.ID)
@@ -406,11 +683,21 @@ func (e *BaseTaskExecutor) runSubtask(ctx context.Context, stepExecutor execute.
 				e.updateSubtaskSummaryLoop(checkCtx, ctx, stepExecutor)
 			})
 		}
+		if renewer, ok := e.taskTable.(SubtaskLeaseRenewer); ok {
+			wg.RunWithLog(func() {
+				e.renewSubtaskLeaseLoop(checkCtx, renewer, subtask.ID)
+			})
+		}
+		if prefetcher, ok := stepExecutor.(execute.Prefetcher); ok {
+			wg.RunWithLog(func() {
+				e.prefetchNextSubtask(checkCtx, prefetcher, subtask)
+			})
+		}
 		defer func() {
 			checkCancel()
 			wg.Wait()
 		}()
-		return stepExecutor.RunSubtask(ctx, subtask)
+		return runSubtaskWithRecover(e.enrichSubtaskContext(ctx, subtask), stepExecutor, subtask)
 	}()
 	failpoint.Inject("MockRunSubtaskCancel", func(val failpoint.Value) {
 		if val.(bool) {
@@ -446,7 +733,7 @@ func (e *BaseTaskExecutor) runSubtask(ctx context.Context, stepExecutor execute.
 	})
 	failpoint.Inject("MockExecutorRunCancel", func(val failpoint.Value) {
 		if taskID, ok := val.(int); ok {
-			mgr, err := storage.GetTaskManager()
+			mgr, err := handle.GetTaskManager()
 			if err != nil {
 				e.logger.Error("get task manager failed", zap.Error(err))
 			} else {
@@ -461,9 +748,16 @@ func (e *BaseTaskExecutor) runSubtask(ctx context.Context, stepExecutor execute.
 }
 
 func (e *BaseTaskExecutor) onSubtaskFinished(ctx context.Context, executor execute.StepExecutor, subtask *proto.Subtask) {
-	if err := e.getError(); err == nil {
+	epoch := e.claimEpochs[subtask.ID]
+	if res, ok := e.finishedResults[subtask.ID]; ok && res.epoch == epoch {
+		e.logger.Info("OnFinished is applied in previous execution of the subtask, skip it",
+			zap.Int64("subtask-id", subtask.ID), zap.Int64("epoch", epoch))
+		subtask.Meta = res.meta
+	} else if err := e.getError(); err == nil {
 		if err = executor.OnFinished(ctx, subtask); err != nil {
 			e.onError(err)
+		} else {
+			e.finishedResults[subtask.ID] = finishedSubtaskResult{epoch: epoch, meta: subtask.Meta}
 		}
 	}
 	failpoint.Inject("MockSubtaskFinishedCancel", func(val failpoint.Value) {
@@ -483,6 +777,8 @@ func (e *BaseTaskExecutor) onSubtaskFinished(ctx context.Context, executor execu
 	if finished {
 		return
 	}
+	delete(e.claimEpochs, subtask.ID)
+	delete(e.finishedResults, subtask.ID)
 
 	failpoint.Inject("syncAfterSubtaskFinish", func() {
 		TestSyncChan <- struct{}{}
@@ -495,6 +791,11 @@ func (e *BaseTaskExecutor) GetTaskBase() *proto.TaskBase {
 	return e.taskBase.Load()
 }
 
+// CancelGracefully implements GracefulCanceler.CancelGracefully.
+func (e *BaseTaskExecutor) CancelGracefully() {
+	e.stopping.Store(true)
+}
+
 // CancelRunningSubtask implements TaskExecutor.CancelRunningSubtask.
 func (e *BaseTaskExecutor) CancelRunningSubtask() {
 	e.cancelRunStepWith(ErrCancelSubtask)
@@ -581,10 +882,15 @@ func (e *BaseTaskExecutor) resetError() {
 
 func (e *BaseTaskExecutor) updateSubtaskStateAndErrorImpl(ctx context.Context, execID string, subtaskID int64, state proto.SubtaskState, subTaskErr error) {
 	// retry for 3+6+12+24+(30-4)*30 ~= 825s ~= 14 minutes
-	backoffer := backoff.NewExponential(scheduler.RetrySQLInterval, 2, scheduler.RetrySQLMaxInterval)
+	backoffer := scheduler.NewRetrySQLBackoffer()
 	err := handle.RunWithRetry(ctx, scheduler.RetrySQLTimes, backoffer, e.logger,
 		func(ctx context.Context) (bool, error) {
-			return true, e.taskTable.UpdateSubtaskStateAndError(ctx, execID, subtaskID, state, subTaskErr)
+			err := e.taskTable.UpdateSubtaskStateAndError(ctx, execID, subtaskID, state, subTaskErr)
+			if errors.Cause(err) == storage.ErrInvalidSubtaskStateTransform {
+				// No need to retry.
+				return false, err
+			}
+			return true, err
 		},
 	)
 	if err != nil {
@@ -597,11 +903,12 @@ func (e *BaseTaskExecutor) updateSubtaskStateAndErrorImpl(ctx context.Context, e
 // the update will fail and task executor should not run the subtask.
 func (e *BaseTaskExecutor) startSubtask(ctx context.Context, subtaskID int64) error {
 	// retry for 3+6+12+24+(30-4)*30 ~= 825s ~= 14 minutes
-	backoffer := backoff.NewExponential(scheduler.RetrySQLInterval, 2, scheduler.RetrySQLMaxInterval)
+	backoffer := scheduler.NewRetrySQLBackoffer()
 	return handle.RunWithRetry(ctx, scheduler.RetrySQLTimes, backoffer, e.logger,
 		func(ctx context.Context) (bool, error) {
 			err := e.taskTable.StartSubtask(ctx, subtaskID, e.id)
-			if err == storage.ErrSubtaskNotFound {
+			if err == storage.ErrSubtaskNotFound || errors.Cause(err) == storage.ErrInvalidSubtaskStateTransform ||
+				errors.Cause(err) == storage.ErrSubtaskSerialKeyBusy {
 				// No need to retry.
 				return false, err
 			}
@@ -611,7 +918,7 @@ func (e *BaseTaskExecutor) startSubtask(ctx context.Context, subtaskID int64) er
 }
 
 func (e *BaseTaskExecutor) finishSubtask(ctx context.Context, subtask *proto.Subtask) {
-	backoffer := backoff.NewExponential(scheduler.RetrySQLInterval, 2, scheduler.RetrySQLMaxInterval)
+	backoffer := scheduler.NewRetrySQLBackoffer()
 	err := handle.RunWithRetry(ctx, scheduler.RetrySQLTimes, backoffer, e.logger,
 		func(ctx context.Context) (bool, error) {
 			return true, e.taskTable.FinishSubtask(ctx, subtask.ExecID, subtask.ID, subtask.Meta)
@@ -629,11 +936,18 @@ func (e *BaseTaskExecutor) finishSubtask(ctx context.Context, subtask *proto.Sub
 func (e *BaseTaskExecutor) markSubTaskCanceledOrFailed(ctx context.Context, subtask *proto.Subtask) bool {
 	if err := e.getError(); err != nil {
 		err := errors.Cause(err)
-		if ctx.Err() != nil && context.Cause(ctx) == ErrCancelSubtask {
+		if isSubtaskPanicErr(err) {
+			e.logger.Error("subtask panicked", zap.Error(err))
+			e.updateSubtaskStateAndErrorImpl(e.ctx, subtask.ExecID, subtask.ID, proto.SubtaskStateFailed, err)
+		} else if ctx.Err() != nil && context.Cause(ctx) == ErrCancelSubtask {
 			e.logger.Warn("subtask canceled", zap.Error(err))
 			e.updateSubtaskStateAndErrorImpl(e.ctx, subtask.ExecID, subtask.ID, proto.SubtaskStateCanceled, nil)
-		} else if e.IsRetryableError(err) {
+		} else if e.shouldRetrySubtask(subtask, err) && e.consumeRetryBudget(subtask) {
 			e.logger.Warn("meet retryable error", zap.Error(err))
+			if !e.reassignSubtaskForRetry(subtask) {
+				e.metRetryableErr.Store(true)
+				e.retryingSubtaskID.Store(subtask.ID)
+			}
 		} else if common.IsContextCanceledError(err) {
 			e.logger.Info("meet context canceled for gracefully shutdown", zap.Error(err))
 		} else {
@@ -646,8 +960,114 @@ func (e *BaseTaskExecutor) markSubTaskCanceledOrFailed(ctx context.Context, subt
 	return false
 }
 
+// getStepExecutor returns the step executor for the current step of the task,
+// see StepExecutorGetter.
+func (e *BaseTaskExecutor) getStepExecutor(task *proto.Task) (execute.StepExecutor, error) {
+	if getter, ok := e.Extension.(StepExecutorGetter); ok {
+		return getter.GetSubtaskExecutorForStep(task, task.Step)
+	}
+	return e.GetStepExecutor(task)
+}
+
+// enrichSubtaskContext returns the context to run the subtask, see
+// SubtaskContextEnricher.
+func (e *BaseTaskExecutor) enrichSubtaskContext(ctx context.Context, subtask *proto.Subtask) context.Context {
+	if enricher, ok := e.Extension.(SubtaskContextEnricher); ok {
+		return enricher.EnrichSubtaskContext(ctx, subtask)
+	}
+	return ctx
+}
+
+// shouldRetrySubtask returns whether the subtask should be retried on err, see
+// SubtaskRetryClassifier.
+func (e *BaseTaskExecutor) shouldRetrySubtask(subtask *proto.Subtask, err error) bool {
+	if e.noAutoRetry {
+		return false
+	}
+	if classifier, ok := e.Extension.(SubtaskRetryClassifier); ok {
+		return classifier.ShouldRetry(subtask, err)
+	}
+	return e.IsRetryableError(err)
+}
+
+// consumeRetryBudget consumes one retry from the retry budget of the task before
+// retrying the subtask, it returns false if the budget is exhausted, then the
+// subtask fails, see RetryBudgetConsumer.
+func (e *BaseTaskExecutor) consumeRetryBudget(subtask *proto.Subtask) bool {
+	consumer, ok := e.taskTable.(RetryBudgetConsumer)
+	if !ok || e.retryBudget <= 0 {
+		return true
+	}
+	consumed, err := consumer.ConsumeRetryBudget(e.ctx, subtask.TaskID)
+	if err != nil {
+		// the budget only bounds the wasted work, retry on error.
+		e.logger.Warn("consume retry budget failed", zap.Int64("subtask-id", subtask.ID), zap.Error(err))
+		return true
+	}
+	if !consumed {
+		e.logger.Warn("retry budget of the task is exhausted, fail the subtask",
+			zap.Int64("subtask-id", subtask.ID), zap.Int("retry-budget", e.retryBudget))
+	}
+	return consumed
+}
+
+// reassignSubtaskForRetry reassigns the subtask to a different node to retry it
+// there, if the retry policy of the task type is RetryOnNewNode. it returns false
+// if the subtask should be retried on this node, such as there is no other node,
+// see SubtaskRetryReassigner.
+func (e *BaseTaskExecutor) reassignSubtaskForRetry(subtask *proto.Subtask) bool {
+	if e.retryPolicy != RetryOnNewNode {
+		return false
+	}
+	reassigner, ok := e.taskTable.(SubtaskRetryReassigner)
+	if !ok {
+		return false
+	}
+	newExecID, err := reassigner.ReassignSubtaskForRetry(e.ctx, e.id, subtask.ID)
+	if err != nil {
+		e.logger.Warn("reassign subtask for retry failed, retry on this node",
+			zap.Int64("subtask-id", subtask.ID), zap.Error(err))
+		return false
+	}
+	if newExecID == "" {
+		e.logger.Info("no other node to retry the subtask, retry on this node",
+			zap.Int64("subtask-id", subtask.ID))
+		return false
+	}
+	e.logger.Info("subtask is reassigned to retry on another node",
+		zap.Int64("subtask-id", subtask.ID), zap.String("new-exec-id", newExecID))
+	return true
+}
+
+// jitterBackoff extends the backoff by a random duration in [0, jitter*backoff).
+func jitterBackoff(backoff time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 || backoff <= 0 {
+		return backoff
+	}
+	return backoff + time.Duration(rand.Float64()*jitter*float64(backoff))
+}
+
+// markSubtaskRetrying updates the subtask which meets retryable error to
+// retrying state, so it's visible that the subtask is waiting for the next retry
+// after backoff.
+func (e *BaseTaskExecutor) markSubtaskRetrying(backoff time.Duration) {
+	subtaskID := e.retryingSubtaskID.Swap(0)
+	if subtaskID == 0 {
+		return
+	}
+	nextRetryTime := time.Now().Add(backoff)
+	if err := e.taskTable.RetrySubtask(e.ctx, e.id, subtaskID, nextRetryTime); err != nil {
+		// the subtask is retried in running state.
+		e.logger.Warn("update subtask to retrying state failed",
+			zap.Int64("subtask-id", subtaskID), zap.Error(err))
+		return
+	}
+	e.logger.Info("subtask waits for the next retry", zap.Int64("subtask-id", subtaskID),
+		zap.Time("next-retry-time", nextRetryTime))
+}
+
 func (e *BaseTaskExecutor) failSubtaskWithRetry(ctx context.Context, taskID int64, err error) error {
-	backoffer := backoff.NewExponential(scheduler.RetrySQLInterval, 2, scheduler.RetrySQLMaxInterval)
+	backoffer := scheduler.NewRetrySQLBackoffer()
 	err1 := handle.RunWithRetry(e.ctx, scheduler.RetrySQLTimes, backoffer, e.logger,
 		func(_ context.Context) (bool, error) {
 			return true, e.taskTable.FailSubtask(ctx, e.id, taskID, err)
@@ -661,7 +1081,7 @@ func (e *BaseTaskExecutor) failSubtaskWithRetry(ctx context.Context, taskID int6
 
 func (e *BaseTaskExecutor) cancelSubtaskWithRetry(ctx context.Context, taskID int64, err error) error {
 	e.logger.Warn("subtask canceled", zap.NamedError("subtask-cancel", err))
-	backoffer := backoff.NewExponential(scheduler.RetrySQLInterval, 2, scheduler.RetrySQLMaxInterval)
+	backoffer := scheduler.NewRetrySQLBackoffer()
 	err1 := handle.RunWithRetry(e.ctx, scheduler.RetrySQLTimes, backoffer, e.logger,
 		func(_ context.Context) (bool, error) {
 			return true, e.taskTable.CancelSubtask(ctx, e.id, taskID)
@@ -685,8 +1105,9 @@ func (e *BaseTaskExecutor) updateSubtask(err error) error {
 	// TODO this branch is unreachable now, remove it when we refactor error handling.
 	if e.ctx.Err() != nil && context.Cause(e.ctx) == ErrCancelSubtask {
 		return e.cancelSubtaskWithRetry(e.ctx, task.ID, ErrCancelSubtask)
-	} else if e.IsRetryableError(err) {
+	} else if !e.noAutoRetry && e.IsRetryableError(err) {
 		e.logger.Warn("meet retryable error", zap.Error(err))
+		e.metRetryableErr.Store(true)
 	} else if common.IsContextCanceledError(err) {
 		e.logger.Info("meet context canceled for gracefully shutdown", zap.Error(err))
 	} else {
@@ -16,6 +16,8 @@ package taskexecutor
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -23,8 +25,10 @@ import (
 	"github.com/pingcap/tidb/pkg/disttask/framework/mock"
 	"github.com/pingcap/tidb/pkg/disttask/framework/mock/execute"
 	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/disttask/framework/scheduler"
 	"github.com/pingcap/tidb/pkg/disttask/framework/storage"
 	"github.com/pingcap/tidb/pkg/disttask/framework/taskexecutor/execute"
+	"github.com/pingcap/tidb/pkg/util/backoff"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
 	"google.golang.org/grpc/codes"
@@ -33,7 +37,7 @@ import (
 
 var (
 	unfinishedNormalSubtaskStates = []any{
-		proto.SubtaskStatePending, proto.SubtaskStateRunning,
+		proto.SubtaskStatePending, proto.SubtaskStateRunning, proto.SubtaskStateRetrying,
 	}
 )
 
@@ -286,6 +290,163 @@ func TestTaskExecutorRun(t *testing.T) {
 	require.True(t, ctrl.Satisfied())
 }
 
+type recordRetryBackoffer struct {
+	retryCnts []int
+}
+
+func (b *recordRetryBackoffer) Backoff(retryCnt int) time.Duration {
+	b.retryCnts = append(b.retryCnts, retryCnt)
+	return time.Millisecond
+}
+
+func TestTaskExecutorRunWithRetryBackoffer(t *testing.T) {
+	var tp proto.TaskType = "test_task_executor_retry_backoffer"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ReduceCheckInterval(t)
+	backoffer := &recordRetryBackoffer{}
+	t.Cleanup(ClearTaskExecutors)
+	RegisterTaskType(tp, nil, WithSubtaskRetryBackoffer(func() backoff.Backoffer {
+		return backoffer
+	}))
+
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{TaskBase: proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: tp, ID: 1, Concurrency: 1}}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	taskExecutor.Extension = mockExtension
+	require.Equal(t, backoffer, taskExecutor.retryBackoffer)
+
+	retryableErr := errors.New("retryable err")
+	mockSubtaskTable.EXPECT().GetTaskBaseByID(gomock.Any(), task.ID).Return(&task.TaskBase, nil).Times(3)
+	mockSubtaskTable.EXPECT().HasSubtasksInStates(gomock.Any(), "id", task.ID, task.Step,
+		unfinishedNormalSubtaskStates...).Return(true, nil).Times(3)
+	mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil).Times(3)
+	// meet retryable error twice, then succeed.
+	mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(nil, retryableErr).Times(2)
+	mockExtension.EXPECT().IsRetryableError(gomock.Any()).Return(true).Times(2)
+	mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(mockStepExecutor, nil)
+	mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(nil, nil)
+	mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+	// task succeed, exit the loop.
+	mockSubtaskTable.EXPECT().GetTaskBaseByID(gomock.Any(), task.ID).Return(
+		&proto.TaskBase{ID: task.ID, State: proto.TaskStateSucceed}, nil)
+	taskExecutor.Run(nil)
+	require.True(t, ctrl.Satisfied())
+	require.Equal(t, []int{0, 1}, backoffer.retryCnts)
+}
+
+type fixedRetryBackoffer struct {
+	backoff time.Duration
+}
+
+func (b *fixedRetryBackoffer) Backoff(int) time.Duration {
+	return b.backoff
+}
+
+func TestTaskExecutorSubtaskRetryJitter(t *testing.T) {
+	var (
+		tp          proto.TaskType = "test_task_executor_retry_jitter"
+		noJitterTp  proto.TaskType = "test_task_executor_retry_no_jitter"
+		baseBackoff                = 10 * time.Second
+		jitter                     = 0.5
+	)
+	t.Cleanup(ClearTaskExecutors)
+	newBackoffer := func() backoff.Backoffer {
+		return &fixedRetryBackoffer{backoff: baseBackoff}
+	}
+	RegisterTaskType(tp, nil, WithSubtaskRetryBackoffer(newBackoffer), WithSubtaskRetryJitter(jitter))
+	RegisterTaskType(noJitterTp, nil, WithSubtaskRetryBackoffer(newBackoffer))
+
+	// many subtasks fail at the same time, and each of them backoff before retry.
+	retryBackoffs := func(taskType proto.TaskType) []time.Duration {
+		backoffs := make([]time.Duration, 0, 100)
+		for i := 0; i < 100; i++ {
+			task := &proto.Task{TaskBase: proto.TaskBase{ID: int64(i + 1), Type: taskType}}
+			taskExecutor := NewBaseTaskExecutor(context.Background(), "id", task, nil)
+			backoffs = append(backoffs, jitterBackoff(taskExecutor.retryBackoffer.Backoff(0), taskExecutor.retryJitter))
+			taskExecutor.cancel()
+		}
+		return backoffs
+	}
+
+	// without jitter, all retries happen together.
+	for _, b := range retryBackoffs(noJitterTp) {
+		require.Equal(t, baseBackoff, b)
+	}
+
+	// with jitter, retries are spread across the window.
+	window := time.Duration(jitter * float64(baseBackoff))
+	const bucketCnt = 5
+	buckets := make([]int, bucketCnt)
+	for _, b := range retryBackoffs(tp) {
+		require.GreaterOrEqual(t, b, baseBackoff)
+		require.Less(t, b, baseBackoff+window)
+		buckets[int((b-baseBackoff)*bucketCnt/window)]++
+	}
+	for i, cnt := range buckets {
+		require.Positive(t, cnt, "no retry in bucket %d: %v", i, buckets)
+		require.Less(t, cnt, 50, "retries are bunched in bucket %d: %v", i, buckets)
+	}
+}
+
+func TestTaskExecutorMarkSubtaskRetrying(t *testing.T) {
+	var tp proto.TaskType = "test_task_executor_subtask_retrying"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ReduceCheckInterval(t)
+	t.Cleanup(ClearTaskExecutors)
+	RegisterTaskType(tp, nil, WithSubtaskRetryBackoffer(func() backoff.Backoffer {
+		return backoff.NewExponential(100*time.Millisecond, 2, time.Second)
+	}))
+
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{TaskBase: proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: tp, ID: 1, Concurrency: 1}}
+	subtask := &proto.Subtask{SubtaskBase: proto.SubtaskBase{ID: 2, Type: tp, Step: proto.StepOne,
+		State: proto.SubtaskStatePending, ExecID: "id"}}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	taskExecutor.Extension = mockExtension
+
+	// mock for checkBalanceSubtask
+	mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+		task.ID, proto.StepOne, proto.SubtaskStateRunning).Return([]*proto.Subtask{subtask}, nil).AnyTimes()
+	mockSubtaskTable.EXPECT().GetTaskBaseByID(gomock.Any(), task.ID).Return(&task.TaskBase, nil)
+	mockSubtaskTable.EXPECT().HasSubtasksInStates(gomock.Any(), "id", task.ID, task.Step,
+		unfinishedNormalSubtaskStates...).Return(true, nil)
+	mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+	mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(mockStepExecutor, nil)
+	mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(subtask, nil)
+	mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), subtask.ID, "id").Return(nil)
+	// meet retryable error, the subtask enters retrying state during backoff.
+	mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).Return(errors.New("retryable err"))
+	mockExtension.EXPECT().IsRetryableError(gomock.Any()).Return(true)
+	mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+	var nextRetryTime time.Time
+	beforeRetry := time.Now()
+	mockSubtaskTable.EXPECT().RetrySubtask(gomock.Any(), "id", subtask.ID, gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ string, _ int64, t time.Time) error {
+			nextRetryTime = t
+			return nil
+		})
+	// task succeed, exit the loop.
+	mockSubtaskTable.EXPECT().GetTaskBaseByID(gomock.Any(), task.ID).Return(
+		&proto.TaskBase{ID: task.ID, State: proto.TaskStateSucceed}, nil)
+	taskExecutor.Run(nil)
+	require.True(t, ctrl.Satisfied())
+	require.GreaterOrEqual(t, nextRetryTime.Sub(beforeRetry), 100*time.Millisecond)
+}
+
 func TestTaskExecutor(t *testing.T) {
 	var tp proto.TaskType = "test_task_executor"
 	var taskID int64 = 1
@@ -435,6 +596,495 @@ func TestCheckBalanceSubtask(t *testing.T) {
 	require.True(t, ctrl.Satisfied())
 }
 
+type retryClassifierExtension struct {
+	*mock.MockExtension
+}
+
+// ShouldRetry implements SubtaskRetryClassifier.ShouldRetry.
+func (*retryClassifierExtension) ShouldRetry(_ *proto.Subtask, err error) bool {
+	return strings.Contains(err.Error(), "timeout")
+}
+
+func TestTaskExecutorSubtaskRetryClassifier(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{TaskBase: proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type", ID: 1, Concurrency: 1}}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	// IsRetryableError of the extension is not consulted for subtask errors.
+	taskExecutor.Extension = &retryClassifierExtension{MockExtension: mockExtension}
+
+	// mock for checkBalanceSubtask
+	mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+		task.ID, proto.StepOne, proto.SubtaskStateRunning).Return([]*proto.Subtask{}, nil).AnyTimes()
+	runStepWithErr := func(runErr error) error {
+		mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+		mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(mockStepExecutor, nil)
+		mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+		mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+			unfinishedNormalSubtaskStates...).Return(&proto.Subtask{SubtaskBase: proto.SubtaskBase{
+			ID: 2, Type: task.Type, Step: proto.StepOne, State: proto.SubtaskStatePending, ExecID: "id"}}, nil)
+		mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), int64(2), "id").Return(nil)
+		mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).Return(runErr)
+		mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+		return taskExecutor.RunStep(nil)
+	}
+
+	// timeout error is retried, subtask state is not changed.
+	require.ErrorContains(t, runStepWithErr(errors.New("mock timeout")), "mock timeout")
+	require.True(t, taskExecutor.metRetryableErr.Load())
+	require.True(t, ctrl.Satisfied())
+
+	// bad input error fails the subtask immediately.
+	mockSubtaskTable.EXPECT().UpdateSubtaskStateAndError(gomock.Any(), "id", int64(2),
+		proto.SubtaskStateFailed, gomock.Any()).Return(nil)
+	require.ErrorContains(t, runStepWithErr(errors.New("mock bad input")), "mock bad input")
+	require.False(t, taskExecutor.metRetryableErr.Load())
+	require.True(t, ctrl.Satisfied())
+}
+
+func TestTaskExecutorNoAutoRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{
+		TaskBase:    proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type", ID: 1, Concurrency: 1},
+		ExtraParams: proto.ExtraParams{NoAutoRetry: true},
+	}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	taskExecutor.Extension = &retryClassifierExtension{MockExtension: mockExtension}
+
+	// mock for checkBalanceSubtask
+	mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+		task.ID, proto.StepOne, proto.SubtaskStateRunning).Return([]*proto.Subtask{}, nil).AnyTimes()
+
+	// transient error of the subtask fails it without retry, so the task is
+	// reverted by the scheduler.
+	mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+	mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(mockStepExecutor, nil)
+	mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(&proto.Subtask{SubtaskBase: proto.SubtaskBase{
+		ID: 2, TaskID: task.ID, Type: task.Type, Step: proto.StepOne, State: proto.SubtaskStatePending, ExecID: "id"}}, nil)
+	mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), int64(2), "id").Return(nil)
+	mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).Return(errors.New("mock timeout"))
+	mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().UpdateSubtaskStateAndError(gomock.Any(), "id", int64(2),
+		proto.SubtaskStateFailed, gomock.Any()).Return(nil)
+	require.ErrorContains(t, taskExecutor.RunStep(nil), "mock timeout")
+	require.False(t, taskExecutor.metRetryableErr.Load())
+	require.Zero(t, taskExecutor.retryingSubtaskID.Load())
+	require.True(t, ctrl.Satisfied())
+}
+
+type retryBudgetTaskTable struct {
+	*mock.MockTaskTable
+	budget   int
+	consumed int
+}
+
+// ConsumeRetryBudget implements RetryBudgetConsumer.ConsumeRetryBudget.
+func (t *retryBudgetTaskTable) ConsumeRetryBudget(context.Context, int64) (bool, error) {
+	if t.consumed >= t.budget {
+		return false, nil
+	}
+	t.consumed++
+	return true, nil
+}
+
+func TestTaskExecutorRetryBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{
+		TaskBase:    proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type", ID: 1, Concurrency: 1},
+		ExtraParams: proto.ExtraParams{RetryBudget: 3},
+	}
+	budgetTable := &retryBudgetTaskTable{MockTaskTable: mockSubtaskTable, budget: task.ExtraParams.RetryBudget}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, budgetTable)
+	taskExecutor.Extension = &retryClassifierExtension{MockExtension: mockExtension}
+
+	// mock for checkBalanceSubtask
+	mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+		task.ID, proto.StepOne, proto.SubtaskStateRunning).Return([]*proto.Subtask{}, nil).AnyTimes()
+	runSubtaskWithErr := func(subtaskID int64) error {
+		mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+		mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(mockStepExecutor, nil)
+		mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+		mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+			unfinishedNormalSubtaskStates...).Return(&proto.Subtask{SubtaskBase: proto.SubtaskBase{
+			ID: subtaskID, TaskID: task.ID, Type: task.Type, Step: proto.StepOne, State: proto.SubtaskStatePending, ExecID: "id"}}, nil)
+		mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), subtaskID, "id").Return(nil)
+		mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).Return(errors.New("mock timeout"))
+		mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+		return taskExecutor.RunStep(nil)
+	}
+
+	// the budget is shared by subtasks, the first 3 failures are retried.
+	for i := 0; i < 3; i++ {
+		require.ErrorContains(t, runSubtaskWithErr(int64(i+2)), "mock timeout")
+		require.True(t, taskExecutor.metRetryableErr.Load())
+		require.True(t, ctrl.Satisfied())
+	}
+	require.Equal(t, 3, budgetTable.consumed)
+
+	// the 4th failure fails the subtask, and the task is reverted by the scheduler.
+	mockSubtaskTable.EXPECT().UpdateSubtaskStateAndError(gomock.Any(), "id", int64(5),
+		proto.SubtaskStateFailed, gomock.Any()).Return(nil)
+	require.ErrorContains(t, runSubtaskWithErr(5), "mock timeout")
+	require.False(t, taskExecutor.metRetryableErr.Load())
+	require.True(t, ctrl.Satisfied())
+	require.Equal(t, 3, budgetTable.consumed)
+}
+
+func TestTaskExecutorRecoverSubtaskPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{TaskBase: proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type", ID: 1, Concurrency: 1}}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	taskExecutor.Extension = mockExtension
+	// the panic is not retried even if the extension takes all errors as retryable.
+	mockExtension.EXPECT().IsRetryableError(gomock.Any()).Return(true).AnyTimes()
+
+	// mock for checkBalanceSubtask
+	mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+		task.ID, proto.StepOne, proto.SubtaskStateRunning).Return([]*proto.Subtask{}, nil).AnyTimes()
+	prepareRunStep := func(subtaskID int64) {
+		mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+		mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(mockStepExecutor, nil)
+		mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+		mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+			unfinishedNormalSubtaskStates...).Return(&proto.Subtask{SubtaskBase: proto.SubtaskBase{
+			ID: subtaskID, Type: task.Type, Step: proto.StepOne, State: proto.SubtaskStatePending, ExecID: "id"}}, nil)
+		mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), subtaskID, "id").Return(nil)
+	}
+
+	// the panic fails the subtask, and the stack is recorded on it.
+	prepareRunStep(2)
+	mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(context.Context, *proto.Subtask) error {
+			panic("mock subtask panic")
+		})
+	var subtaskErr error
+	mockSubtaskTable.EXPECT().UpdateSubtaskStateAndError(gomock.Any(), "id", int64(2),
+		proto.SubtaskStateFailed, gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ string, _ int64, _ proto.SubtaskState, err error) error {
+			subtaskErr = err
+			return nil
+		})
+	mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+	err := taskExecutor.RunStep(nil)
+	require.ErrorContains(t, err, "mock subtask panic")
+	require.True(t, isSubtaskPanicErr(err))
+	require.False(t, taskExecutor.metRetryableErr.Load())
+	require.True(t, isSubtaskPanicErr(subtaskErr))
+	require.ErrorContains(t, subtaskErr, "subtask panicked: mock subtask panic")
+	require.ErrorContains(t, subtaskErr, "runSubtaskWithRecover")
+	require.True(t, ctrl.Satisfied())
+
+	// the task executor keeps running subtasks after the panic.
+	prepareRunStep(3)
+	mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).Return(nil)
+	mockStepExecutor.EXPECT().OnFinished(gomock.Any(), gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().FinishSubtask(gomock.Any(), "id", int64(3), gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(nil, nil)
+	mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+	require.NoError(t, taskExecutor.RunStep(nil))
+	require.True(t, ctrl.Satisfied())
+}
+
+func TestTaskExecutorApplyOnFinishedOnce(t *testing.T) {
+	bak := scheduler.RetrySQLTimes
+	t.Cleanup(func() {
+		scheduler.RetrySQLTimes = bak
+	})
+	scheduler.RetrySQLTimes = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{TaskBase: proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type", ID: 1, Concurrency: 1}}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	taskExecutor.Extension = mockExtension
+	mockExtension.EXPECT().IsRetryableError(gomock.Any()).Return(true).AnyTimes()
+	mockExtension.EXPECT().IsIdempotent(gomock.Any()).Return(true).AnyTimes()
+	// mock for checkBalanceSubtask
+	mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+		task.ID, proto.StepOne, proto.SubtaskStateRunning).Return([]*proto.Subtask{}, nil).AnyTimes()
+	// OnFinished accumulates the result into the meta of the subtask.
+	var onFinishedCnt int
+	mockStepExecutor.EXPECT().OnFinished(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, subtask *proto.Subtask) error {
+			onFinishedCnt++
+			subtask.Meta = append(subtask.Meta, []byte("-finished")...)
+			return nil
+		}).AnyTimes()
+	runStep := func(state proto.SubtaskState, finishErr error, expectedMeta string) error {
+		mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+		mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(mockStepExecutor, nil)
+		mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+		mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+			unfinishedNormalSubtaskStates...).Return(&proto.Subtask{SubtaskBase: proto.SubtaskBase{
+			ID: 1, Type: task.Type, Step: proto.StepOne, State: state, ExecID: "id"}, Meta: []byte("meta")}, nil)
+		if state == proto.SubtaskStatePending {
+			mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), int64(1), "id").Return(nil)
+		}
+		mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).Return(nil)
+		mockSubtaskTable.EXPECT().FinishSubtask(gomock.Any(), "id", int64(1), []byte(expectedMeta)).Return(finishErr)
+		if finishErr == nil {
+			mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+				unfinishedNormalSubtaskStates...).Return(nil, nil)
+		}
+		mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+		return taskExecutor.RunStep(nil)
+	}
+
+	// the finished state fails to persist, the subtask is left in running state.
+	require.ErrorContains(t, runStep(proto.SubtaskStatePending, errors.New("mock finish err"), "meta-finished"), "mock finish err")
+	require.True(t, taskExecutor.metRetryableErr.Load())
+	require.Equal(t, 1, onFinishedCnt)
+	require.True(t, ctrl.Satisfied())
+	// the subtask runs again, OnFinished is not applied again, and the result of
+	// the previous execution is persisted.
+	require.NoError(t, runStep(proto.SubtaskStateRunning, nil, "meta-finished"))
+	require.Equal(t, 1, onFinishedCnt)
+	require.Empty(t, taskExecutor.finishedResults)
+	require.True(t, ctrl.Satisfied())
+
+	// the subtask is claimed again in a new epoch, OnFinished is applied.
+	require.ErrorContains(t, runStep(proto.SubtaskStatePending, errors.New("mock finish err"), "meta-finished"), "mock finish err")
+	require.Equal(t, 2, onFinishedCnt)
+	require.NoError(t, runStep(proto.SubtaskStatePending, nil, "meta-finished"))
+	require.Equal(t, 3, onFinishedCnt)
+	require.True(t, ctrl.Satisfied())
+}
+
+type stepExecutorGetterExtension struct {
+	*mock.MockExtension
+	stepExecutors map[proto.Step]execute.StepExecutor
+}
+
+// GetSubtaskExecutorForStep implements StepExecutorGetter.GetSubtaskExecutorForStep.
+func (e *stepExecutorGetterExtension) GetSubtaskExecutorForStep(_ *proto.Task, step proto.Step) (execute.StepExecutor, error) {
+	return e.stepExecutors[step], nil
+}
+
+func TestTaskExecutorStepExecutorGetter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	stepOneExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	stepTwoExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{TaskBase: proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type", ID: 1, Concurrency: 1}}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	// GetStepExecutor of the extension is not called.
+	taskExecutor.Extension = &stepExecutorGetterExtension{
+		MockExtension: mockExtension,
+		stepExecutors: map[proto.Step]execute.StepExecutor{
+			proto.StepOne: stepOneExecutor,
+			proto.StepTwo: stepTwoExecutor,
+		},
+	}
+
+	runStep := func(step proto.Step, stepExecutor *mockexecute.MockStepExecutor) {
+		stepTask := *task
+		stepTask.Step = step
+		mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+			task.ID, step, proto.SubtaskStateRunning).Return([]*proto.Subtask{}, nil).AnyTimes()
+		mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(&stepTask, nil)
+		stepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+		mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, step,
+			unfinishedNormalSubtaskStates...).Return(&proto.Subtask{SubtaskBase: proto.SubtaskBase{
+			ID: int64(step), Type: task.Type, Step: step, State: proto.SubtaskStatePending, ExecID: "id"}}, nil)
+		mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), int64(step), "id").Return(nil)
+		stepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, subtask *proto.Subtask) error {
+				require.Equal(t, step, subtask.Step)
+				return nil
+			})
+		stepExecutor.EXPECT().OnFinished(gomock.Any(), gomock.Any()).Return(nil)
+		mockSubtaskTable.EXPECT().FinishSubtask(gomock.Any(), "id", int64(step), gomock.Any()).Return(nil)
+		mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, step,
+			unfinishedNormalSubtaskStates...).Return(nil, nil)
+		stepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+		require.NoError(t, taskExecutor.RunStep(nil))
+		require.True(t, ctrl.Satisfied())
+	}
+	// each step executor is only invoked for its own step.
+	runStep(proto.StepOne, stepOneExecutor)
+	runStep(proto.StepTwo, stepTwoExecutor)
+}
+
+type subtaskCtxKey struct{}
+
+type contextEnricherExtension struct {
+	*mock.MockExtension
+}
+
+// EnrichSubtaskContext implements SubtaskContextEnricher.EnrichSubtaskContext.
+func (*contextEnricherExtension) EnrichSubtaskContext(ctx context.Context, subtask *proto.Subtask) context.Context {
+	return context.WithValue(ctx, subtaskCtxKey{}, fmt.Sprintf("client-of-subtask-%d", subtask.ID))
+}
+
+func TestTaskExecutorSubtaskContextEnricher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{TaskBase: proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type", ID: 1, Concurrency: 1}}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	taskExecutor.Extension = &contextEnricherExtension{MockExtension: mockExtension}
+
+	// mock for checkBalanceSubtask
+	mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+		task.ID, proto.StepOne, proto.SubtaskStateRunning).Return([]*proto.Subtask{}, nil).AnyTimes()
+	mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+	mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(mockStepExecutor, nil)
+	mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(&proto.Subtask{SubtaskBase: proto.SubtaskBase{
+		ID: 2, Type: task.Type, Step: proto.StepOne, State: proto.SubtaskStatePending, ExecID: "id"}}, nil)
+	mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), int64(2), "id").Return(nil)
+	mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *proto.Subtask) error {
+			require.Equal(t, "client-of-subtask-2", ctx.Value(subtaskCtxKey{}))
+			return nil
+		})
+	mockStepExecutor.EXPECT().OnFinished(gomock.Any(), gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().FinishSubtask(gomock.Any(), "id", int64(2), gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(nil, nil)
+	mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+	require.NoError(t, taskExecutor.RunStep(nil))
+	require.True(t, ctrl.Satisfied())
+}
+
+func TestTaskExecutorSubtaskContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	startTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	task := &proto.Task{TaskBase: proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type", ID: 1, Concurrency: 1},
+		StartTime: startTime, ExtraParams: proto.ExtraParams{TimeoutSeconds: 3600}}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	taskExecutor.Extension = mockExtension
+
+	// mock for checkBalanceSubtask
+	mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+		task.ID, proto.StepOne, proto.SubtaskStateRunning).Return([]*proto.Subtask{}, nil).AnyTimes()
+	mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+	mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(mockStepExecutor, nil)
+	mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(&proto.Subtask{SubtaskBase: proto.SubtaskBase{
+		ID: 2, Type: task.Type, Step: proto.StepOne, State: proto.SubtaskStatePending, ExecID: "id"}}, nil)
+	mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), int64(2), "id").Return(nil)
+	mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *proto.Subtask) error {
+			deadline, ok := ctx.Deadline()
+			require.True(t, ok)
+			require.Equal(t, startTime.Add(time.Hour), deadline)
+			remaining := time.Until(deadline)
+			require.Greater(t, remaining, 58*time.Minute)
+			require.LessOrEqual(t, remaining, 59*time.Minute)
+			return nil
+		})
+	mockStepExecutor.EXPECT().OnFinished(gomock.Any(), gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().FinishSubtask(gomock.Any(), "id", int64(2), gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(nil, nil)
+	mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+	require.NoError(t, taskExecutor.RunStep(nil))
+	require.True(t, ctrl.Satisfied())
+
+	// no deadline if the task has no timeout.
+	task.ExtraParams.TimeoutSeconds = 0
+	_, ok := task.Deadline()
+	require.False(t, ok)
+}
+
+type doneCheckerStepExecutor struct {
+	*mockexecute.MockStepExecutor
+}
+
+// IsAlreadyDone implements execute.DoneChecker.IsAlreadyDone.
+func (*doneCheckerStepExecutor) IsAlreadyDone(_ context.Context, subtask *proto.Subtask) (bool, error) {
+	return subtask.ID%2 == 0, nil
+}
+
+func TestTaskExecutorSkipDoneSubtasks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{TaskBase: proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type", ID: 1, Concurrency: 1}}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	taskExecutor.Extension = mockExtension
+
+	// mock for checkBalanceSubtask
+	mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+		task.ID, proto.StepOne, proto.SubtaskStateRunning).Return([]*proto.Subtask{}, nil).AnyTimes()
+	mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+	mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(&doneCheckerStepExecutor{MockStepExecutor: mockStepExecutor}, nil)
+	mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	var ranSubtaskIDs []int64
+	for i := int64(1); i <= 4; i++ {
+		mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+			unfinishedNormalSubtaskStates...).Return(&proto.Subtask{SubtaskBase: proto.SubtaskBase{
+			ID: i, Type: task.Type, Step: proto.StepOne, State: proto.SubtaskStatePending, ExecID: "id"}}, nil)
+		mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), i, "id").Return(nil)
+		if i%2 == 1 {
+			mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ context.Context, subtask *proto.Subtask) error {
+					ranSubtaskIDs = append(ranSubtaskIDs, subtask.ID)
+					return nil
+				})
+			mockStepExecutor.EXPECT().OnFinished(gomock.Any(), gomock.Any()).Return(nil)
+		}
+		mockSubtaskTable.EXPECT().FinishSubtask(gomock.Any(), "id", i, gomock.Any()).Return(nil)
+	}
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(nil, nil)
+	mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+	require.NoError(t, taskExecutor.RunStep(nil))
+	require.Equal(t, []int64{1, 3}, ranSubtaskIDs)
+	require.True(t, ctrl.Satisfied())
+}
+
 func TestExecutorErrHandling(t *testing.T) {
 	var tp proto.TaskType = "test_task_executor"
 	var concurrency = 10
@@ -539,6 +1189,74 @@ func TestExecutorErrHandling(t *testing.T) {
 	require.True(t, ctrl.Satisfied())
 }
 
+type prefetchStepExecutor struct {
+	*mockexecute.MockStepExecutor
+	prefetchedCh chan int64
+}
+
+func (e *prefetchStepExecutor) Prefetch(_ context.Context, nextSubtask *proto.Subtask) error {
+	e.prefetchedCh <- nextSubtask.ID
+	return errors.New("mock prefetch error")
+}
+
+func TestPrefetchNextSubtask(t *testing.T) {
+	var tp proto.TaskType = "test_task_executor_prefetch"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	stepExecutor := &prefetchStepExecutor{
+		MockStepExecutor: mockexecute.NewMockStepExecutor(ctrl),
+		prefetchedCh:     make(chan int64, 1),
+	}
+	task := &proto.Task{TaskBase: proto.TaskBase{Step: proto.StepOne, Type: tp, ID: 1, Concurrency: 1}}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, mockSubtaskTable)
+	taskExecutor.Extension = mockExtension
+
+	subtask1 := &proto.Subtask{SubtaskBase: proto.SubtaskBase{
+		ID: 1, TaskID: task.ID, Type: tp, Step: proto.StepOne, State: proto.SubtaskStatePending, ExecID: "id"}}
+	subtask2 := &proto.Subtask{SubtaskBase: proto.SubtaskBase{
+		ID: 2, TaskID: task.ID, Type: tp, Step: proto.StepOne, State: proto.SubtaskStatePending, ExecID: "id"}}
+	mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+	mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(stepExecutor, nil)
+	stepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	// run subtask 1, prefetch subtask 2 during it, prefetch error is ignored.
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(subtask1, nil)
+	mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), subtask1.ID, "id").Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		proto.SubtaskStatePending).Return(subtask2, nil)
+	stepExecutor.EXPECT().RunSubtask(gomock.Any(), subtask1).DoAndReturn(
+		func(context.Context, *proto.Subtask) error {
+			select {
+			case id := <-stepExecutor.prefetchedCh:
+				require.Equal(t, subtask2.ID, id)
+			case <-time.After(10 * time.Second):
+				require.FailNow(t, "prefetch not called")
+			}
+			return nil
+		})
+	stepExecutor.EXPECT().OnFinished(gomock.Any(), subtask1).Return(nil)
+	mockSubtaskTable.EXPECT().FinishSubtask(gomock.Any(), "id", subtask1.ID, gomock.Any()).Return(nil)
+	// run subtask 2, no more subtask to prefetch.
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(subtask2, nil)
+	mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), subtask2.ID, "id").Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		proto.SubtaskStatePending).Return(nil, nil)
+	stepExecutor.EXPECT().RunSubtask(gomock.Any(), subtask2).Return(nil)
+	stepExecutor.EXPECT().OnFinished(gomock.Any(), subtask2).Return(nil)
+	mockSubtaskTable.EXPECT().FinishSubtask(gomock.Any(), "id", subtask2.ID, gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().GetFirstSubtaskInStates(gomock.Any(), "id", task.ID, proto.StepOne,
+		unfinishedNormalSubtaskStates...).Return(nil, nil)
+	stepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+	require.NoError(t, taskExecutor.RunStep(nil))
+	require.True(t, ctrl.Satisfied())
+	require.Empty(t, stepExecutor.prefetchedCh)
+}
+
 func TestInject(t *testing.T) {
 	e := &EmptyStepExecutor{}
 	r := &proto.StepResource{CPU: proto.NewAllocatable(1)}
@@ -546,3 +1264,64 @@ func TestInject(t *testing.T) {
 	got := e.GetResource()
 	require.Equal(t, r, got)
 }
+
+type batchTaskTable struct {
+	*mock.MockTaskTable
+	pending    []*proto.Subtask
+	fetchSizes []int
+}
+
+// GetFirstSubtasksInStates implements SubtaskBatchGetter.GetFirstSubtasksInStates.
+func (t *batchTaskTable) GetFirstSubtasksInStates(_ context.Context, _ string, _ int64, _ proto.Step, limit int, _ ...proto.SubtaskState) ([]*proto.Subtask, error) {
+	n := min(limit, len(t.pending))
+	res := t.pending[:n]
+	t.pending = t.pending[n:]
+	t.fetchSizes = append(t.fetchSizes, n)
+	return res, nil
+}
+
+func TestTaskExecutorSubtaskFetchLimit(t *testing.T) {
+	bak := SubtaskFetchLimit
+	SubtaskFetchLimit = 5
+	t.Cleanup(func() {
+		SubtaskFetchLimit = bak
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockSubtaskTable := mock.NewMockTaskTable(ctrl)
+	mockStepExecutor := mockexecute.NewMockStepExecutor(ctrl)
+	mockExtension := mock.NewMockExtension(ctrl)
+	task := &proto.Task{TaskBase: proto.TaskBase{State: proto.TaskStateRunning, Step: proto.StepOne, Type: "type", ID: 1, Concurrency: 1}}
+	table := &batchTaskTable{MockTaskTable: mockSubtaskTable}
+	for i := 0; i < 50; i++ {
+		table.pending = append(table.pending, &proto.Subtask{SubtaskBase: proto.SubtaskBase{
+			ID: int64(i + 1), TaskID: task.ID, Type: task.Type, Step: proto.StepOne,
+			State: proto.SubtaskStatePending, ExecID: "id"}})
+	}
+	taskExecutor := NewBaseTaskExecutor(ctx, "id", task, table)
+	taskExecutor.Extension = mockExtension
+
+	// mock for checkBalanceSubtask
+	mockSubtaskTable.EXPECT().GetSubtasksByExecIDAndStepAndStates(gomock.Any(), "id",
+		task.ID, proto.StepOne, proto.SubtaskStateRunning).Return([]*proto.Subtask{}, nil).AnyTimes()
+	mockSubtaskTable.EXPECT().GetTaskByID(gomock.Any(), task.ID).Return(task, nil)
+	mockExtension.EXPECT().GetStepExecutor(gomock.Any()).Return(mockStepExecutor, nil)
+	mockStepExecutor.EXPECT().Init(gomock.Any()).Return(nil)
+	mockSubtaskTable.EXPECT().StartSubtask(gomock.Any(), gomock.Any(), "id").Return(nil).Times(50)
+	mockStepExecutor.EXPECT().RunSubtask(gomock.Any(), gomock.Any()).Return(nil).Times(50)
+	mockStepExecutor.EXPECT().OnFinished(gomock.Any(), gomock.Any()).Return(nil).Times(50)
+	mockSubtaskTable.EXPECT().FinishSubtask(gomock.Any(), "id", gomock.Any(), gomock.Any()).Return(nil).Times(50)
+	mockStepExecutor.EXPECT().Cleanup(gomock.Any()).Return(nil)
+	require.NoError(t, taskExecutor.RunStep(nil))
+	require.True(t, ctrl.Satisfied())
+
+	// each fetch considers at most 5 candidates, and the last one finds nothing.
+	require.Len(t, table.fetchSizes, 11)
+	for _, n := range table.fetchSizes[:10] {
+		require.Equal(t, 5, n)
+	}
+	require.Zero(t, table.fetchSizes[10])
+	require.Empty(t, taskExecutor.subtaskCandidates)
+}
@@ -104,3 +104,74 @@ func TestTaskExecutorBasic(t *testing.T) {
 		runOneTask(ctx, t, mgr, "key"+strconv.Itoa(i), i)
 	}
 }
+
+func TestPeekNextSubtask(t *testing.T) {
+	_, mgr, ctx := testutil.InitTableTest(t)
+	require.NoError(t, mgr.InitMeta(ctx, ":4000", ""))
+	require.NoError(t, mgr.InitMeta(ctx, ":4001", ""))
+	taskID, err := mgr.CreateTask(ctx, "key1", proto.TaskTypeExample, 1, nil)
+	require.NoError(t, err)
+	task, err := mgr.GetTaskByID(ctx, taskID)
+	require.NoError(t, err)
+	executor := taskexecutor.NewBaseTaskExecutor(ctx, ":4000", task, mgr)
+
+	// task is not running.
+	next, err := executor.PeekNextSubtask(ctx)
+	require.NoError(t, err)
+	require.Nil(t, next)
+
+	// subtasks of other nodes are skipped, and subtasks with the same serial key
+	// run one by one.
+	subtasks := []*proto.Subtask{
+		proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample, ":4001", 1, []byte("0"), 1),
+		proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample, ":4000", 1, []byte("1"), 2),
+		proto.NewSubtask(proto.StepOne, taskID, proto.TaskTypeExample, ":4000", 1, []byte("2"), 3),
+	}
+	subtasks[0].SerialKey = "p1"
+	subtasks[1].SerialKey = "p1"
+	require.NoError(t, mgr.SwitchTaskStep(ctx, task, proto.TaskStateRunning, proto.StepOne, subtasks))
+	createdSubtasks, err := mgr.GetSubtasksWithHistory(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.Len(t, createdSubtasks, 3)
+	ids := make(map[int]int64, len(createdSubtasks))
+	for _, st := range createdSubtasks {
+		ids[st.Ordinal] = st.ID
+	}
+	peekAndCheck := func(expectedID int64) {
+		t.Helper()
+		next, err := executor.PeekNextSubtask(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, next)
+		require.Equal(t, expectedID, next.ID)
+	}
+	peekAndCheck(ids[2])
+	// peek doesn't claim the subtask.
+	peekAndCheck(ids[2])
+	cntByStates, err := mgr.GetSubtaskCntGroupByStates(ctx, taskID, proto.StepOne)
+	require.NoError(t, err)
+	require.Equal(t, map[proto.SubtaskState]int64{proto.SubtaskStatePending: 3}, cntByStates)
+
+	// the serial key is held by the subtask running on other node.
+	require.NoError(t, mgr.StartSubtask(ctx, ids[1], ":4001"))
+	peekAndCheck(ids[3])
+	require.NoError(t, mgr.FinishSubtask(ctx, ":4001", ids[1], nil))
+	peekAndCheck(ids[2])
+
+	// the running subtask of this node is resumed before claiming others.
+	require.NoError(t, mgr.StartSubtask(ctx, ids[2], ":4000"))
+	peekAndCheck(ids[2])
+	require.NoError(t, mgr.FinishSubtask(ctx, ":4000", ids[2], nil))
+	peekAndCheck(ids[3])
+	require.NoError(t, mgr.StartSubtask(ctx, ids[3], ":4000"))
+	require.NoError(t, mgr.FinishSubtask(ctx, ":4000", ids[3], nil))
+	next, err = executor.PeekNextSubtask(ctx)
+	require.NoError(t, err)
+	require.Nil(t, next)
+
+	// no subtask is claimed after the executor is cancelled gracefully.
+	testutil.CreateSubTask(t, mgr, taskID, proto.StepOne, ":4000", nil, proto.TaskTypeExample, 1)
+	executor.CancelGracefully()
+	next, err = executor.PeekNextSubtask(ctx)
+	require.NoError(t, err)
+	require.Nil(t, next)
+}
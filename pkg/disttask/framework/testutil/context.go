@@ -85,6 +85,8 @@ func NewTestDXFContext(t testing.TB, nodeNum int, cpuCount int, reduceCheckInter
 }
 
 func newTestDXFContext(t testing.TB) *TestDXFContext {
+	CheckFailpointLeak(t)
+	collectTaskStateEvents(t)
 	seed := time.Now().UnixNano()
 	t.Log("dxf context seed:", seed)
 	c := &TestDXFContext{
@@ -389,6 +391,7 @@ func InitTestContext(t *testing.T, nodeNum int) (context.Context, *gomock.Contro
 	defer ctrl.Finish()
 	ctx := util.WithInternalSourceType(context.Background(), "scheduler")
 	testkit.EnableFailPoint(t, "github.com/pingcap/tidb/pkg/util/cpu/mockNumCpu", "return(8)")
+	collectTaskStateEvents(t)
 
 	executionContext := testkit.NewDistExecutionContext(t, nodeNum)
 	testCtx := &TestContext{
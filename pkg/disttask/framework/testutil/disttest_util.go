@@ -16,6 +16,7 @@ package testutil
 
 import (
 	"context"
+	"sync"
 	"testing"
 
 	"github.com/pingcap/tidb/pkg/disttask/framework/handle"
@@ -140,3 +141,44 @@ func waitTaskUntil(ctx context.Context, t testing.TB, taskKey string, fn func(ta
 	require.NoError(t, err)
 	return task
 }
+
+// taskStateEvents is the event log of task state changes observed by schedulers,
+// it's collected during the run of each test, see collectTaskStateEvents.
+var taskStateEvents = struct {
+	sync.Mutex
+	// task key -> states in the order they are entered.
+	states map[string][]proto.TaskState
+}{}
+
+// collectTaskStateEvents starts collecting the task state changes observed by
+// schedulers into the event log until the test ends.
+func collectTaskStateEvents(t testing.TB) {
+	taskStateEvents.Lock()
+	taskStateEvents.states = make(map[string][]proto.TaskState)
+	taskStateEvents.Unlock()
+	scheduler.SetTaskStateObserver(func(task *proto.Task) {
+		taskStateEvents.Lock()
+		defer taskStateEvents.Unlock()
+		taskStateEvents.states[task.Key] = append(taskStateEvents.states[task.Key], task.State)
+	})
+	t.Cleanup(func() {
+		scheduler.SetTaskStateObserver(nil)
+	})
+}
+
+// GetTaskStateEvents returns the states the task has entered in order, collected
+// from the event log.
+func GetTaskStateEvents(taskKey string) []proto.TaskState {
+	taskStateEvents.Lock()
+	defer taskStateEvents.Unlock()
+	return append([]proto.TaskState(nil), taskStateEvents.states[taskKey]...)
+}
+
+// AssertTaskNeverEnteredState waits the task done, and asserts it never entered
+// the state during the run using the event log.
+func AssertTaskNeverEnteredState(ctx context.Context, t testing.TB, taskKey string, state proto.TaskState) {
+	WaitTaskDone(ctx, t, taskKey)
+	states := GetTaskStateEvents(taskKey)
+	require.NotEmpty(t, states, "no state change of task %s is collected", taskKey)
+	require.NotContains(t, states, state, "task %s entered state %s, states: %v", taskKey, state, states)
+}
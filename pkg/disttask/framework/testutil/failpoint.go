@@ -0,0 +1,61 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pingcap/failpoint"
+)
+
+const frameworkFailpointPrefix = "github.com/pingcap/tidb/pkg/disttask/framework/"
+
+// listEnabledFrameworkFailpoints returns the enabled failpoints of the framework.
+func listEnabledFrameworkFailpoints() []string {
+	var enabled []string
+	for _, fp := range failpoint.List() {
+		if !strings.HasPrefix(fp, frameworkFailpointPrefix) {
+			continue
+		}
+		// List returns disabled failpoints too, Status returns error for them.
+		if _, err := failpoint.Status(fp); err == nil {
+			enabled = append(enabled, fp)
+		}
+	}
+	return enabled
+}
+
+// CheckFailpointLeak snapshots the enabled failpoints of the framework, and
+// fails the test on cleanup if some failpoint enabled during the test is left
+// enabled, such as when a panic skips the deferred Disable. Leaked failpoints
+// are disabled, so they don't affect other tests.
+// it should be called before enabling failpoints in the test, as cleanups run
+// in reverse order.
+func CheckFailpointLeak(t testing.TB) {
+	enabledBefore := make(map[string]struct{})
+	for _, fp := range listEnabledFrameworkFailpoints() {
+		enabledBefore[fp] = struct{}{}
+	}
+	t.Cleanup(func() {
+		for _, fp := range listEnabledFrameworkFailpoints() {
+			if _, ok := enabledBefore[fp]; ok {
+				continue
+			}
+			t.Errorf("failpoint %s is left enabled after the test", fp)
+			_ = failpoint.Disable(fp)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pingcap/failpoint"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTB records the errors and cleanups, so we can check the failure
+// reported by the guard without failing the test itself.
+type recordingTB struct {
+	testing.TB
+	errs     []string
+	cleanups []func()
+}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Cleanup(f func()) {
+	r.cleanups = append(r.cleanups, f)
+}
+
+func (r *recordingTB) runCleanups() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+func TestCheckFailpointLeak(t *testing.T) {
+	const (
+		leakedFP = "github.com/pingcap/tidb/pkg/disttask/framework/taskexecutor/MockExecutorRunErr"
+		otherFP  = "github.com/pingcap/tidb/pkg/util/cpu/mockNumCpu"
+	)
+
+	// failpoints disabled in the test are not reported.
+	tb := &recordingTB{TB: t}
+	CheckFailpointLeak(tb)
+	require.NoError(t, failpoint.Enable(leakedFP, "return(true)"))
+	require.NoError(t, failpoint.Disable(leakedFP))
+	tb.runCleanups()
+	require.Empty(t, tb.errs)
+
+	// leaked failpoint is reported and disabled, failpoints outside the
+	// framework are not checked.
+	tb = &recordingTB{TB: t}
+	CheckFailpointLeak(tb)
+	require.NoError(t, failpoint.Enable(leakedFP, "return(true)"))
+	require.NoError(t, failpoint.Enable(otherFP, "return(8)"))
+	t.Cleanup(func() {
+		require.NoError(t, failpoint.Disable(otherFP))
+	})
+	tb.runCleanups()
+	require.Equal(t, []string{fmt.Sprintf("failpoint %s is left enabled after the test", leakedFP)}, tb.errs)
+	_, err := failpoint.Status(leakedFP)
+	require.Error(t, err)
+
+	// failpoint enabled before the guard is not reported.
+	require.NoError(t, failpoint.Enable(leakedFP, "return(true)"))
+	tb = &recordingTB{TB: t}
+	CheckFailpointLeak(tb)
+	tb.runCleanups()
+	require.Empty(t, tb.errs)
+	require.NoError(t, failpoint.Disable(leakedFP))
+}
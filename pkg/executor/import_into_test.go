@@ -15,10 +15,19 @@
 package executor_test
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/pingcap/tidb/pkg/disttask/framework/proto"
+	"github.com/pingcap/tidb/pkg/disttask/framework/testutil"
+	"github.com/pingcap/tidb/pkg/disttask/importinto"
+	"github.com/pingcap/tidb/pkg/executor/importer"
+	"github.com/pingcap/tidb/pkg/parser/auth"
+	"github.com/pingcap/tidb/pkg/sessionctx"
 	"github.com/pingcap/tidb/pkg/testkit"
 	"github.com/pingcap/tidb/pkg/util/sem"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSecurityEnhancedMode(t *testing.T) {
@@ -33,3 +42,50 @@ func TestSecurityEnhancedMode(t *testing.T) {
 	// regardless of what privileges they have available.
 	tk.MustGetErrMsg("IMPORT INTO test.t FROM '/file.csv'", "[planner:8132]Feature 'IMPORT INTO from server disk' is not supported when security enhanced mode is enabled")
 }
+
+func TestCancelImportJobNotCountedAsFailure(t *testing.T) {
+	store, gm, ctx := testutil.InitTableTest(t)
+	require.NoError(t, gm.InitMeta(ctx, ":4000", ""))
+	tk := testkit.NewTestKit(t, store)
+	require.NoError(t, tk.Session().Auth(&auth.UserIdentity{Username: "root", Hostname: "localhost"}, nil, nil, nil))
+
+	var jobID int64
+	require.NoError(t, gm.WithNewSession(func(se sessionctx.Context) error {
+		var err error
+		jobID, err = importer.CreateJob(ctx, se.GetSQLExecutor(), "test", "t", 1, "root", &importer.ImportParameters{}, 0)
+		return err
+	}))
+	taskID, err := gm.CreateTask(ctx, importinto.TaskKey(jobID), proto.ImportInto, 1, []byte("{}"))
+	require.NoError(t, err)
+
+	// dist task is disabled in this test, revert the task as the scheduler does
+	// after it's cancelled.
+	done := make(chan error, 1)
+	go func() {
+		for {
+			task, err := gm.GetTaskByID(ctx, taskID)
+			if err != nil {
+				done <- err
+				return
+			}
+			if task.State == proto.TaskStateCancelling {
+				if err = gm.RevertTask(ctx, taskID, proto.TaskStateCancelling, nil); err == nil {
+					err = gm.RevertedTask(ctx, taskID)
+				}
+				done <- err
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	tk.MustExec(fmt.Sprintf("cancel import job %d", jobID))
+	require.NoError(t, <-done)
+
+	task, err := gm.GetTaskByIDWithHistory(ctx, taskID)
+	require.NoError(t, err)
+	require.Equal(t, proto.TaskStateReverted, task.State)
+	require.Equal(t, proto.CancelModeForce, task.ExtraParams.CancelMode)
+	// user cancels don't count as failures, so they don't trip the circuit
+	// breaker of the task type.
+	require.False(t, task.IsFailure())
+}
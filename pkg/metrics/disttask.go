@@ -45,6 +45,11 @@ var (
 	DistTaskStartTimeGauge *prometheus.GaugeVec
 	// DistTaskUsedSlotsGauge is the gauge of used slots on executor node.
 	DistTaskUsedSlotsGauge *prometheus.GaugeVec
+	// DistTaskStalledCounter is the counter of stalled tasks detected by scheduler.
+	DistTaskStalledCounter *prometheus.CounterVec
+	// DistTaskBalanceCounter is the counter of scheduling decisions made by the
+	// subtask balancer of scheduler.
+	DistTaskBalanceCounter *prometheus.CounterVec
 )
 
 // InitDistTaskMetrics initializes disttask metrics.
@@ -71,6 +76,20 @@ func InitDistTaskMetrics() {
 			Name:      "used_slots",
 			Help:      "Gauge of used slots on a executor node.",
 		}, []string{"service_scope"})
+	DistTaskStalledCounter = NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "disttask",
+			Name:      "stalled_task_total",
+			Help:      "Counter of tasks which make no progress for a long time.",
+		}, []string{lblTaskType})
+	DistTaskBalanceCounter = NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "disttask",
+			Name:      "balance_decision_total",
+			Help:      "Counter of scheduling decisions made by the subtask balancer.",
+		}, []string{LblType})
 }
 
 // UpdateMetricsForAddTask update metrics when a task is added
@@ -270,6 +270,8 @@ func RegisterMetrics() {
 	prometheus.MustRegister(DistTaskGauge)
 	prometheus.MustRegister(DistTaskStartTimeGauge)
 	prometheus.MustRegister(DistTaskUsedSlotsGauge)
+	prometheus.MustRegister(DistTaskStalledCounter)
+	prometheus.MustRegister(DistTaskBalanceCounter)
 	prometheus.MustRegister(RunawayCheckerCounter)
 	prometheus.MustRegister(GlobalSortWriteToCloudStorageDuration)
 	prometheus.MustRegister(GlobalSortWriteToCloudStorageRate)
@@ -584,6 +584,7 @@ const (
 		concurrency INT(11),
 		step INT(11),
 		error BLOB,
+		extra_params json,
 		key(state),
       	UNIQUE KEY task_key(task_key)
 	);`
@@ -604,6 +605,7 @@ const (
 		concurrency INT(11),
 		step INT(11),
 		error BLOB,
+		extra_params json,
 		key(state),
       	UNIQUE KEY task_key(task_key)
 	);`
@@ -1082,11 +1084,27 @@ const (
 	//   create `sys` schema
 	//   create `sys.schema_unused_indexes` table
 	version195 = 195
+
+	// version 196
+	//   add `extra_params` to `mysql.tidb_global_task`/`mysql.tidb_global_task_history`
+	version196 = 196
+
+	// version 197
+	//   add `group_name` to `mysql.tidb_background_subtask`/`mysql.tidb_background_subtask_history`
+	version197 = 197
+
+	// version 198
+	//   add `serial_key` to `mysql.tidb_background_subtask`/`mysql.tidb_background_subtask_history`
+	version198 = 198
+
+	// version 199
+	//   add `weight` to `mysql.tidb_background_subtask`/`mysql.tidb_background_subtask_history`
+	version199 = 199
 )
 
 // currentBootstrapVersion is defined as a variable, so we can modify its value for testing.
 // please make sure this is the largest version
-var currentBootstrapVersion int64 = version195
+var currentBootstrapVersion int64 = version199
 
 // DDL owner key's expired time is ManagerSessionTTL seconds, we should wait the time and give more time to have a chance to finish it.
 var internalSQLTimeout = owner.ManagerSessionTTL + 15
@@ -1247,6 +1265,10 @@ var (
 		upgradeToVer193,
 		upgradeToVer194,
 		upgradeToVer195,
+		upgradeToVer196,
+		upgradeToVer197,
+		upgradeToVer198,
+		upgradeToVer199,
 	}
 )
 
@@ -3069,6 +3091,42 @@ func upgradeToVer195(s sessiontypes.Session, ver int64) {
 	doReentrantDDL(s, DropMySQLIndexUsageTable)
 }
 
+func upgradeToVer196(s sessiontypes.Session, ver int64) {
+	if ver >= version196 {
+		return
+	}
+
+	doReentrantDDL(s, "ALTER TABLE mysql.tidb_global_task ADD COLUMN `extra_params` json AFTER `error`", infoschema.ErrColumnExists)
+	doReentrantDDL(s, "ALTER TABLE mysql.tidb_global_task_history ADD COLUMN `extra_params` json AFTER `error`", infoschema.ErrColumnExists)
+}
+
+func upgradeToVer197(s sessiontypes.Session, ver int64) {
+	if ver >= version197 {
+		return
+	}
+
+	doReentrantDDL(s, "ALTER TABLE mysql.tidb_background_subtask ADD COLUMN `group_name` varchar(256) AFTER `summary`", infoschema.ErrColumnExists)
+	doReentrantDDL(s, "ALTER TABLE mysql.tidb_background_subtask_history ADD COLUMN `group_name` varchar(256) AFTER `summary`", infoschema.ErrColumnExists)
+}
+
+func upgradeToVer198(s sessiontypes.Session, ver int64) {
+	if ver >= version198 {
+		return
+	}
+
+	doReentrantDDL(s, "ALTER TABLE mysql.tidb_background_subtask ADD COLUMN `serial_key` varchar(256) AFTER `group_name`", infoschema.ErrColumnExists)
+	doReentrantDDL(s, "ALTER TABLE mysql.tidb_background_subtask_history ADD COLUMN `serial_key` varchar(256) AFTER `group_name`", infoschema.ErrColumnExists)
+}
+
+func upgradeToVer199(s sessiontypes.Session, ver int64) {
+	if ver >= version199 {
+		return
+	}
+
+	doReentrantDDL(s, "ALTER TABLE mysql.tidb_background_subtask ADD COLUMN `weight` bigint AFTER `serial_key`", infoschema.ErrColumnExists)
+	doReentrantDDL(s, "ALTER TABLE mysql.tidb_background_subtask_history ADD COLUMN `weight` bigint AFTER `serial_key`", infoschema.ErrColumnExists)
+}
+
 func writeOOMAction(s sessiontypes.Session) {
 	comment := "oom-action is `log` by default in v3.0.x, `cancel` by default in v4.0.11+"
 	mustExecute(s, `INSERT HIGH_PRIORITY INTO %n.%n VALUES (%?, %?, %?) ON DUPLICATE KEY UPDATE VARIABLE_VALUE= %?`,
@@ -14,7 +14,10 @@
 
 package backoff
 
-import "time"
+import (
+	"math/rand"
+	"time"
+)
 
 // Backoffer is the interface to get backoff.
 type Backoffer interface {
@@ -59,3 +62,50 @@ func (b *Exponential) Backoff(retryCnt int) time.Duration {
 	}
 	return b.nextBackoff
 }
+
+// Constant implements the backoff algorithm which always returns the same
+// duration.
+type Constant struct {
+	backoff time.Duration
+}
+
+var _ Backoffer = &Constant{}
+
+// NewConstant creates a new Constant backoff.
+func NewConstant(backoff time.Duration) *Constant {
+	return &Constant{backoff: backoff}
+}
+
+// Backoff returns the duration to wait for the retryCnt-th retry.
+func (b *Constant) Backoff(int) time.Duration {
+	return b.backoff
+}
+
+// Jitter wraps a Backoffer and adds random jitter to the returned duration to
+// avoid retrying at the same time on different nodes.
+// the returned duration is in range [d*(1-ratio), d], d is the duration returned
+// by the wrapped Backoffer, so the max backoff of it is still respected.
+type Jitter struct {
+	backoffer Backoffer
+	ratio     float64
+	rand      *rand.Rand
+}
+
+var _ Backoffer = &Jitter{}
+
+// NewJitter creates a new Jitter backoff, ratio should be in range [0, 1].
+func NewJitter(backoffer Backoffer, ratio float64) *Jitter {
+	return &Jitter{
+		backoffer: backoffer,
+		ratio:     min(max(ratio, 0), 1),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Backoff returns the duration to wait for the retryCnt-th retry.
+// retryCnt starts from 0.
+func (b *Jitter) Backoff(retryCnt int) time.Duration {
+	d := b.backoffer.Backoff(retryCnt)
+	jitter := time.Duration(b.rand.Float64() * b.ratio * float64(d))
+	return d - jitter
+}
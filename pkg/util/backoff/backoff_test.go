@@ -36,3 +36,80 @@ func TestExponential(t *testing.T) {
 		require.Equal(t, res[i], backoffer.Backoff(i))
 	}
 }
+
+func TestExponentialReset(t *testing.T) {
+	backoffer := NewExponential(1, 2, 100)
+	res := []time.Duration{1, 2, 4, 8}
+	for i := 0; i < len(res); i++ {
+		require.Equal(t, res[i], backoffer.Backoff(i))
+	}
+	// retryCnt = 0 resets the backoff.
+	for i := 0; i < len(res); i++ {
+		require.Equal(t, res[i], backoffer.Backoff(i))
+	}
+
+	// reset after the backoff is capped, it grows from the base again.
+	for i := 0; i < 10; i++ {
+		backoffer.Backoff(i)
+	}
+	require.Equal(t, time.Duration(100), backoffer.Backoff(10))
+	require.Equal(t, time.Duration(1), backoffer.Backoff(0))
+	require.Equal(t, time.Duration(2), backoffer.Backoff(1))
+
+	// reset in the middle of the sequence.
+	require.Equal(t, time.Duration(4), backoffer.Backoff(2))
+	require.Equal(t, time.Duration(1), backoffer.Backoff(0))
+	require.Equal(t, time.Duration(2), backoffer.Backoff(1))
+
+	// Jitter resets the wrapped backoffer too.
+	jitter := NewJitter(NewExponential(time.Second, 2, 10*time.Second), 0)
+	for i := 0; i < 10; i++ {
+		jitter.Backoff(i)
+	}
+	require.Equal(t, time.Second, jitter.Backoff(0))
+	require.Equal(t, 2*time.Second, jitter.Backoff(1))
+}
+
+func TestConstant(t *testing.T) {
+	backoffer := NewConstant(time.Second)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, time.Second, backoffer.Backoff(i))
+	}
+	require.Equal(t, time.Second, backoffer.Backoff(0))
+}
+
+func TestJitter(t *testing.T) {
+	// no jitter.
+	backoffer := NewJitter(NewExponential(time.Second, 2, 10*time.Second), 0)
+	res := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i := 0; i < len(res); i++ {
+		require.Equal(t, res[i]*time.Second, backoffer.Backoff(i))
+	}
+
+	// jitter never exceeds the max backoff.
+	backoffer = NewJitter(NewExponential(time.Second, 2, 10*time.Second), 0.5)
+	for round := 0; round < 10; round++ {
+		for i := 0; i < len(res); i++ {
+			d := backoffer.Backoff(i)
+			require.LessOrEqual(t, d, res[i]*time.Second)
+			require.GreaterOrEqual(t, d, res[i]*time.Second/2)
+		}
+	}
+
+	// jitter is randomized.
+	backoffer = NewJitter(NewConstant(time.Second), 1)
+	seen := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		d := backoffer.Backoff(i)
+		require.LessOrEqual(t, d, time.Second)
+		require.GreaterOrEqual(t, d, time.Duration(0))
+		seen[d] = struct{}{}
+	}
+	require.Greater(t, len(seen), 1)
+
+	// invalid ratio is adjusted.
+	backoffer = NewJitter(NewConstant(time.Second), -1)
+	require.Equal(t, time.Second, backoffer.Backoff(0))
+	backoffer = NewJitter(NewConstant(time.Second), 2)
+	require.LessOrEqual(t, backoffer.Backoff(0), time.Second)
+}